@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// archive compression codecs, detected from magic bytes
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+)
+
+// number of leading bytes needed to detect archive compression
+const compressionHeaderLength = 4
+
+// detects archive compression from its leading magic bytes
+func DetectCompression(archivePath string) (string, error) {
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open archive: %v", err)
+	}
+	defer archiveFile.Close()
+
+	header := make([]byte, compressionHeaderLength)
+	if _, err := io.ReadFull(archiveFile, header); err != nil {
+		return "", fmt.Errorf("failed to read archive header: %v", err)
+	}
+	return compressionFromHeader(header), nil
+}
+
+// detects compression of a streamed archive without consuming it, returning the reader to continue from
+func DetectStreamCompression(stream io.Reader) (string, io.Reader, error) {
+	buffered := bufio.NewReader(stream)
+	header, err := buffered.Peek(compressionHeaderLength)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read archive header: %v", err)
+	}
+	return compressionFromHeader(header), buffered, nil
+}
+
+func compressionFromHeader(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return CompressionGzip
+	case bytes.Equal(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return CompressionZstd
+	default:
+		return CompressionNone
+	}
+}
+
+// tar flags selecting decompression for codec
+func TarCompressionFlags(compression string) []string {
+	switch compression {
+	case CompressionGzip:
+		return []string{"-z"}
+	case CompressionZstd:
+		return []string{"--zstd"}
+	default:
+		return nil
+	}
+}
+
+// decompresses stream for codec, zstd is decompressed through the external zstd binary
+// closing the returned reader reports failures of the external decompressor
+func Decompress(stream io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		gzReader, err := gzip.NewReader(stream)
+		if err != nil {
+			return nil, fmt.Errorf("archive is not a valid gzip stream: %v", err)
+		}
+		return gzReader, nil
+	case CompressionZstd:
+		zstdReader, err := util.StartCommandReader(stream, "zstd", "-dc")
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress zstd archive: %v", err)
+		}
+		return zstdReader, nil
+	default:
+		return io.NopCloser(stream), nil
+	}
+}
@@ -0,0 +1,120 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// subset of a compose file cargoport needs to reason about services
+type composeFile struct {
+	Name     string                    `yaml:"name"`
+	Services map[string]composeService `yaml:"services"`
+}
+
+// compose service definition
+type composeService struct {
+	Image     string           `yaml:"image"`
+	Build     composeBuild     `yaml:"build"`
+	DependsOn composeDependsOn `yaml:"depends_on"`
+	Labels    composeLabels    `yaml:"labels"`
+}
+
+// compose labels section, either a mapping or a list of key=value strings
+type composeLabels map[string]string
+
+func (l *composeLabels) UnmarshalYAML(node *yaml.Node) error {
+	labels := composeLabels{}
+	switch node.Kind {
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			key, value, _ := strings.Cut(item.Value, "=")
+			labels[key] = value
+		}
+	case yaml.MappingNode:
+		// scalar values such as `true` are kept as written rather than decoded by type
+		for i := 0; i < len(node.Content); i += 2 {
+			labels[node.Content[i].Value] = node.Content[i+1].Value
+		}
+	default:
+		return fmt.Errorf("labels must be a list or mapping")
+	}
+	*l = labels
+	return nil
+}
+
+// compose depends_on section, either a list of services or a mapping of service to conditions
+type composeDependsOn []string
+
+func (d *composeDependsOn) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		var services []string
+		if err := node.Decode(&services); err != nil {
+			return err
+		}
+		*d = services
+	case yaml.MappingNode:
+		// mapping keys & values alternate in node content
+		for i := 0; i < len(node.Content); i += 2 {
+			*d = append(*d, node.Content[i].Value)
+		}
+	default:
+		return fmt.Errorf("depends_on must be a list or mapping of services")
+	}
+	return nil
+}
+
+// compose build section, either a context path string or a mapping
+type composeBuild struct {
+	Context    string `yaml:"context"`
+	Dockerfile string `yaml:"dockerfile"`
+}
+
+func (b *composeBuild) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		b.Context = node.Value
+		return nil
+	}
+	type plainBuild composeBuild
+	return node.Decode((*plainBuild)(b))
+}
+
+// parses compose file from disk
+func parseComposeFile(composeFilePath string) (*composeFile, error) {
+	composeData, err := os.ReadFile(composeFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compose file %s: %v", composeFilePath, err)
+	}
+	var compose composeFile
+	if err := yaml.Unmarshal(composeData, &compose); err != nil {
+		return nil, fmt.Errorf("failed to parse compose file %s: %v", composeFilePath, err)
+	}
+	return &compose, nil
+}
+
+// compose filenames recognised in a project directory, in docker compose's order of preference
+var composeFileNames = []string{"compose.yaml", "compose.yml", "docker-compose.yaml", "docker-compose.yml"}
+
+// returns compose file within dir, empty when dir holds none
+func FindComposeFileInDir(dir string) string {
+	for _, name := range composeFileNames {
+		candidate := filepath.Join(dir, name)
+		if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// returns the top-level `name` of compose file, empty when unset or unreadable
+func ComposeProjectName(composeFilePath string) string {
+	compose, err := parseComposeFile(composeFilePath)
+	if err != nil {
+		return ""
+	}
+	return compose.Name
+}
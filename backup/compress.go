@@ -42,15 +42,16 @@ func ShellCompressDirectory(jobctx *job.JobContext, targetDir, outputFile string
 		return fmt.Errorf("invalid directory structure for: %s", targetDir)
 	}
 
+	if err := resetIncrementalIndex(jobctx); err != nil {
+		return err
+	}
+
 	// run tar compression
-	err := util.RunCommand(
-		"tar",
-		"-cvzf",
-		outputFile,
-		"-C",
-		parentDir, // Parent directory
-		baseDir,   // Directory to compress
-	)
+	tarArgs := append([]string{"-cvzf", outputFile}, tarSourceArgs(jobctx, parentDir, baseDir)...)
+	tarCmd := util.ReadAllCommand("tar", tarArgs...)
+	tarCmd.Stdout = os.Stdout
+	tarCmd.Stderr = os.Stderr
+	err := tarCmd.Run()
 	if err != nil {
 		logger.LogxWithFields("error", fmt.Sprintf("Error compressing directory: %s/%s", parentDir, baseDir), map[string]interface{}{
 			"package": "backup",
@@ -60,6 +61,8 @@ func ShellCompressDirectory(jobctx *job.JobContext, targetDir, outputFile string
 		return fmt.Errorf("error compressing directory: %v", err)
 	}
 
+	recordDeletedPaths(jobctx)
+
 	// get output file size and return to job context
 	fileInfo, err := os.Stat(outputFile)
 	if err != nil {
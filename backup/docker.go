@@ -2,11 +2,11 @@ package backup
 
 import (
 	"fmt"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
+	"github.com/adrian-griffin/cargoport/dockerapi"
+	"github.com/adrian-griffin/cargoport/input"
 	"github.com/adrian-griffin/cargoport/job"
 	"github.com/adrian-griffin/cargoport/logger"
 	"github.com/adrian-griffin/cargoport/util"
@@ -24,10 +24,16 @@ func dockerLogBaseFields(context *job.JobContext) map[string]interface{} {
 	return fields
 }
 
+// docker engine client constructor, replaced by a fake in tests
+var newDockerClient = dockerapi.NewClient
+
 // locates docker compose file based on container name
 func FindComposeFile(containerName, targetBaseName string) (string, error) {
-	cmd := exec.Command("docker", "inspect", containerName, "--format", "{{ index .Config.Labels \"com.docker.compose.project.working_dir\" }}")
-	output, err := cmd.Output()
+	client, err := newDockerClient()
+	if err != nil {
+		return "", err
+	}
+	container, err := client.InspectContainer(containerName)
 	if err != nil {
 		logger.LogxWithFields("error", fmt.Sprintf("Failed to locate docker compose file for container '%s': %v", containerName, err), map[string]interface{}{
 			"package": "docker",
@@ -35,22 +41,32 @@ func FindComposeFile(containerName, targetBaseName string) (string, error) {
 		})
 		return "", fmt.Errorf("failed to locate docker compose file for container '%s': %v", containerName, err)
 	}
-	composePath := strings.TrimSpace(string(output))
-	return filepath.Join(composePath, "docker-compose.yml"), nil // return filepath to compose
+	return ComposeFileFromLabels(containerName, container.Config.Labels)
 }
 
-// returns whether or not any docker services are running from target composefile
-func checkDockerRunState(composeFile string) (bool, error) {
-	cmd := exec.Command("docker", "compose", "-f", composeFile, "ps", "--services", "--filter", "status=running")
-	output, err := cmd.Output()
-	if err != nil {
-		return false, fmt.Errorf("failed to obtain Docker container status: %v", err)
+// determines composefile from compose labels, preferring the config files compose was invoked with
+func ComposeFileFromLabels(containerName string, labels map[string]string) (string, error) {
+	if configFiles := labels[dockerapi.LabelComposeConfigFiles]; configFiles != "" {
+		return strings.TrimSpace(strings.Split(configFiles, ",")[0]), nil
+	}
+	if workingDir := labels[dockerapi.LabelComposeWorkingDir]; workingDir != "" {
+		return filepath.Join(workingDir, "docker-compose.yml"), nil // return filepath to compose
 	}
-	runningServices := strings.TrimSpace(string(output))
-	if runningServices == "" {
-		return false, fmt.Errorf("no active services found from composefile (container is likely off)")
+	return "", fmt.Errorf("container '%s': %w", containerName, errNotComposeManaged)
+}
+
+// lists containers created from composefile, matched by working dir label & falling back to the default project name
+// generated stacks of standalone containers resolve to the original container until compose has created its own
+func composeContainers(client dockerapi.Client, composeFile string) ([]dockerapi.Container, error) {
+	workingDir := filepath.Dir(composeFile)
+	containers, err := dockerapi.ComposeContainers(client, workingDir)
+	if err != nil || len(containers) > 0 {
+		return containers, err
+	}
+	if containers, ok, err := standaloneContainers(client, workingDir); ok {
+		return containers, err
 	}
-	return true, nil
+	return dockerapi.ProjectContainers(client, strings.ToLower(filepath.Base(workingDir)))
 }
 
 // stop docker containers & collect image ids and digests
@@ -61,97 +77,154 @@ func HandleDockerPreBackup(context *job.JobContext, composeFilePath, targetBaseN
 	coreFields := logger.CoreLogFields(context, "docker")
 
 	logger.LogxWithFields("debug", fmt.Sprintf("Handling docker pre-backup tasks"), verboseFields)
-	// checks whether docker is running
-	running, err := checkDockerRunState(composeFilePath)
-	if err != nil || !running {
-		logger.LogxWithFields("warn", fmt.Sprintf("No active Docker container at %s. Proceeding with backup.", composeFilePath), coreFields)
-		// temporarily partially bring up container to gather image information
-		if err := util.RunCommand("docker", "compose", "-f", composeFilePath, "up", "--no-start"); err != nil {
-			return fmt.Errorf("failed to partially bring up docker containers containers for image inspection: %v", err)
-		}
+	client, err := newDockerClient()
+	if err != nil {
+		return err
 	}
 
-	// gathers and writes images to disk
-	imageVersionFile := filepath.Join(filepath.Dir(composeFilePath), "compose-img-digests.txt")
-	if err := writeDockerImages(context, composeFilePath, imageVersionFile); err != nil {
-		return fmt.Errorf("failed to collect Docker images: %v", err)
+	// standalone containers are never removed, compose down would lose them
+	if context.Standalone && context.StopStrategy != input.StopStrategyPause {
+		context.StopStrategy = input.StopStrategyStop
 	}
 
-	// shuts down docker container from composefile
-	logger.LogxWithFields("debug", fmt.Sprintf("Performing Docker compose down jobs on %s", composeFilePath), verboseFields)
-	if err := util.RunCommand("docker", "compose", "-f", composeFilePath, "down"); err != nil {
-		return fmt.Errorf("failed to stop Docker containers: %v", err)
+	// records per-service state, restored exactly once the backup completes
+	states, err := recordServiceStates(client, composeFilePath)
+	if err != nil {
+		return err
+	}
+	context.ServiceStates = states
+	active := servicesInState(states, ServiceStateRunning, ServiceStatePaused)
+	if len(active) == 0 {
+		logger.LogxWithFields("warn", fmt.Sprintf("No active Docker container at %s, services will be left stopped. Proceeding with backup.", composeFilePath), coreFields)
 	}
 
-	// notify pre-backup docker job status
-	logger.LogxWithFields("info", fmt.Sprintf("Pre-backup docker jobs handled successfully"), map[string]interface{}{
-		"package": "docker",
-		"target":  context.Target,
-		"job_id":  context.JobID,
-		"remote":  context.Remote,
-		"docker":  context.Docker,
-		// add # of services as a tag perhaps?
-	})
-	return nil
-}
-
-// collects docker image information and digests, stores alongside `docker-compose.yml` file
-func writeDockerImages(context *job.JobContext, composeFile string, outputFile string) error {
-
-	// defining logging fields
-	verboseFields := dockerLogBaseFields(context)
-	// coreFields := logger.CoreLogFields(context, "docker")
+	// pre-hooks & database dumps from compose labels run while services are still online
+	if err := runServiceCommands(context, client, composeFilePath); err != nil {
+		return err
+	}
 
-	cmd := exec.Command("docker", "compose", "-f", composeFile, "images", "--quiet")
-	output, err := cmd.Output()
+	// gathers and writes image lockfile to disk
+	lock, err := writeImageLock(context, client, composeFilePath)
 	if err != nil {
-		return fmt.Errorf("failed to obtain docker images: %v", err)
+		return fmt.Errorf("failed to collect Docker images: %v", err)
 	}
 
-	// loops over image ids to gather docker image digests
-	imageLines := string(output)
-	imageList := strings.Split(imageLines, "\n")
-	var imageInfo string
-
-	for _, imageID := range imageList {
-		if imageID == "" {
-			continue
+	// saves images into the shared image store for offline restores
+	if context.EmbedImages {
+		if err := embedImages(context, client, lock); err != nil {
+			return fmt.Errorf("failed to embed Docker images: %v", err)
 		}
-
-		// grab image digests based on image id
-		cmdInspect := exec.Command("docker", "inspect", "--format", "{{index .RepoDigests 0}}", imageID)
-		digestOutput, err := cmdInspect.Output()
-		if err != nil {
-			return fmt.Errorf("failed to inspect docker images: %v", err)
-		}
-		imageInfo += fmt.Sprintf("Image ID: %s  |  Image Digest: %s\n", imageID, digestOutput)
 	}
 
-	// cleans up image whitespace formatting and writes to file
-	trimmedImageInfo := strings.TrimSpace(imageInfo)
-	err = os.WriteFile(outputFile, []byte(trimmedImageInfo), 0644)
-	if err != nil {
-		return fmt.Errorf("failed to write docker image version info to file: %v", err)
+	// takes docker services offline using the configured stop strategy
+	if context.StopStrategy == input.StopStrategyStop || context.StopStrategy == input.StopStrategyPause {
+		logger.LogxWithFields("debug", fmt.Sprintf("Taking Docker services offline via %s strategy on %s", context.StopStrategy, composeFilePath), verboseFields)
+		if err := stopComposeServices(context, client, composeFilePath); err != nil {
+			return fmt.Errorf("failed to stop Docker containers: %v", err)
+		}
+	} else if len(active) > 0 {
+		logger.LogxWithFields("debug", fmt.Sprintf("Performing Docker compose down jobs on %s", composeFilePath), verboseFields)
+		if err := util.RunCommand("docker", "compose", "-f", composeFilePath, "down"); err != nil {
+			return fmt.Errorf("failed to stop Docker containers: %v", err)
+		}
 	}
 
-	logger.LogxWithFields("debug", fmt.Sprintf("Docker service image IDs and digests saved to %s", outputFile), verboseFields)
+	// notify pre-backup docker job status
+	logger.LogxWithFields("info", fmt.Sprintf("Pre-backup docker jobs handled successfully"), map[string]interface{}{
+		"package":  "docker",
+		"target":   context.Target,
+		"job_id":   context.JobID,
+		"remote":   context.Remote,
+		"docker":   context.Docker,
+		"strategy": context.StopStrategy,
+		"stopped":  len(context.StoppedContainers),
+	})
 	return nil
 }
 
-// handles docker container restart/turn-up commands
+// handles docker container restart/turn-up commands & verifies services come back healthy
 func HandleDockerPostBackup(context *job.JobContext, composeFilePath string, restartDockerBool bool) error {
 
 	verboseFields := dockerLogBaseFields(context)
 	// coreFields := logger.CoreLogFields(context, "docker")
 
+	// services are brought back online once per job, straight after the snapshot when one was taken
+	if context.ServicesRestored {
+		return nil
+	}
+	context.ServicesRestored = true
+
 	if !restartDockerBool {
+		if context.StopStrategy == input.StopStrategyPause && len(context.StoppedContainers) > 0 {
+			logger.LogxWithFields("warn", fmt.Sprintf("Docker service restart disabled, %d container(s) remain paused", len(context.StoppedContainers)), verboseFields)
+			return nil
+		}
 		logger.LogxWithFields("info", fmt.Sprintf("Docker service restart disabled, skipping restart"), verboseFields)
 		return nil
 	}
-	logger.LogxWithFields("debug", fmt.Sprintf("Restarting Docker compose services via %s", composeFilePath), verboseFields)
-	if err := startDockerContainer(context, composeFilePath); err != nil {
-		return fmt.Errorf("failed to restart Docker containers at : %s", composeFilePath)
+
+	client, err := newDockerClient()
+	if err != nil {
+		return err
 	}
+
+	// mirrors the stop or pause strategy used during pre-backup
+	var watched []watchedContainer
+	if context.StopStrategy == input.StopStrategyStop || context.StopStrategy == input.StopStrategyPause {
+		for _, stopped := range context.StoppedContainers {
+			watched = append(watched, watchedContainer{Service: stopped.Service, ID: stopped.ID})
+		}
+		logger.LogxWithFields("debug", fmt.Sprintf("Bringing Docker services back online via %s strategy", context.StopStrategy), verboseFields)
+		if err := restartComposeServices(context, client); err != nil {
+			return fmt.Errorf("failed to restart Docker containers at %s: %v", composeFilePath, err)
+		}
+	} else if len(servicesInState(context.ServiceStates, ServiceStateRunning, ServiceStatePaused)) == 0 {
+		// compose down is skipped for inactive stacks, so there is nothing to restore
+		logger.LogxWithFields("info", "Docker services were not running before backup, leaving them stopped", verboseFields)
+		return nil
+	} else {
+		logger.LogxWithFields("debug", fmt.Sprintf("Restarting Docker compose services via %s", composeFilePath), verboseFields)
+		if err := startDockerContainer(context, composeFilePath); err != nil {
+			return fmt.Errorf("failed to restart Docker containers at : %s", composeFilePath)
+		}
+		if context.HealthCheck {
+			containers, err := composeServiceContainers(client, composeFilePath)
+			if err != nil {
+				return fmt.Errorf("failed to list restarted Docker containers: %v", err)
+			}
+			// only services started above are expected to come up
+			for _, container := range containers {
+				if state := context.ServiceStates[container.Service]; state == ServiceStateRunning || state == ServiceStatePaused {
+					watched = append(watched, container)
+				}
+			}
+		}
+	}
+
+	// compose exiting cleanly does not mean services stay up, wait for them to settle
+	if context.HealthCheck {
+		if err := verifyServiceHealth(context, client, watched); err != nil {
+			return err
+		}
+	}
+
+	// services which were paused before backup are paused again once verified
+	if context.StopStrategy != input.StopStrategyStop && context.StopStrategy != input.StopStrategyPause {
+		if err := PauseRecordedServices(client, composeFilePath, context.ServiceStates); err != nil {
+			return err
+		}
+	}
+
+	logger.LogxWithFields("info", "Post-backup docker jobs handled successfully", map[string]interface{}{
+		"package":        "docker",
+		"target":         context.Target,
+		"job_id":         context.JobID,
+		"remote":         context.Remote,
+		"docker":         context.Docker,
+		"restart_docker": context.RestartDocker,
+		"strategy":       context.StopStrategy,
+		"health_check":   context.HealthCheck,
+	})
 	return nil
 }
 
@@ -161,24 +234,13 @@ func startDockerContainer(context *job.JobContext, composefile string) error {
 	verboseFields := dockerLogBaseFields(context)
 	coreFields := logger.CoreLogFields(context, "docker")
 
-	// restart docker container
+	// restart services which were active before backup, recreating stopped ones without starting them
 	logger.LogxWithFields("debug", fmt.Sprintf("Starting Docker container at %s as headless daemon", filepath.Dir(composefile)), verboseFields)
-	err := util.RunCommand("docker", "compose", "-f", composefile, "up", "-d")
+	err := StartRecordedServices([]string{composefile}, context.ServiceStates)
 	if err != nil {
 		logger.LogxWithFields("error", fmt.Sprintf("Error starting Docker container: %v", err), coreFields)
 		return err
 	}
 	logger.LogxWithFields("debug", fmt.Sprintf("Successful startup job on docker compose at %s", composefile), verboseFields)
-
-	// if no errors, info alert of success
-	logger.LogxWithFields("info", "Post-backup docker jobs handled successfully", map[string]interface{}{
-		"package":        "docker",
-		"target":         context.Target,
-		"job_id":         context.JobID,
-		"remote":         context.Remote,
-		"docker":         context.Docker,
-		"restart_docker": context.RestartDocker,
-	})
-
-	return err
+	return nil
 }
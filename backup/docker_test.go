@@ -0,0 +1,265 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/adrian-griffin/cargoport/dockerapi"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/job"
+)
+
+// writes compose file into a new stack dir, returning its path
+func writeTestCompose(t *testing.T, dirName, content string) string {
+	t.Helper()
+	stackDir := filepath.Join(t.TempDir(), dirName)
+	if err := os.MkdirAll(stackDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	composeFilePath := filepath.Join(stackDir, "docker-compose.yml")
+	if err := os.WriteFile(composeFilePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return composeFilePath
+}
+
+func containerIDs(containers []dockerapi.Container) []string {
+	var ids []string
+	for _, container := range containers {
+		ids = append(ids, container.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+const dependentCompose = `
+services:
+  web:
+    image: nginx
+    depends_on: [api]
+  api:
+    image: api
+    depends_on:
+      db:
+        condition: service_healthy
+  db:
+    image: postgres
+`
+
+func TestComposeContainersByWorkingDir(t *testing.T) {
+	client := &fakeDockerClient{}
+	client.addComposeContainer("web1", "/srv/app", "app", "web", "running")
+	client.addComposeContainer("db1", "/srv/app", "app", "db", "exited")
+	client.addComposeContainer("other1", "/srv/other", "app", "web", "running")
+
+	containers, err := composeContainers(client, "/srv/app/docker-compose.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := containerIDs(containers), []string{"db1", "web1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("containers = %v, want %v", got, want)
+	}
+}
+
+func TestComposeContainersFallsBackToProjectName(t *testing.T) {
+	client := &fakeDockerClient{}
+	// created from a different path to the same project, e.g: the stack dir was moved
+	client.addComposeContainer("web1", "/old/path/App", "app", "web", "running")
+	client.addComposeContainer("other1", "/srv/other", "other", "web", "running")
+
+	containers, err := composeContainers(client, "/srv/App/docker-compose.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := containerIDs(containers), []string{"web1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("containers = %v, want %v", got, want)
+	}
+}
+
+func TestComposeContainersStandalone(t *testing.T) {
+	composeFilePath := writeTestCompose(t, "redis", "services:\n  redis:\n    image: redis\n")
+	stackDir := filepath.Dir(composeFilePath)
+	if err := os.WriteFile(filepath.Join(stackDir, StandaloneInspectName), []byte(`{"Id": "abc123"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	details := &dockerapi.ContainerDetails{ID: "abc123", Name: "/redis"}
+	details.State.Status = "running"
+	client := &fakeDockerClient{details: map[string]*dockerapi.ContainerDetails{"abc123": details}}
+
+	containers, err := composeContainers(client, composeFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 || containers[0].ID != "abc123" || containers[0].Service() != "redis" || containers[0].State != "running" {
+		t.Errorf("containers = %+v, want the standalone container as service redis", containers)
+	}
+
+	// once the original container is gone, the generated stack has no containers
+	client.details = nil
+	containers, err = composeContainers(client, composeFilePath)
+	if err != nil || len(containers) != 0 {
+		t.Errorf("containers = %+v, %v, want none once the standalone container is removed", containers, err)
+	}
+}
+
+func TestRecordServiceStates(t *testing.T) {
+	composeFilePath := writeTestCompose(t, "app", `
+services:
+  web:
+    image: nginx
+  db:
+    image: postgres
+  cache:
+    image: redis
+  worker:
+    image: worker
+`)
+	workingDir := filepath.Dir(composeFilePath)
+
+	client := &fakeDockerClient{}
+	// any running replica counts the service as running
+	client.addComposeContainer("web1", workingDir, "app", "web", "exited")
+	client.addComposeContainer("web2", workingDir, "app", "web", "running")
+	client.addComposeContainer("db1", workingDir, "app", "db", "paused")
+	client.addComposeContainer("cache1", workingDir, "app", "cache", "created")
+	// services no longer in the compose file are ignored
+	client.addComposeContainer("old1", workingDir, "app", "old", "running")
+
+	states, err := recordServiceStates(client, composeFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"web":    ServiceStateRunning,
+		"db":     ServiceStatePaused,
+		"cache":  ServiceStateExited,
+		"worker": ServiceStateAbsent,
+	}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states = %v, want %v", states, want)
+	}
+	if got, want := servicesInState(states, ServiceStateRunning, ServiceStatePaused), []string{"db", "web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("active services = %v, want %v", got, want)
+	}
+}
+
+func TestStopAndRestartFollowDependencyOrder(t *testing.T) {
+	for _, strategy := range []string{input.StopStrategyStop, input.StopStrategyPause} {
+		t.Run(strategy, func(t *testing.T) {
+			composeFilePath := writeTestCompose(t, "app", dependentCompose)
+			workingDir := filepath.Dir(composeFilePath)
+
+			client := &fakeDockerClient{}
+			client.addComposeContainer("db1", workingDir, "app", "db", "running")
+			client.addComposeContainer("web1", workingDir, "app", "web", "running")
+			client.addComposeContainer("api1", workingDir, "app", "api", "running")
+
+			jobctx := &job.JobContext{StopStrategy: strategy}
+			if err := stopComposeServices(jobctx, client, composeFilePath); err != nil {
+				t.Fatal(err)
+			}
+			if err := restartComposeServices(jobctx, client); err != nil {
+				t.Fatal(err)
+			}
+
+			stopCall, startCall := "stop", "start"
+			if strategy == input.StopStrategyPause {
+				stopCall, startCall = "pause", "unpause"
+			}
+			want := []string{
+				// dependents go offline before their dependencies
+				stopCall + " web1", stopCall + " api1", stopCall + " db1",
+				// & come back after them
+				startCall + " db1", startCall + " api1", startCall + " web1",
+			}
+			if !reflect.DeepEqual(client.calls, want) {
+				t.Errorf("calls = %v, want %v", client.calls, want)
+			}
+			if len(jobctx.StoppedContainers) != 0 {
+				t.Errorf("stopped containers = %v, want none after restart", jobctx.StoppedContainers)
+			}
+		})
+	}
+}
+
+func TestStopSkipsServicesNotRunning(t *testing.T) {
+	composeFilePath := writeTestCompose(t, "app", dependentCompose)
+	workingDir := filepath.Dir(composeFilePath)
+
+	client := &fakeDockerClient{}
+	client.addComposeContainer("db1", workingDir, "app", "db", "running")
+	client.addComposeContainer("api1", workingDir, "app", "api", "exited")
+	client.addComposeContainer("web1", workingDir, "app", "web", "running")
+
+	jobctx := &job.JobContext{StopStrategy: input.StopStrategyStop, StopServices: []string{"api", "db"}}
+	if err := stopComposeServices(jobctx, client, composeFilePath); err != nil {
+		t.Fatal(err)
+	}
+	// web is not selected & api is already stopped
+	if want := []string{"stop db1"}; !reflect.DeepEqual(client.calls, want) {
+		t.Errorf("calls = %v, want %v", client.calls, want)
+	}
+	if want := []job.StoppedContainer{{Service: "db", ID: "db1"}}; !reflect.DeepEqual(jobctx.StoppedContainers, want) {
+		t.Errorf("stopped containers = %v, want %v", jobctx.StoppedContainers, want)
+	}
+}
+
+func TestFailedStopRestartsStoppedServices(t *testing.T) {
+	composeFilePath := writeTestCompose(t, "app", dependentCompose)
+	workingDir := filepath.Dir(composeFilePath)
+
+	client := &fakeDockerClient{failures: map[string]error{"stop db1": fmt.Errorf("engine unavailable")}}
+	client.addComposeContainer("db1", workingDir, "app", "db", "running")
+	client.addComposeContainer("api1", workingDir, "app", "api", "running")
+	client.addComposeContainer("web1", workingDir, "app", "web", "running")
+
+	jobctx := &job.JobContext{StopStrategy: input.StopStrategyStop}
+	if err := stopComposeServices(jobctx, client, composeFilePath); err == nil {
+		t.Fatal("expected failed stop to return an error")
+	}
+	want := []string{"stop web1", "stop api1", "stop db1", "start api1", "start web1"}
+	if !reflect.DeepEqual(client.calls, want) {
+		t.Errorf("calls = %v, want %v", client.calls, want)
+	}
+	for _, container := range client.containers {
+		if container.State != "running" {
+			t.Errorf("container %s left %s after failed stop", container.ID, container.State)
+		}
+	}
+}
+
+func TestServiceStartOrderDetectsCycles(t *testing.T) {
+	compose := &composeFile{Services: map[string]composeService{
+		"a": {DependsOn: composeDependsOn{"b"}},
+		"b": {DependsOn: composeDependsOn{"a"}},
+	}}
+	if _, err := serviceStartOrder(compose, []string{"a", "b"}); err == nil {
+		t.Error("expected circular depends_on to be rejected")
+	}
+}
+
+func TestFindComposeFileFromLabels(t *testing.T) {
+	details := &dockerapi.ContainerDetails{}
+	details.Config.Labels = map[string]string{
+		dockerapi.LabelComposeWorkingDir:  "/srv/app",
+		dockerapi.LabelComposeConfigFiles: "/srv/app/compose.yaml,/srv/app/compose.override.yaml",
+	}
+	client := &fakeDockerClient{details: map[string]*dockerapi.ContainerDetails{"web": details}}
+
+	originalClient := newDockerClient
+	newDockerClient = func() (dockerapi.Client, error) { return client, nil }
+	t.Cleanup(func() { newDockerClient = originalClient })
+
+	composeFilePath, err := FindComposeFile("web", "app")
+	if err != nil || composeFilePath != "/srv/app/compose.yaml" {
+		t.Errorf("compose file = %q, %v, want the first config file compose was invoked with", composeFilePath, err)
+	}
+	if _, err := FindComposeFile("missing", "app"); err == nil {
+		t.Error("expected missing container to be an error")
+	}
+}
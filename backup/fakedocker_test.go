@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/adrian-griffin/cargoport/dockerapi"
+	"github.com/adrian-griffin/cargoport/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.Logx = logrus.New()
+	logger.Logx.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// in-memory docker engine, recording every container operation in order
+type fakeDockerClient struct {
+	containers []dockerapi.Container
+	details    map[string]*dockerapi.ContainerDetails
+	images     map[string]*dockerapi.Image
+	failures   map[string]error // operation errors keyed by `<operation> <container id>`
+	calls      []string         // `<operation> <container id>`
+}
+
+var _ dockerapi.Client = (*fakeDockerClient)(nil)
+
+// adds a compose container for service in working dir
+func (f *fakeDockerClient) addComposeContainer(id, workingDir, project, service, state string) {
+	f.containers = append(f.containers, dockerapi.Container{
+		ID:    id,
+		Names: []string{"/" + project + "-" + service + "-1"},
+		State: state,
+		Labels: map[string]string{
+			dockerapi.LabelComposeWorkingDir: workingDir,
+			dockerapi.LabelComposeProject:    project,
+			dockerapi.LabelComposeService:    service,
+		},
+	})
+}
+
+func (f *fakeDockerClient) container(nameOrID string) *dockerapi.Container {
+	for i := range f.containers {
+		if f.containers[i].ID == nameOrID {
+			return &f.containers[i]
+		}
+	}
+	return nil
+}
+
+// records call & applies state change, unless a failure was set up for it
+func (f *fakeDockerClient) operate(operation, nameOrID, state string) error {
+	f.calls = append(f.calls, operation+" "+nameOrID)
+	if err := f.failures[operation+" "+nameOrID]; err != nil {
+		return err
+	}
+	container := f.container(nameOrID)
+	if container == nil {
+		return dockerapi.ErrNotFound
+	}
+	container.State = state
+	return nil
+}
+
+func (f *fakeDockerClient) ListContainers(labels []string, all bool) ([]dockerapi.Container, error) {
+	var matched []dockerapi.Container
+	for _, container := range f.containers {
+		if !all && container.State != "running" {
+			continue
+		}
+		matches := true
+		for _, label := range labels {
+			key, value, hasValue := strings.Cut(label, "=")
+			actual, ok := container.Labels[key]
+			if !ok || (hasValue && actual != value) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			matched = append(matched, container)
+		}
+	}
+	return matched, nil
+}
+
+func (f *fakeDockerClient) InspectContainer(nameOrID string) (*dockerapi.ContainerDetails, error) {
+	if details, ok := f.details[nameOrID]; ok {
+		return details, nil
+	}
+	return nil, fmt.Errorf("container %s: %w", nameOrID, dockerapi.ErrNotFound)
+}
+
+func (f *fakeDockerClient) InspectImage(nameOrID string) (*dockerapi.Image, error) {
+	if image, ok := f.images[nameOrID]; ok {
+		return image, nil
+	}
+	return nil, fmt.Errorf("image %s: %w", nameOrID, dockerapi.ErrNotFound)
+}
+
+func (f *fakeDockerClient) StopContainer(nameOrID string, timeout time.Duration) error {
+	return f.operate("stop", nameOrID, "exited")
+}
+
+func (f *fakeDockerClient) StartContainer(nameOrID string) error {
+	return f.operate("start", nameOrID, "running")
+}
+
+func (f *fakeDockerClient) PauseContainer(nameOrID string) error {
+	return f.operate("pause", nameOrID, "paused")
+}
+
+func (f *fakeDockerClient) UnpauseContainer(nameOrID string) error {
+	return f.operate("unpause", nameOrID, "running")
+}
+
+func (f *fakeDockerClient) ContainerLogs(nameOrID string, tail int) (string, error) {
+	return "", nil
+}
+
+func (f *fakeDockerClient) SaveImage(names []string, w io.Writer) error {
+	return fmt.Errorf("not supported by fake")
+}
+
+func (f *fakeDockerClient) LoadImage(r io.Reader) error {
+	return fmt.Errorf("not supported by fake")
+}
+
+func (f *fakeDockerClient) TagImage(nameOrID, reference string) error {
+	return fmt.Errorf("not supported by fake")
+}
@@ -0,0 +1,203 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/dockerapi"
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/logger"
+)
+
+// interval between container state polls while waiting for services to settle
+var healthPollInterval = 2 * time.Second
+
+// log lines captured from each failing container
+const healthLogTail = 20
+
+// label set by compose on containers created via `docker compose run`
+const labelComposeOneOff = "com.docker.compose.oneoff"
+
+// container watched during post-restart health verification
+type watchedContainer struct {
+	Service string
+	ID      string
+}
+
+// progress of a single container towards being considered healthy
+type containerHealth struct {
+	done         bool
+	failure      string // reason the container is considered failed
+	runningSince time.Time
+	restartCount int
+	observed     bool
+	baseRestarts int // restart count when verification began
+	restarts     int // restarts observed since verification began
+}
+
+// lists containers expected to be running after `docker compose up -d`
+func composeServiceContainers(client dockerapi.Client, composeFilePath string) ([]watchedContainer, error) {
+	compose, err := parseComposeFile(composeFilePath)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := composeContainers(client, composeFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Docker containers: %v", err)
+	}
+
+	var watched []watchedContainer
+	for _, container := range containers {
+		if _, defined := compose.Services[container.Service()]; !defined || strings.EqualFold(container.Labels[labelComposeOneOff], "true") {
+			continue
+		}
+		watched = append(watched, watchedContainer{Service: container.Service(), ID: container.ID})
+	}
+	return watched, nil
+}
+
+// waits until every container reports healthy, or running for the settle time when it has no healthcheck
+// fails as soon as a container exits non-zero or turns unhealthy, or once the health timeout elapses
+func verifyServiceHealth(context *job.JobContext, client dockerapi.Client, containers []watchedContainer) error {
+	verboseFields := dockerLogBaseFields(context)
+	logger.LogxWithFields("debug", fmt.Sprintf("Verifying health of %d container(s), settle time %s", len(containers), context.SettleTime), verboseFields)
+
+	states := make(map[string]*containerHealth, len(containers))
+	for _, container := range containers {
+		states[container.ID] = &containerHealth{}
+	}
+
+	deadline := time.Now().Add(context.HealthTimeout)
+	for {
+		pending := 0
+		for _, container := range containers {
+			state := states[container.ID]
+			if state.done {
+				continue
+			}
+			checkContainerHealth(client, container, state, context.SettleTime)
+			if !state.done {
+				pending++
+			}
+		}
+		if pending == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(healthPollInterval)
+	}
+
+	// collect failures & pending containers, capturing their last log lines
+	var failures []string
+	for _, container := range containers {
+		state := states[container.ID]
+		if state.done && state.failure == "" {
+			continue
+		}
+		reason := state.failure
+		if reason == "" && state.restarts > 0 {
+			reason = fmt.Sprintf("restarted %d time(s) within %s", state.restarts, context.HealthTimeout)
+		} else if reason == "" {
+			reason = fmt.Sprintf("not healthy after %s", context.HealthTimeout)
+		}
+		failure := fmt.Sprintf("service %s (container %.12s): %s", container.Service, container.ID, reason)
+
+		logs, err := client.ContainerLogs(container.ID, healthLogTail)
+		if err != nil {
+			logs = fmt.Sprintf("failed to fetch logs: %v", err)
+		}
+		logger.LogxWithFields("error", fmt.Sprintf("Service %s failed health verification: %s, last log lines:\n%s", container.Service, reason, strings.TrimRight(logs, "\n")), verboseFields)
+		failures = append(failures, fmt.Sprintf("%s\n%s", failure, indentLines(logs)))
+	}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return fmt.Errorf("%d service container(s) failed health verification:\n%s", len(failures), strings.Join(failures, "\n"))
+	}
+
+	logger.LogxWithFields("debug", "All Docker services passed health verification", verboseFields)
+	return nil
+}
+
+// waits for services of a restored compose project to become healthy once brought up
+// services recorded as running or paused are expected up, or every service when no states were recorded
+func VerifyComposeHealth(context *job.JobContext, composeFilePath string, serviceStates map[string]string) error {
+	client, err := newDockerClient()
+	if err != nil {
+		return err
+	}
+	containers, err := composeServiceContainers(client, composeFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to list started Docker containers: %v", err)
+	}
+
+	var watched []watchedContainer
+	for _, container := range containers {
+		if state := serviceStates[container.Service]; len(serviceStates) == 0 || state == ServiceStateRunning || state == ServiceStatePaused {
+			watched = append(watched, container)
+		}
+	}
+	if len(watched) == 0 {
+		return fmt.Errorf("no containers of compose project %s are running", filepath.Dir(composeFilePath))
+	}
+	return verifyServiceHealth(context, client, watched)
+}
+
+// updates container progress from its current engine state
+func checkContainerHealth(client dockerapi.Client, container watchedContainer, state *containerHealth, settleTime time.Duration) {
+	details, err := client.InspectContainer(container.ID)
+	if err != nil {
+		if errors.Is(err, dockerapi.ErrNotFound) {
+			state.done, state.failure = true, "container was removed"
+		}
+		// transient engine errors are retried until the timeout
+		return
+	}
+	if !state.observed {
+		state.observed, state.baseRestarts = true, details.RestartCount
+	}
+	state.restarts = details.RestartCount - state.baseRestarts
+
+	switch {
+	case details.State.Status == "exited" || details.State.Status == "dead":
+		// one-shot services which completed successfully are not failures
+		if details.State.ExitCode == 0 && state.restarts == 0 {
+			state.done = true
+			return
+		}
+		state.done, state.failure = true, fmt.Sprintf("%s with exit code %d", details.State.Status, details.State.ExitCode)
+		return
+	case details.State.Health != nil && details.State.Health.Status == "unhealthy":
+		state.done, state.failure = true, "healthcheck reports unhealthy"
+		return
+	case details.State.Health != nil && details.State.Health.Status == "healthy":
+		state.done = true
+		return
+	case !details.State.Running || details.State.Restarting || details.State.Paused:
+		state.runningSince = time.Time{}
+		return
+	case details.State.Health != nil:
+		// healthcheck still starting
+		return
+	}
+
+	// containers without a healthcheck must keep running, without restarting, for the settle time
+	if state.runningSince.IsZero() || details.RestartCount != state.restartCount {
+		state.runningSince = time.Now()
+		state.restartCount = details.RestartCount
+	}
+	if time.Since(state.runningSince) >= settleTime {
+		state.done = true
+	}
+}
+
+// indents captured log lines beneath their failure line
+func indentLines(text string) string {
+	text = strings.TrimRight(text, "\n")
+	if text == "" {
+		return "    (no log output)"
+	}
+	return "    " + strings.ReplaceAll(text, "\n", "\n    ")
+}
@@ -0,0 +1,175 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/adrian-griffin/cargoport/dockerapi"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/logger"
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// image store directory name, under the cargoport root locally & the output dir on remotes
+const ImageStoreDirName = "images"
+
+// returns image store filename for image id, identical images share a single file across jobs
+func ImageFileName(imageID string) string {
+	return strings.TrimPrefix(imageID, "sha256:") + ".tar"
+}
+
+// saves every locked service image into the image store, skipping images which are already stored
+func embedImages(context *job.JobContext, client dockerapi.Client, lock *ImageLock) error {
+	verboseFields := dockerLogBaseFields(context)
+
+	if err := os.MkdirAll(context.ImageStoreDir, 0755); err != nil {
+		return fmt.Errorf("failed to create image store %s: %v", context.ImageStoreDir, err)
+	}
+
+	imageFiles := make(map[string]bool)
+	for serviceName, serviceLock := range lock.Services {
+		if serviceLock.ImageID == "" {
+			logger.LogxWithFields("warn", fmt.Sprintf("Image %s for service %s is not present locally, it will not be embedded", serviceLock.Image, serviceName), verboseFields)
+			continue
+		}
+		imagePath := filepath.Join(context.ImageStoreDir, ImageFileName(serviceLock.ImageID))
+		if imageFiles[imagePath] {
+			continue
+		}
+		imageFiles[imagePath] = true
+
+		if _, err := os.Stat(imagePath); err == nil {
+			logger.LogxWithFields("debug", fmt.Sprintf("Image for service %s already stored at %s", serviceName, imagePath), verboseFields)
+			continue
+		}
+
+		// save by tag where possible so names survive a load, falling back to the bare id
+		image, err := client.InspectImage(serviceLock.ImageID)
+		if err != nil {
+			return fmt.Errorf("failed to inspect image for service %s: %v", serviceName, err)
+		}
+		names := image.RepoTags
+		if len(names) == 0 {
+			names = []string{image.ID}
+		}
+
+		if err := saveImageFile(client, names, imagePath); err != nil {
+			return fmt.Errorf("failed to save image for service %s: %v", serviceName, err)
+		}
+		logger.LogxWithFields("debug", fmt.Sprintf("Image for service %s saved to %s", serviceName, imagePath), verboseFields)
+	}
+
+	context.ImageFiles = context.ImageFiles[:0]
+	for imagePath := range imageFiles {
+		context.ImageFiles = append(context.ImageFiles, imagePath)
+	}
+	sort.Strings(context.ImageFiles)
+
+	logger.LogxWithFields("info", fmt.Sprintf("%d image(s) embedded in image store", len(context.ImageFiles)), verboseFields)
+	return nil
+}
+
+// writes image tarball to a partial file, renamed into place once complete
+func saveImageFile(client dockerapi.Client, names []string, imagePath string) error {
+	partialPath := imagePath + ".partial"
+	imageFile, err := os.Create(partialPath)
+	if err != nil {
+		return err
+	}
+	if err := client.SaveImage(names, imageFile); err != nil {
+		imageFile.Close()
+		os.Remove(partialPath)
+		return err
+	}
+	if err := imageFile.Close(); err != nil {
+		os.Remove(partialPath)
+		return err
+	}
+	return os.Rename(partialPath, imagePath)
+}
+
+// sends embedded image tarballs to remote image store, images already present on remote are skipped
+func sendImagesToRemote(jobctx *job.JobContext, destination input.RemoteTarget, cargoportKey string) error {
+	if len(jobctx.ImageFiles) == 0 {
+		return nil
+	}
+
+	remoteImageDir := RemoteArchivePath(destination.OutputDir, ImageStoreDirName) + "/"
+	rsyncArgs := []string{
+		"-av",
+		"--ignore-existing",
+		"--partial-dir=.cargoport-partial",
+		"-e", util.SSHCommandString(cargoportKey, destination.Port),
+	}
+	if destination.BandwidthLimit > 0 {
+		rsyncArgs = append(rsyncArgs, fmt.Sprintf("--bwlimit=%d", destination.BandwidthLimit))
+	}
+	rsyncArgs = append(rsyncArgs, jobctx.ImageFiles...)
+	rsyncArgs = append(rsyncArgs, fmt.Sprintf("%s@%s:%s", destination.User, destination.Host, remoteImageDir))
+
+	if err := util.RunCommand("rsync", rsyncArgs...); err != nil {
+		return fmt.Errorf("failed to send images: %v", err)
+	}
+
+	logger.LogxWithFields("debug", fmt.Sprintf("%d image(s) sent to remote '%s'", len(jobctx.ImageFiles), destination.Name), logger.MergeFields(remoteLogDebugFields(jobctx), map[string]interface{}{
+		"remote_name": destination.Name,
+		"remote_dir":  remoteImageDir,
+	}))
+	return nil
+}
+
+// loads archived images missing from the local engine, tagging each with its locked reference,
+// returns services whose images were loaded from the image store
+func LoadEmbeddedImages(client dockerapi.Client, lock *ImageLock, imageDirs []string) (map[string]bool, error) {
+	loaded := make(map[string]bool)
+	loadedImages := make(map[string]bool)
+	for serviceName, serviceLock := range lock.Services {
+		if serviceLock.ImageID == "" {
+			continue
+		}
+		if _, err := client.InspectImage(serviceLock.ImageID); err == nil && !loadedImages[serviceLock.ImageID] {
+			continue
+		}
+
+		if !loadedImages[serviceLock.ImageID] {
+			imagePath := findImageFile(imageDirs, serviceLock.ImageID)
+			if imagePath == "" {
+				continue
+			}
+			imageFile, err := os.Open(imagePath)
+			if err != nil {
+				return loaded, fmt.Errorf("failed to open image %s: %v", imagePath, err)
+			}
+			err = client.LoadImage(imageFile)
+			imageFile.Close()
+			if err != nil {
+				return loaded, fmt.Errorf("failed to load image for service %s: %v", serviceName, err)
+			}
+			loadedImages[serviceLock.ImageID] = true
+		}
+
+		// images are deduplicated by id, so the stored tarball may carry another stack's tag
+		if serviceLock.Image != "" && !strings.Contains(serviceLock.Image, "@") {
+			if err := client.TagImage(serviceLock.ImageID, serviceLock.Image); err != nil {
+				return loaded, fmt.Errorf("failed to tag image for service %s: %v", serviceName, err)
+			}
+		}
+		loaded[serviceName] = true
+	}
+	return loaded, nil
+}
+
+// returns first image store tarball found for image id
+func findImageFile(imageDirs []string, imageID string) string {
+	for _, imageDir := range imageDirs {
+		imagePath := filepath.Join(imageDir, ImageFileName(imageID))
+		if _, err := os.Stat(imagePath); err == nil {
+			return imagePath
+		}
+	}
+	return ""
+}
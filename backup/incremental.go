@@ -0,0 +1,423 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/logger"
+)
+
+// directory within the cargoport root holding tar snapshot indexes, one subdirectory per target & tag
+const IncrementalDirName = "incremental"
+
+const (
+	fullIndexName   = "full.snar"   // index as of the chain's full backup, base of differential backups
+	latestIndexName = "latest.snar" // index as of the latest full or incremental backup, base of incremental backups
+	chainStateName  = "chain.json"
+)
+
+// short backup level names used in chained archive names
+var levelNames = map[string]string{
+	input.BackupModeFull:         "full",
+	input.BackupModeIncremental:  "incr",
+	input.BackupModeDifferential: "diff",
+}
+
+// current incremental chain of a target, stored alongside its indexes
+type chainState struct {
+	ChainID      string    `json:"chain_id"` // job id of the chain's full backup
+	TargetDir    string    `json:"target_dir"`
+	Count        int       `json:"count"` // archives in the chain, including the full backup
+	FullArchive  string    `json:"full_archive,omitempty"`
+	IndexJobID   string    `json:"index_job_id"` // job latest.snar was recorded by
+	IndexArchive string    `json:"index_archive,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// builds chained archive name, e.g: service1-nightly-20250621-010000-incr.bak.tar.gz
+func ChainArchiveName(baseName, tag, level string, timestamp time.Time) string {
+	return strings.TrimSuffix(TimestampedArchiveName(baseName, tag, timestamp), ArchiveSuffix) + "-" + levelNames[level] + ArchiveSuffix
+}
+
+// returns index dir for target & tag within the cargoport root
+func chainDir(cargoportDir, target, tag string) string {
+	name := target
+	if tag != "" {
+		name += "-" + tag
+	}
+	return filepath.Join(cargoportDir, IncrementalDirName, name)
+}
+
+// determines backup level & parent for incremental or differential jobs, starting a new chain with a full backup
+// when there is none, it is complete, or an archive or index it depends on has gone missing
+func prepareChain(jobctx *job.JobContext, inputctx *input.InputContext) error {
+	if inputctx.BackupMode == "" || inputctx.BackupMode == input.BackupModeFull {
+		return nil
+	}
+	coreFields := logger.CoreLogFields(jobctx, "backup")
+
+	// mounts outside the target dir are placed in the archive by name transforms, which indexes do not follow
+	if len(jobctx.ArchiveMounts) > 0 {
+		logger.LogxWithFields("warn", fmt.Sprintf("%s backups are not supported for containers with mounts outside the target dir, taking a full backup", inputctx.BackupMode), coreFields)
+		return nil
+	}
+
+	dir := chainDir(inputctx.Config.DefaultCargoportDir, jobctx.Target, jobctx.Tag)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create incremental index directory: %v", err)
+	}
+	jobctx.IncrementalIndex = filepath.Join(dir, jobctx.JobID+".snar.partial")
+
+	state, reason := loadChain(dir, jobctx, inputctx)
+	if reason != "" {
+		logger.LogxWithFields("info", fmt.Sprintf("Starting new backup chain with a full backup, %s", reason), coreFields)
+		jobctx.BackupLevel = input.BackupModeFull
+		jobctx.ChainID = jobctx.JobID
+		return nil
+	}
+
+	jobctx.BackupLevel = inputctx.BackupMode
+	jobctx.ChainID = state.ChainID
+	if inputctx.BackupMode == input.BackupModeDifferential {
+		jobctx.ParentJobID = state.ChainID
+		jobctx.IncrementalBase = filepath.Join(dir, fullIndexName)
+	} else {
+		jobctx.ParentJobID = state.IndexJobID
+		jobctx.IncrementalBase = filepath.Join(dir, latestIndexName)
+	}
+	logger.LogxWithFields("debug", fmt.Sprintf("Taking %s backup against job %s, chain %s", jobctx.BackupLevel, jobctx.ParentJobID, jobctx.ChainID), backupLogBaseFields(*jobctx))
+	return nil
+}
+
+// reads chain state, returning why a new chain must be started when the current one cannot be extended
+func loadChain(dir string, jobctx *job.JobContext, inputctx *input.InputContext) (*chainState, string) {
+	stateData, err := os.ReadFile(filepath.Join(dir, chainStateName))
+	if err != nil {
+		return nil, "no previous backup chain"
+	}
+	var state chainState
+	if err := json.Unmarshal(stateData, &state); err != nil {
+		return nil, "previous chain state is unreadable"
+	}
+
+	switch {
+	case state.TargetDir != jobctx.TargetDir:
+		return nil, fmt.Sprintf("previous chain was of %s", state.TargetDir)
+	case state.Count >= inputctx.Config.IncrementalFullEvery:
+		return nil, fmt.Sprintf("previous chain holds %d backups", state.Count)
+	case !fileExists(filepath.Join(dir, fullIndexName)) || !fileExists(filepath.Join(dir, latestIndexName)):
+		return nil, "previous chain index is missing"
+	case state.FullArchive != "" && !fileExists(state.FullArchive):
+		return nil, fmt.Sprintf("full backup %s is missing", state.FullArchive)
+	case inputctx.BackupMode == input.BackupModeIncremental && state.IndexArchive != "" && !fileExists(state.IndexArchive):
+		return nil, fmt.Sprintf("previous backup %s is missing", state.IndexArchive)
+	}
+	return &state, ""
+}
+
+// resets the working index to its base before each tar run, so retried runs archive the same changes
+func resetIncrementalIndex(jobctx *job.JobContext) error {
+	if jobctx.IncrementalIndex == "" {
+		return nil
+	}
+	if err := os.Remove(jobctx.IncrementalIndex); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to reset incremental index: %v", err)
+	}
+	if jobctx.IncrementalBase == "" {
+		return nil
+	}
+	if err := copyFile(jobctx.IncrementalBase, jobctx.IncrementalIndex); err != nil {
+		return fmt.Errorf("failed to prepare incremental index: %v", err)
+	}
+	return nil
+}
+
+// builds tar args recording the archive against the working index
+func tarIncrementalArgs(jobctx *job.JobContext) []string {
+	if jobctx.IncrementalIndex == "" {
+		return nil
+	}
+	// snapshots present the target dir on a different device, which tar would otherwise treat as all new
+	return []string{"--listed-incremental=" + jobctx.IncrementalIndex, "--no-check-device"}
+}
+
+// records paths removed since the parent backup by comparing the base & updated indexes
+func recordDeletedPaths(jobctx *job.JobContext) {
+	if jobctx.IncrementalBase == "" {
+		return
+	}
+	deleted, err := deletedPaths(jobctx.IncrementalBase, jobctx.IncrementalIndex)
+	if err != nil {
+		logger.LogxWithFields("warn", fmt.Sprintf("Failed to determine deleted paths: %v", err), logger.CoreLogFields(jobctx, "backup"))
+		return
+	}
+	jobctx.DeletedPaths = deleted
+}
+
+// advances the target's chain once the job has completed, applying chain retention to local archives
+func CommitChain(jobctx *job.JobContext, inputctx *input.InputContext, archivePath string) error {
+	if jobctx.BackupLevel == "" {
+		return nil
+	}
+	dir := filepath.Dir(jobctx.IncrementalIndex)
+	if jobctx.SkipLocal {
+		archivePath = ""
+	}
+
+	var state chainState
+	if stateData, err := os.ReadFile(filepath.Join(dir, chainStateName)); err == nil {
+		json.Unmarshal(stateData, &state)
+	}
+
+	switch jobctx.BackupLevel {
+	case input.BackupModeFull:
+		if err := copyFile(jobctx.IncrementalIndex, filepath.Join(dir, fullIndexName)); err != nil {
+			return fmt.Errorf("failed to store full backup index: %v", err)
+		}
+		if err := os.Rename(jobctx.IncrementalIndex, filepath.Join(dir, latestIndexName)); err != nil {
+			return fmt.Errorf("failed to store backup index: %v", err)
+		}
+		state = chainState{ChainID: jobctx.JobID, TargetDir: jobctx.TargetDir, FullArchive: archivePath}
+		state.IndexJobID, state.IndexArchive = jobctx.JobID, archivePath
+	case input.BackupModeIncremental:
+		if err := os.Rename(jobctx.IncrementalIndex, filepath.Join(dir, latestIndexName)); err != nil {
+			return fmt.Errorf("failed to store backup index: %v", err)
+		}
+		state.IndexJobID, state.IndexArchive = jobctx.JobID, archivePath
+	case input.BackupModeDifferential:
+		// differential backups always start from the full index, leaving the latest index as it was
+		os.Remove(jobctx.IncrementalIndex)
+	}
+	state.Count++
+	state.UpdatedAt = time.Now()
+
+	stateData, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode chain state: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, chainStateName), stateData, 0600); err != nil {
+		return fmt.Errorf("failed to write chain state: %v", err)
+	}
+
+	if archivePath != "" {
+		removed, err := ApplyChainRetention(filepath.Dir(archivePath), jobctx.Target, jobctx.Tag, inputctx.Config.IncrementalKeepChains)
+		if err != nil {
+			return err
+		}
+		if len(removed) > 0 {
+			logger.LogxWithFields("info", fmt.Sprintf("Chain retention removed %d expired archive(s)", len(removed)), logger.CoreLogFields(jobctx, "backup"))
+		}
+	}
+	return nil
+}
+
+// discards the working index of a failed job
+func DiscardIncrementalIndex(jobctx *job.JobContext) {
+	if jobctx.IncrementalIndex != "" {
+		os.Remove(jobctx.IncrementalIndex)
+	}
+}
+
+// removes whole chains of target & tag in archiveDir beyond the newest keepChains
+// archives are only ever removed along with their full backup, so no kept archive loses an archive it depends on
+func ApplyChainRetention(archiveDir, target, tag string, keepChains int) ([]string, error) {
+	if keepChains <= 0 {
+		return nil, nil
+	}
+	manifests, err := readDirManifests(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// chains keyed by id, ordered by their full backup's creation
+	chains := map[string][]*Manifest{}
+	chainStarted := map[string]time.Time{}
+	for _, manifest := range manifests {
+		if manifest.ChainID == "" || manifest.Target != target || manifest.Tag != tag {
+			continue
+		}
+		chains[manifest.ChainID] = append(chains[manifest.ChainID], manifest)
+		if started, seen := chainStarted[manifest.ChainID]; !seen || manifest.CreatedAt.Before(started) {
+			chainStarted[manifest.ChainID] = manifest.CreatedAt
+		}
+	}
+	if len(chains) <= keepChains {
+		return nil, nil
+	}
+	chainIDs := make([]string, 0, len(chains))
+	for chainID := range chains {
+		chainIDs = append(chainIDs, chainID)
+	}
+	sort.Slice(chainIDs, func(i, j int) bool {
+		return chainStarted[chainIDs[i]].After(chainStarted[chainIDs[j]])
+	})
+
+	var removed []string
+	for _, chainID := range chainIDs[keepChains:] {
+		for _, manifest := range chains[chainID] {
+			archivePath := filepath.Join(archiveDir, manifest.Archive)
+			if err := os.Remove(archivePath); err != nil && !os.IsNotExist(err) {
+				return removed, fmt.Errorf("failed to remove expired archive %s: %v", archivePath, err)
+			}
+			os.Remove(ManifestPath(archivePath))
+			removed = append(removed, archivePath)
+
+			logger.LogxWithFields("debug", fmt.Sprintf("Chain retention removed expired archive %s", archivePath), map[string]interface{}{
+				"package": "retention",
+				"target":  target,
+			})
+		}
+	}
+	return removed, nil
+}
+
+// returns archives to restore for archivePath in order, from its chain's full backup through archivePath itself
+// parents are located by job id among the manifests beside the archive, so renamed archives still resolve
+func ResolveChain(archivePath string) ([]string, error) {
+	manifest, err := ReadManifest(archivePath)
+	if err != nil || manifest.ParentJobID == "" {
+		return []string{archivePath}, nil
+	}
+
+	archiveDir := filepath.Dir(archivePath)
+	manifests, err := readDirManifests(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+	byJobID := map[string]*Manifest{}
+	for _, candidate := range manifests {
+		byJobID[candidate.JobID] = candidate
+	}
+
+	chain := []string{archivePath}
+	for parentID := manifest.ParentJobID; parentID != ""; {
+		parent, found := byJobID[parentID]
+		if !found {
+			return nil, fmt.Errorf("backup chain is broken, archive of job %s is missing from %s", parentID, archiveDir)
+		}
+		if len(chain) > len(manifests) {
+			return nil, fmt.Errorf("backup chain of %s refers back to itself", filepath.Base(archivePath))
+		}
+		chain = append([]string{filepath.Join(archiveDir, parent.Archive)}, chain...)
+		parentID = parent.ParentJobID
+	}
+	return chain, nil
+}
+
+// reads every sidecar manifest in dir, skipping unreadable ones
+func readDirManifests(dir string) ([]*Manifest, error) {
+	manifestPaths, err := filepath.Glob(filepath.Join(dir, "*"+ArchiveSuffix+ManifestSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive directory %s: %v", dir, err)
+	}
+	var manifests []*Manifest
+	for _, manifestPath := range manifestPaths {
+		manifest, err := ReadManifest(strings.TrimSuffix(manifestPath, ManifestSuffix))
+		if err != nil {
+			continue
+		}
+		// the manifest's own archive name is authoritative, pulled archives are renamed on arrival
+		manifest.Archive = filepath.Base(strings.TrimSuffix(manifestPath, ManifestSuffix))
+		manifests = append(manifests, manifest)
+	}
+	return manifests, nil
+}
+
+// returns archive paths present in the base index but missing from the updated one
+// only the topmost deleted path is listed, contents of deleted directories are implied
+func deletedPaths(baseIndex, updatedIndex string) ([]string, error) {
+	before, err := readIncrementalIndex(baseIndex)
+	if err != nil {
+		return nil, err
+	}
+	after, err := readIncrementalIndex(updatedIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for dir, entries := range before {
+		current, stillExists := after[dir]
+		if !stillExists {
+			continue
+		}
+		for entry := range entries {
+			if !current[entry] {
+				deleted = append(deleted, path.Join(dir, entry))
+			}
+		}
+	}
+	sort.Strings(deleted)
+	return deleted, nil
+}
+
+// parses a gnu tar format 2 snapshot index into the entries of each directory
+// 'GNU tar-<version>-2\n<sec>\0<nsec>\0' then per directory '<nfs>\0<sec>\0<nsec>\0<dev>\0<ino>\0<name>\0' followed
+// by '<status><entry>\0' per entry, the directory's entries ending with an empty string
+func readIncrementalIndex(indexPath string) (map[string]map[string]bool, error) {
+	indexData, err := os.ReadFile(indexPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read incremental index: %v", err)
+	}
+	header, body, found := bytes.Cut(indexData, []byte("\n"))
+	if !found || !bytes.HasPrefix(header, []byte("GNU tar-")) || !bytes.HasSuffix(header, []byte("-2")) {
+		return nil, fmt.Errorf("unsupported incremental index format in %s", indexPath)
+	}
+
+	tokens := strings.Split(string(body), "\x00")
+	directories := map[string]map[string]bool{}
+	position := 2 // skips the index's own timestamp
+	for position < len(tokens) {
+		// records are separated by an additional empty string
+		if tokens[position] == "" {
+			position++
+			continue
+		}
+		if position+6 > len(tokens) {
+			return nil, fmt.Errorf("truncated incremental index %s", indexPath)
+		}
+		name := tokens[position+5]
+		position += 6
+
+		entries := map[string]bool{}
+		for position < len(tokens) && tokens[position] != "" {
+			entries[tokens[position][1:]] = true
+			position++
+		}
+		directories[name] = entries
+	}
+	return directories, nil
+}
+
+func fileExists(filePath string) bool {
+	_, err := os.Stat(filePath)
+	return err == nil
+}
+
+func copyFile(source, dest string) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destFile, sourceFile); err != nil {
+		destFile.Close()
+		return err
+	}
+	return destFile.Close()
+}
@@ -0,0 +1,131 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/input"
+)
+
+// builds a gnu tar format 2 snapshot index, directories given as name followed by '<status><entry>' entries
+func writeTestIndex(t *testing.T, directories ...[]string) string {
+	t.Helper()
+	var index strings.Builder
+	index.WriteString("GNU tar-1.34-2\n1792356533\x00200993620\x00")
+	for _, directory := range directories {
+		index.WriteString("0\x001792356533\x00199884802\x0065024\x009625634\x00" + directory[0] + "\x00")
+		for _, entry := range directory[1:] {
+			index.WriteString(entry + "\x00")
+		}
+		index.WriteString("\x00\x00")
+	}
+	indexPath := filepath.Join(t.TempDir(), "index.snar")
+	if err := os.WriteFile(indexPath, []byte(index.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return indexPath
+}
+
+func TestReadIncrementalIndex(t *testing.T) {
+	indexPath := writeTestIndex(t,
+		[]string{"data/sub", "Yb"},
+		[]string{"data", "Ya", "Dsub", "Nunchanged"},
+		[]string{"data/empty"},
+	)
+	directories, err := readIncrementalIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]bool{
+		"data/sub":   {"b": true},
+		"data":       {"a": true, "sub": true, "unchanged": true},
+		"data/empty": {},
+	}
+	if !reflect.DeepEqual(directories, want) {
+		t.Errorf("directories = %v, want %v", directories, want)
+	}
+}
+
+func TestReadIncrementalIndexRejectsOtherFormats(t *testing.T) {
+	for name, content := range map[string]string{
+		"format 1":  "GNU tar-1.34-1\n1792356533\n",
+		"not tar":   "{}",
+		"truncated": "GNU tar-1.34-2\n1792356533\x00200993620\x000\x001792356533\x00",
+	} {
+		indexPath := filepath.Join(t.TempDir(), "index.snar")
+		if err := os.WriteFile(indexPath, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readIncrementalIndex(indexPath); err == nil {
+			t.Errorf("%s: expected index to be rejected", name)
+		}
+	}
+	if _, err := readIncrementalIndex(filepath.Join(t.TempDir(), "missing.snar")); err == nil {
+		t.Error("expected missing index to be an error")
+	}
+}
+
+func TestDeletedPaths(t *testing.T) {
+	baseIndex := writeTestIndex(t,
+		[]string{"data", "Ya", "Yb", "Dsub", "Dold"},
+		[]string{"data/sub", "Yc", "Yd"},
+		[]string{"data/old", "Ye"},
+	)
+	updatedIndex := writeTestIndex(t,
+		[]string{"data", "Ya", "Dsub", "Ynew"},
+		[]string{"data/sub", "Yd"},
+	)
+	deleted, err := deletedPaths(baseIndex, updatedIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// contents of the deleted directory are implied by the directory itself
+	if want := []string{"data/b", "data/old", "data/sub/c"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted = %v, want %v", deleted, want)
+	}
+}
+
+// writes a chained archive & manifest for each of the given chains, one day apart
+func writeTestChains(t *testing.T, archiveDir string, chainIDs ...string) []string {
+	t.Helper()
+	var archives []string
+	for i, chainID := range chainIDs {
+		createdAt := time.Date(2025, 6, 21+i, 1, 0, 0, 0, time.Local)
+		archivePath := filepath.Join(archiveDir, ChainArchiveName("app", "", input.BackupModeFull, createdAt))
+		if err := os.WriteFile(archivePath, []byte(chainID), 0600); err != nil {
+			t.Fatal(err)
+		}
+		manifest := &Manifest{JobID: chainID, Target: "app", CreatedAt: createdAt, Archive: filepath.Base(archivePath), BackupLevel: input.BackupModeFull, ChainID: chainID}
+		if err := WriteManifest(archivePath, manifest); err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, archivePath)
+	}
+	return archives
+}
+
+func TestApplyChainRetention(t *testing.T) {
+	archiveDir := t.TempDir()
+	archives := writeTestChains(t, archiveDir, "chain1", "chain2", "chain3")
+
+	// 0 keeps every chain
+	if removed, err := ApplyChainRetention(archiveDir, "app", "", 0); err != nil || len(removed) != 0 {
+		t.Fatalf("keep 0 removed %v, %v, want nothing", removed, err)
+	}
+	removed, err := ApplyChainRetention(archiveDir, "app", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := archives[:1]; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed = %v, want the oldest chain %v", removed, want)
+	}
+	for _, archivePath := range archives[1:] {
+		if !fileExists(archivePath) {
+			t.Errorf("kept chain archive %s was removed", archivePath)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/adrian-griffin/cargoport/dockerapi"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/logger"
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// directory within the target dir database dumps are written to, archived along with the stack
+const DumpDirName = "cargoport-dumps"
+
+// dump commands run via `sh -c` inside the database container, credentials come from the image's own env vars
+var dumpCommands = map[string]string{
+	input.DumpPostgres: `pg_dumpall --clean --if-exists -U "${POSTGRES_USER:-postgres}"`,
+	input.DumpMySQL:    `MYSQL_PWD="$MYSQL_ROOT_PASSWORD" mysqldump -uroot --all-databases --single-transaction --routines --events`,
+	input.DumpMariaDB:  `MYSQL_PWD="${MARIADB_ROOT_PASSWORD:-$MYSQL_ROOT_PASSWORD}" mariadb-dump -uroot --all-databases --single-transaction --routines --events`,
+}
+
+// resolves the target stack from -docker-name or -target-dir & reads its cargoport labels
+// returns nil labels when the target cannot be resolved, leaving the job itself to report why
+func LoadStackLabels(inputctx *input.InputContext) (*input.StackLabels, error) {
+	if inputctx.DockerName != "" {
+		client, err := newDockerClient()
+		if err != nil {
+			return nil, nil
+		}
+		container, err := client.InspectContainer(inputctx.DockerName)
+		if err != nil {
+			return nil, nil
+		}
+		composeFilePath, err := ComposeFileFromLabels(inputctx.DockerName, container.Config.Labels)
+		if errors.Is(err, errNotComposeManaged) {
+			// standalone containers carry their labels directly until a compose file is generated for them
+			return input.ParseStackLabels(map[string]map[string]string{
+				strings.TrimPrefix(container.Name, "/"): container.Config.Labels,
+			})
+		}
+		return ReadStackLabels(client, composeFilePath)
+	}
+
+	composeFilePath := FindComposeFileInDir(strings.TrimSuffix(inputctx.TargetDir, "/"))
+	if composeFilePath == "" {
+		return nil, nil
+	}
+	client, err := newDockerClient()
+	if err != nil {
+		return nil, nil
+	}
+	return ReadStackLabels(client, composeFilePath)
+}
+
+// reads cargoport labels of every service in compose file
+// falls back to the labels of the project's containers when the compose file cannot be read
+func ReadStackLabels(client dockerapi.Client, composeFilePath string) (*input.StackLabels, error) {
+	serviceLabels := map[string]map[string]string{}
+
+	compose, err := parseComposeFile(composeFilePath)
+	if err == nil {
+		for service, definition := range compose.Services {
+			serviceLabels[service] = definition.Labels
+		}
+		return input.ParseStackLabels(serviceLabels)
+	}
+
+	containers, listErr := composeContainers(client, composeFilePath)
+	if listErr != nil || len(containers) == 0 {
+		return nil, nil
+	}
+	for _, container := range containers {
+		serviceLabels[container.Service()] = container.Labels
+	}
+	return input.ParseStackLabels(serviceLabels)
+}
+
+// runs pre-hook commands, then database dumps, inside running service containers before they are taken offline
+// services which are not running are skipped with a warning
+func runServiceCommands(context *job.JobContext, client dockerapi.Client, composeFilePath string) error {
+	if len(context.PreHooks) == 0 && len(context.Dumps) == 0 {
+		return nil
+	}
+	verboseFields := dockerLogBaseFields(context)
+	coreFields := logger.CoreLogFields(context, "docker")
+
+	containers, err := composeServiceContainers(client, composeFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to list Docker containers: %v", err)
+	}
+	running := map[string]string{} // service to container id
+	for _, container := range containers {
+		if context.ServiceStates[container.Service] == ServiceStateRunning {
+			running[container.Service] = container.ID
+		}
+	}
+
+	for _, hook := range context.PreHooks {
+		containerID, ok := running[hook.Service]
+		if !ok {
+			logger.LogxWithFields("warn", fmt.Sprintf("Service %s is not running, skipping its pre-hook", hook.Service), coreFields)
+			continue
+		}
+		logger.LogxWithFields("debug", fmt.Sprintf("Running pre-hook in service %s: %s", hook.Service, hook.Command), verboseFields)
+		if output, err := util.RunCommandWithOutput("docker", "exec", containerID, "sh", "-c", hook.Command); err != nil {
+			return fmt.Errorf("pre-hook failed in service %s: %s", hook.Service, strings.TrimSpace(output))
+		}
+	}
+
+	for _, dump := range context.Dumps {
+		containerID, ok := running[dump.Service]
+		if !ok {
+			logger.LogxWithFields("warn", fmt.Sprintf("Service %s is not running, skipping its %s dump", dump.Service, dump.Kind), coreFields)
+			continue
+		}
+		dumpPath, err := dumpService(context, containerID, dump)
+		if err != nil {
+			return err
+		}
+		logger.LogxWithFields("info", fmt.Sprintf("Dumped %s database of service %s to %s", dump.Kind, dump.Service, dumpPath), coreFields)
+	}
+	return nil
+}
+
+// writes a database dump of the service's container into the target dir, replacing the previous dump only once complete
+func dumpService(context *job.JobContext, containerID string, dump job.ServiceDump) (string, error) {
+	dumpDir := filepath.Join(context.TargetDir, DumpDirName)
+	if err := os.MkdirAll(dumpDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create dump directory: %v", err)
+	}
+	dumpPath := filepath.Join(dumpDir, fmt.Sprintf("%s.%s.sql", dump.Service, dump.Kind))
+	partialPath := dumpPath + ".partial"
+
+	if err := util.RunCommandToFile(partialPath, "docker", "exec", containerID, "sh", "-c", dumpCommands[dump.Kind]); err != nil {
+		os.Remove(partialPath)
+		return "", fmt.Errorf("%s dump failed in service %s: %v", dump.Kind, dump.Service, err)
+	}
+	if err := os.Rename(partialPath, dumpPath); err != nil {
+		os.Remove(partialPath)
+		return "", fmt.Errorf("failed to store %s dump of service %s: %v", dump.Kind, dump.Service, err)
+	}
+	return dumpPath, nil
+}
+
+// builds tar exclude args for patterns relative to the target dir, placed ahead of the source args
+func tarExcludeArgs(jobctx *job.JobContext, baseDir string) []string {
+	var args []string
+	for _, pattern := range jobctx.ArchiveExclude {
+		args = append(args, "--exclude", filepath.Join(baseDir, pattern))
+	}
+	return args
+}
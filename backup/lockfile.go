@@ -0,0 +1,227 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/adrian-griffin/cargoport/dockerapi"
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/logger"
+)
+
+// image lockfile, written alongside the compose file so it is archived with the backup
+const LockFileName = "cargoport-lock.json"
+
+// compose override generated on restore, pinning services to their locked digests
+const PinnedOverrideName = "docker-compose.cargoport-pinned.yml"
+
+// current lockfile schema version
+const lockFileVersion = 1
+
+// images used by every compose service at backup time
+type ImageLock struct {
+	Version     int                    `json:"lockfile_version"`
+	GeneratedAt time.Time              `json:"generated_at"`
+	ComposeFile string                 `json:"compose_file"`
+	Project     string                 `json:"project,omitempty"`
+	Services    map[string]ServiceLock `json:"services"`
+}
+
+// image details for a single compose service
+type ServiceLock struct {
+	Image    string     `json:"image"`            // image reference as configured
+	ImageID  string     `json:"image_id"`         // local image id
+	Digest   string     `json:"digest,omitempty"` // repo digest reference, empty for locally built images
+	Platform string     `json:"platform"`         // os/arch[/variant]
+	Build    *BuildLock `json:"build,omitempty"`  // set when service is built locally
+}
+
+// build context of a locally built service
+type BuildLock struct {
+	Context    string `json:"context"`
+	Dockerfile string `json:"dockerfile,omitempty"`
+}
+
+// reference pinning service to its exact image, empty when no registry digest exists
+func (s ServiceLock) PinnedReference() string {
+	return s.Digest
+}
+
+// builds lockfile from the compose project's containers & images
+func buildImageLock(client dockerapi.Client, composeFilePath string) (*ImageLock, error) {
+	containers, err := composeContainers(client, composeFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list compose containers: %v", err)
+	}
+
+	lock := &ImageLock{
+		Version:     lockFileVersion,
+		GeneratedAt: time.Now().UTC(),
+		ComposeFile: filepath.Base(composeFilePath),
+		Services:    make(map[string]ServiceLock),
+	}
+
+	// build contexts are only known from the compose file itself
+	compose, err := parseComposeFile(composeFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, container := range containers {
+		serviceName := container.Service()
+		if serviceName == "" {
+			continue
+		}
+		if lock.Project == "" {
+			lock.Project = container.Labels[dockerapi.LabelComposeProject]
+		}
+
+		image, err := client.InspectImage(container.ImageID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect image for service %s: %v", serviceName, err)
+		}
+
+		serviceLock := ServiceLock{
+			Image:    container.Image,
+			ImageID:  image.ID,
+			Digest:   matchRepoDigest(container.Image, image.RepoDigests),
+			Platform: imagePlatform(image),
+		}
+		if composeService, ok := compose.Services[serviceName]; ok {
+			if composeService.Image != "" {
+				serviceLock.Image = composeService.Image
+			}
+			if composeService.Build.Context != "" {
+				serviceLock.Build = &BuildLock{
+					Context:    composeService.Build.Context,
+					Dockerfile: composeService.Build.Dockerfile,
+				}
+			}
+		}
+		lock.Services[serviceName] = serviceLock
+	}
+
+	// services without containers are locked from their configured image, if present locally
+	for serviceName, composeService := range compose.Services {
+		if _, locked := lock.Services[serviceName]; locked || composeService.Image == "" {
+			continue
+		}
+		serviceLock := ServiceLock{Image: composeService.Image}
+		if image, err := client.InspectImage(composeService.Image); err == nil {
+			serviceLock.ImageID = image.ID
+			serviceLock.Digest = matchRepoDigest(composeService.Image, image.RepoDigests)
+			serviceLock.Platform = imagePlatform(image)
+		} else if !errors.Is(err, dockerapi.ErrNotFound) {
+			return nil, fmt.Errorf("failed to inspect image for service %s: %v", serviceName, err)
+		}
+		lock.Services[serviceName] = serviceLock
+	}
+	return lock, nil
+}
+
+// picks repo digest matching configured image repository, falling back to the first digest
+func matchRepoDigest(imageRef string, repoDigests []string) string {
+	if len(repoDigests) == 0 {
+		return ""
+	}
+	repository := imageRef
+	if at := strings.Index(repository, "@"); at >= 0 {
+		repository = repository[:at]
+	}
+	if colon := strings.LastIndex(repository, ":"); colon > strings.LastIndex(repository, "/") {
+		repository = repository[:colon]
+	}
+	for _, repoDigest := range repoDigests {
+		if strings.HasPrefix(repoDigest, repository+"@") {
+			return repoDigest
+		}
+	}
+	return repoDigests[0]
+}
+
+// formats image platform as os/arch[/variant]
+func imagePlatform(image *dockerapi.Image) string {
+	platform := fmt.Sprintf("%s/%s", image.Os, image.Architecture)
+	if image.Variant != "" {
+		platform += "/" + image.Variant
+	}
+	return platform
+}
+
+// collects service images & writes lockfile alongside the compose file
+func writeImageLock(context *job.JobContext, client dockerapi.Client, composeFilePath string) (*ImageLock, error) {
+	verboseFields := dockerLogBaseFields(context)
+
+	lock, err := buildImageLock(client, composeFilePath)
+	if err != nil {
+		return nil, err
+	}
+	lockData, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode lockfile: %v", err)
+	}
+
+	lockPath := filepath.Join(filepath.Dir(composeFilePath), LockFileName)
+	if err := os.WriteFile(lockPath, append(lockData, '\n'), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write lockfile %s: %v", lockPath, err)
+	}
+
+	logger.LogxWithFields("debug", fmt.Sprintf("Image lockfile for %d service(s) saved to %s", len(lock.Services), lockPath), verboseFields)
+	return lock, nil
+}
+
+// reads lockfile from compose dir
+func ReadImageLock(composeDir string) (*ImageLock, error) {
+	lockPath := filepath.Join(composeDir, LockFileName)
+	lockData, err := os.ReadFile(lockPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lockfile %s: %v", lockPath, err)
+	}
+	var lock ImageLock
+	if err := json.Unmarshal(lockData, &lock); err != nil {
+		return nil, fmt.Errorf("failed to parse lockfile %s: %v", lockPath, err)
+	}
+	return &lock, nil
+}
+
+// writes compose override pinning each service to its locked digest, returns override path
+// & the services which could not be pinned as they were built locally,
+// services loaded from embedded images already resolve to their exact image & are left as-is
+func WritePinnedOverride(composeDir string, lock *ImageLock, loaded map[string]bool) (string, []string, error) {
+	pinnedServices := make(map[string]map[string]string)
+	var unpinned []string
+	for serviceName, serviceLock := range lock.Services {
+		if loaded[serviceName] {
+			continue
+		}
+		if serviceLock.PinnedReference() == "" {
+			unpinned = append(unpinned, serviceName)
+			continue
+		}
+		pinnedServices[serviceName] = map[string]string{"image": serviceLock.PinnedReference()}
+	}
+	sort.Strings(unpinned)
+
+	overrideData, err := yaml.Marshal(map[string]interface{}{"services": pinnedServices})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to encode pinned override: %v", err)
+	}
+	header := fmt.Sprintf("# generated by cargoport from %s, pins services to the image digests recorded at backup time\n", LockFileName)
+	if len(unpinned) > 0 {
+		header += fmt.Sprintf("# not pinned (locally built, no registry digest): %s\n", strings.Join(unpinned, ", "))
+	}
+
+	overridePath := filepath.Join(composeDir, PinnedOverrideName)
+	if err := os.WriteFile(overridePath, append([]byte(header), overrideData...), 0644); err != nil {
+		return "", nil, fmt.Errorf("failed to write pinned override %s: %v", overridePath, err)
+	}
+	return overridePath, unpinned, nil
+}
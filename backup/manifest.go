@@ -0,0 +1,132 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/meta"
+)
+
+// current manifest schema version
+const ManifestVersion = 1
+
+// sidecar manifest suffix, stored alongside archive as <archive>.manifest.json
+const ManifestSuffix = ".manifest.json"
+
+// describes a single cargoport archive, stored as a sidecar next to the archive
+type Manifest struct {
+	Version          int       `json:"manifest_version"`
+	CargoportVersion string    `json:"cargoport_version"`
+	JobID            string    `json:"job_id"`
+	Hostname         string    `json:"hostname"`
+	Target           string    `json:"target"`
+	TargetDir        string    `json:"target_dir"`
+	Tag              string    `json:"tag,omitempty"`
+	Docker           bool      `json:"docker"`
+	CreatedAt        time.Time `json:"created_at"`
+	Archive          string    `json:"archive"`
+	SizeBytes        int64     `json:"size_bytes"`
+	SHA256           string    `json:"sha256"`
+	Compression      string    `json:"compression"`
+	Images           []string  `json:"images,omitempty"` // embedded image tarballs, stored in the image store
+
+	// compose service states recorded before backup, reproduced by `cargoport restore -up`
+	ServiceStates map[string]string `json:"service_states,omitempty"`
+	// provider of the filesystem snapshot the archive was taken from
+	Snapshot string `json:"snapshot,omitempty"`
+
+	// incremental & differential chains, restoring the archive first restores each parent back to the full backup
+	BackupLevel string   `json:"backup_level,omitempty"`
+	ChainID     string   `json:"chain_id,omitempty"`
+	ParentJobID string   `json:"parent_job_id,omitempty"`
+	Deleted     []string `json:"deleted,omitempty"` // archive paths removed since the parent backup
+}
+
+// returns sidecar manifest path for archive
+func ManifestPath(archivePath string) string {
+	return archivePath + ManifestSuffix
+}
+
+// builds manifest from completed job context
+func NewManifest(jobctx *job.JobContext, archivePath string) *Manifest {
+	hostName, _ := os.Hostname()
+
+	return &Manifest{
+		Version:          ManifestVersion,
+		CargoportVersion: meta.Version,
+		JobID:            jobctx.JobID,
+		Hostname:         hostName,
+		Target:           jobctx.Target,
+		TargetDir:        jobctx.TargetDir,
+		Tag:              jobctx.Tag,
+		Docker:           jobctx.Docker,
+		CreatedAt:        jobctx.StartTime,
+		Archive:          filepath.Base(archivePath),
+		SizeBytes:        jobctx.CompressedSizeBytesInt,
+		SHA256:           jobctx.ArchiveSHA256,
+		Compression:      CompressionGzip,
+		Images:           imageFileNames(jobctx.ImageFiles),
+		ServiceStates:    jobctx.ServiceStates,
+		Snapshot:         jobctx.SnapshotProvider,
+		BackupLevel:      jobctx.BackupLevel,
+		ChainID:          jobctx.ChainID,
+		ParentJobID:      jobctx.ParentJobID,
+		Deleted:          jobctx.DeletedPaths,
+	}
+}
+
+// returns image store filenames for embedded image paths
+func imageFileNames(imagePaths []string) []string {
+	var names []string
+	for _, imagePath := range imagePaths {
+		names = append(names, filepath.Base(imagePath))
+	}
+	return names
+}
+
+// writes manifest as sidecar json next to archive
+func WriteManifest(archivePath string, manifest *Manifest) error {
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	if err := os.WriteFile(ManifestPath(archivePath), manifestData, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+// reads sidecar manifest for archive
+func ReadManifest(archivePath string) (*Manifest, error) {
+	manifestData, err := os.ReadFile(ManifestPath(archivePath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	return &manifest, nil
+}
+
+// computes sha256 checksum of file on disk
+func FileSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -3,8 +3,11 @@ package backup
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/adrian-griffin/cargoport/input"
 	"github.com/adrian-griffin/cargoport/job"
@@ -31,42 +34,228 @@ func remoteLogDebugFields(context *job.JobContext) map[string]interface{} {
 // <here> logic for validating remote target dir existence, permissions, etc.
 // as well as logic for confirming enough space on remote for transfer
 
-// wrapper function for all remote-send functions
+// wrapper function for all remote-send functions, fans archive out to every destination in parallel
 func HandleRemoteTransfer(jobctx *job.JobContext, filePath string, inputctx *input.InputContext) error {
 
-	// <here> need to add logic here to toggle off icmp & ssh tests/validations in configfile
+	// defining logging fields
+	verboseFields := remoteLogDebugFields(jobctx)
+
 	cargoportKey := filepath.Join(inputctx.Config.SSHKeyDir, inputctx.Config.SSHKeyName)
 
-	if inputctx.Config.ICMPTest {
-		// test to ensure remote host is reachable via icmp
-		if err := util.ICMPRemoteHost(inputctx.RemoteHost); err != nil {
-			return fmt.Errorf("remote host is not responding to ICMP: %v", err)
+	err := transferToDestinations(jobctx, inputctx, func(destination input.RemoteTarget) error {
+		return sendToRemote(jobctx, destination.OutputDir, destination.User, destination.Host, destination.Port, filepath.Base(filePath), filePath, cargoportKey, destination.BandwidthLimit, *inputctx.Config)
+	})
+	if err != nil {
+		// keep archive on disk when skipLocal is enabled, as it may be the only remaining copy
+		if jobctx.SkipLocal {
+			logger.LogxWithFields("warn", fmt.Sprintf("Remote policy not satisfied, retaining local archive at %s", filePath), verboseFields)
 		}
+		return err
 	}
 
-	if inputctx.Config.SSHTest {
-		// test ssh connectivity prior to attempting rsync
-		if err := util.SSHTestRemoteHost(jobctx, inputctx.RemoteHost, inputctx.RemoteUser, cargoportKey); err != nil {
-			return fmt.Errorf("remote host is not responding to SSH: %s", inputctx.RemoteHost)
+	// clean up local tempfile only after all required destinations succeed when skipLocal is enabled,
+	// whatever the remote policy, as policy `any` is satisfied while a required destination has failed
+	if jobctx.SkipLocal {
+		if failedRequired := failedRequiredDestinations(jobctx.RemoteResults); len(failedRequired) > 0 {
+			logger.LogxWithFields("warn", fmt.Sprintf("Required remote destination(s) %s failed, retaining local archive at %s", strings.Join(failedRequired, ", "), filePath), verboseFields)
+			return nil
 		}
+		util.RemoveTempFile(jobctx, filePath)
 	}
 
-	// proceed with remote transfer
-	err := sendToRemote(jobctx, inputctx.RemoteOutputDir, inputctx.RemoteUser, inputctx.RemoteHost, filepath.Base(filePath), filePath, cargoportKey, *inputctx.Config)
+	return nil
+}
+
+// runs send against every destination in parallel, recording results & evaluating them against the remote policy
+func transferToDestinations(jobctx *job.JobContext, inputctx *input.InputContext, send func(destination input.RemoteTarget) error) error {
+
+	// defining logging fields
+	verboseFields := remoteLogDebugFields(jobctx)
+
+	cargoportKey := filepath.Join(inputctx.Config.SSHKeyDir, inputctx.Config.SSHKeyName)
+
+	if len(inputctx.Destinations) == 0 {
+		return fmt.Errorf("no remote destinations defined for transfer")
+	}
+
+	// run each destination's transfer concurrently, tracking results by index
+	results := make([]job.RemoteResult, len(inputctx.Destinations))
+	var wg sync.WaitGroup
+	for i, destination := range inputctx.Destinations {
+		wg.Add(1)
+		go func(i int, destination input.RemoteTarget) {
+			defer wg.Done()
+			results[i] = transferToDestination(jobctx, destination, cargoportKey, inputctx.Config, send)
+		}(i, destination)
+	}
+	wg.Wait()
+	jobctx.RemoteResults = results
+
+	// log per-destination outcome
+	for _, result := range results {
+		fields := logger.MergeFields(verboseFields, map[string]interface{}{
+			"remote_name": result.Name,
+			"remote_host": result.Host,
+			"remote_user": result.User,
+			"required":    result.Required,
+			"success":     result.Success,
+			"duration":    fmt.Sprintf("%.2fs", result.Duration.Seconds()),
+		})
+		if result.Success {
+			logger.LogxWithFields("debug", fmt.Sprintf("Transfer to remote '%s' complete", result.Name), fields)
+		} else {
+			logger.LogxWithFields("error", fmt.Sprintf("Transfer to remote '%s' failed: %s", result.Name, result.Error), fields)
+		}
+	}
+
+	// evaluate results against configured success policy
+	return evaluateRemotePolicy(results, inputctx.Config.RemoteSuccessPolicy)
+}
+
+// runs prechecks & transfer for a single destination, returning its result
+func transferToDestination(jobctx *job.JobContext, destination input.RemoteTarget, cargoportKey string, configFile *input.ConfigFile, send func(destination input.RemoteTarget) error) job.RemoteResult {
+	startTime := time.Now()
+	result := job.RemoteResult{
+		Name:     destination.Name,
+		Host:     destination.Host,
+		User:     destination.User,
+		Required: destination.Required,
+	}
+
+	fail := func(err error) job.RemoteResult {
+		result.Error = err.Error()
+		result.Duration = time.Since(startTime)
+		return result
+	}
+
+	// probe tcp/ssh reachability prior to attempting rsync
+	probeReport := util.ProbeRemote(destination.Host, configFile.ProbeOptions(destination.User, destination.Port))
+	util.LogProbeReport(probeReport, logger.MergeFields(remoteLogDebugFields(jobctx), map[string]interface{}{
+		"remote_name": destination.Name,
+	}))
+	if err := probeReport.Err(); err != nil {
+		return fail(fmt.Errorf("remote host is not reachable: %v", err))
+	}
+
+	// proceed with remote transfer, retrying with exponential backoff
+	// rsync keeps partial uploads between attempts, so each retry resumes rather than restarts
+	maxAttempts := configFile.TransferRetries + 1
+	backoff := time.Duration(configFile.TransferRetryBackoff) * time.Second
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		result.Attempts = attempt
+		attemptFields := logger.MergeFields(remoteLogDebugFields(jobctx), map[string]interface{}{
+			"remote_name":  destination.Name,
+			"remote_host":  destination.Host,
+			"attempt":      attempt,
+			"max_attempts": maxAttempts,
+		})
+
+		err = send(destination)
+		if err == nil {
+			break
+		}
+
+		if attempt < maxAttempts {
+			logger.LogxWithFields("warn", fmt.Sprintf("Transfer attempt %d/%d to remote '%s' failed, retrying in %s: %v", attempt, maxAttempts, destination.Name, backoff, err), attemptFields)
+			time.Sleep(backoff)
+			backoff *= 2
+		} else {
+			logger.LogxWithFields("warn", fmt.Sprintf("Transfer attempt %d/%d to remote '%s' failed: %v", attempt, maxAttempts, destination.Name, err), attemptFields)
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("error performing remote transfer: %v", err)
+		return fail(fmt.Errorf("error performing remote transfer after %d attempt(s): %v", result.Attempts, err))
 	}
 
-	// clean up local tempfile after transfer if skipLocal is enabled
-	if jobctx.SkipLocal {
-		util.RemoveTempFile(jobctx, filePath)
+	// embedded images are sent beside the archive
+	if err := sendImagesToRemote(jobctx, destination, cargoportKey); err != nil {
+		return fail(err)
+	}
+
+	result.Success = true
+	result.Duration = time.Since(startTime)
+	result.SHA256 = jobctx.ArchiveSHA256
+	result.SizeBytes = jobctx.CompressedSizeBytesInt
+	return result
+}
+
+// names of required destinations which failed
+func failedRequiredDestinations(results []job.RemoteResult) []string {
+	var failedRequired []string
+	for _, result := range results {
+		if !result.Success && result.Required {
+			failedRequired = append(failedRequired, result.Name)
+		}
+	}
+	return failedRequired
+}
+
+// determines whether set of destination results satisfies remote success policy
+func evaluateRemotePolicy(results []job.RemoteResult, policy string) error {
+	var failed []string
+	failedRequired := failedRequiredDestinations(results)
+	succeeded := 0
+
+	for _, result := range results {
+		if result.Success {
+			succeeded++
+			continue
+		}
+		failed = append(failed, result.Name)
+	}
+
+	switch policy {
+	case input.RemotePolicyAny:
+		if succeeded == 0 {
+			return fmt.Errorf("transfer failed to all remote destinations: %s", strings.Join(failed, ", "))
+		}
+	case input.RemotePolicyRequired:
+		if len(failedRequired) > 0 {
+			return fmt.Errorf("transfer failed to required remote destinations: %s", strings.Join(failedRequired, ", "))
+		}
+		if succeeded == 0 {
+			return fmt.Errorf("transfer failed to all remote destinations: %s", strings.Join(failed, ", "))
+		}
+	default:
+		if len(failed) > 0 {
+			return fmt.Errorf("transfer failed to remote destinations: %s", strings.Join(failed, ", "))
+		}
 	}
 
 	return nil
 }
 
+// constructs remote archive path, falling back to remote user's home dir if no custom path defined
+func RemoteArchivePath(remoteDir, fileName string) string {
+	if remoteDir != "" {
+		return fmt.Sprintf("%s/%s", strings.TrimSuffix(remoteDir, "/"), fileName)
+	}
+	return fmt.Sprintf("~/%s", fileName)
+}
+
+// creates remote dir & any missing parents over ssh
+func makeRemoteDir(remoteUser, remoteHost string, remotePort int, cargoportKey, remoteDir string) error {
+	sshArgs := append(util.SSHBaseOptions(cargoportKey, remotePort), fmt.Sprintf("%s@%s", remoteUser, remoteHost), "mkdir -p "+RemoteShellPath(remoteDir))
+	if output, err := util.RunCommandWithOutput("ssh", sshArgs...); err != nil {
+		return fmt.Errorf("failed to create remote dir %s: %s", remoteDir, strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// quotes remote path for use within a remote shell command, preserving `~/` home dir expansion
+func RemoteShellPath(remotePath string) string {
+	if remotePath == "~" {
+		return `"$HOME"`
+	}
+	if strings.HasPrefix(remotePath, "~/") {
+		return `"$HOME"/` + util.ShellQuote(strings.TrimPrefix(remotePath, "~/"))
+	}
+	return util.ShellQuote(remotePath)
+}
+
 // handle remote rsync transfer to defined node
-func sendToRemote(jobctx *job.JobContext, passedRemotePath, passedRemoteUser, passedRemoteHost, backupFileNameBase, targetFileToTransfer, cargoportKey string, configFile input.ConfigFile) error {
+func sendToRemote(jobctx *job.JobContext, passedRemotePath, passedRemoteUser, passedRemoteHost string, passedRemotePort int, backupFileNameBase, targetFileToTransfer, cargoportKey string, bandwidthLimit int, configFile input.ConfigFile) error {
 
 	// defining logging fields
 	verboseFields := remoteLogDebugFields(jobctx)
@@ -78,23 +267,13 @@ func sendToRemote(jobctx *job.JobContext, passedRemotePath, passedRemoteUser, pa
 		return fmt.Errorf("both remote user and host must be specified for remote transfer")
 	}
 
-	var remoteFilePath string
-
 	// ensure SSH key exists
 	if _, err := os.Stat(cargoportKey); err != nil {
 		return fmt.Errorf("SSH key not found at %s: %v", cargoportKey, err)
 	}
 
 	// construct remote file path
-	// fallback to config if no custom path defined
-	if passedRemotePath != "" {
-		// custom path provided at runtime
-		remoteFilePath = strings.TrimSuffix(passedRemotePath, "/")
-		remoteFilePath = fmt.Sprintf("%s/%s", remoteFilePath, backupFileNameBase)
-	} else {
-		// fallback to configuration-defined path
-		remoteFilePath = fmt.Sprintf("~/%s", backupFileNameBase)
-	}
+	remoteFilePath := RemoteArchivePath(passedRemotePath, backupFileNameBase)
 	logger.LogxWithFields("debug", fmt.Sprintf("Transferring to remote %s@%s:%s", passedRemoteUser, passedRemoteHost, remoteFilePath), logger.MergeFields(verboseFields, map[string]interface{}{
 		"remote_dir": filepath.Dir(remoteFilePath),
 	}))
@@ -102,16 +281,31 @@ func sendToRemote(jobctx *job.JobContext, passedRemotePath, passedRemoteUser, pa
 	rsyncArgs := []string{
 		"-avz",
 		"--checksum",
-		"-e", fmt.Sprintf("ssh -i %s -o ConnectTimeout=10 -o ServerAliveInterval=5 -o ServerAliveCountMax=2", cargoportKey),
+		"--partial-dir=.cargoport-partial", // keep interrupted uploads out of sight & resume from them
+		"-e", util.SSHCommandString(cargoportKey, passedRemotePort),
+	}
+	// restricted remotes never replace existing files & require rsync to skip them
+	if configFile.RestrictRemoteKeys {
+		rsyncArgs = append(rsyncArgs, "--ignore-existing")
+	}
+	if bandwidthLimit > 0 {
+		rsyncArgs = append(rsyncArgs, fmt.Sprintf("--bwlimit=%d", bandwidthLimit))
+	}
+	rsyncArgs = append(rsyncArgs,
 		targetFileToTransfer,
 		fmt.Sprintf("%s@%s:%s", passedRemoteUser, passedRemoteHost, remoteFilePath),
-	}
+	)
 
 	// validate ssh private key integrity
 	if err := util.ValidateSSHPrivateKeyPerms(cargoportKey); err != nil {
 		return fmt.Errorf("private SSH key integrity check failed, key may have been tampered with, please generate a new keypair")
 	}
 
+	// rsync does not create missing parent dirs, such as the default remote dir on first use
+	if err := makeRemoteDir(passedRemoteUser, passedRemoteHost, passedRemotePort, cargoportKey, path.Dir(remoteFilePath)); err != nil {
+		return err
+	}
+
 	// run rsync
 	if err := util.RunCommand("rsync", rsyncArgs...); err != nil {
 		return fmt.Errorf("rsync failed: %v", err)
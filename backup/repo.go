@@ -0,0 +1,187 @@
+package backup
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/logger"
+	"github.com/adrian-griffin/cargoport/meta"
+	"github.com/adrian-griffin/cargoport/repo"
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// opens the repository in repoDir, unlocking it with the password held in passwordFile when one is set
+// create initialises a new repository when none exists, encrypted when a password file is set
+func OpenRepository(repoDir, passwordFile string, create bool) (*repo.Repository, error) {
+	password := ""
+	if passwordFile != "" {
+		passwordData, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read repository password file: %v", err)
+		}
+		password = strings.TrimSpace(string(passwordData))
+		if password == "" {
+			return nil, fmt.Errorf("repository password file %s is empty", passwordFile)
+		}
+	}
+	if create {
+		return repo.OpenOrInit(repoDir, password)
+	}
+	return repo.Open(repoDir, password)
+}
+
+// records the job's target as a snapshot in the configured repository in place of a tarball
+// snapshot paths match tarball member names, & repo_keep_last prunes the target's older snapshots afterwards
+func BackupToRepository(jobctx *job.JobContext, inputctx *input.InputContext) error {
+	verboseFields := backupLogBaseFields(*jobctx)
+	coreFields := logger.CoreLogFields(jobctx, "backup")
+	configFile := inputctx.Config
+
+	if !repo.Exists(configFile.RepoDir) {
+		logger.LogxWithFields("info", fmt.Sprintf("Initialising backup repository at %s", configFile.RepoDir), coreFields)
+	}
+	repository, err := OpenRepository(configFile.RepoDir, configFile.RepoPasswordFile, true)
+	if err != nil {
+		return err
+	}
+
+	// mounts outside the target dir are placed beneath it, as with tarball name transforms
+	baseDir := filepath.Base(jobctx.TargetDir)
+	sources := []repo.Source{{Dir: ArchiveSourceDir(jobctx), Path: baseDir}}
+	for _, mount := range jobctx.ArchiveMounts {
+		sources = append(sources, repo.Source{Dir: mount.Source, Path: path.Join(baseDir, filepath.ToSlash(mount.Path))})
+	}
+	var exclude []string
+	for _, pattern := range jobctx.ArchiveExclude {
+		exclude = append(exclude, path.Join(baseDir, filepath.ToSlash(pattern)))
+	}
+
+	hostName, _ := os.Hostname()
+	snap := &repo.Snapshot{
+		ID:               jobctx.JobID,
+		Time:             jobctx.StartTime,
+		Hostname:         hostName,
+		Target:           jobctx.Target,
+		TargetDir:        jobctx.TargetDir,
+		Tag:              jobctx.Tag,
+		Docker:           jobctx.Docker,
+		CargoportVersion: meta.Version,
+		ServiceStates:    jobctx.ServiceStates,
+		Snapshot:         jobctx.SnapshotProvider,
+	}
+
+	logger.LogxWithFields("debug", fmt.Sprintf("Storing %s in repository %s", jobctx.TargetDir, configFile.RepoDir), verboseFields)
+	skipped, err := repository.Backup(snap, sources, exclude)
+	if err != nil {
+		return fmt.Errorf("failed to store snapshot in repository: %v", err)
+	}
+	if len(skipped) > 0 {
+		logger.LogxWithFields("warn", fmt.Sprintf("Skipped %d socket, device or fifo file(s) not stored in repository", len(skipped)), coreFields)
+	}
+
+	// job size reflects what the snapshot added to the repository, rather than the size of the target
+	jobctx.RepoSnapshotID = snap.ID
+	jobctx.CompressedSizeBytesInt = snap.AddedBytes
+	jobctx.CompressedSizeMBString = fmt.Sprintf("%.2f MB", float64(snap.AddedBytes)/1024.0/1024.0)
+
+	logger.LogxWithFields("info", fmt.Sprintf("Stored snapshot %s in repository, %s added for %.2f MB of data", snap.ID, jobctx.CompressedSizeMBString, float64(snap.Size)/1024.0/1024.0), logger.MergeFields(coreFields, map[string]interface{}{
+		"snapshot_id": snap.ID,
+		"files":       len(snap.Files),
+		"size":        jobctx.CompressedSizeMBString,
+		"encrypted":   repository.Encrypted(),
+	}))
+
+	if configFile.RepoKeepLast > 0 {
+		result, err := repository.Prune(configFile.RepoKeepLast, jobctx.Target, false)
+		if err != nil {
+			logger.LogxWithFields("warn", fmt.Sprintf("Failed to prune repository: %v", err), coreFields)
+		} else if len(result.Removed) > 0 {
+			logger.LogxWithFields("info", fmt.Sprintf("Repository retention removed %d snapshot(s) & %d chunk(s), freeing %.2f MB", len(result.Removed), result.Chunks, float64(result.FreedBytes)/1024.0/1024.0), coreFields)
+		}
+	}
+	return nil
+}
+
+// copies new repository contents to every destination, at <remote output dir>/<repository dir name>-<repository id>
+// remote copies are append-only, as restricted remote keys cannot delete, so are pruned on the remote itself
+func HandleRepoTransfer(jobctx *job.JobContext, inputctx *input.InputContext) error {
+	cargoportKey := filepath.Join(inputctx.Config.SSHKeyDir, inputctx.Config.SSHKeyName)
+	repoDir := inputctx.Config.RepoDir
+
+	remoteRepoName, err := remoteRepoDirName(repoDir)
+	if err != nil {
+		return err
+	}
+	return transferToDestinations(jobctx, inputctx, func(destination input.RemoteTarget) error {
+		return syncRepoToRemote(jobctx, destination, repoDir, remoteRepoName, cargoportKey)
+	})
+}
+
+// returns dir name of the repository's remote copies, namespaced by repository id
+// so hosts whose repositories share a dir name never sync into one another's copy
+func remoteRepoDirName(repoDir string) (string, error) {
+	config, err := repo.ReadConfig(repoDir)
+	if err != nil {
+		return "", err
+	}
+	if _, err := hex.DecodeString(config.ID); err != nil || config.ID == "" {
+		return "", fmt.Errorf("repository at %s has an invalid id '%s'", repoDir, config.ID)
+	}
+	return filepath.Base(repoDir) + "-" + config.ID, nil
+}
+
+// rsyncs repository to destination, sending chunks before snapshot indexes
+// so an interrupted sync never leaves the remote with a snapshot whose chunks are missing
+func syncRepoToRemote(jobctx *job.JobContext, destination input.RemoteTarget, repoDir, remoteRepoName, cargoportKey string) error {
+	if err := util.ValidateSSHPrivateKeyPerms(cargoportKey); err != nil {
+		return fmt.Errorf("private SSH key integrity check failed, key may have been tampered with, please generate a new keypair")
+	}
+
+	remoteRepoPath := RemoteArchivePath(destination.OutputDir, remoteRepoName)
+	logger.LogxWithFields("debug", fmt.Sprintf("Syncing repository to remote %s@%s:%s", destination.User, destination.Host, remoteRepoPath), remoteLogDebugFields(jobctx))
+
+	// stored objects never change once written, so existing remote files are skipped without comparison
+	rsyncArgs := []string{
+		"-a",
+		"--ignore-existing",
+		"--partial-dir=.cargoport-partial",
+		"--exclude=/lock",
+		"-e", util.SSHCommandString(cargoportKey, destination.Port),
+	}
+	if destination.BandwidthLimit > 0 {
+		rsyncArgs = append(rsyncArgs, fmt.Sprintf("--bwlimit=%d", destination.BandwidthLimit))
+	}
+	remote := fmt.Sprintf("%s@%s:%s/", destination.User, destination.Host, remoteRepoPath)
+
+	if err := makeRemoteDir(destination.User, destination.Host, destination.Port, cargoportKey, remoteRepoPath); err != nil {
+		return err
+	}
+
+	passes := [][]string{
+		{"--exclude=/snapshots"},
+		nil,
+	}
+	for _, passArgs := range passes {
+		args := append(append(append([]string{}, rsyncArgs...), passArgs...), strings.TrimSuffix(repoDir, "/")+"/", remote)
+		if err := util.RunCommand("rsync", args...); err != nil {
+			return fmt.Errorf("rsync failed: %v", err)
+		}
+	}
+
+	logger.LogxWithFields("info", "Repository successfully synced to remote", map[string]interface{}{
+		"package":     "remote",
+		"remote":      true,
+		"remote_host": destination.Host,
+		"remote_user": destination.User,
+		"success":     true,
+		"target":      jobctx.Target,
+		"job_id":      jobctx.JobID,
+	})
+	return nil
+}
@@ -0,0 +1,49 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adrian-griffin/cargoport/repo"
+)
+
+func TestRemoteRepoDirNameIsUniquePerRepository(t *testing.T) {
+	// two hosts with the default repo_directory
+	firstDir := filepath.Join(t.TempDir(), "repo")
+	secondDir := filepath.Join(t.TempDir(), "repo")
+	for _, dir := range []string{firstDir, secondDir} {
+		if _, err := repo.Init(dir, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	firstName, err := remoteRepoDirName(firstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondName, err := remoteRepoDirName(secondDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstName == secondName {
+		t.Errorf("repositories share remote dir name %s", firstName)
+	}
+	if !strings.HasPrefix(firstName, "repo-") || strings.ContainsAny(firstName, "/.") {
+		t.Errorf("remote dir name = %s, want repo-<repository id>", firstName)
+	}
+}
+
+func TestRemoteRepoDirNameRejectsInvalidID(t *testing.T) {
+	repoDir := t.TempDir()
+	if _, err := remoteRepoDirName(repoDir); err == nil {
+		t.Error("expected missing repository to be an error")
+	}
+	if err := os.WriteFile(filepath.Join(repoDir, "config.json"), []byte(`{"version": 1, "id": "../other"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remoteRepoDirName(repoDir); err == nil {
+		t.Error("expected non-hex repository id to be rejected")
+	}
+}
@@ -1,6 +1,7 @@
 package backup
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -29,6 +30,16 @@ func ResolveTarget(inputctx *input.InputContext, jobctx *job.JobContext) (string
 	jobctx.Target = filepath.Base(targetPath)
 	jobctx.TargetDir = targetPath
 
+	// repository backups have no archive file, the repository itself is recorded as the output
+	if inputctx.Format == input.BackupFormatRepo {
+		return composeFilePath, inputctx.Config.RepoDir, nil
+	}
+
+	// determine backup level for incremental & differential modes, which also names the archive
+	if err := prepareChain(jobctx, inputctx); err != nil {
+		return "", "", err
+	}
+
 	// prepare local backupfile & compose
 	outputFilePath, err := PrepareBackupFilePath(jobctx, inputctx)
 	if err != nil {
@@ -52,6 +63,15 @@ func DetermineBackupTarget(jobctx *job.JobContext, inputcxt *input.InputContext)
 	if inputcxt.DockerName != "" {
 		var err error
 		composeFilePath, err = FindComposeFile(inputcxt.DockerName, filepath.Base(inputcxt.TargetDir))
+		if errors.Is(err, errNotComposeManaged) {
+			// plain `docker run` containers are backed up as a generated compose stack
+			logger.LogxWithFields("debug", fmt.Sprintf("Container '%s' is not managed by compose, treating as standalone container", inputcxt.DockerName), map[string]interface{}{
+				"package": "backup",
+				"target":  inputcxt.DockerName,
+				"job_id":  jobctx.JobID,
+			})
+			composeFilePath, err = PrepareStandaloneTarget(jobctx, inputcxt)
+		}
 		if err != nil {
 			logger.LogxWithFields("error", fmt.Sprintf("Compose file validation failure at %s", inputcxt.TargetDir), map[string]interface{}{
 				"package": "backup",
@@ -76,10 +96,9 @@ func DetermineBackupTarget(jobctx *job.JobContext, inputcxt *input.InputContext)
 		}
 
 		// tries to determine composefile
-		possibleComposeFile := filepath.Join(targetDirectory, "docker-compose.yml")
-		_, err := os.Stat(possibleComposeFile)
-		if err == nil {
-			logger.LogxWithFields("debug", fmt.Sprintf("Compose file found in target dir at %s", filepath.Join(targetDirectory, "docker-compose.yml")), map[string]interface{}{
+		possibleComposeFile := FindComposeFileInDir(targetDirectory)
+		if possibleComposeFile != "" {
+			logger.LogxWithFields("debug", fmt.Sprintf("Compose file found in target dir at %s", possibleComposeFile), map[string]interface{}{
 				"package": "backup",
 				"target":  filepath.Base(targetDirectory),
 				"job_id":  jobctx.JobID,
@@ -87,7 +106,7 @@ func DetermineBackupTarget(jobctx *job.JobContext, inputcxt *input.InputContext)
 			return targetDirectory, possibleComposeFile, true, nil
 		}
 
-		logger.LogxWithFields("debug", fmt.Sprintf("Compose file not found in target dir at %s", filepath.Join(targetDirectory, "docker-compose.yml")), map[string]interface{}{
+		logger.LogxWithFields("debug", fmt.Sprintf("Compose file not found in target dir %s", targetDirectory), map[string]interface{}{
 			"package": "backup",
 			"target":  filepath.Base(targetDirectory),
 			"job_id":  jobctx.JobID,
@@ -115,8 +134,8 @@ func PrepareBackupFilePath(jobctx *job.JobContext, inputctx *input.InputContext)
 	verboseFields := backupLogBaseFields(*jobctx)
 	// coreFields := logger.CoreLogFields(context, "backup")
 
-	// sanitize target directory suffix
-	targetDir := strings.TrimSuffix(inputctx.TargetDir, "/")
+	// sanitize target directory suffix, resolved from -docker-name when no -target-dir was passed
+	targetDir := strings.TrimSuffix(jobctx.TargetDir, "/")
 	baseName := filepath.Base(targetDir)
 
 	var tagOutputString = ""
@@ -139,6 +158,11 @@ func PrepareBackupFilePath(jobctx *job.JobContext, inputctx *input.InputContext)
 
 	backupFileName := baseName + tagOutputString + ".bak.tar.gz"
 
+	// chained archives are kept side by side, so are named by timestamp & backup level
+	if jobctx.BackupLevel != "" {
+		backupFileName = ChainArchiveName(baseName, inputctx.Tag, jobctx.BackupLevel, jobctx.StartTime)
+	}
+
 	// form output filepath using input's defined outputdir & filename
 	filePathString := filepath.Join(inputctx.OutputDir, backupFileName)
 
@@ -0,0 +1,151 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/logger"
+)
+
+// timestamp format used for timestamped archive names (e.g: service1-nightly-20250621-010000.bak.tar.gz)
+const ArchiveTimestampFormat = "20060102-150405"
+
+// archive file suffix
+const ArchiveSuffix = ".bak.tar.gz"
+
+// builds timestamped archive name for target & tag
+func TimestampedArchiveName(baseName, tag string, timestamp time.Time) string {
+	tagOutputString := ""
+	if tag != "" {
+		tagOutputString = "-" + tag
+	}
+	return fmt.Sprintf("%s%s-%s%s", baseName, tagOutputString, timestamp.Format(ArchiveTimestampFormat), ArchiveSuffix)
+}
+
+// archive name split back into the parts it was built from
+type ArchiveName struct {
+	Stem      string    // <target>[-tag], the target & tag cannot be told apart without the manifest
+	Timestamp time.Time // zero for untimestamped archives, replaced by each full backup
+	Level     string    // backup mode of chained archives
+}
+
+// parses cargoport archive name, reporting false for names without the archive suffix
+func ParseArchiveName(name string) (ArchiveName, bool) {
+	if !strings.HasSuffix(name, ArchiveSuffix) {
+		return ArchiveName{}, false
+	}
+	stem := strings.TrimSuffix(name, ArchiveSuffix)
+
+	// chained archives end in -<timestamp>-<level>, timestamped archives in -<timestamp>
+	level := ""
+	for mode, levelName := range levelNames {
+		if strings.HasSuffix(stem, "-"+levelName) {
+			level = mode
+			stem = strings.TrimSuffix(stem, "-"+levelName)
+			break
+		}
+	}
+	timestampLength := len(ArchiveTimestampFormat)
+	if len(stem) > timestampLength+1 && stem[len(stem)-timestampLength-1] == '-' {
+		if timestamp, err := time.ParseInLocation(ArchiveTimestampFormat, stem[len(stem)-timestampLength:], time.Local); err == nil {
+			return ArchiveName{Stem: stem[:len(stem)-timestampLength-1], Timestamp: timestamp, Level: level}, true
+		}
+	}
+	if level != "" {
+		// level suffix without a timestamp is part of the target or tag
+		stem = strings.TrimSuffix(name, ArchiveSuffix)
+	}
+	return ArchiveName{Stem: stem}, true
+}
+
+// removes all but the newest `keepLast` timestamped archives for target & tag in directory
+// archives that kept incremental or differential archives depend on are never removed
+func ApplyRetention(archiveDir, baseName, tag string, keepLast int) ([]string, error) {
+	if keepLast <= 0 {
+		return nil, nil
+	}
+
+	prefix := baseName
+	if tag != "" {
+		prefix += "-" + tag
+	}
+	prefix += "-"
+
+	dirEntries, err := os.ReadDir(archiveDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive directory %s: %v", archiveDir, err)
+	}
+
+	// gather archives matching <prefix><timestamp>.bak.tar.gz
+	type timestampedArchive struct {
+		name      string
+		timestamp time.Time
+	}
+	var archives []timestampedArchive
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ArchiveSuffix) {
+			continue
+		}
+		timestampString := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ArchiveSuffix)
+		timestamp, err := time.Parse(ArchiveTimestampFormat, timestampString)
+		if err != nil {
+			continue // not one of ours, or belongs to a longer tag sharing this prefix
+		}
+		archives = append(archives, timestampedArchive{name: name, timestamp: timestamp})
+	}
+
+	if len(archives) <= keepLast {
+		return nil, nil
+	}
+
+	// newest first, remove everything past keepLast
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].timestamp.After(archives[j].timestamp)
+	})
+
+	// protect every parent of kept archives, back to their full backup
+	protected := map[string]bool{}
+	if manifests, err := readDirManifests(archiveDir); err == nil {
+		byJobID := map[string]*Manifest{}
+		byArchive := map[string]*Manifest{}
+		for _, manifest := range manifests {
+			byJobID[manifest.JobID] = manifest
+			byArchive[manifest.Archive] = manifest
+		}
+		for _, archive := range archives[:keepLast] {
+			for manifest := byArchive[archive.name]; manifest != nil && manifest.ParentJobID != ""; {
+				parent := byJobID[manifest.ParentJobID]
+				if parent == nil || protected[parent.Archive] {
+					break
+				}
+				protected[parent.Archive] = true
+				manifest = parent
+			}
+		}
+	}
+
+	var removed []string
+	for _, archive := range archives[keepLast:] {
+		if protected[archive.name] {
+			continue
+		}
+		archivePath := filepath.Join(archiveDir, archive.name)
+		if err := os.Remove(archivePath); err != nil {
+			return removed, fmt.Errorf("failed to remove expired archive %s: %v", archivePath, err)
+		}
+		os.Remove(ManifestPath(archivePath))
+		removed = append(removed, archivePath)
+
+		logger.LogxWithFields("debug", fmt.Sprintf("Retention removed expired archive %s", archivePath), map[string]interface{}{
+			"package": "retention",
+			"target":  baseName,
+		})
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,57 @@
+package backup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/input"
+)
+
+func TestParseArchiveName(t *testing.T) {
+	timestamp := time.Date(2025, 6, 21, 1, 0, 0, 0, time.Local)
+	tests := []struct {
+		name string
+		want ArchiveName
+	}{
+		{"service1.bak.tar.gz", ArchiveName{Stem: "service1"}},
+		{"service1-nightly.bak.tar.gz", ArchiveName{Stem: "service1-nightly"}},
+		{TimestampedArchiveName("service1", "", timestamp), ArchiveName{Stem: "service1", Timestamp: timestamp}},
+		{TimestampedArchiveName("service1", "nightly", timestamp), ArchiveName{Stem: "service1-nightly", Timestamp: timestamp}},
+		{ChainArchiveName("service1", "nightly", input.BackupModeFull, timestamp), ArchiveName{Stem: "service1-nightly", Timestamp: timestamp, Level: input.BackupModeFull}},
+		{ChainArchiveName("service1", "", input.BackupModeIncremental, timestamp), ArchiveName{Stem: "service1", Timestamp: timestamp, Level: input.BackupModeIncremental}},
+		{ChainArchiveName("service1", "", input.BackupModeDifferential, timestamp), ArchiveName{Stem: "service1", Timestamp: timestamp, Level: input.BackupModeDifferential}},
+		// level names without a timestamp belong to the target or tag
+		{"service1-full.bak.tar.gz", ArchiveName{Stem: "service1-full"}},
+		// timestamp-like tags that do not parse are part of the stem
+		{"service1-20251399-999999.bak.tar.gz", ArchiveName{Stem: "service1-20251399-999999"}},
+	}
+	for _, test := range tests {
+		got, ok := ParseArchiveName(test.name)
+		if !ok {
+			t.Errorf("ParseArchiveName(%q) reported not an archive", test.name)
+			continue
+		}
+		if got.Stem != test.want.Stem || !got.Timestamp.Equal(test.want.Timestamp) || got.Level != test.want.Level {
+			t.Errorf("ParseArchiveName(%q) = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	for _, name := range []string{"service1.tar.gz", "service1.bak.tar.gz.manifest.json", ""} {
+		if _, ok := ParseArchiveName(name); ok {
+			t.Errorf("ParseArchiveName(%q) reported an archive", name)
+		}
+	}
+}
+
+func TestArchiveNames(t *testing.T) {
+	timestamp := time.Date(2025, 6, 21, 1, 0, 0, 0, time.Local)
+	if got, want := TimestampedArchiveName("service1", "nightly", timestamp), "service1-nightly-20250621-010000.bak.tar.gz"; got != want {
+		t.Errorf("TimestampedArchiveName = %q, want %q", got, want)
+	}
+	if got, want := TimestampedArchiveName("service1", "", timestamp), "service1-20250621-010000.bak.tar.gz"; got != want {
+		t.Errorf("TimestampedArchiveName = %q, want %q", got, want)
+	}
+	if got, want := ChainArchiveName("service1", "nightly", input.BackupModeIncremental, timestamp), "service1-nightly-20250621-010000-incr.bak.tar.gz"; got != want {
+		t.Errorf("ChainArchiveName = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,116 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/adrian-griffin/cargoport/dockerapi"
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// pre-backup states of compose services, recorded in the manifest & restored once the backup completes
+const (
+	ServiceStateRunning = "running"
+	ServiceStatePaused  = "paused"
+	ServiceStateExited  = "exited" // containers exist but are stopped
+	ServiceStateAbsent  = "absent" // no containers exist
+)
+
+// records the state of every service defined in composefile
+// a service with any running container counts as running, then paused, then exited
+func recordServiceStates(client dockerapi.Client, composeFilePath string) (map[string]string, error) {
+	compose, err := parseComposeFile(composeFilePath)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := composeContainers(client, composeFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain Docker container status: %v", err)
+	}
+
+	states := make(map[string]string, len(compose.Services))
+	for service := range compose.Services {
+		states[service] = ServiceStateAbsent
+	}
+	rank := map[string]int{ServiceStateAbsent: 0, ServiceStateExited: 1, ServiceStatePaused: 2, ServiceStateRunning: 3}
+	for _, container := range containers {
+		service := container.Service()
+		if _, defined := states[service]; !defined {
+			continue
+		}
+		state := ServiceStateExited
+		switch container.State {
+		case "running", "restarting":
+			state = ServiceStateRunning
+		case "paused":
+			state = ServiceStatePaused
+		}
+		if rank[state] > rank[states[service]] {
+			states[service] = state
+		}
+	}
+	return states, nil
+}
+
+// returns sorted services recorded in any of the given states
+func servicesInState(states map[string]string, wanted ...string) []string {
+	var services []string
+	for service, state := range states {
+		for _, match := range wanted {
+			if state == match {
+				services = append(services, service)
+				break
+			}
+		}
+	}
+	sort.Strings(services)
+	return services
+}
+
+// builds `docker compose` args for compose files
+func composeFileArgs(composeFiles []string) []string {
+	args := []string{"compose"}
+	for _, composeFile := range composeFiles {
+		args = append(args, "-f", composeFile)
+	}
+	return args
+}
+
+// brings compose services up to their recorded states, paused services are started & must be paused afterwards
+// exited services are recreated without being started, absent services are left absent
+func StartRecordedServices(composeFiles []string, states map[string]string) error {
+	if active := servicesInState(states, ServiceStateRunning, ServiceStatePaused); len(active) > 0 {
+		args := append(composeFileArgs(composeFiles), "up", "-d", "--no-deps")
+		if err := util.RunCommand("docker", append(args, active...)...); err != nil {
+			return fmt.Errorf("failed to start services %v: %v", active, err)
+		}
+	}
+	if exited := servicesInState(states, ServiceStateExited); len(exited) > 0 {
+		args := append(composeFileArgs(composeFiles), "up", "--no-start", "--no-deps")
+		if err := util.RunCommand("docker", append(args, exited...)...); err != nil {
+			return fmt.Errorf("failed to recreate stopped services %v: %v", exited, err)
+		}
+	}
+	return nil
+}
+
+// pauses containers of services recorded as paused
+func PauseRecordedServices(client dockerapi.Client, composeFilePath string, states map[string]string) error {
+	paused := servicesInState(states, ServiceStatePaused)
+	if len(paused) == 0 {
+		return nil
+	}
+	containers, err := composeContainers(client, composeFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to list Docker containers: %v", err)
+	}
+	for _, container := range containers {
+		if states[container.Service()] != ServiceStatePaused || container.State != "running" {
+			continue
+		}
+		if err := client.PauseContainer(container.ID); err != nil {
+			return fmt.Errorf("failed to pause service %s: %v", container.Service(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/logger"
+	"github.com/adrian-griffin/cargoport/snapshot"
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// directory within the cargoport root holding mountpoints of active snapshots
+const SnapshotMountDirName = "snapshots"
+
+// snapshots the target dir via providerName, so services can come back online before it is archived
+// returns nil when the live target dir should be archived instead, an auto detected provider failing falls back to it
+func CreateSnapshot(jobctx *job.JobContext, providerName, cargoportDir string) (*snapshot.Snapshot, error) {
+	verboseFields := backupLogBaseFields(*jobctx)
+	coreFields := logger.CoreLogFields(jobctx, "backup")
+
+	if providerName == snapshot.ProviderNone {
+		return nil, nil
+	}
+	// mounts outside the target dir are not covered by its snapshot, so must be archived while still offline
+	if len(jobctx.ArchiveMounts) > 0 {
+		logger.LogxWithFields("debug", "Skipping snapshot, container mounts outside the target dir are archived live", verboseFields)
+		return nil, nil
+	}
+
+	// snapshots need root, auto detection quietly archives the live dir for unprivileged users
+	if providerName == snapshot.ProviderAuto && !util.IsRoot() && !util.HasCapability(util.CapSysAdmin) {
+		logger.LogxWithFields("debug", "Skipping snapshot detection, creating snapshots requires root", verboseFields)
+		return nil, nil
+	}
+
+	provider, err := snapshot.ForDir(providerName, jobctx.TargetDir, filepath.Join(cargoportDir, SnapshotMountDirName))
+	if err != nil {
+		if providerName != snapshot.ProviderAuto {
+			return nil, fmt.Errorf("failed to select snapshot provider: %v", err)
+		}
+		logger.LogxWithFields("warn", fmt.Sprintf("Failed to detect snapshot provider, archiving live target dir: %v", err), coreFields)
+		return nil, nil
+	}
+	if provider.Name() == snapshot.ProviderNone {
+		logger.LogxWithFields("debug", fmt.Sprintf("No snapshot support detected for %s, archiving live target dir", jobctx.TargetDir), verboseFields)
+		return nil, nil
+	}
+
+	snap, err := provider.Create(jobctx.TargetDir, "cargoport-"+jobctx.JobID)
+	if err != nil {
+		if providerName != snapshot.ProviderAuto {
+			return nil, fmt.Errorf("failed to create %s snapshot: %v", provider.Name(), err)
+		}
+		logger.LogxWithFields("warn", fmt.Sprintf("Failed to create %s snapshot, archiving live target dir: %v", provider.Name(), err), coreFields)
+		return nil, nil
+	}
+
+	jobctx.SnapshotProvider = snap.Provider
+	jobctx.SnapshotDir = snap.Dir
+	jobctx.ArchiveExclude = append(jobctx.ArchiveExclude, snap.Exclude...)
+	logger.LogxWithFields("info", fmt.Sprintf("Created %s snapshot of %s", snap.Provider, jobctx.TargetDir), logger.MergeFields(coreFields, map[string]interface{}{
+		"snapshot":     snap.Provider,
+		"snapshot_dir": snap.Dir,
+	}))
+	return snap, nil
+}
+
+// removes snapshot once archived, a failure leaves the snapshot in place & is only logged
+func RemoveSnapshot(jobctx *job.JobContext, snap *snapshot.Snapshot) {
+	if err := snap.Remove(); err != nil {
+		logger.LogxWithFields("warn", fmt.Sprintf("Failed to remove snapshot, remove it manually: %v", err), logger.CoreLogFields(jobctx, "backup"))
+		return
+	}
+	jobctx.SnapshotDir = ""
+	logger.LogxWithFields("debug", fmt.Sprintf("Removed %s snapshot of %s", snap.Provider, jobctx.TargetDir), backupLogBaseFields(*jobctx))
+}
+
+// returns directory archived for the job, the target dir within its snapshot when one was taken
+func ArchiveSourceDir(jobctx *job.JobContext) string {
+	if jobctx.SnapshotDir != "" {
+		return jobctx.SnapshotDir
+	}
+	return jobctx.TargetDir
+}
@@ -0,0 +1,363 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/adrian-griffin/cargoport/dockerapi"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/logger"
+)
+
+// directory under the cargoport root holding generated compose stacks for standalone containers
+const StandaloneDirName = "standalone"
+
+// full inspect configuration of a standalone container, stored beside its generated compose file
+const StandaloneInspectName = "cargoport-container.json"
+
+// returned when a container carries no compose labels
+var errNotComposeManaged = errors.New("container is not managed by docker compose")
+
+// compose service generated from a standalone container
+type standaloneService struct {
+	Image         string            `yaml:"image"`
+	ContainerName string            `yaml:"container_name"`
+	Hostname      string            `yaml:"hostname,omitempty"`
+	Entrypoint    []string          `yaml:"entrypoint,omitempty"`
+	Command       []string          `yaml:"command,omitempty"`
+	User          string            `yaml:"user,omitempty"`
+	WorkingDir    string            `yaml:"working_dir,omitempty"`
+	Environment   []string          `yaml:"environment,omitempty"`
+	Ports         []string          `yaml:"ports,omitempty"`
+	Volumes       []string          `yaml:"volumes,omitempty"`
+	NetworkMode   string            `yaml:"network_mode,omitempty"`
+	Networks      []string          `yaml:"networks,omitempty"`
+	Restart       string            `yaml:"restart,omitempty"`
+	Privileged    bool              `yaml:"privileged,omitempty"`
+	CapAdd        []string          `yaml:"cap_add,omitempty"`
+	CapDrop       []string          `yaml:"cap_drop,omitempty"`
+	ExtraHosts    []string          `yaml:"extra_hosts,omitempty"`
+	Labels        map[string]string `yaml:"labels,omitempty"`
+	Tty           bool              `yaml:"tty,omitempty"`
+	StdinOpen     bool              `yaml:"stdin_open,omitempty"`
+}
+
+// top-level network of a generated compose file
+type standaloneNetworkConfig struct {
+	External bool `yaml:"external,omitempty"`
+}
+
+// generated compose file for a standalone container
+type standaloneCompose struct {
+	Services map[string]*standaloneService       `yaml:"services"`
+	Networks map[string]*standaloneNetworkConfig `yaml:"networks,omitempty"`
+}
+
+// inspects standalone container & writes its generated compose stack under the cargoport root, returning the compose file path
+func PrepareStandaloneTarget(jobctx *job.JobContext, inputctx *input.InputContext) (string, error) {
+	client, err := newDockerClient()
+	if err != nil {
+		return "", err
+	}
+	details, err := client.InspectContainer(inputctx.DockerName)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect container '%s': %v", inputctx.DockerName, err)
+	}
+	name := strings.TrimPrefix(details.Name, "/")
+
+	// auto-removed containers are deleted by the engine as soon as they stop
+	if details.HostConfig.AutoRemove && jobctx.StopStrategy != input.StopStrategyPause {
+		return "", fmt.Errorf("container '%s' was started with --rm & would be removed when stopped, use -stop-strategy=pause", name)
+	}
+
+	var image *dockerapi.Image
+	if image, err = client.InspectImage(details.Image); err != nil {
+		return "", fmt.Errorf("failed to inspect image for container '%s': %v", name, err)
+	}
+
+	// the generated stack holds the container's environment, secrets included, so is private to the cargoport user
+	// modes are also applied to files & dirs left by earlier runs, which were created world readable
+	stackDir := filepath.Join(inputctx.Config.DefaultCargoportDir, StandaloneDirName, name)
+	if err := os.MkdirAll(stackDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create standalone stack dir %s: %v", stackDir, err)
+	}
+	if err := os.Chmod(stackDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to restrict standalone stack dir %s: %v", stackDir, err)
+	}
+
+	compose, mounts := generateStandaloneCompose(name, details, image)
+	composeData, err := yaml.Marshal(compose)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode generated compose file: %v", err)
+	}
+	header := fmt.Sprintf("# generated by cargoport from standalone container '%s', see %s for its full configuration\n", name, StandaloneInspectName)
+	composeFilePath := filepath.Join(stackDir, "docker-compose.yml")
+	if err := writePrivateFile(composeFilePath, append([]byte(header), composeData...)); err != nil {
+		return "", fmt.Errorf("failed to write generated compose file %s: %v", composeFilePath, err)
+	}
+
+	// keeps the full inspect output, also marks the stack dir as belonging to the container
+	var inspectData json.RawMessage = details.Raw
+	if indented, err := json.MarshalIndent(details.Raw, "", "  "); err == nil {
+		inspectData = indented
+	}
+	if err := writePrivateFile(filepath.Join(stackDir, StandaloneInspectName), append(inspectData, '\n')); err != nil {
+		return "", fmt.Errorf("failed to write container configuration: %v", err)
+	}
+
+	jobctx.Standalone = true
+	jobctx.ArchiveMounts = mounts
+
+	logger.LogxWithFields("info", fmt.Sprintf("Generated compose stack for standalone container '%s' at %s with %d archived mount(s)", name, stackDir, len(mounts)), map[string]interface{}{
+		"package": "docker",
+		"target":  name,
+		"job_id":  jobctx.JobID,
+	})
+	return composeFilePath, nil
+}
+
+// writes file readable by its owner only, including when it already exists with a wider mode
+func writePrivateFile(filePath string, data []byte) error {
+	if err := os.Chmod(filePath, 0600); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.WriteFile(filePath, data, 0600)
+}
+
+// builds an equivalent compose file for container, returning it with the host paths to archive beside it
+// settings inherited from the image are omitted so image updates still apply after a restore
+func generateStandaloneCompose(name string, details *dockerapi.ContainerDetails, image *dockerapi.Image) (*standaloneCompose, []job.ArchiveMount) {
+	service := &standaloneService{
+		Image:         details.Config.Image,
+		ContainerName: name,
+		Tty:           details.Config.Tty,
+		StdinOpen:     details.Config.OpenStdin,
+		Privileged:    details.HostConfig.Privileged,
+		CapAdd:        details.HostConfig.CapAdd,
+		CapDrop:       details.HostConfig.CapDrop,
+		ExtraHosts:    details.HostConfig.ExtraHosts,
+	}
+	imageDefaults := image.Config
+	if imageDefaults == nil {
+		imageDefaults = &dockerapi.ImageConfig{}
+	}
+
+	// docker defaults the hostname to the short container id
+	if details.Config.Hostname != "" && !strings.HasPrefix(details.ID, details.Config.Hostname) {
+		service.Hostname = details.Config.Hostname
+	}
+	if !equalStrings(details.Config.Entrypoint, imageDefaults.Entrypoint) {
+		service.Entrypoint = escapeComposeValues(details.Config.Entrypoint)
+	}
+	if !equalStrings(details.Config.Cmd, imageDefaults.Cmd) {
+		service.Command = escapeComposeValues(details.Config.Cmd)
+	}
+	if details.Config.User != imageDefaults.User {
+		service.User = details.Config.User
+	}
+	if details.Config.WorkingDir != imageDefaults.WorkingDir {
+		service.WorkingDir = details.Config.WorkingDir
+	}
+
+	imageEnv := make(map[string]bool, len(imageDefaults.Env))
+	for _, variable := range imageDefaults.Env {
+		imageEnv[variable] = true
+	}
+	for _, variable := range details.Config.Env {
+		if !imageEnv[variable] {
+			service.Environment = append(service.Environment, escapeComposeValue(variable))
+		}
+	}
+
+	for label, value := range details.Config.Labels {
+		if imageValue, inherited := imageDefaults.Labels[label]; inherited && imageValue == value {
+			continue
+		}
+		if service.Labels == nil {
+			service.Labels = make(map[string]string)
+		}
+		service.Labels[label] = escapeComposeValue(value)
+	}
+
+	service.Ports = composePorts(details.HostConfig.PortBindings)
+
+	restartPolicy := details.HostConfig.RestartPolicy
+	switch {
+	case restartPolicy.Name == "on-failure" && restartPolicy.MaximumRetryCount > 0:
+		service.Restart = fmt.Sprintf("on-failure:%d", restartPolicy.MaximumRetryCount)
+	case restartPolicy.Name != "" && restartPolicy.Name != "no":
+		service.Restart = restartPolicy.Name
+	}
+
+	// bridge containers join the project's default network, user-defined networks are expected to exist on restore
+	compose := &standaloneCompose{Services: map[string]*standaloneService{name: service}}
+	networkMode := details.HostConfig.NetworkMode
+	switch {
+	case networkMode == "host" || networkMode == "none":
+		service.NetworkMode = networkMode
+	case strings.HasPrefix(networkMode, "container:"):
+		logger.LogxWithFields("warn", fmt.Sprintf("Container '%s' shares the network of another container, network settings are not reproduced", name), map[string]interface{}{
+			"package": "docker",
+			"target":  name,
+		})
+	default:
+		for network := range details.NetworkSettings.Networks {
+			if network == "bridge" {
+				continue
+			}
+			if compose.Networks == nil {
+				compose.Networks = make(map[string]*standaloneNetworkConfig)
+			}
+			service.Networks = append(service.Networks, network)
+			compose.Networks[network] = &standaloneNetworkConfig{External: true}
+		}
+		sort.Strings(service.Networks)
+	}
+
+	var mounts []job.ArchiveMount
+	for _, mount := range details.Mounts {
+		var archivePath string
+		switch mount.Type {
+		case "volume":
+			archivePath = filepath.Join("volumes", mount.Name)
+		case "bind":
+			archivePath = filepath.Join("binds", strings.ReplaceAll(strings.Trim(mount.Source, "/"), "/", "_"))
+		default:
+			continue
+		}
+
+		volume := ""
+		if info, err := os.Stat(mount.Source); err == nil && (info.IsDir() || info.Mode().IsRegular()) {
+			mounts = append(mounts, job.ArchiveMount{Source: mount.Source, Path: archivePath})
+			volume = "./" + archivePath + ":" + mount.Destination
+		} else {
+			// sockets, devices & missing paths are mounted from the host as-is
+			volume = mount.Source + ":" + mount.Destination
+		}
+		if !mount.RW {
+			volume += ":ro"
+		}
+		service.Volumes = append(service.Volumes, volume)
+	}
+	sort.Strings(service.Volumes)
+	return compose, mounts
+}
+
+// formats published ports as compose port specs, e.g. `127.0.0.1:8080:80` or `53:53/udp`
+func composePorts(bindings map[string][]dockerapi.PortBinding) []string {
+	seen := make(map[string]bool)
+	var ports []string
+	for containerPort, hostBindings := range bindings {
+		containerPort = strings.TrimSuffix(containerPort, "/tcp")
+		for _, binding := range hostBindings {
+			port := containerPort
+			if binding.HostPort != "" {
+				port = binding.HostPort + ":" + containerPort
+			}
+			switch {
+			case binding.HostIP == "" || binding.HostIP == "0.0.0.0" || binding.HostIP == "::":
+			case strings.Contains(binding.HostIP, ":"):
+				port = "[" + binding.HostIP + "]:" + port
+			default:
+				port = binding.HostIP + ":" + port
+			}
+			if !seen[port] {
+				seen[port] = true
+				ports = append(ports, port)
+			}
+		}
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// escapes `$` so compose does not interpolate values taken from the container
+func escapeComposeValue(value string) string {
+	return strings.ReplaceAll(value, "$", "$$")
+}
+
+func escapeComposeValues(values []string) []string {
+	escaped := make([]string, len(values))
+	for i, value := range values {
+		escaped[i] = escapeComposeValue(value)
+	}
+	return escaped
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// returns the standalone container recorded in a generated stack dir, labelled as a compose service
+// ok is false when dir is not a generated stack
+func standaloneContainers(client dockerapi.Client, stackDir string) ([]dockerapi.Container, bool, error) {
+	inspectData, err := os.ReadFile(filepath.Join(stackDir, StandaloneInspectName))
+	if err != nil {
+		return nil, false, nil
+	}
+	var recorded struct {
+		ID string `json:"Id"`
+	}
+	if err := json.Unmarshal(inspectData, &recorded); err != nil || recorded.ID == "" {
+		return nil, false, nil
+	}
+
+	details, err := client.InspectContainer(recorded.ID)
+	if errors.Is(err, dockerapi.ErrNotFound) {
+		return nil, true, nil
+	} else if err != nil {
+		return nil, true, err
+	}
+
+	name := strings.TrimPrefix(details.Name, "/")
+	labels := make(map[string]string, len(details.Config.Labels)+1)
+	for label, value := range details.Config.Labels {
+		labels[label] = value
+	}
+	labels[dockerapi.LabelComposeService] = name
+	return []dockerapi.Container{{
+		ID:      details.ID,
+		Names:   []string{details.Name},
+		Image:   details.Config.Image,
+		ImageID: details.Image,
+		State:   details.State.Status,
+		Labels:  labels,
+		Mounts:  details.Mounts,
+	}}, true, nil
+}
+
+// builds tar source args for target dir, placing archive mounts beneath it via name transforms
+func tarSourceArgs(jobctx *job.JobContext, parentDir, baseDir string) []string {
+	args := append(tarIncrementalArgs(jobctx), tarExcludeArgs(jobctx, baseDir)...)
+	for _, mount := range jobctx.ArchiveMounts {
+		args = append(args, "--transform", tarTransform(mount.Source, filepath.Join(baseDir, mount.Path)))
+	}
+	args = append(args, "-C", parentDir, baseDir)
+	for _, mount := range jobctx.ArchiveMounts {
+		args = append(args, "-C", "/", strings.TrimPrefix(mount.Source, "/"))
+	}
+	return args
+}
+
+// builds a gnu tar transform renaming members under source to archivePath, leaving symlink targets untouched
+func tarTransform(source, archivePath string) string {
+	regexEscaper := strings.NewReplacer(`\`, `\\`, `.`, `\.`, `[`, `\[`, `]`, `\]`, `*`, `\*`, `^`, `\^`, `$`, `\$`, `,`, `\,`)
+	replacementEscaper := strings.NewReplacer(`\`, `\\`, `&`, `\&`, `,`, `\,`)
+	return fmt.Sprintf(`s,^%s\($\|/\),%s\1,S`, regexEscaper.Replace(strings.TrimPrefix(source, "/")), replacementEscaper.Replace(archivePath))
+}
@@ -0,0 +1,55 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adrian-griffin/cargoport/dockerapi"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/job"
+)
+
+func TestPrepareStandaloneTargetIsPrivate(t *testing.T) {
+	details := &dockerapi.ContainerDetails{ID: "abc123", Name: "/redis", Image: "sha256:redis"}
+	details.Config.Image = "redis:7"
+	details.Config.Env = []string{"REDIS_PASSWORD=secret"}
+	details.Raw = []byte(`{"Id": "abc123"}`)
+	client := &fakeDockerClient{
+		details: map[string]*dockerapi.ContainerDetails{"redis": details},
+		images:  map[string]*dockerapi.Image{"sha256:redis": {ID: "sha256:redis"}},
+	}
+	originalClient := newDockerClient
+	newDockerClient = func() (dockerapi.Client, error) { return client, nil }
+	t.Cleanup(func() { newDockerClient = originalClient })
+
+	cargoportDir := t.TempDir()
+	stackDir := filepath.Join(cargoportDir, StandaloneDirName, "redis")
+	// files left world readable by an earlier run are restricted too
+	if err := os.MkdirAll(stackDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(stackDir, "docker-compose.yml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	inputctx := &input.InputContext{DockerName: "redis", Config: &input.ConfigFile{DefaultCargoportDir: cargoportDir}}
+	composeFilePath, err := PrepareStandaloneTarget(&job.JobContext{}, inputctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for filePath, want := range map[string]os.FileMode{
+		stackDir:        0700,
+		composeFilePath: 0600,
+		filepath.Join(stackDir, StandaloneInspectName): 0600,
+	} {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("%s has mode %v, want %v", filePath, info.Mode().Perm(), want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/adrian-griffin/cargoport/dockerapi"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/logger"
+)
+
+// orders services so each follows the services it depends on, including dependencies reached through services left running
+func serviceStartOrder(compose *composeFile, services []string) ([]string, error) {
+	selected := make(map[string]bool, len(services))
+	for _, service := range services {
+		selected[service] = true
+	}
+
+	// sorted for a stable order between independent services
+	names := append([]string(nil), services...)
+	sort.Strings(names)
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(names))
+	var order []string
+
+	var visit func(service string, path []string) error
+	visit = func(service string, path []string) error {
+		switch state[service] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("circular depends_on between services: %s", strings.Join(append(path, service), " -> "))
+		}
+		state[service] = visiting
+
+		dependencies := append([]string(nil), compose.Services[service].DependsOn...)
+		sort.Strings(dependencies)
+		for _, dependency := range dependencies {
+			if err := visit(dependency, append(path, service)); err != nil {
+				return err
+			}
+		}
+
+		state[service] = visited
+		if selected[service] {
+			order = append(order, service)
+		}
+		return nil
+	}
+
+	for _, service := range names {
+		if err := visit(service, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// determines which services the job takes offline, defaulting to every service in the composefile
+func servicesToStop(context *job.JobContext, compose *composeFile) ([]string, error) {
+	if len(context.StopServices) == 0 {
+		var services []string
+		for service := range compose.Services {
+			services = append(services, service)
+		}
+		return services, nil
+	}
+	for _, service := range context.StopServices {
+		if _, ok := compose.Services[service]; !ok {
+			return nil, fmt.Errorf("service '%s' is not defined in the compose file", service)
+		}
+	}
+	return context.StopServices, nil
+}
+
+// stops or pauses running services in reverse dependency order, dependents go offline before their dependencies
+func stopComposeServices(context *job.JobContext, client dockerapi.Client, composeFilePath string) error {
+	verboseFields := dockerLogBaseFields(context)
+
+	compose, err := parseComposeFile(composeFilePath)
+	if err != nil {
+		return err
+	}
+	services, err := servicesToStop(context, compose)
+	if err != nil {
+		return err
+	}
+	order, err := serviceStartOrder(compose, services)
+	if err != nil {
+		return err
+	}
+
+	containers, err := composeContainers(client, composeFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to list Docker containers: %v", err)
+	}
+	running := make(map[string][]dockerapi.Container)
+	for _, container := range containers {
+		if container.State == "running" {
+			running[container.Service()] = append(running[container.Service()], container)
+		}
+	}
+
+	for i := len(order) - 1; i >= 0; i-- {
+		service := order[i]
+		if len(running[service]) == 0 {
+			logger.LogxWithFields("debug", fmt.Sprintf("Service %s has no running containers, skipping", service), verboseFields)
+			continue
+		}
+		for _, container := range running[service] {
+			logger.LogxWithFields("debug", fmt.Sprintf("Taking service %s offline via %s (container %.12s)", service, context.StopStrategy, container.ID), verboseFields)
+
+			if context.StopStrategy == input.StopStrategyPause {
+				err = client.PauseContainer(container.ID)
+			} else {
+				err = client.StopContainer(container.ID, context.StopTimeout)
+			}
+			if err != nil {
+				// bring already stopped services back before giving up
+				if restartErr := restartComposeServices(context, client); restartErr != nil {
+					logger.LogxWithFields("error", fmt.Sprintf("Failed to restart services after failed stop: %v", restartErr), verboseFields)
+				}
+				return fmt.Errorf("failed to %s service %s: %v", context.StopStrategy, service, err)
+			}
+			context.StoppedContainers = append(context.StoppedContainers, job.StoppedContainer{Service: service, ID: container.ID})
+		}
+	}
+	return nil
+}
+
+// starts or unpauses containers taken offline by stopComposeServices, dependencies come back before their dependents
+func restartComposeServices(context *job.JobContext, client dockerapi.Client) error {
+	verboseFields := dockerLogBaseFields(context)
+
+	var failed []string
+	for i := len(context.StoppedContainers) - 1; i >= 0; i-- {
+		stopped := context.StoppedContainers[i]
+		logger.LogxWithFields("debug", fmt.Sprintf("Bringing service %s back online (container %.12s)", stopped.Service, stopped.ID), verboseFields)
+
+		var err error
+		if context.StopStrategy == input.StopStrategyPause {
+			err = client.UnpauseContainer(stopped.ID)
+		} else {
+			err = client.StartContainer(stopped.ID)
+		}
+		if err != nil {
+			// keep going so a single failure does not leave the remaining services offline
+			logger.LogxWithFields("error", fmt.Sprintf("Failed to restart service %s: %v", stopped.Service, err), verboseFields)
+			failed = append(failed, stopped.Service)
+		}
+	}
+	context.StoppedContainers = nil
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to restart services: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
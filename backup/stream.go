@@ -0,0 +1,397 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/logger"
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// destination receiving a streamed archive, ssh is currently the only implementation
+// but object-store uploads can satisfy the same interface
+type streamSink interface {
+	Write(p []byte) (int, error)
+	// closes input & waits for the destination to commit the archive
+	Finish() error
+	// stops the stream & removes any partial data on the destination
+	Abort()
+	// writes sidecar manifest next to the committed archive
+	WriteManifest(manifestData []byte) error
+}
+
+// streams archive over ssh into a `.partial` file, renamed into place once complete
+type sshStreamSink struct {
+	remoteUserHost string
+	remotePort     int
+	cargoportKey   string
+	remotePath     string
+	cmd            *exec.Cmd
+	stdin          io.WriteCloser
+	stderr         bytes.Buffer
+	committed      bool
+}
+
+// starts remote receiving process for destination
+func newSSHStreamSink(destination input.RemoteTarget, cargoportKey, archiveName string) (*sshStreamSink, error) {
+	sink := &sshStreamSink{
+		remoteUserHost: fmt.Sprintf("%s@%s", destination.User, destination.Host),
+		remotePort:     destination.Port,
+		cargoportKey:   cargoportKey,
+		remotePath:     RemoteArchivePath(destination.OutputDir, archiveName),
+	}
+
+	partialPath := RemoteShellPath(sink.remotePath + ".partial")
+	receiveCommand := fmt.Sprintf("mkdir -p %s && cat > %s && mv %s %s",
+		RemoteShellPath(path.Dir(sink.remotePath)), partialPath, partialPath, RemoteShellPath(sink.remotePath))
+
+	sshArgs := append(util.SSHBaseOptions(cargoportKey, sink.remotePort), sink.remoteUserHost, receiveCommand)
+	sink.cmd = exec.Command("ssh", sshArgs...)
+	sink.cmd.Stderr = &sink.stderr
+
+	stdin, err := sink.cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ssh stdin: %v", err)
+	}
+	sink.stdin = stdin
+
+	if err := sink.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ssh stream: %v", err)
+	}
+	return sink, nil
+}
+
+func (s *sshStreamSink) Write(p []byte) (int, error) {
+	return s.stdin.Write(p)
+}
+
+func (s *sshStreamSink) Finish() error {
+	s.stdin.Close()
+	if err := s.cmd.Wait(); err != nil {
+		return fmt.Errorf("remote receive failed: %v: %s", err, strings.TrimSpace(s.stderr.String()))
+	}
+	s.committed = true
+	return nil
+}
+
+func (s *sshStreamSink) Abort() {
+	s.stdin.Close()
+	if s.cmd.ProcessState == nil {
+		s.cmd.Process.Kill()
+		s.cmd.Wait()
+	}
+
+	// remove partial upload, as well as the archive & manifest if this stream already committed them
+	cleanupCommand := fmt.Sprintf("rm -f %s", RemoteShellPath(s.remotePath+".partial"))
+	if s.committed {
+		cleanupCommand += fmt.Sprintf(" %s %s", RemoteShellPath(s.remotePath), RemoteShellPath(s.remotePath+ManifestSuffix))
+	}
+	sshArgs := append(util.SSHBaseOptions(s.cargoportKey, s.remotePort), s.remoteUserHost, cleanupCommand)
+	util.RunCommandWithOutput("ssh", sshArgs...)
+}
+
+func (s *sshStreamSink) WriteManifest(manifestData []byte) error {
+	writeCommand := fmt.Sprintf("cat > %s", RemoteShellPath(s.remotePath+ManifestSuffix))
+	sshArgs := append(util.SSHBaseOptions(s.cargoportKey, s.remotePort), s.remoteUserHost, writeCommand)
+	cmd := exec.Command("ssh", sshArgs...)
+	cmd.Stdin = bytes.NewReader(manifestData)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to write remote manifest: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// tracks a sink alongside its outcome during a stream
+type streamDestination struct {
+	destination input.RemoteTarget
+	sink        streamSink
+	err         error
+	startTime   time.Time
+}
+
+// writes each chunk to every healthy destination, dropping destinations as they fail
+type fanoutWriter struct {
+	destinations []*streamDestination
+}
+
+func (f *fanoutWriter) Write(p []byte) (int, error) {
+	healthy := 0
+	for _, dest := range f.destinations {
+		if dest.err != nil {
+			continue
+		}
+		if _, err := dest.sink.Write(p); err != nil {
+			dest.err = fmt.Errorf("stream write failed: %v", err)
+			continue
+		}
+		healthy++
+	}
+	if healthy == 0 {
+		return 0, fmt.Errorf("all stream destinations failed")
+	}
+	return len(p), nil
+}
+
+// counts bytes passing through stream
+type countingWriter struct {
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.count += int64(len(p))
+	return len(p), nil
+}
+
+// compresses target directory & pipes output straight to every remote destination without a local tempfile,
+// computing archive checksum in-flight
+func StreamToRemotes(jobctx *job.JobContext, inputctx *input.InputContext, targetDir, archiveName string) error {
+
+	// defining logging fields
+	verboseFields := remoteLogDebugFields(jobctx)
+
+	cargoportKey := filepath.Join(inputctx.Config.SSHKeyDir, inputctx.Config.SSHKeyName)
+	if err := util.ValidateSSHPrivateKeyPerms(cargoportKey); err != nil {
+		return fmt.Errorf("private SSH key integrity check failed, key may have been tampered with, please generate a new keypair")
+	}
+	if len(inputctx.Destinations) == 0 {
+		return fmt.Errorf("no remote destinations defined for stream")
+	}
+
+	parentDir := filepath.Dir(targetDir)
+	baseDir := filepath.Base(targetDir)
+	if baseDir == "" || baseDir == "." {
+		return fmt.Errorf("invalid directory structure for: %s", targetDir)
+	}
+
+	// streams cannot resume, so failed destinations are retried by re-streaming to only those destinations
+	results := make([]job.RemoteResult, len(inputctx.Destinations))
+	pending := make([]int, len(inputctx.Destinations))
+	for i := range pending {
+		pending[i] = i
+	}
+	maxAttempts := inputctx.Config.TransferRetries + 1
+	backoff := time.Duration(inputctx.Config.TransferRetryBackoff) * time.Second
+
+	for attempt := 1; attempt <= maxAttempts && len(pending) > 0; attempt++ {
+		var destinations []input.RemoteTarget
+		for _, index := range pending {
+			destinations = append(destinations, inputctx.Destinations[index])
+		}
+
+		passResults, err := streamPass(jobctx, inputctx.Config, destinations, cargoportKey, archiveName, parentDir, baseDir)
+		if err != nil {
+			return err
+		}
+
+		var stillPending []int
+		for i, index := range pending {
+			passResults[i].Attempts = attempt
+			results[index] = passResults[i]
+			if !passResults[i].Success {
+				stillPending = append(stillPending, index)
+				logger.LogxWithFields("warn", fmt.Sprintf("Stream attempt %d/%d to remote '%s' failed: %s", attempt, maxAttempts, passResults[i].Name, passResults[i].Error), logger.MergeFields(verboseFields, map[string]interface{}{
+					"remote_name":  passResults[i].Name,
+					"remote_host":  passResults[i].Host,
+					"attempt":      attempt,
+					"max_attempts": maxAttempts,
+				}))
+			}
+		}
+		pending = stillPending
+
+		if len(pending) > 0 && attempt < maxAttempts {
+			logger.LogxWithFields("warn", fmt.Sprintf("Retrying stream to %d remote destination(s) in %s", len(pending), backoff), verboseFields)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	// each pass runs tar again, so destinations committed on different passes hold different archives
+	// the job records the archive of the first successful destination, every destination keeps its own checksum
+	var recorded *job.RemoteResult
+	for i := range results {
+		if !results[i].Success {
+			continue
+		}
+		if recorded == nil {
+			recorded = &results[i]
+			jobctx.ArchiveSHA256 = recorded.SHA256
+			jobctx.CompressedSizeBytesInt = recorded.SizeBytes
+			jobctx.CompressedSizeMBString = fmt.Sprintf("%.2f MB", float64(recorded.SizeBytes)/1024.0/1024.0)
+		} else if results[i].SHA256 != recorded.SHA256 {
+			logger.LogxWithFields("warn", fmt.Sprintf("Remote '%s' holds a different archive to '%s' after retrying, sha256 %s", results[i].Name, recorded.Name, results[i].SHA256), logger.MergeFields(verboseFields, map[string]interface{}{
+				"remote_name": results[i].Name,
+				"sha256":      results[i].SHA256,
+			}))
+		}
+	}
+
+	// embedded images are sent beside the streamed archive, from the local image store
+	for i, result := range results {
+		if !result.Success {
+			continue
+		}
+		if err := sendImagesToRemote(jobctx, inputctx.Destinations[i], cargoportKey); err != nil {
+			results[i].Success = false
+			results[i].Error = err.Error()
+		}
+	}
+	jobctx.RemoteResults = results
+
+	if err := evaluateRemotePolicy(results, inputctx.Config.RemoteSuccessPolicy); err != nil {
+		return err
+	}
+
+	logger.LogxWithFields("info", "Snapshot successfully streamed to remote", map[string]interface{}{
+		"package": "remote",
+		"remote":  true,
+		"success": true,
+		"target":  jobctx.Target,
+		"job_id":  jobctx.JobID,
+		"size":    jobctx.CompressedSizeMBString,
+		"sha256":  jobctx.ArchiveSHA256,
+	})
+	return nil
+}
+
+// runs a single tar stream to a set of destinations, returning a result per destination
+// an error is only returned when the archive itself could not be produced
+func streamPass(jobctx *job.JobContext, configFile *input.ConfigFile, destinations []input.RemoteTarget, cargoportKey, archiveName, parentDir, baseDir string) ([]job.RemoteResult, error) {
+
+	// defining logging fields
+	verboseFields := remoteLogDebugFields(jobctx)
+
+	// open a sink per destination, throttling the shared stream to the lowest bandwidth cap
+	fanout := &fanoutWriter{}
+	bandwidthLimit := 0
+	for _, destination := range destinations {
+		dest := &streamDestination{destination: destination, startTime: time.Now()}
+		fanout.destinations = append(fanout.destinations, dest)
+
+		// probe tcp/ssh reachability prior to opening stream
+		probeReport := util.ProbeRemote(destination.Host, configFile.ProbeOptions(destination.User, destination.Port))
+		util.LogProbeReport(probeReport, logger.MergeFields(verboseFields, map[string]interface{}{
+			"remote_name": destination.Name,
+		}))
+		if err := probeReport.Err(); err != nil {
+			dest.err = fmt.Errorf("remote host is not reachable: %v", err)
+			continue
+		}
+
+		sink, err := newSSHStreamSink(destination, cargoportKey, archiveName)
+		if err != nil {
+			dest.err = err
+		} else {
+			dest.sink = sink
+		}
+
+		if destination.BandwidthLimit > 0 && (bandwidthLimit == 0 || destination.BandwidthLimit < bandwidthLimit) {
+			bandwidthLimit = destination.BandwidthLimit
+		}
+	}
+
+	logger.LogxWithFields("debug", fmt.Sprintf("Streaming %s to %d remote destination(s) as %s", filepath.Join(parentDir, baseDir), len(fanout.destinations), archiveName), verboseFields)
+
+	if err := resetIncrementalIndex(jobctx); err != nil {
+		abortStreams(fanout)
+		return nil, err
+	}
+
+	// run tar compression to stdout
+	tarCmd := util.ReadAllCommand("tar", append([]string{"-czf", "-"}, tarSourceArgs(jobctx, parentDir, baseDir)...)...)
+	tarCmd.Stderr = os.Stderr
+	tarOutput, err := tarCmd.StdoutPipe()
+	if err != nil {
+		abortStreams(fanout)
+		return nil, fmt.Errorf("failed to open tar output: %v", err)
+	}
+	if err := tarCmd.Start(); err != nil {
+		abortStreams(fanout)
+		return nil, fmt.Errorf("failed to start tar: %v", err)
+	}
+
+	hasher := sha256.New()
+	counter := &countingWriter{}
+	_, copyErr := io.Copy(io.MultiWriter(hasher, counter, util.NewRateLimitedWriter(fanout, bandwidthLimit)), tarOutput)
+	if copyErr != nil {
+		tarCmd.Process.Kill()
+	}
+	tarErr := tarCmd.Wait()
+
+	// if tar itself failed, no destination holds a complete archive
+	if tarErr != nil && copyErr == nil {
+		abortStreams(fanout)
+		return nil, fmt.Errorf("error compressing directory: %v", tarErr)
+	}
+
+	var manifestData []byte
+	if copyErr == nil {
+		recordDeletedPaths(jobctx)
+		jobctx.CompressedSizeBytesInt = counter.count
+		jobctx.CompressedSizeMBString = fmt.Sprintf("%.2f MB", float64(counter.count)/1024.0/1024.0)
+		jobctx.ArchiveSHA256 = hex.EncodeToString(hasher.Sum(nil))
+
+		// destinations committed by this pass receive a manifest for this pass's archive, so every
+		// remote copy is verifiable on its own even when retries leave destinations with differing archives
+		manifestData, err = json.MarshalIndent(NewManifest(jobctx, archiveName), "", "  ")
+		if err != nil {
+			abortStreams(fanout)
+			return nil, fmt.Errorf("failed to encode manifest: %v", err)
+		}
+	}
+
+	// commit each destination, cleaning up any that failed along the way
+	results := make([]job.RemoteResult, len(fanout.destinations))
+	for i, dest := range fanout.destinations {
+		if dest.err == nil && copyErr != nil {
+			dest.err = fmt.Errorf("stream interrupted: %v", copyErr)
+		}
+		if dest.err == nil {
+			dest.err = dest.sink.Finish()
+		}
+		if dest.err == nil {
+			dest.err = dest.sink.WriteManifest(manifestData)
+		}
+		if dest.err != nil && dest.sink != nil {
+			dest.sink.Abort()
+		}
+
+		results[i] = job.RemoteResult{
+			Name:     dest.destination.Name,
+			Host:     dest.destination.Host,
+			User:     dest.destination.User,
+			Required: dest.destination.Required,
+			Success:  dest.err == nil,
+			Duration: time.Since(dest.startTime),
+		}
+		if dest.err != nil {
+			results[i].Error = dest.err.Error()
+		} else {
+			results[i].SHA256 = jobctx.ArchiveSHA256
+			results[i].SizeBytes = jobctx.CompressedSizeBytesInt
+		}
+	}
+
+	return results, nil
+}
+
+// aborts every open stream destination
+func abortStreams(fanout *fanoutWriter) {
+	for _, dest := range fanout.destinations {
+		if dest.sink != nil {
+			dest.sink.Abort()
+		}
+	}
+}
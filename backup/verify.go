@@ -0,0 +1,62 @@
+package backup
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+)
+
+// verifies archive checksum (when expected checksum is known) & reads through full tarball to confirm integrity
+func VerifyArchive(archivePath, expectedSHA256 string) error {
+	if expectedSHA256 != "" {
+		actualSHA256, err := FileSHA256(archivePath)
+		if err != nil {
+			return fmt.Errorf("failed to checksum archive: %v", err)
+		}
+		if actualSHA256 != expectedSHA256 {
+			return fmt.Errorf("checksum mismatch: expected %s, got %s", expectedSHA256, actualSHA256)
+		}
+	}
+
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %v", err)
+	}
+	defer archiveFile.Close()
+
+	compression, stream, err := DetectStreamCompression(archiveFile)
+	if err != nil {
+		return err
+	}
+	decompressed, err := Decompress(stream, compression)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+
+	// walk every tar entry, reading contents to surface truncation or corruption
+	tarReader := tar.NewReader(decompressed)
+	entries := 0
+	for {
+		_, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("archive is corrupt after %d entries: %v", entries, err)
+		}
+		if _, err := io.Copy(io.Discard, tarReader); err != nil {
+			return fmt.Errorf("archive is corrupt after %d entries: %v", entries, err)
+		}
+		entries++
+	}
+
+	if entries == 0 {
+		return fmt.Errorf("archive contains no entries")
+	}
+	if err := decompressed.Close(); err != nil {
+		return fmt.Errorf("failed to decompress archive: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+package catalog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/backup"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/repo"
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// locations backups are listed from, pulled archives are listed as pull:<host> & remote destinations as remote:<name>
+const (
+	LocationLocal    = "local"    // local output dir
+	LocationReceived = "received" // <root>/remote, holding archives sent from other hosts
+	LocationRepo     = "repo"     // local backup repository
+)
+
+// verification status of a listed backup
+const (
+	StatusVerified   = "verified"    // checksum & contents verified by -verify, or when pulled
+	StatusFailed     = "failed"      // verification failed
+	StatusUnverified = "unverified"  // checksum recorded in manifest, not yet verified
+	StatusNoManifest = "no manifest" // archive has no manifest to verify against
+)
+
+// compression reported for repository snapshots, whose chunks are individually deflated
+const repoCompression = "deflate"
+
+// single backup found locally, on a remote destination or in the backup repository
+type Entry struct {
+	Location    string    `json:"location"`
+	Path        string    `json:"path"` // archive path, user@host:path for remote archives, or repository dir
+	Archive     string    `json:"archive,omitempty"`
+	Snapshot    string    `json:"snapshot,omitempty"` // repository snapshot id
+	JobID       string    `json:"job_id,omitempty"`
+	Hostname    string    `json:"hostname,omitempty"` // host the backup was taken on
+	Target      string    `json:"target"`
+	Tag         string    `json:"tag,omitempty"`
+	Time        time.Time `json:"time"`
+	Level       string    `json:"backup_level,omitempty"`
+	SizeBytes   int64     `json:"size_bytes"`
+	Compression string    `json:"compression"`
+	Encrypted   bool      `json:"encrypted"`
+	Status      string    `json:"status"`
+
+	// archives without manifests only know <target>[-tag] from their name
+	nameOnly bool
+}
+
+// selects which backups are listed
+type Options struct {
+	Target  string
+	Tag     string
+	Remotes []string // named remotes to list, default & every named remote when empty
+	Local   bool     // list local archives & repository snapshots
+	Remote  bool     // list remote destinations
+	Verify  bool     // verify local archives & snapshots rather than reporting recorded status
+}
+
+// reports whether entry belongs to target & tag, either may be empty to match any
+func (e Entry) matches(target, tag string) bool {
+	if e.nameOnly {
+		if target != "" && e.Target != target && !strings.HasPrefix(e.Target, target+"-") {
+			return false
+		}
+		return tag == "" || strings.HasSuffix(e.Target, "-"+tag)
+	}
+	return (target == "" || e.Target == target) && (tag == "" || e.Tag == tag)
+}
+
+// lists backups matching opts, sorted by target & tag then newest first
+// locations which cannot be listed are returned as errors alongside every backup that could be listed
+func List(configFile *input.ConfigFile, opts Options) ([]Entry, []error) {
+	var entries []Entry
+	var errs []error
+	add := func(listed []Entry, err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, entry := range listed {
+			if entry.matches(opts.Target, opts.Tag) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	if opts.Local {
+		// pulled archives are verified centrally as they are fetched
+		verified := map[string]bool{}
+		if ledger, err := job.ReadLedger(configFile.DefaultCargoportDir); err == nil {
+			for _, ledgerEntry := range ledger {
+				if ledgerEntry.Verified && ledgerEntry.Archive != "" {
+					verified[ledgerEntry.Archive] = true
+				}
+			}
+		}
+
+		add(listArchiveDir(configFile.DefaultOutputDir, LocationLocal, verified, opts.Verify))
+		receivedDir := filepath.Join(configFile.DefaultCargoportDir, "remote")
+		add(listArchiveDir(receivedDir, LocationReceived, verified, opts.Verify))
+		if hostDirs, err := os.ReadDir(receivedDir); err == nil {
+			for _, hostDir := range hostDirs {
+				if hostDir.IsDir() && !strings.HasPrefix(hostDir.Name(), ".") {
+					add(listArchiveDir(filepath.Join(receivedDir, hostDir.Name()), "pull:"+hostDir.Name(), verified, opts.Verify))
+				}
+			}
+		}
+		if repo.Exists(configFile.RepoDir) {
+			add(listRepository(configFile, opts.Verify))
+		}
+	}
+
+	if opts.Remote {
+		destinations, err := remoteDestinations(configFile, opts.Remotes)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		cargoportKey := filepath.Join(configFile.SSHKeyDir, configFile.SSHKeyName)
+
+		// remotes are listed in parallel, as unreachable remotes each wait out the ssh connect timeout
+		results := make([][]Entry, len(destinations))
+		remoteErrs := make([]error, len(destinations))
+		var wg sync.WaitGroup
+		for i, destination := range destinations {
+			wg.Add(1)
+			go func(i int, destination input.RemoteTarget) {
+				defer wg.Done()
+				results[i], remoteErrs[i] = listRemote(destination, cargoportKey)
+			}(i, destination)
+		}
+		wg.Wait()
+		for i := range destinations {
+			add(results[i], remoteErrs[i])
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Target != entries[j].Target {
+			return entries[i].Target < entries[j].Target
+		}
+		if entries[i].Tag != entries[j].Tag {
+			return entries[i].Tag < entries[j].Tag
+		}
+		return entries[i].Time.After(entries[j].Time)
+	})
+	return entries, errs
+}
+
+// lists archives directly within dir, a missing dir holds no archives
+func listArchiveDir(dir, location string, verified map[string]bool, verify bool) ([]Entry, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", dir, err)
+	}
+
+	var entries []Entry
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if dirEntry.IsDir() || !strings.HasSuffix(name, backup.ArchiveSuffix) {
+			continue
+		}
+		archivePath := filepath.Join(dir, name)
+		fileInfo, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		manifest, _ := backup.ReadManifest(archivePath)
+		entry := archiveEntry(location, archivePath, name, fileInfo.Size(), fileInfo.ModTime(), manifest)
+		if manifest == nil {
+			if compression, err := backup.DetectCompression(archivePath); err == nil {
+				entry.Compression = compression
+			}
+		}
+
+		switch {
+		case verify:
+			expectedSHA256 := ""
+			if manifest != nil {
+				expectedSHA256 = manifest.SHA256
+			}
+			entry.Status = StatusVerified
+			if err := backup.VerifyArchive(archivePath, expectedSHA256); err != nil {
+				entry.Status = StatusFailed
+			}
+		case verified[archivePath]:
+			entry.Status = StatusVerified
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// builds entry for archive from its name, falling back to its modified time for untimestamped archives
+// manifest may be nil, in which case target & tag cannot be told apart
+func archiveEntry(location, archivePath, name string, size int64, modTime time.Time, manifest *backup.Manifest) Entry {
+	parsed, _ := backup.ParseArchiveName(name)
+	entry := Entry{
+		Location:    location,
+		Path:        archivePath,
+		Archive:     name,
+		Target:      parsed.Stem,
+		Time:        parsed.Timestamp,
+		Level:       parsed.Level,
+		SizeBytes:   size,
+		Compression: backup.CompressionGzip,
+		Status:      StatusNoManifest,
+		nameOnly:    true,
+	}
+	if entry.Time.IsZero() {
+		entry.Time = modTime
+	}
+	if manifest == nil {
+		return entry
+	}
+
+	entry.nameOnly = false
+	entry.Target = manifest.Target
+	entry.Tag = manifest.Tag
+	entry.JobID = manifest.JobID
+	entry.Hostname = manifest.Hostname
+	entry.Status = StatusUnverified
+	if !manifest.CreatedAt.IsZero() {
+		entry.Time = manifest.CreatedAt
+	}
+	if manifest.BackupLevel != "" {
+		entry.Level = manifest.BackupLevel
+	}
+	if manifest.Compression != "" {
+		entry.Compression = manifest.Compression
+	}
+	return entry
+}
+
+// lists snapshots in the local backup repository
+func listRepository(configFile *input.ConfigFile, verify bool) ([]Entry, error) {
+	repository, err := backup.OpenRepository(configFile.RepoDir, configFile.RepoPasswordFile, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository: %v", err)
+	}
+	snapshots, err := repository.Snapshots()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repository snapshots: %v", err)
+	}
+
+	var entries []Entry
+	for _, snap := range snapshots {
+		entry := Entry{
+			Location:    LocationRepo,
+			Path:        repository.Dir,
+			Snapshot:    snap.ID,
+			JobID:       snap.ID,
+			Hostname:    snap.Hostname,
+			Target:      snap.Target,
+			Tag:         snap.Tag,
+			Time:        snap.Time,
+			SizeBytes:   snap.Size,
+			Compression: repoCompression,
+			Encrypted:   repository.Encrypted(),
+			Status:      StatusUnverified,
+		}
+		if verify {
+			entry.Status = StatusVerified
+			if err := repository.VerifySnapshot(snap); err != nil {
+				entry.Status = StatusFailed
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// resolves remote destinations to list, the default remote & every named remote unless names are given
+func remoteDestinations(configFile *input.ConfigFile, names []string) ([]input.RemoteTarget, error) {
+	var destinations []input.RemoteTarget
+	addRemote := func(remote input.RemoteConfig) {
+		if remote.Port == 0 {
+			remote.Port = configFile.RemotePort
+		}
+		if remote.OutputDir == "" {
+			remote.OutputDir = configFile.RemoteOutputDir
+		}
+		destinations = append(destinations, input.RemoteTarget{
+			Name:      remote.Name,
+			User:      remote.User,
+			Host:      remote.Host,
+			Port:      remote.Port,
+			OutputDir: remote.OutputDir,
+		})
+	}
+
+	if len(names) > 0 {
+		for _, name := range names {
+			remote, ok := configFile.FindRemote(name)
+			if !ok {
+				return destinations, fmt.Errorf("remote '%s' is not defined in configfile", name)
+			}
+			addRemote(*remote)
+		}
+		return destinations, nil
+	}
+
+	if configFile.RemoteHost != "" && configFile.RemoteUser != "" {
+		addRemote(input.RemoteConfig{Name: configFile.RemoteHost, User: configFile.RemoteUser, Host: configFile.RemoteHost})
+	}
+	for _, remote := range configFile.Remotes {
+		addRemote(remote)
+	}
+	return destinations, nil
+}
+
+// lists archives held in a remote destination's output dir over ssh
+func listRemote(destination input.RemoteTarget, cargoportKey string) ([]Entry, error) {
+	remoteDir := destination.OutputDir
+	if remoteDir == "" {
+		remoteDir = "~"
+	}
+	remoteUserHost := fmt.Sprintf("%s@%s", destination.User, destination.Host)
+	sshArgs := append(util.SSHBaseOptions(cargoportKey, destination.Port), remoteUserHost, util.ListArchivesCommand(backup.RemoteShellPath(remoteDir)))
+	output, err := util.RunCommandWithOutput("ssh", sshArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote '%s': %s", destination.Name, strings.TrimSpace(output))
+	}
+
+	// archive records are listed before or after their manifests depending on name order
+	type remoteArchive struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var archives []remoteArchive
+	manifests := map[string]*backup.Manifest{}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 2*1024*1024)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 4)
+		switch {
+		case len(fields) == 4 && fields[0] == "A":
+			size, sizeErr := strconv.ParseInt(fields[1], 10, 64)
+			modified, timeErr := strconv.ParseInt(fields[2], 10, 64)
+			if sizeErr != nil || timeErr != nil {
+				continue
+			}
+			archives = append(archives, remoteArchive{name: fields[3], size: size, modTime: time.Unix(modified, 0)})
+		case len(fields) >= 3 && fields[0] == "M":
+			var manifest backup.Manifest
+			if json.Unmarshal([]byte(strings.Join(fields[2:], "\t")), &manifest) == nil {
+				manifests[fields[1]] = &manifest
+			}
+		}
+	}
+
+	location := "remote:" + destination.Name
+	var entries []Entry
+	for _, archive := range archives {
+		remotePath := fmt.Sprintf("%s:%s/%s", remoteUserHost, strings.TrimSuffix(remoteDir, "/"), archive.name)
+		entries = append(entries, archiveEntry(location, remotePath, archive.name, archive.size, archive.modTime, manifests[archive.name+backup.ManifestSuffix]))
+	}
+	return entries, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/backup"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/logger"
+	"github.com/adrian-griffin/cargoport/pull"
+	"github.com/adrian-griffin/cargoport/receive"
+	"github.com/adrian-griffin/cargoport/restore"
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// loads configfile & initializes logging, exits on failure
+func loadConfigAndLogging() *input.ConfigFile {
+	configFile, err := input.LoadConfigFile()
+	if err != nil {
+		log.Printf("Error parsing config: %v", err)
+		log.Fatalf("Perhaps consider running cargoport -setup again")
+	}
+
+	logger.InitLogging(configFile.DefaultCargoportDir, configFile.LogLevel, configFile.LogFormat, configFile.LogTextColour)
+
+	// root is no longer required, record how this process is able to read data & reach docker
+	logger.LogxWithFields("debug", "Process privileges", map[string]interface{}{
+		"package":             "main",
+		"uid":                 os.Geteuid(),
+		"root":                util.IsRoot(),
+		"cap_dac_read_search": util.HasCapability(util.CapDACReadSearch),
+		"docker_socket":       util.DockerSocketPath(),
+	})
+	return configFile
+}
+
+// dispatches named subcommand with its own flagset
+func runSubcommand(name string, args []string) {
+	switch name {
+	case "pull":
+		runPullCommand(args)
+	case "probe":
+		runProbeCommand(args)
+	case "serve-receive":
+		runServeReceiveCommand(args)
+	case "restore":
+		runRestoreCommand(args)
+	case "repo":
+		runRepoCommand(args)
+	case "inspect":
+		runInspectCommand(args)
+	case "extract":
+		runExtractCommand(args)
+	case "diff":
+		runDiffCommand(args)
+	case "migrate":
+		runMigrateCommand(args)
+	default:
+		fmt.Printf("Unknown command '%s', see `cargoport -help`\n", name)
+		os.Exit(1)
+	}
+}
+
+// cargoport pull [-host <name>]
+func runPullCommand(args []string) {
+	pullFlags := flag.NewFlagSet("pull", flag.ExitOnError)
+	hostFilter := pullFlags.String("host", "", "Only pull from the named pull host (default pulls from all registered hosts)")
+	pullFlags.Parse(args)
+
+	configFile := loadConfigAndLogging()
+
+	if err := pull.RunPull(configFile, *hostFilter); err != nil {
+		logger.Logx.Fatalf("Failure to complete pull: %v", err)
+	}
+}
+
+// cargoport probe [-remotes <name,name>] [-remote-host <host> -remote-user <user>] [-json]
+func runProbeCommand(args []string) {
+	probeFlags := flag.NewFlagSet("probe", flag.ExitOnError)
+	remoteNames := probeFlags.String("remotes", "", "Comma separated list of named remotes from config to probe")
+	remoteHost := probeFlags.String("remote-host", "", "Remote machine IP(v4/v6) address or hostname")
+	remoteUser := probeFlags.String("remote-user", "", "Remote machine username")
+	remotePort := probeFlags.Int("remote-port", 0, "Remote machine SSH port")
+	jsonOutput := probeFlags.Bool("json", false, "Output diagnostics as json")
+	probeFlags.Parse(args)
+
+	configFile := loadConfigAndLogging()
+
+	// resolve probe targets, defaulting to every configured remote
+	inputCTX := &input.InputContext{
+		RemoteHost:  *remoteHost,
+		RemoteUser:  *remoteUser,
+		RemotePort:  *remotePort,
+		RemoteNames: input.ParseRemoteNames(*remoteNames),
+		Config:      configFile,
+	}
+	if inputCTX.RemoteHost == "" && len(inputCTX.RemoteNames) == 0 {
+		for _, remote := range configFile.Remotes {
+			inputCTX.RemoteNames = append(inputCTX.RemoteNames, remote.Name)
+		}
+		if configFile.RemoteHost != "" {
+			inputCTX.RemoteHost = configFile.RemoteHost
+			inputCTX.RemoteUser = configFile.RemoteUser
+		}
+	}
+	if inputCTX.RemoteHost != "" && inputCTX.RemoteUser == "" {
+		inputCTX.RemoteUser = configFile.RemoteUser
+	}
+	if inputCTX.RemotePort == 0 {
+		inputCTX.RemotePort = configFile.RemotePort
+	}
+	destinations, err := input.ResolveDestinations(inputCTX)
+	if err != nil {
+		logger.Logx.Fatalf("Failure resolving remotes: %v", err)
+	}
+	if len(destinations) == 0 {
+		logger.Logx.Fatalf("No remotes to probe, pass -remotes or -remote-host")
+	}
+
+	// always run handshake when probing explicitly
+	failed := false
+	var reports []*util.ProbeReport
+	for _, destination := range destinations {
+		probeOptions := configFile.ProbeOptions(destination.User, destination.Port)
+		probeOptions.SSHHandshake = true
+		report := util.ProbeRemote(destination.Host, probeOptions)
+		util.LogProbeReport(report, map[string]interface{}{"remote_name": destination.Name})
+		if report.Err() != nil {
+			failed = true
+		}
+		reports = append(reports, report)
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(reports)
+	} else {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "REMOTE\tCHECK\tRESULT\tTIME\tDETAIL")
+		for i, report := range reports {
+			for _, check := range report.Checks {
+				result := "ok"
+				if !check.Success {
+					result = "FAIL"
+				}
+				fmt.Fprintf(writer, "%s\t%s\t%s\t%dms\t%s\n", destinations[i].Name, check.Name, result, check.Duration.Milliseconds(), check.Detail)
+			}
+		}
+		writer.Flush()
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// cargoport serve-receive -dir <dir>
+// runs as the forced command of restricted authorized_keys entries on remotes, without root or configfile
+func runServeReceiveCommand(args []string) {
+	receiveFlags := flag.NewFlagSet("serve-receive", flag.ExitOnError)
+	allowedDir := receiveFlags.String("dir", util.DefaultRemoteDir, "Directory uploads are confined to, never the home dir or an ancestor of it")
+	receiveFlags.Parse(args)
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cargoport serve-receive: failed to determine home directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	receiver := &receive.Receiver{
+		AllowedDir:       *allowedDir,
+		CargoportCommand: os.Args[0],
+		HomeDir:          homeDir,
+		Stdin:            os.Stdin,
+		Stdout:           os.Stdout,
+		Stderr:           os.Stderr,
+	}
+	if err := receiver.Serve(os.Getenv("SSH_ORIGINAL_COMMAND")); err != nil {
+		fmt.Fprintf(os.Stderr, "cargoport serve-receive: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// splits leading positional args from flags, as flagsets stop parsing at the first positional arg
+func splitPositionalArgs(args []string, count int) ([]string, []string) {
+	var positional []string
+	for len(positional) < count && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	return positional, args
+}
+
+// cargoport restore <archive> -to <dir> [-pin=false] [-up] [-verify-health]
+func runRestoreCommand(args []string) {
+	restoreFlags := flag.NewFlagSet("restore", flag.ExitOnError)
+	destDir := restoreFlags.String("to", "", "Directory to restore archive into")
+	pinImages := restoreFlags.Bool("pin", true, "Generate docker-compose.cargoport-pinned.yml pinning services to archived image digests")
+	composeUp := restoreFlags.Bool("up", false, "Bring restored compose project up once extracted")
+	loadImages := restoreFlags.Bool("load-images", true, "Load embedded images missing from docker, searched beside the archive & in <root>/images/")
+	verifyHealth := restoreFlags.Bool("verify-health", false, "With -up, wait for restored services to become healthy, failing the restore otherwise")
+	jobID := restoreFlags.String("job-id", "", "Log restore under an existing job id, as passed by `cargoport migrate`")
+	positional, flagArgs := splitPositionalArgs(args, 1)
+	restoreFlags.Parse(flagArgs)
+	positional = append(positional, restoreFlags.Args()...)
+
+	if len(positional) != 1 || *destDir == "" {
+		fmt.Println("Usage: cargoport restore <archive> -to <dir> [-pin=false] [-load-images=false] [-up] [-verify-health]")
+		os.Exit(1)
+	}
+	if *verifyHealth && !*composeUp {
+		fmt.Println("-verify-health requires -up")
+		os.Exit(1)
+	}
+	configFile := loadConfigAndLogging()
+
+	opts := restore.Options{
+		ArchivePath: positional[0],
+		DestDir:     *destDir,
+		Pin:         *pinImages,
+		Up:          *composeUp,
+		LoadImages:  *loadImages,
+		ImageDirs: []string{
+			filepath.Join(filepath.Dir(positional[0]), backup.ImageStoreDirName),
+			filepath.Join(configFile.DefaultCargoportDir, backup.ImageStoreDirName),
+		},
+		VerifyHealth:  *verifyHealth,
+		HealthTimeout: time.Duration(configFile.DockerHealthTimeout) * time.Second,
+		SettleTime:    time.Duration(configFile.DockerSettleTime) * time.Second,
+		JobID:         *jobID,
+	}
+	if err := restore.RunRestore(opts); err != nil {
+		logger.Logx.Fatalf("Failure to restore archive: %v", err)
+	}
+}
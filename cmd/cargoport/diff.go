@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/adrian-griffin/cargoport/inspect"
+	"github.com/adrian-griffin/cargoport/logger"
+)
+
+// cargoport diff <archiveA> <archiveB> [-files=false] [-json]
+func runDiffCommand(args []string) {
+	diffFlags := flag.NewFlagSet("diff", flag.ExitOnError)
+	listFiles := diffFlags.Bool("files", true, "List added, removed & modified files")
+	jsonOutput := diffFlags.Bool("json", false, "Output differences as json")
+	positional, flagArgs := splitPositionalArgs(args, 2)
+	diffFlags.Parse(flagArgs)
+	positional = append(positional, diffFlags.Args()...)
+
+	if len(positional) != 2 {
+		fmt.Println("Usage: cargoport diff <archiveA|user@host:archiveA> <archiveB|user@host:archiveB> [-files=false] [-json]")
+		os.Exit(1)
+	}
+	configFile := loadConfigAndLogging()
+	oldSource := resolveArchiveSource(configFile, positional[0])
+	newSource := resolveArchiveSource(configFile, positional[1])
+
+	diff, err := inspect.Compare(oldSource, newSource)
+	if err != nil {
+		logger.Logx.Fatalf("Failure to compare archives: %v", err)
+	}
+
+	if *jsonOutput {
+		if !*listFiles {
+			diff.Files = nil
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(diff)
+		return
+	}
+	for _, warning := range diff.Warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	printDiff(diff, *listFiles)
+}
+
+// prints manifest, image, file & compose file differences between archives
+func printDiff(diff *inspect.Diff, listFiles bool) {
+	fmt.Printf("--- %s\n+++ %s\n", diff.Old, diff.New)
+
+	if len(diff.Manifest) > 0 {
+		fmt.Println("\nManifest")
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, change := range diff.Manifest {
+			fmt.Fprintf(writer, "  %s\t%s\t->\t%s\n", change.Field, orDash(change.Old), orDash(change.New))
+		}
+		writer.Flush()
+	}
+
+	if len(diff.Images) == 0 {
+		fmt.Println("\nImages unchanged")
+	} else {
+		fmt.Printf("\nImages (%d service(s) changed)\n", len(diff.Images))
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "  SERVICE\tCHANGE\tOLD\tNEW")
+		for _, change := range diff.Images {
+			label := change.Change
+			if len(change.Details) > 0 {
+				label = strings.Join(change.Details, ", ") + " changed"
+			}
+			fmt.Fprintf(writer, "  %s\t%s\t%s\t%s\n", change.Service, label, imageReference(change.OldImage, change.OldDigest), imageReference(change.NewImage, change.NewDigest))
+		}
+		writer.Flush()
+	}
+
+	added, removed, modified := diff.FileCounts()
+	fmt.Printf("\nFiles (%d added, %d removed, %d modified)\n", added, removed, modified)
+	if listFiles {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, change := range diff.Files {
+			switch change.Change {
+			case inspect.ChangeAdded:
+				fmt.Fprintf(writer, "  +\t%s\t%s\n", change.Path, formatFileSize(change.NewSize))
+			case inspect.ChangeRemoved:
+				fmt.Fprintf(writer, "  -\t%s\t%s\n", change.Path, formatFileSize(change.OldSize))
+			default:
+				detail := strings.Join(change.Details, ", ")
+				if change.OldSize != change.NewSize {
+					detail += fmt.Sprintf(", %s -> %s", formatFileSize(change.OldSize), formatFileSize(change.NewSize))
+				}
+				if change.OldSHA256 != change.NewSHA256 && change.OldSHA256 != "" && change.NewSHA256 != "" {
+					detail += fmt.Sprintf(", sha256 %s -> %s", change.OldSHA256[:12], change.NewSHA256[:12])
+				}
+				fmt.Fprintf(writer, "  ~\t%s\t%s\n", change.Path, detail)
+			}
+		}
+		writer.Flush()
+	}
+
+	for _, config := range diff.Configs {
+		fmt.Printf("\n%s (%s)\n", config.Path, config.Change)
+		for _, line := range config.Lines {
+			fmt.Println("  " + line)
+		}
+	}
+}
+
+// image reference with its digest, as recorded in the lockfile
+func imageReference(image, digest string) string {
+	switch {
+	case image == "" && digest == "":
+		return "-"
+	case digest == "":
+		return image
+	default:
+		return image + "@" + digest[strings.Index(digest, "@")+1:]
+	}
+}
+
+// human readable file size
+func formatFileSize(size int64) string {
+	switch {
+	case size >= 1024*1024:
+		return fmt.Sprintf("%.2f MB", float64(size)/1024.0/1024.0)
+	case size >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(size)/1024.0)
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/adrian-griffin/cargoport/discover"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/logger"
+	"github.com/adrian-griffin/cargoport/runner"
+)
+
+// cargoport -discover [-dry-run], lists compose projects on the host & backs up every project not excluded
+func runDiscover(base input.InputContext, dryRun bool) {
+	projects, err := discover.FindProjects(base.Config)
+	if err != nil {
+		logger.Logx.Fatalf("Failure to discover compose projects: %v", err)
+	}
+	if len(projects) == 0 {
+		fmt.Println("No compose projects discovered, check discover.scan_roots in config.yml")
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "PROJECT\tSTATUS\tCONTAINERS\tSOURCE\tBACKUP\tSCHEDULE\tDIR")
+	for _, project := range projects {
+		action := "yes"
+		if project.Excluded {
+			action = "excluded"
+		} else if project.Status == discover.StatusMissing {
+			action = "skip"
+		} else if project.Error != "" {
+			action = "invalid labels"
+		} else if !project.Due {
+			action = "not due"
+		}
+		schedule := project.Schedule
+		if schedule == "" {
+			schedule = "-"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d/%d\t%s\t%s\t%s\t%s\n", project.Name, project.Status, project.Running, project.Containers, project.Source, action, schedule, project.Dir)
+	}
+	writer.Flush()
+
+	if dryRun {
+		return
+	}
+
+	results := runner.RunDiscovered(base, projects)
+
+	fmt.Println(" ")
+	failed := 0
+	writer = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "PROJECT\tRESULT\tJOB ID\tSIZE\tDURATION\tDETAIL")
+	for _, result := range results {
+		outcome, detail := "ok", ""
+		switch {
+		case result.Skipped != "":
+			outcome, detail = "skipped", result.Skipped
+		case !result.Success:
+			outcome, detail = "FAIL", result.Error
+			failed++
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%.2f MB\t%.1fs\t%s\n", result.Project.Name, outcome, result.JobID,
+			float64(result.SizeBytes)/1024.0/1024.0, result.Duration.Seconds(), firstLine(detail))
+	}
+	writer.Flush()
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// returns first line of multi-line errors, such as health verification output, for table cells
+func firstLine(text string) string {
+	for i, char := range text {
+		if char == '\n' {
+			return text[:i]
+		}
+	}
+	return text
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// maps known host flags to a single action, the first set flag wins
+func hostKeyAction(trust, list, fingerprint, revoke bool) string {
+	switch {
+	case trust:
+		return input.HostKeyActionTrust
+	case list:
+		return input.HostKeyActionList
+	case fingerprint:
+		return input.HostKeyActionFingerprint
+	case revoke:
+		return input.HostKeyActionRevoke
+	}
+	return ""
+}
+
+// handles known_hosts trust, list, fingerprint & revoke actions
+func runHostKeyAction(inputctx *input.InputContext, assumeYes bool) error {
+	knownHostsPath := util.KnownHostsPath(inputctx.Config.SSHKeyDir)
+
+	if inputctx.HostKeyAction == input.HostKeyActionList {
+		entries, err := util.ListKnownHosts(knownHostsPath)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			fmt.Printf("No trusted host keys in %s\n", knownHostsPath)
+			return nil
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "HOST\tKEY TYPE\tFINGERPRINT")
+		for _, entry := range entries {
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", strings.Join(entry.Hosts, ","), entry.KeyType, entry.Fingerprint)
+		}
+		return writer.Flush()
+	}
+
+	for _, destination := range inputctx.Destinations {
+		switch inputctx.HostKeyAction {
+		case input.HostKeyActionTrust:
+			keys, err := util.ScanHostKeys(destination.Host, destination.Port)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Host keys presented by %s (port %d):\n", destination.Host, destination.Port)
+			for _, key := range keys {
+				fmt.Printf("  %-20s %s\n", key.Type(), ssh.FingerprintSHA256(key))
+			}
+			if !assumeYes && !confirm("Verify these fingerprints out-of-band. Trust them?") {
+				fmt.Printf("Skipping %s\n", destination.Host)
+				continue
+			}
+			if err := util.TrustHostKeys(knownHostsPath, destination.Host, destination.Port, keys); err != nil {
+				return err
+			}
+
+		case input.HostKeyActionFingerprint:
+			trusted, err := util.KnownHostFingerprints(knownHostsPath, destination.Host, destination.Port)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s (port %d)\n", destination.Host, destination.Port)
+			if len(trusted) == 0 {
+				fmt.Println("  trusted:   none")
+			}
+			for _, entry := range trusted {
+				fmt.Printf("  trusted:   %-20s %s\n", entry.KeyType, entry.Fingerprint)
+			}
+			presented, err := util.ScanHostKeys(destination.Host, destination.Port)
+			if err != nil {
+				fmt.Printf("  presented: unavailable (%v)\n", err)
+				continue
+			}
+			for _, key := range presented {
+				fmt.Printf("  presented: %-20s %s\n", key.Type(), ssh.FingerprintSHA256(key))
+			}
+
+		case input.HostKeyActionRevoke:
+			if !assumeYes && !confirm(fmt.Sprintf("Revoke all trusted host keys for %s?", destination.Host)) {
+				continue
+			}
+			removed, err := util.RevokeHostKeys(knownHostsPath, destination.Host, destination.Port)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Revoked %d host key(s) for %s\n", removed, destination.Host)
+		}
+	}
+	return nil
+}
+
+// prompts for y/n confirmation on stdin
+func confirm(prompt string) bool {
+	fmt.Printf("%s (y/n): ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.ToLower(strings.TrimSpace(answer)) == "y"
+}
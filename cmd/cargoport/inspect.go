@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/adrian-griffin/cargoport/backup"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/inspect"
+	"github.com/adrian-griffin/cargoport/logger"
+)
+
+// archive inspection as output by `cargoport inspect -json`
+type inspection struct {
+	Archive  string            `json:"archive"`
+	Manifest *backup.Manifest  `json:"manifest,omitempty"`
+	Lock     *backup.ImageLock `json:"lockfile,omitempty"`
+	SHA256   string            `json:"sha256"`
+	Verified bool              `json:"verified"` // checksum matches the manifest
+	Files    []inspect.File    `json:"files,omitempty"`
+}
+
+// resolves archive argument, exiting on failure
+func resolveArchiveSource(configFile *input.ConfigFile, archive string) *inspect.Source {
+	source, err := inspect.ResolveSource(configFile, archive)
+	if err != nil {
+		logger.Logx.Fatalf("Failure to resolve archive: %v", err)
+	}
+	return source
+}
+
+// cargoport inspect <archive> [-files=false] [-json]
+func runInspectCommand(args []string) {
+	inspectFlags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	listFiles := inspectFlags.Bool("files", true, "List the archive's file tree")
+	jsonOutput := inspectFlags.Bool("json", false, "Output manifest, lockfile & file tree as json")
+	positional, flagArgs := splitPositionalArgs(args, 1)
+	inspectFlags.Parse(flagArgs)
+	positional = append(positional, inspectFlags.Args()...)
+
+	if len(positional) != 1 {
+		fmt.Println("Usage: cargoport inspect <archive|user@host:archive> [-files=false] [-json]")
+		os.Exit(1)
+	}
+	configFile := loadConfigAndLogging()
+	source := resolveArchiveSource(configFile, positional[0])
+
+	manifest, manifestErr := source.Manifest()
+	contents, err := inspect.Read(source, inspect.ReadOptions{})
+	if err != nil {
+		logger.Logx.Fatalf("Failure to read archive %s: %v", source, err)
+	}
+
+	result := inspection{
+		Archive:  source.String(),
+		Manifest: manifest,
+		Lock:     contents.Lock,
+		SHA256:   contents.SHA256,
+		Verified: manifest != nil && manifest.SHA256 == contents.SHA256,
+	}
+	if *listFiles {
+		result.Files = contents.Files
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(result)
+	} else {
+		printInspection(result, contents, manifestErr)
+	}
+
+	if manifest != nil && manifest.SHA256 != "" && !result.Verified {
+		os.Exit(1)
+	}
+}
+
+// prints manifest, lockfile & file tree of an inspected archive
+func printInspection(result inspection, contents *inspect.Contents, manifestErr error) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "Archive\t%s\n", result.Archive)
+
+	manifest := result.Manifest
+	if manifest == nil {
+		fmt.Fprintf(writer, "Manifest\tnone (%v)\n", manifestErr)
+		fmt.Fprintf(writer, "SHA256\t%s (not verified)\n", result.SHA256)
+	} else {
+		fmt.Fprintf(writer, "Target\t%s\n", manifest.Target)
+		fmt.Fprintf(writer, "Tag\t%s\n", orDash(manifest.Tag))
+		fmt.Fprintf(writer, "Target dir\t%s\n", manifest.TargetDir)
+		fmt.Fprintf(writer, "Hostname\t%s\n", manifest.Hostname)
+		fmt.Fprintf(writer, "Job ID\t%s\n", manifest.JobID)
+		fmt.Fprintf(writer, "Created\t%s\n", manifest.CreatedAt.Local().Format("2006-01-02 15:04:05"))
+		fmt.Fprintf(writer, "Cargoport version\t%s\n", manifest.CargoportVersion)
+		fmt.Fprintf(writer, "Docker\t%t\n", manifest.Docker)
+		if manifest.BackupLevel != "" {
+			fmt.Fprintf(writer, "Backup level\t%s (chain %s, parent %s)\n", manifest.BackupLevel, manifest.ChainID, orDash(manifest.ParentJobID))
+			fmt.Fprintf(writer, "Deleted since parent\t%d path(s)\n", len(manifest.Deleted))
+		}
+		if manifest.Snapshot != "" {
+			fmt.Fprintf(writer, "Snapshot\t%s\n", manifest.Snapshot)
+		}
+		fmt.Fprintf(writer, "Size\t%.2f MB\n", float64(manifest.SizeBytes)/1024.0/1024.0)
+		fmt.Fprintf(writer, "Compression\t%s\n", manifest.Compression)
+		switch {
+		case manifest.SHA256 == "":
+			fmt.Fprintf(writer, "SHA256\t%s (no checksum in manifest)\n", result.SHA256)
+		case result.Verified:
+			fmt.Fprintf(writer, "SHA256\t%s (verified)\n", result.SHA256)
+		default:
+			fmt.Fprintf(writer, "SHA256\t%s (MISMATCH, manifest records %s)\n", result.SHA256, manifest.SHA256)
+		}
+		if len(manifest.ServiceStates) > 0 {
+			var states []string
+			for service, state := range manifest.ServiceStates {
+				states = append(states, service+"="+state)
+			}
+			sort.Strings(states)
+			fmt.Fprintf(writer, "Service states\t%s\n", strings.Join(states, ", "))
+		}
+		if len(manifest.Images) > 0 {
+			fmt.Fprintf(writer, "Embedded images\t%s\n", strings.Join(manifest.Images, ", "))
+		}
+	}
+	writer.Flush()
+
+	if lock := contents.Lock; lock != nil {
+		fmt.Printf("\nImage lockfile %s (compose file %s)\n", contents.LockPath, lock.ComposeFile)
+		writer = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "SERVICE\tIMAGE\tDIGEST\tPLATFORM")
+		services := make([]string, 0, len(lock.Services))
+		for service := range lock.Services {
+			services = append(services, service)
+		}
+		sort.Strings(services)
+		for _, service := range services {
+			serviceLock := lock.Services[service]
+			digest := serviceLock.Digest
+			if serviceLock.Build != nil {
+				digest = "built from " + serviceLock.Build.Context
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", service, serviceLock.Image, orDash(digest), orDash(serviceLock.Platform))
+		}
+		writer.Flush()
+	}
+
+	if result.Files != nil {
+		var totalSize int64
+		for _, file := range result.Files {
+			totalSize += file.Size
+		}
+		fmt.Printf("\nFiles (%d entries, %.2f MB)\n", len(result.Files), float64(totalSize)/1024.0/1024.0)
+		writer = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, file := range result.Files {
+			name := file.Path
+			if file.Link != "" {
+				name += " -> " + file.Link
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\n", file.Mode, file.Owner, file.Size, file.ModTime.Local().Format("2006-01-02 15:04"), name)
+		}
+		writer.Flush()
+	}
+}
+
+// cargoport extract <archive> <path...> -to <dir>
+func runExtractCommand(args []string) {
+	extractFlags := flag.NewFlagSet("extract", flag.ExitOnError)
+	destDir := extractFlags.String("to", "", "Directory to extract files into")
+	positional, flagArgs := splitPositionalArgs(args, len(args))
+	extractFlags.Parse(flagArgs)
+	positional = append(positional, extractFlags.Args()...)
+
+	if len(positional) < 2 || *destDir == "" {
+		fmt.Println("Usage: cargoport extract <archive|user@host:archive> <path...> -to <dir>")
+		os.Exit(1)
+	}
+	configFile := loadConfigAndLogging()
+	source := resolveArchiveSource(configFile, positional[0])
+	paths := positional[1:]
+	logFields := map[string]interface{}{
+		"package":  "extract",
+		"archive":  source.String(),
+		"dest_dir": *destDir,
+	}
+
+	manifest, err := source.Manifest()
+	if err != nil {
+		logger.LogxWithFields("warn", "No manifest found alongside archive, checksum will not be verified", logFields)
+	} else if manifest.BackupLevel == input.BackupModeIncremental || manifest.BackupLevel == input.BackupModeDifferential {
+		logger.LogxWithFields("info", fmt.Sprintf("Archive is part of a backup chain (%s), files unchanged since its parent are held by earlier archives in the chain", manifest.BackupLevel), logFields)
+	}
+
+	if err := os.MkdirAll(*destDir, 0755); err != nil {
+		logger.Logx.Fatalf("Failure to create destination %s: %v", *destDir, err)
+	}
+	archiveSHA256, err := inspect.Extract(source, paths, *destDir)
+	if err != nil {
+		logger.Logx.Fatalf("Failure to extract files: %v", err)
+	}
+	if manifest != nil && manifest.SHA256 != "" && manifest.SHA256 != archiveSHA256 {
+		logger.Logx.Fatalf("Archive failed verification, extracted files may be corrupt: checksum mismatch: expected %s, got %s", manifest.SHA256, archiveSHA256)
+	}
+	logger.LogxWithFields("info", fmt.Sprintf("Extracted %d path(s) from %s to %s", len(paths), source.Name(), *destDir), logFields)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/adrian-griffin/cargoport/catalog"
+	"github.com/adrian-griffin/cargoport/input"
+)
+
+// cargoport -list [-target <name>] [-tag <tag>] [-remotes <name,name>] [-skip-local] [-verify] [-json]
+func runList(configFile *input.ConfigFile, opts catalog.Options, jsonOutput bool) {
+	entries, errs := catalog.List(configFile, opts)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	failed := 0
+	for _, entry := range entries {
+		if entry.Status == catalog.StatusFailed {
+			failed++
+		}
+	}
+
+	if jsonOutput {
+		if entries == nil {
+			entries = []catalog.Entry{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(entries)
+	} else if len(entries) == 0 {
+		fmt.Println("No backups found")
+	} else {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "TARGET\tTAG\tTIME\tLEVEL\tSIZE\tLOCATION\tCOMPRESSION\tENCRYPTED\tSTATUS\tNAME")
+		for _, entry := range entries {
+			name := entry.Archive
+			if entry.Snapshot != "" {
+				name = entry.Snapshot
+			}
+			encrypted := "no"
+			if entry.Encrypted {
+				encrypted = "yes"
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%.2f MB\t%s\t%s\t%s\t%s\t%s\n", entry.Target, orDash(entry.Tag), entry.Time.Format("2006-01-02 15:04:05"),
+				orDash(entry.Level), float64(entry.SizeBytes)/1024.0/1024.0, entry.Location, entry.Compression, encrypted, entry.Status, name)
+		}
+		writer.Flush()
+	}
+
+	if len(errs) > 0 || failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// placeholder for empty table cells
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
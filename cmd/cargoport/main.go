@@ -5,10 +5,12 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/adrian-griffin/cargoport/backup"
+	"github.com/adrian-griffin/cargoport/catalog"
 	"github.com/adrian-griffin/cargoport/input"
 	"github.com/adrian-griffin/cargoport/job"
 	"github.com/adrian-griffin/cargoport/logger"
@@ -46,50 +48,142 @@ func mainLogFatalFields(context *job.JobContext) map[string]interface{} {
 
 // main loop
 func main() {
+	// subcommands are dispatched prior to parsing main job flags
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		runSubcommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	// version & setup flags
 	appVersion := flag.Bool("version", false, "Display app version information")
 	setupBool := flag.Bool("setup", false, "Run setup utility")
 
+	// backup listing flags
+	listBool := flag.Bool("list", false, "List local & remote backups, filtered by -target & -tag")
+	listTarget := flag.String("target", "", "With -list, only list backups of the named target")
+	verifyBool := flag.Bool("verify", false, "With -list, verify local archives & repository snapshots rather than reporting recorded status")
+	jsonBool := flag.Bool("json", false, "With -list, output backups as json")
+
 	// core job flags
 	targetDir := flag.String("target-dir", "", "Target directory to back up (detects if the directory is a Docker environment)")
+	discoverBool := flag.Bool("discover", false, "Discover compose projects on the host & back up every project not excluded in config")
+	dryRunBool := flag.Bool("dry-run", false, "With -discover, list discovered projects & their status without backing them up")
 	dockerName := flag.String("docker-name", "", "Target Docker service name (involves all Docker containers defined in the compose file)")
 	localOutputDir := flag.String("output-dir", "", "Custom destination for local output")
 	restartDockerBool := flag.Bool("restart-docker", true, "Restart docker container after successful backup. Enabled by default")
 	tagOutputString := flag.String("tag", "", "Append identifying tag to output file name (e.g: service1-<tag>.bak.tar.gz)")
+	backupFormat := flag.String("format", "", "Backup format: tar or repo, a snapshot in the deduplicating backup repository (defaults to backup_format in config)")
+	backupMode := flag.String("mode", "", "Backup mode: full, incremental or differential (defaults to backup_mode in config)")
+	snapshotProvider := flag.String("snapshot", "", "Snapshot provider used to archive the target dir after restarting services: auto, btrfs, lvm or none (defaults to snapshot_provider in config)")
+	stopStrategy := flag.String("stop-strategy", "", "How Docker services are taken offline during backup: down, stop or pause (defaults to the cargoport.stop-strategy label, then docker_stop_strategy in config)")
+	stopServices := flag.String("stop-services", "", "Comma separated list of compose services to stop, leaving others running (requires stop or pause strategy)")
+	skipHealthCheck := flag.Bool("skip-health-check", false, "Skip waiting for Docker services to become healthy after restart")
+	embedImagesBool := flag.Bool("embed-images", false, "Save compose images into the deduplicated image store & send them with the backup for offline restores")
 
 	// remote transfer flags
 	skipLocal := flag.Bool("skip-local", false, "Skip local backup & only send to remote target")
+	streamBool := flag.Bool("stream", false, "Stream archive directly to remote target(s) without writing a local tempfile (implies -skip-local)")
 	remoteUser := flag.String("remote-user", "", "Remote machine username")
 	remoteHost := flag.String("remote-host", "", "Remote machine IP(v4/v6) address or hostname")
+	remotePort := flag.Int("remote-port", 0, "Remote machine SSH port (defaults to default_remote_port in config, or 22)")
 	remoteOutputDir := flag.String("remote-dir", "", "Remote target directory (file saved as <remote-dir>/<file>.bak.tar.gz)")
 	sendDefaults := flag.Bool("remote-send-defaults", false, "Toggles remote send functionality using configfile default creds, overrides remote-user and remote-host flags")
+	remoteNames := flag.String("remotes", "", "Comma separated list of named remotes from config to send backup to (e.g: offsite,nas)")
 
 	// ssh key flags
 	newSSHKeyBool := flag.Bool("generate-keypair", false, "Generate new SSH key for cargoport")
 	copySSHKeyBool := flag.Bool("copy-key", false, "Copy cargoport SSH key to remote host")
+	rotateSSHKeyBool := flag.Bool("rotate-key", false, "Rotate cargoport SSH key across all configured remotes")
+	restrictKeyBool := flag.Bool("restrict", false, "Install copied key as a restricted entry only permitting cargoport uploads into -remote-dir")
+
+	// known host flags
+	trustHostBool := flag.Bool("trust-host", false, "Scan & trust remote host keys in cargoport's known_hosts")
+	listHostsBool := flag.Bool("list-hosts", false, "List trusted remote host keys")
+	hostFingerprintBool := flag.Bool("host-fingerprint", false, "Show trusted & currently presented host key fingerprints for remote")
+	revokeHostBool := flag.Bool("revoke-host", false, "Revoke trusted host keys for remote")
+	assumeYes := flag.Bool("yes", false, "Skip interactive confirmation prompts")
 
 	// custom help messaging
 	flag.Usage = func() {
 		fmt.Println("------------------------------------------------------------------------")
 		fmt.Printf("cargoport %s  ~  %s\n", meta.Version, meta.MOTD)
 		fmt.Println("-------------------------------------------------------------------------")
+		fmt.Println("[Commands]")
+		fmt.Println("     pull [-host <name>]")
+		fmt.Println("        Fetch archives from registered pull_hosts in config.yml, stored under <root>/remote/<host>/")
+		fmt.Println("     probe [-remotes <name,name>] [-remote-host <host> -remote-user <user>]")
+		fmt.Println("        Run TCP/SSH connectivity diagnostics against remotes (default probes every configured remote)")
+		fmt.Println("     restore <archive> -to <dir> [-pin=false] [-load-images=false] [-up] [-verify-health]")
+		fmt.Println("        Verify & extract archive, generating a compose override pinning services to their archived image digests")
+		fmt.Println("     inspect <archive> [-files=false] [-json]")
+		fmt.Println("        Show an archive's manifest, image lockfile & file tree, verifying its checksum")
+		fmt.Println("     extract <archive> <path...> -to <dir>")
+		fmt.Println("        Extract individual files or directories without a full restore, paths as listed by inspect")
+		fmt.Println("     diff <archiveA> <archiveB> [-files=false] [-json]")
+		fmt.Println("        Compare two backups of a target: manifests, image digests per service, files, compose & .env files")
+		fmt.Println("        Archives may be remote, as user@host:path or <remote name>:path, read over SSH with an unrestricted key")
+		fmt.Println("     migrate -docker-name <name> -to <remote|user@host> [-clone] [-restore-dir <dir>] [-force]")
+		fmt.Println("        Stream a full backup to another host & restore it there with its cargoport over SSH, verifying health")
+		fmt.Println("        The source stack is left stopped (failover) unless -clone is given, & restarted if the migration fails")
+		fmt.Println("     repo <snapshots|restore|prune|check> [-repo <dir>] [-password-file <file>]")
+		fmt.Println("        Manage the deduplicating backup repository used by -format repo (defaults to repo_directory in config)")
+		fmt.Println("     serve-receive [-dir <dir>]")
+		fmt.Println("        Forced command for restricted keys on remotes, only permits cargoport uploads into <dir>")
+		fmt.Println(" ")
 		fmt.Println("[Options]")
 		fmt.Println("  [Setup & Info]")
 		fmt.Println("     -setup")
 		fmt.Println("        Run setup utility to init the cargoport environment (default is /var/cargoport/)")
 		fmt.Println("     -version")
 		fmt.Println("        Display app version information")
+		fmt.Println("\n  [Listing Flags]")
+		fmt.Println("     -list")
+		fmt.Println("        List backups in the local output dir, received & pulled archives, the backup repository & remote destinations")
+		fmt.Println("        Shows target, tag, time, size, location, compression, encryption & verification status")
+		fmt.Println("     -target <name>")
+		fmt.Println("        With -list, only list backups of the named target, -tag filters by tag")
+		fmt.Println("     -remotes <name,name>")
+		fmt.Println("        With -list, only list the named remotes (default lists the default remote & every named remote)")
+		fmt.Println("     -skip-local")
+		fmt.Println("        With -list, only list remote destinations")
+		fmt.Println("     -verify")
+		fmt.Println("        With -list, verify checksums & contents of local archives & repository snapshots")
+		fmt.Println("     -json")
+		fmt.Println("        With -list, output backups as json for scripts")
 		fmt.Println("\n  [SSH Key Flags]")
 		fmt.Println("     -copy-key")
 		fmt.Println("        Copy public key to remote machine, must be passed with explicit remote-host & remote-user")
+		fmt.Println("     -restrict")
+		fmt.Println("        With -copy-key, installs a forced-command entry only permitting uploads into -remote-dir (or default_remote_output_dir)")
+		fmt.Println("        The dir must not be the remote home dir or an ancestor of it, hidden files within it cannot be written")
+		fmt.Println("        Requires cargoport on the remote, enabled by default with restrict_remote_keys in config")
 		fmt.Println("     -generate-keypair")
 		fmt.Println("        Generate a new set of SSH keys based on name & location defined in config")
+		fmt.Println("     -rotate-key")
+		fmt.Println("        Generate a new key, install & verify it on every configured remote, then retire the old key")
+		fmt.Println("        Old keys are archived under <ssh_key_directory>/archive/")
+		fmt.Println("\n  [Known Host Flags]")
+		fmt.Println("     -trust-host")
+		fmt.Println("        Scan remote host keys & trust them after confirming fingerprints, pass with -remote-host or -remotes")
+		fmt.Println("     -list-hosts")
+		fmt.Println("        List all trusted remote host keys & fingerprints")
+		fmt.Println("     -host-fingerprint")
+		fmt.Println("        Compare trusted & currently presented host key fingerprints, pass with -remote-host or -remotes")
+		fmt.Println("     -revoke-host")
+		fmt.Println("        Revoke trusted host keys, pass with -remote-host or -remotes")
+		fmt.Println("     -yes")
+		fmt.Println("        Skip interactive confirmation prompts")
 		fmt.Println("\n  [Main Backup Flags]")
 		fmt.Println("      [Target Selection Flags]")
 		fmt.Println("        -target-dir <dir>")
 		fmt.Println("           Target directory to back up (detects if the directory is a Docker environment)")
+		fmt.Println("        -discover")
+		fmt.Println("           Discover compose projects via container labels & discover.scan_roots, backing up every project not excluded")
+		fmt.Println("        -dry-run")
+		fmt.Println("           With -discover, only list discovered projects & their status")
 		fmt.Println("        -docker-name <name>")
 		fmt.Println("           Target Docker service name (involves all Docker containers defined in the compose file)")
+		fmt.Println("           Plain `docker run` containers are backed up as a generated compose stack including their mounts")
 		fmt.Println("\n    [Extra Job Flags]")
 		fmt.Println("        -output-dir <dir>")
 		fmt.Println("           Custom destination for local output")
@@ -97,28 +191,72 @@ func main() {
 		fmt.Println("           Restart docker container after successful backup. Enabled by default")
 		fmt.Println("        -tag <tag>")
 		fmt.Println("           Append identifying tag to output file name (e.g: service1-<tag>.bak.tar.gz)")
+		fmt.Println("        -stop-strategy <down|stop|pause>")
+		fmt.Println("           down removes containers & networks, stop keeps them in place, pause freezes processes (default down)")
+		fmt.Println("           Overrides the cargoport.stop-strategy compose label, which overrides docker_stop_strategy in config")
+		fmt.Println("        -format <tar|repo>")
+		fmt.Println("           tar writes a compressed tarball, repo stores a deduplicated snapshot in repo_directory (default tar)")
+		fmt.Println("           Repository snapshots are synced to remotes & cannot be combined with -stream or -skip-local")
+		fmt.Println("        -mode <full|incremental|differential>")
+		fmt.Println("           incremental archives changes since the previous backup, differential since the last full (default full)")
+		fmt.Println("           Chains start with a full backup every incremental_full_every backups, restored together by `cargoport restore`")
+		fmt.Println("        -snapshot <auto|btrfs|lvm|none>")
+		fmt.Println("           Snapshot the target dir while services are offline & restart them before archiving (default auto)")
+		fmt.Println("        -stop-services <service,service>")
+		fmt.Println("           Only stop the listed compose services (e.g: db), honouring depends_on ordering; requires stop or pause")
+		fmt.Println("        -skip-health-check")
+		fmt.Println("           Skip verifying Docker services are healthy, or running for docker_settle_seconds, after restart")
+		fmt.Println("        -embed-images")
+		fmt.Println("           Save compose images to <root>/images/ (deduplicated across jobs) & send them alongside the backup")
 		fmt.Println("\n  [Remote Transfer Flags]")
 		fmt.Println("      -skip-local")
 		fmt.Println("         Skip local backup and only send to the remote target (Note: utilized `/tmp`)")
+		fmt.Println("      -stream")
+		fmt.Println("         Stream archive directly to remote target(s) over SSH without a local tempfile (implies -skip-local)")
 		fmt.Println("      -remote-user <user>")
 		fmt.Println("         Remote machine username")
 		fmt.Println("      -remote-host <host>")
 		fmt.Println("         Remote machine IP(v4/v6) address or hostname")
+		fmt.Println("      -remote-port <port>")
+		fmt.Println("         Remote machine SSH port (defaults to default_remote_port in config, or 22)")
 		fmt.Println("      -remote-dir <dir>")
 		fmt.Println("         Remote target directory (file will save as <remote-dir>/<file>.bak.tar.gz)")
 		fmt.Println("      -remote-send-defaults")
 		fmt.Println("         Remote transfer backup using default remote values in config.yml")
+		fmt.Println("      -remotes <name,name>")
+		fmt.Println("         Send backup to one or more named remotes defined in config.yml, transfers run in parallel")
 
 		fmt.Println("\n[Examples]")
 		fmt.Println("  First time setup")
 		fmt.Println("    cargoport -setup")
-		fmt.Println("\n  Copy SSH key to remote machine")
+		fmt.Println("\n  Trust remote host key, then copy SSH key to remote machine")
+		fmt.Println("    cargoport -trust-host -remote-host <host>")
 		fmt.Println("    cargoport -copy-key -remote-host <host> -remote-user <username>")
+		fmt.Println("\n  Pull archives from every registered host on a central backup server")
+		fmt.Println("    cargoport pull")
+		fmt.Println("\n  Back up every compose project on the host, listing them first")
+		fmt.Println("    cargoport -discover -dry-run")
+		fmt.Println("    cargoport -discover -remotes=offsite")
+		fmt.Println("\n  List every backup of a target, locally & on remotes")
+		fmt.Println("    cargoport -list -target=container-name")
+		fmt.Println("    cargoport -list -remotes=offsite -json")
+		fmt.Println("\n  Pull a single file out of last week's backup on a remote")
+		fmt.Println("    cargoport inspect offsite:/srv/backups/container-name-20250614-010000.bak.tar.gz")
+		fmt.Println("    cargoport extract offsite:/srv/backups/container-name-20250614-010000.bak.tar.gz container-name/data/app.db -to /tmp/restored")
+		fmt.Println("\n  Show what changed between Monday's & Tuesday's backup")
+		fmt.Println("    cargoport diff container-name-20250616-010000.bak.tar.gz container-name-20250617-010000.bak.tar.gz")
+		fmt.Println("\n  Move a compose stack to another host, leaving the source stopped")
+		fmt.Println("    cargoport migrate -docker-name=container-name -to=offsite -restore-dir=/opt/stacks")
+		fmt.Println("\n  Store a deduplicated snapshot in the backup repository, then list its snapshots")
+		fmt.Println("    cargoport -docker-name=container-name -format=repo")
+		fmt.Println("    cargoport repo snapshots")
 		fmt.Println("\n  Perform compressive backup of target directory")
 		fmt.Println("    cargoport -target-dir=/path/to/dir -remote-user=admin -remote-host=<host>")
 		fmt.Println("\n  Perform compressive backup of target docker container(s) by service name")
 		fmt.Println("    cargoport -docker-name=container-name -remote-send-defaults -skip-local")
 		fmt.Println("    cargoport -docker-name=container-name -tag='pre-pull' -restart-docker=false")
+		fmt.Println("    cargoport -docker-name=container-name -remotes=offsite,nas")
+		fmt.Println("    cargoport -docker-name=container-name -stop-strategy=stop -stop-services=db")
 
 		fmt.Println("\nFor more information, please check out the git repo readme <3")
 	}
@@ -132,29 +270,30 @@ func main() {
 		os.Exit(0)
 	}
 
-	// validate that current UID=0/program is running as root
-	if os.Geteuid() != 0 {
-		fmt.Println("Please run Cargoport with sudo or as the root user")
-		fmt.Println("This is required to access Docker volumes, manage SSH keys, and write to system directories")
-		fmt.Println("For details and security considerations, see the GitHub README <3")
-		os.Exit(0)
-	}
-
 	// if setup flag passed
 	if *setupBool {
 		input.SetupTool()
 		os.Exit(0)
 	}
 
-	// load configfile
-	configFile, err := input.LoadConfigFile()
-	if err != nil {
-		log.Printf("Error parsing config: %v", err)
-		log.Fatalf("Perhaps consider running cargoport -setup again")
-	}
+	// load configfile & init logging
+	configFile := loadConfigAndLogging()
 
-	// init logging
-	logger.InitLogging(configFile.DefaultCargoportDir, configFile.LogLevel, configFile.LogFormat, configFile.LogTextColour)
+	// list backups rather than running a job
+	if *listBool {
+		runList(configFile, catalog.Options{
+			Target:  *listTarget,
+			Tag:     *tagOutputString,
+			Remotes: input.ParseRemoteNames(*remoteNames),
+			Local:   !*skipLocal,
+			Remote:  true,
+			Verify:  *verifyBool,
+		}, *jsonBool)
+		os.Exit(0)
+	}
+	if *listTarget != "" || *verifyBool || *jsonBool {
+		logger.Logx.Fatal("-target, -verify & -json are only supported with -list")
+	}
 
 	// build input context
 	inputCTX := &input.InputContext{
@@ -165,14 +304,53 @@ func main() {
 		SkipLocal:        *skipLocal,
 		RemoteUser:       *remoteUser,
 		RemoteHost:       *remoteHost,
+		RemotePort:       *remotePort,
 		RemoteOutputDir:  *remoteOutputDir,
 		SendDefaults:     *sendDefaults,
+		RemoteNames:      input.ParseRemoteNames(*remoteNames),
+		Stream:           *streamBool,
+		EmbedImages:      *embedImagesBool,
+		StopStrategy:     *stopStrategy,
+		SnapshotProvider: *snapshotProvider,
+		BackupMode:       *backupMode,
+		Format:           *backupFormat,
+		StopServices:     input.ParseRemoteNames(*stopServices),
+		SkipHealthCheck:  *skipHealthCheck,
+		Discover:         *discoverBool,
 		Tag:              *tagOutputString,
 		CopySSHKey:       *copySSHKeyBool,
 		GenerateSSHKey:   *newSSHKeyBool,
+		RotateSSHKey:     *rotateSSHKeyBool,
+		HostKeyAction:    hostKeyAction(*trustHostBool, *listHostsBool, *hostFingerprintBool, *revokeHostBool),
 		DefaultOutputDir: configFile.DefaultCargoportDir,
 		Config:           configFile,
 	}
+	if *dryRunBool && !*discoverBool {
+		logger.Logx.Fatal("-dry-run is only supported with -discover")
+	}
+
+	// flags passed explicitly take precedence over compose labels, which take precedence over config defaults
+	inputCTX.SetFlags = map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		inputCTX.SetFlags[f.Name] = true
+	})
+
+	// discovered projects are validated individually from the unvalidated inputs
+	baseCTX := *inputCTX
+
+	// read cargoport labels from the target stack's compose file
+	if inputCTX.DockerName != "" || inputCTX.TargetDir != "" {
+		labels, err := backup.LoadStackLabels(inputCTX)
+		if err != nil {
+			logger.LogxWithFields("fatal", fmt.Sprintf("Failure to parse cargoport compose labels: %v", err), map[string]interface{}{
+				"package": "main",
+				"target":  filepath.Base(*targetDir),
+				"success": false,
+			})
+		}
+		inputCTX.Labels = labels
+	}
+
 	// interpret flags & handle config overrides
 	if err := input.ValidateInputs(inputCTX); err != nil {
 		logger.LogxWithFields("fatal", fmt.Sprintf("Failure to parse input: %v", err), map[string]interface{}{
@@ -192,10 +370,51 @@ func main() {
 		os.Exit(0)
 	}
 
+	// rotate ssh key across every configured remote
+	if inputCTX.RotateSSHKey {
+		remotes := configFile.KeyRemotes()
+		if len(remotes) == 0 {
+			logger.Logx.Fatal("No remotes configured, nothing to rotate key across")
+		}
+		if !*assumeYes && !confirm(fmt.Sprintf("Rotate SSH key across %d remote(s)?", len(remotes))) {
+			os.Exit(0)
+		}
+		if err := util.RotateSSHKeypair(configFile.SSHKeyDir, configFile.SSHKeyName, remotes); err != nil {
+			logger.Logx.Fatalf("Failure rotating SSH key: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	// manage cargoport known_hosts
+	if inputCTX.HostKeyAction != "" {
+		if err := runHostKeyAction(inputCTX, *assumeYes); err != nil {
+			logger.Logx.Fatalf("Failure managing host keys: %v", err)
+		}
+		os.Exit(0)
+	}
+
 	// copy public key to remote machine if passed
 	if inputCTX.CopySSHKey {
 		sshPrivKeypath := filepath.Join(configFile.SSHKeyDir, configFile.SSHKeyName)
-		if err := util.CopyPublicKey(sshPrivKeypath, *remoteUser, *remoteHost); err != nil {
+
+		// restrict key to cargoport uploads into the remote output dir
+		restrictOptions := ""
+		if *restrictKeyBool || configFile.RestrictRemoteKeys {
+			allowedDir := *remoteOutputDir
+			if allowedDir == "" {
+				allowedDir = configFile.RemoteOutputDir
+			}
+			// uploads default to the home dir, which restricted keys refuse in favour of a dedicated dir
+			if allowedDir == "" {
+				allowedDir = "~"
+			}
+			if err := util.CheckRestrictedDir(allowedDir, *remoteUser); err != nil {
+				logger.Logx.Fatalf("Failure restricting SSH public key: %v", err)
+			}
+			restrictOptions = util.RestrictedKeyOptions(configFile.RemoteCargoportCommand, allowedDir)
+		}
+
+		if err := util.CopyPublicKey(sshPrivKeypath, *remoteUser, *remoteHost, inputCTX.RemotePort, restrictOptions); err != nil {
 			logger.Logx.Errorf("Failure copying SSH public key: %v", err)
 		}
 		os.Exit(0)
@@ -208,7 +427,13 @@ func main() {
 		logger.Logx.Fatalf("Key validation error: %v", err)
 	}
 
-	if err := runner.RunJob(inputCTX); err != nil {
+	// back up every discovered compose project
+	if inputCTX.Discover {
+		runDiscover(baseCTX, *dryRunBool)
+		os.Exit(0)
+	}
+
+	if _, err := runner.RunJob(inputCTX); err != nil {
 		logger.Logx.Fatalf("Failure to complete job: %v", err)
 	}
 }
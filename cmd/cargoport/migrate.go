@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/adrian-griffin/cargoport/backup"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/logger"
+	"github.com/adrian-griffin/cargoport/runner"
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// cargoport migrate -docker-name <name> -to <remote|user@host> [-clone] [-restore-dir <dir>]
+func runMigrateCommand(args []string) {
+	migrateFlags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dockerName := migrateFlags.String("docker-name", "", "Docker service of the compose stack to migrate")
+	targetDir := migrateFlags.String("target-dir", "", "Target directory to migrate, a compose project when it holds a compose file")
+	destination := migrateFlags.String("to", "", "Destination host, as a named remote from config or [user@]host")
+	remoteOutputDir := migrateFlags.String("remote-dir", "", "Directory the archive is streamed into on the destination (defaults to the remote's output dir)")
+	restoreDir := migrateFlags.String("restore-dir", "", "Directory the stack is restored into on the destination (defaults to the source target dir's parent)")
+	cloneBool := migrateFlags.Bool("clone", false, "Leave the source stack running once migrated, rather than stopped (failover)")
+	forceBool := migrateFlags.Bool("force", false, "Restore over an existing target dir on the destination")
+	tag := migrateFlags.String("tag", "migrate", "Tag appended to the migration archive's file name")
+	embedImages := migrateFlags.Bool("embed-images", false, "Send compose images along with the archive, for locally built or unpublished images")
+	stopStrategy := migrateFlags.String("stop-strategy", "", "How Docker services are taken offline for the backup: down, stop or pause (failover never pauses)")
+	skipHealthCheck := migrateFlags.Bool("skip-health-check", false, "Skip waiting for services to become healthy on the destination")
+	migrateFlags.Parse(args)
+
+	if *destination == "" || (*dockerName == "" && *targetDir == "") || migrateFlags.NArg() > 0 {
+		fmt.Println("Usage: cargoport migrate -docker-name <name>|-target-dir <dir> -to <remote|user@host> [-clone] [-restore-dir <dir>] [-force]")
+		os.Exit(1)
+	}
+	configFile := loadConfigAndLogging()
+
+	inputCTX := &input.InputContext{
+		TargetDir:        *targetDir,
+		DockerName:       *dockerName,
+		RemoteOutputDir:  *remoteOutputDir,
+		Tag:              *tag,
+		Stream:           true,
+		EmbedImages:      *embedImages,
+		StopStrategy:     *stopStrategy,
+		SkipHealthCheck:  *skipHealthCheck,
+		BackupMode:       input.BackupModeFull,
+		Format:           input.BackupFormatTar,
+		DefaultOutputDir: configFile.DefaultCargoportDir,
+		Config:           configFile,
+		SetFlags:         map[string]bool{},
+	}
+	migrateFlags.Visit(func(f *flag.Flag) {
+		inputCTX.SetFlags[f.Name] = true
+	})
+
+	// named remotes carry their own user, port & output dir, anything else is a host reached as the default remote user
+	if _, named := configFile.FindRemote(*destination); named {
+		inputCTX.RemoteNames = []string{*destination}
+	} else {
+		inputCTX.RemoteUser, inputCTX.RemoteHost = configFile.RemoteUser, *destination
+		if at := strings.LastIndex(*destination, "@"); at >= 0 {
+			inputCTX.RemoteUser, inputCTX.RemoteHost = (*destination)[:at], (*destination)[at+1:]
+		}
+	}
+
+	labels, err := backup.LoadStackLabels(inputCTX)
+	if err != nil {
+		logger.Logx.Fatalf("Failure to parse cargoport compose labels: %v", err)
+	}
+	inputCTX.Labels = labels
+	if err := input.ValidateInputs(inputCTX); err != nil {
+		logger.Logx.Fatalf("Failure to parse input: %v", err)
+	}
+
+	// the destination must receive the archive for the migration to go ahead, whatever the remote success policy
+	inputCTX.Destinations[0].Required = true
+
+	sshPrivateKeyPath := filepath.Join(configFile.SSHKeyDir, configFile.SSHKeyName)
+	if err := util.ValidateSSHPrivateKeyPerms(sshPrivateKeyPath); err != nil {
+		logger.Logx.Fatalf("Key validation error: %v", err)
+	}
+
+	opts := runner.MigrateOptions{
+		RestoreDir: *restoreDir,
+		Clone:      *cloneBool,
+		Force:      *forceBool,
+	}
+	if _, err := runner.RunMigrate(inputCTX, opts); err != nil {
+		logger.Logx.Fatalf("Failure to migrate: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/adrian-griffin/cargoport/backup"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/logger"
+	"github.com/adrian-griffin/cargoport/repo"
+	"github.com/adrian-griffin/cargoport/restore"
+)
+
+const repoUsage = "Usage: cargoport repo <snapshots|restore|prune|check> [-repo <dir>] [-password-file <file>]"
+
+// cargoport repo <snapshots|restore|prune|check>
+func runRepoCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println(repoUsage)
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "snapshots":
+		runRepoSnapshotsCommand(args[1:])
+	case "restore":
+		runRepoRestoreCommand(args[1:])
+	case "prune":
+		runRepoPruneCommand(args[1:])
+	case "check":
+		runRepoCheckCommand(args[1:])
+	default:
+		fmt.Println(repoUsage)
+		os.Exit(1)
+	}
+}
+
+// repository location flags shared by repo commands, defaulting to repo_directory & repo_password_file in config
+type repoLocation struct {
+	dir          *string
+	passwordFile *string
+}
+
+func addRepoFlags(flags *flag.FlagSet) repoLocation {
+	return repoLocation{
+		dir:          flags.String("repo", "", "Repository directory (defaults to repo_directory in config)"),
+		passwordFile: flags.String("password-file", "", "File holding the repository password (defaults to repo_password_file in config)"),
+	}
+}
+
+// opens the repository selected by flags & config, exits on failure
+func (l repoLocation) open(configFile *input.ConfigFile) *repo.Repository {
+	repoDir := *l.dir
+	if repoDir == "" {
+		repoDir = configFile.RepoDir
+	}
+	passwordFile := *l.passwordFile
+	if passwordFile == "" {
+		passwordFile = configFile.RepoPasswordFile
+	}
+	repository, err := backup.OpenRepository(repoDir, passwordFile, false)
+	if err != nil {
+		logger.Logx.Fatalf("Failure to open repository: %v", err)
+	}
+	return repository
+}
+
+// cargoport repo snapshots [-target <name>] [-json]
+func runRepoSnapshotsCommand(args []string) {
+	snapshotsFlags := flag.NewFlagSet("repo snapshots", flag.ExitOnError)
+	location := addRepoFlags(snapshotsFlags)
+	targetFilter := snapshotsFlags.String("target", "", "Only list snapshots of the named target")
+	jsonOutput := snapshotsFlags.Bool("json", false, "Output snapshots as json, without their file lists")
+	snapshotsFlags.Parse(args)
+
+	configFile := loadConfigAndLogging()
+	repository := location.open(configFile)
+
+	snapshots, err := repository.Snapshots()
+	if err != nil {
+		logger.Logx.Fatalf("Failure to list snapshots: %v", err)
+	}
+	var listed []*repo.Snapshot
+	for _, snap := range snapshots {
+		if *targetFilter == "" || snap.Target == *targetFilter {
+			snap.Files = nil
+			listed = append(listed, snap)
+		}
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(listed)
+		return
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tTIME\tHOST\tTARGET\tTAG\tSIZE\tADDED")
+	for _, snap := range listed {
+		tag := snap.Tag
+		if tag == "" {
+			tag = "-"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%.2f MB\t%.2f MB\n", snap.ID, snap.Time.Format("2006-01-02 15:04:05"), snap.Hostname, snap.Target, tag,
+			float64(snap.Size)/1024.0/1024.0, float64(snap.AddedBytes)/1024.0/1024.0)
+	}
+	writer.Flush()
+}
+
+// cargoport repo restore <snapshot> -to <dir> [-pin=false] [-load-images=false] [-up]
+func runRepoRestoreCommand(args []string) {
+	restoreFlags := flag.NewFlagSet("repo restore", flag.ExitOnError)
+	location := addRepoFlags(restoreFlags)
+	destDir := restoreFlags.String("to", "", "Directory to restore snapshot into")
+	pinImages := restoreFlags.Bool("pin", true, "Generate docker-compose.cargoport-pinned.yml pinning services to archived image digests")
+	composeUp := restoreFlags.Bool("up", false, "Bring restored compose project up once restored")
+	loadImages := restoreFlags.Bool("load-images", true, "Load embedded images missing from docker, searched in <root>/images/")
+	positional, flagArgs := splitPositionalArgs(args, 1)
+	restoreFlags.Parse(flagArgs)
+	positional = append(positional, restoreFlags.Args()...)
+
+	if len(positional) != 1 || *destDir == "" {
+		fmt.Println("Usage: cargoport repo restore <snapshot> -to <dir> [-pin=false] [-load-images=false] [-up]")
+		os.Exit(1)
+	}
+	configFile := loadConfigAndLogging()
+	repository := location.open(configFile)
+
+	opts := restore.Options{
+		DestDir:    *destDir,
+		Pin:        *pinImages,
+		Up:         *composeUp,
+		LoadImages: *loadImages,
+		ImageDirs:  []string{filepath.Join(configFile.DefaultCargoportDir, backup.ImageStoreDirName)},
+	}
+	if err := restore.RunRepoRestore(repository, positional[0], opts); err != nil {
+		logger.Logx.Fatalf("Failure to restore snapshot: %v", err)
+	}
+}
+
+// cargoport repo prune -keep-last <n> [-target <name>] [-dry-run]
+func runRepoPruneCommand(args []string) {
+	pruneFlags := flag.NewFlagSet("repo prune", flag.ExitOnError)
+	location := addRepoFlags(pruneFlags)
+	keepLast := pruneFlags.Int("keep-last", 0, "Snapshots kept per host, target & tag (defaults to repo_keep_last in config)")
+	targetFilter := pruneFlags.String("target", "", "Only prune snapshots of the named target")
+	dryRun := pruneFlags.Bool("dry-run", false, "List snapshots & chunks which would be removed without removing them")
+	pruneFlags.Parse(args)
+
+	configFile := loadConfigAndLogging()
+	if *keepLast == 0 {
+		*keepLast = configFile.RepoKeepLast
+	}
+	if *keepLast <= 0 {
+		fmt.Println("Usage: cargoport repo prune -keep-last <n> [-target <name>] [-dry-run]")
+		os.Exit(1)
+	}
+	repository := location.open(configFile)
+
+	result, err := repository.Prune(*keepLast, *targetFilter, *dryRun)
+	if err != nil {
+		logger.Logx.Fatalf("Failure to prune repository: %v", err)
+	}
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	for _, snap := range result.Removed {
+		fmt.Printf("%s snapshot %s  %s  %s\n", verb, snap.ID, snap.Time.Format("2006-01-02 15:04:05"), snap.Target)
+	}
+	fmt.Printf("%s %d snapshot(s) & %d unreferenced chunk(s), freeing %.2f MB\n", verb, len(result.Removed), result.Chunks, float64(result.FreedBytes)/1024.0/1024.0)
+}
+
+// cargoport repo check [-read-data]
+func runRepoCheckCommand(args []string) {
+	checkFlags := flag.NewFlagSet("repo check", flag.ExitOnError)
+	location := addRepoFlags(checkFlags)
+	readData := checkFlags.Bool("read-data", false, "Read & verify the content of every referenced chunk, rather than only that it exists")
+	checkFlags.Parse(args)
+
+	configFile := loadConfigAndLogging()
+	repository := location.open(configFile)
+
+	result, err := repository.Check(*readData)
+	if err != nil {
+		logger.Logx.Fatalf("Failure to check repository: %v", err)
+	}
+	for _, checkErr := range result.Errors {
+		fmt.Println("error: " + checkErr)
+	}
+	fmt.Printf("%d snapshot(s), %d referenced chunk(s), %d unreferenced chunk(s)\n", result.Snapshots, result.Chunks, result.Unreferenced)
+	if !result.OK() {
+		fmt.Printf("Repository check failed with %d error(s)\n", len(result.Errors))
+		os.Exit(1)
+	}
+	fmt.Println("Repository check passed")
+}
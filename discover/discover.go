@@ -0,0 +1,260 @@
+package discover
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/backup"
+	"github.com/adrian-griffin/cargoport/dockerapi"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/logger"
+	"github.com/adrian-griffin/cargoport/schedule"
+)
+
+// project statuses, derived from the containers compose created for a project
+const (
+	StatusRunning = "running" // every container running
+	StatusPartial = "partial" // some containers running
+	StatusStopped = "stopped" // containers exist but none are running
+	StatusAbsent  = "absent"  // no containers exist
+	StatusMissing = "missing" // containers exist but their compose file is gone
+)
+
+// compose project found on the host
+type Project struct {
+	Name        string `json:"name"`
+	Dir         string `json:"dir"`
+	ComposeFile string `json:"compose_file"`
+	Source      string `json:"source"` // 'labels', 'scan' or 'labels+scan'
+	Status      string `json:"status"`
+	Running     int    `json:"running"`
+	Containers  int    `json:"containers"`
+	Excluded    bool   `json:"excluded"`
+
+	Schedule   string    `json:"schedule,omitempty"`    // cron expression from labels or config overrides
+	Due        bool      `json:"due"`                   // always true for unscheduled projects
+	LastBackup time.Time `json:"last_backup,omitempty"` // latest successful backup in the history ledger
+	Error      string    `json:"error,omitempty"`       // invalid cargoport labels, the project is not backed up
+
+	Labels *input.StackLabels `json:"-"`
+}
+
+// finds compose projects via container labels & configured scan roots, sorted by name
+func FindProjects(cfg *input.ConfigFile) ([]Project, error) {
+	projects := make(map[string]*Project) // keyed by project dir
+
+	client, err := dockerapi.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := client.ListContainers([]string{dockerapi.LabelComposeProject}, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list compose containers: %v", err)
+	}
+
+	// label discovery, containers of every project known to the engine
+	if !cfg.Discover.SkipLabels {
+		for _, container := range containers {
+			composeFile, err := backup.ComposeFileFromLabels(container.ID, container.Labels)
+			if err != nil {
+				continue
+			}
+			dir := filepath.Dir(composeFile)
+			if _, found := projects[dir]; !found {
+				projects[dir] = &Project{
+					Name:        container.Labels[dockerapi.LabelComposeProject],
+					Dir:         dir,
+					ComposeFile: composeFile,
+					Source:      "labels",
+				}
+			}
+		}
+	}
+
+	// scan discovery, projects which may have never been started
+	for _, root := range cfg.Discover.ScanRoots {
+		composeFiles, err := scanRoot(root, cfg.Discover.ScanDepth, cfg.DefaultCargoportDir)
+		if err != nil {
+			logger.LogxWithFields("warn", fmt.Sprintf("Failed to scan %s for compose projects: %v", root, err), map[string]interface{}{
+				"package": "discover",
+			})
+			continue
+		}
+		for _, composeFile := range composeFiles {
+			dir := filepath.Dir(composeFile)
+			if project, found := projects[dir]; found {
+				project.Source = "labels+scan"
+				continue
+			}
+			projects[dir] = &Project{
+				Name:        projectName(composeFile),
+				Dir:         dir,
+				ComposeFile: composeFile,
+				Source:      "scan",
+			}
+		}
+	}
+
+	// latest successful backup per target, used to determine whether scheduled projects are due
+	ledger, err := job.ReadLedger(cfg.DefaultCargoportDir)
+	if err != nil {
+		logger.LogxWithFields("warn", fmt.Sprintf("Failed to read history ledger, scheduled projects are treated as due: %v", err), map[string]interface{}{
+			"package": "discover",
+		})
+	}
+	lastBackups := map[string]time.Time{}
+	for _, entry := range ledger {
+		if entry.Kind == "backup" && entry.Success && entry.Time.After(lastBackups[entry.Target]) {
+			lastBackups[entry.Target] = entry.Time
+		}
+	}
+	now := time.Now()
+
+	// container counts & status per project
+	var found []Project
+	for _, project := range projects {
+		for _, container := range containers {
+			// containers are matched by working dir, falling back to project name when compose did not record it
+			if workingDir := container.Labels[dockerapi.LabelComposeWorkingDir]; workingDir != "" && workingDir != project.Dir {
+				continue
+			} else if workingDir == "" && container.Labels[dockerapi.LabelComposeProject] != project.Name {
+				continue
+			}
+			project.Containers++
+			if container.State == "running" {
+				project.Running++
+			}
+		}
+		project.Status = projectStatus(project)
+		project.Excluded = isExcluded(cfg.Discover.Exclude, project)
+		if project.Status != StatusMissing {
+			applyProjectLabels(cfg, client, project)
+		}
+		project.LastBackup = lastBackups[filepath.Base(project.Dir)]
+		project.Due = isDue(project, now)
+		found = append(found, *project)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Name != found[j].Name {
+			return found[i].Name < found[j].Name
+		}
+		return found[i].Dir < found[j].Dir
+	})
+	return found, nil
+}
+
+// walks root up to depth directory levels, returning the preferred compose file of each directory holding one
+// hidden directories & the cargoport root are skipped
+func scanRoot(root string, depth int, cargoportDir string) ([]string, error) {
+	root = filepath.Clean(root)
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("scan root %s is not a directory", root)
+	}
+
+	var composeFiles []string
+	err := filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			// unreadable directories are skipped rather than aborting the scan
+			if entry != nil && entry.IsDir() && path != root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if path != root && (strings.HasPrefix(entry.Name(), ".") || path == filepath.Clean(cargoportDir)) {
+			return filepath.SkipDir
+		}
+		if composeFile := backup.FindComposeFileInDir(path); composeFile != "" {
+			composeFiles = append(composeFiles, composeFile)
+			// nested directories of a project belong to it
+			return filepath.SkipDir
+		}
+		relative, _ := filepath.Rel(root, path)
+		if relative != "." && strings.Count(relative, string(filepath.Separator))+1 >= depth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return composeFiles, err
+}
+
+// returns project name from the compose file's `name`, defaulting to its directory as compose does
+func projectName(composeFile string) string {
+	if name := backup.ComposeProjectName(composeFile); name != "" {
+		return name
+	}
+	return strings.ToLower(filepath.Base(filepath.Dir(composeFile)))
+}
+
+func projectStatus(project *Project) string {
+	if _, err := os.Stat(project.ComposeFile); err != nil {
+		return StatusMissing
+	}
+	switch {
+	case project.Containers == 0:
+		return StatusAbsent
+	case project.Running == project.Containers:
+		return StatusRunning
+	case project.Running > 0:
+		return StatusPartial
+	}
+	return StatusStopped
+}
+
+// reports whether project matches an exclusion by name, name glob or directory
+func isExcluded(exclusions []string, project *Project) bool {
+	for _, exclusion := range exclusions {
+		if filepath.IsAbs(exclusion) {
+			if filepath.Clean(exclusion) == project.Dir {
+				return true
+			}
+			continue
+		}
+		if matched, _ := filepath.Match(exclusion, project.Name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// reads the project's cargoport labels, which take precedence over discovery config
+// cargoport.enable overrides discover.exclude & cargoport.schedule the project's configured schedule
+func applyProjectLabels(cfg *input.ConfigFile, client dockerapi.Client, project *Project) {
+	if overrides, ok := cfg.Discover.FindProject(project.Name); ok {
+		project.Schedule = overrides.Schedule
+	}
+	labels, err := backup.ReadStackLabels(client, project.ComposeFile)
+	if err != nil {
+		project.Error = err.Error()
+		return
+	}
+	if labels == nil {
+		return
+	}
+	project.Labels = labels
+	if labels.Enable != nil {
+		project.Excluded = !*labels.Enable
+	}
+	if labels.Schedule != "" {
+		project.Schedule = labels.Schedule
+	}
+}
+
+// reports whether project's schedule fired since its last successful backup, unscheduled projects are always due
+func isDue(project *Project, now time.Time) bool {
+	if project.Schedule == "" {
+		return true
+	}
+	cron, err := schedule.Parse(project.Schedule)
+	if err != nil {
+		return false
+	}
+	return cron.Due(project.LastBackup, now)
+}
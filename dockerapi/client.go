@@ -0,0 +1,451 @@
+package dockerapi
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// compose labels set by docker compose on every container it creates
+const (
+	LabelComposeProject     = "com.docker.compose.project"
+	LabelComposeService     = "com.docker.compose.service"
+	LabelComposeWorkingDir  = "com.docker.compose.project.working_dir"
+	LabelComposeConfigFiles = "com.docker.compose.project.config_files"
+)
+
+// default timeout for engine requests which do not wait on containers
+const defaultRequestTimeout = 30 * time.Second
+
+// returned when the engine responds with 404 for a container or image
+var ErrNotFound = errors.New("not found")
+
+// docker engine operations used by cargoport, implemented over the engine api & by fakes in tests
+type Client interface {
+	// lists containers matching label filters (`key` or `key=value`), including stopped containers when all is set
+	ListContainers(labels []string, all bool) ([]Container, error)
+	InspectContainer(nameOrID string) (*ContainerDetails, error)
+	InspectImage(nameOrID string) (*Image, error)
+	StopContainer(nameOrID string, timeout time.Duration) error
+	StartContainer(nameOrID string) error
+	// freezes container processes via the cgroup freezer
+	PauseContainer(nameOrID string) error
+	UnpauseContainer(nameOrID string) error
+	// returns the last tail lines of container stdout & stderr
+	ContainerLogs(nameOrID string, tail int) (string, error)
+	// writes a tarball of images, as `docker save` would, preserving the given names
+	SaveImage(names []string, w io.Writer) error
+	// loads a tarball produced by SaveImage, as `docker load` would
+	LoadImage(r io.Reader) error
+	// tags image with reference, defaulting to `latest` when reference has no tag
+	TagImage(nameOrID, reference string) error
+}
+
+// container summary as returned by the list endpoint
+type Container struct {
+	ID      string            `json:"Id"`
+	Names   []string          `json:"Names"`
+	Image   string            `json:"Image"`
+	ImageID string            `json:"ImageID"`
+	State   string            `json:"State"`
+	Status  string            `json:"Status"`
+	Labels  map[string]string `json:"Labels"`
+	Mounts  []Mount           `json:"Mounts"`
+}
+
+// volume or bind mount attached to a container
+type Mount struct {
+	Type        string `json:"Type"` // 'bind', 'volume', 'tmpfs'
+	Name        string `json:"Name,omitempty"`
+	Source      string `json:"Source"`
+	Destination string `json:"Destination"`
+	RW          bool   `json:"RW"`
+}
+
+// detailed container state as returned by the inspect endpoint
+type ContainerDetails struct {
+	ID    string `json:"Id"`
+	Name  string `json:"Name"`
+	Image string `json:"Image"` // image id the container was created from
+	State struct {
+		Status     string `json:"Status"`
+		Running    bool   `json:"Running"`
+		Paused     bool   `json:"Paused"`
+		Restarting bool   `json:"Restarting"`
+		ExitCode   int    `json:"ExitCode"`
+		StartedAt  string `json:"StartedAt"`
+		Health     *struct {
+			Status string `json:"Status"`
+		} `json:"Health,omitempty"`
+	} `json:"State"`
+	Config struct {
+		Image      string            `json:"Image"` // image reference as configured
+		Labels     map[string]string `json:"Labels"`
+		Env        []string          `json:"Env"`
+		Cmd        []string          `json:"Cmd"`
+		Entrypoint []string          `json:"Entrypoint"`
+		User       string            `json:"User"`
+		WorkingDir string            `json:"WorkingDir"`
+		Hostname   string            `json:"Hostname"`
+		Tty        bool              `json:"Tty"`
+		OpenStdin  bool              `json:"OpenStdin"`
+	} `json:"Config"`
+	HostConfig struct {
+		NetworkMode   string                   `json:"NetworkMode"`
+		PortBindings  map[string][]PortBinding `json:"PortBindings"`
+		RestartPolicy struct {
+			Name              string `json:"Name"`
+			MaximumRetryCount int    `json:"MaximumRetryCount"`
+		} `json:"RestartPolicy"`
+		AutoRemove bool     `json:"AutoRemove"`
+		Privileged bool     `json:"Privileged"`
+		CapAdd     []string `json:"CapAdd"`
+		CapDrop    []string `json:"CapDrop"`
+		ExtraHosts []string `json:"ExtraHosts"`
+	} `json:"HostConfig"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			Aliases []string `json:"Aliases"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+	Mounts       []Mount `json:"Mounts"`
+	RestartCount int     `json:"RestartCount"`
+
+	// undecoded inspect response, kept so the full configuration can be archived
+	Raw json.RawMessage `json:"-"`
+}
+
+// host address a container port is published on
+type PortBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string `json:"HostPort"`
+}
+
+// image metadata as returned by the inspect endpoint
+type Image struct {
+	ID           string       `json:"Id"`
+	RepoTags     []string     `json:"RepoTags"`
+	RepoDigests  []string     `json:"RepoDigests"`
+	Architecture string       `json:"Architecture"`
+	Os           string       `json:"Os"`
+	Variant      string       `json:"Variant,omitempty"`
+	Config       *ImageConfig `json:"Config,omitempty"`
+}
+
+// defaults containers inherit from their image
+type ImageConfig struct {
+	Env        []string          `json:"Env"`
+	Cmd        []string          `json:"Cmd"`
+	Entrypoint []string          `json:"Entrypoint"`
+	User       string            `json:"User"`
+	WorkingDir string            `json:"WorkingDir"`
+	Labels     map[string]string `json:"Labels"`
+}
+
+// returns first repo digest, empty for locally built images which were never pushed or pulled
+func (i *Image) Digest() string {
+	if len(i.RepoDigests) == 0 {
+		return ""
+	}
+	return i.RepoDigests[0]
+}
+
+// returns compose service name from container labels
+func (c *Container) Service() string {
+	return c.Labels[LabelComposeService]
+}
+
+// engine api client speaking http over the docker unix socket, or tcp when DOCKER_HOST requests it
+type engineClient struct {
+	httpClient *http.Client
+	baseURL    string
+}
+
+// creates engine client for DOCKER_HOST, defaulting to the local docker socket
+func NewClient() (Client, error) {
+	dockerHost := os.Getenv("DOCKER_HOST")
+
+	switch {
+	case dockerHost == "" || strings.HasPrefix(dockerHost, "unix://"):
+		socketPath := util.DockerSocketPath()
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		}
+		return &engineClient{httpClient: &http.Client{Transport: transport}, baseURL: "http://docker"}, nil
+
+	case strings.HasPrefix(dockerHost, "tcp://"):
+		return &engineClient{httpClient: &http.Client{}, baseURL: "http://" + strings.TrimPrefix(dockerHost, "tcp://")}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported DOCKER_HOST %s, only unix:// & tcp:// endpoints are supported", dockerHost)
+	}
+}
+
+// engine error response body
+type apiError struct {
+	Message string `json:"message"`
+}
+
+// performs request against engine api, decoding json response into out when set
+func (c *engineClient) do(ctx context.Context, method, path string, query url.Values, out interface{}) error {
+	requestURL := c.baseURL + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+	request, err := http.NewRequestWithContext(ctx, method, requestURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to build docker request: %v", err)
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("docker engine %s %s failed: %v", method, path, err)
+	}
+	defer response.Body.Close()
+
+	// 304 is returned when starting a running or stopping a stopped container
+	if response.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if response.StatusCode >= 400 {
+		var engineErr apiError
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+		if json.Unmarshal(body, &engineErr) != nil || engineErr.Message == "" {
+			engineErr.Message = strings.TrimSpace(string(body))
+		}
+		if response.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("docker engine %s %s: %s: %w", method, path, engineErr.Message, ErrNotFound)
+		}
+		return fmt.Errorf("docker engine %s %s: %s (status %d)", method, path, engineErr.Message, response.StatusCode)
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode docker engine response for %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *engineClient) ListContainers(labels []string, all bool) ([]Container, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	query := url.Values{}
+	if all {
+		query.Set("all", "true")
+	}
+	if len(labels) > 0 {
+		filters, err := json.Marshal(map[string][]string{"label": labels})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode container filters: %v", err)
+		}
+		query.Set("filters", string(filters))
+	}
+
+	var containers []Container
+	if err := c.do(ctx, http.MethodGet, "/containers/json", query, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+func (c *engineClient) InspectContainer(nameOrID string) (*ContainerDetails, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	var raw json.RawMessage
+	if err := c.do(ctx, http.MethodGet, "/containers/"+url.PathEscape(nameOrID)+"/json", nil, &raw); err != nil {
+		return nil, err
+	}
+	var details ContainerDetails
+	if err := json.Unmarshal(raw, &details); err != nil {
+		return nil, fmt.Errorf("failed to decode container %s: %v", nameOrID, err)
+	}
+	details.Raw = raw
+	return &details, nil
+}
+
+func (c *engineClient) InspectImage(nameOrID string) (*Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	var image Image
+	if err := c.do(ctx, http.MethodGet, "/images/"+url.PathEscape(nameOrID)+"/json", nil, &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// stops container, the engine kills it once timeout elapses
+func (c *engineClient) StopContainer(nameOrID string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+defaultRequestTimeout)
+	defer cancel()
+
+	query := url.Values{"t": []string{strconv.Itoa(int(timeout.Seconds()))}}
+	return c.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(nameOrID)+"/stop", query, nil)
+}
+
+func (c *engineClient) StartContainer(nameOrID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	return c.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(nameOrID)+"/start", nil, nil)
+}
+
+func (c *engineClient) PauseContainer(nameOrID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	return c.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(nameOrID)+"/pause", nil, nil)
+}
+
+func (c *engineClient) UnpauseContainer(nameOrID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	return c.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(nameOrID)+"/unpause", nil, nil)
+}
+
+func (c *engineClient) ContainerLogs(nameOrID string, tail int) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	query := url.Values{"stdout": []string{"1"}, "stderr": []string{"1"}, "tail": []string{strconv.Itoa(tail)}}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/containers/"+url.PathEscape(nameOrID)+"/logs?"+query.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to build docker request: %v", err)
+	}
+	response, err := c.stream(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1024*1024))
+	if err != nil {
+		return "", fmt.Errorf("failed to read logs for container %s: %v", nameOrID, err)
+	}
+	return string(demuxLogs(body)), nil
+}
+
+// strips stream headers from multiplexed log output, output of tty containers is returned as-is
+// each frame is prefixed by [stream, 0, 0, 0, size (4 bytes big endian)]
+func demuxLogs(body []byte) []byte {
+	var output []byte
+	for rest := body; len(rest) > 0; {
+		if len(rest) < 8 || rest[0] > 2 || rest[1] != 0 || rest[2] != 0 || rest[3] != 0 {
+			return body
+		}
+		size := int(binary.BigEndian.Uint32(rest[4:8]))
+		if 8+size > len(rest) {
+			return body
+		}
+		output = append(output, rest[8:8+size]...)
+		rest = rest[8+size:]
+	}
+	return output
+}
+
+func (c *engineClient) SaveImage(names []string, w io.Writer) error {
+	query := url.Values{"names": names}
+	request, err := http.NewRequest(http.MethodGet, c.baseURL+"/images/get?"+query.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to build docker request: %v", err)
+	}
+	response, err := c.stream(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if _, err := io.Copy(w, response.Body); err != nil {
+		return fmt.Errorf("failed to save images %s: %v", strings.Join(names, ", "), err)
+	}
+	return nil
+}
+
+func (c *engineClient) LoadImage(r io.Reader) error {
+	request, err := http.NewRequest(http.MethodPost, c.baseURL+"/images/load?quiet=1", r)
+	if err != nil {
+		return fmt.Errorf("failed to build docker request: %v", err)
+	}
+	request.Header.Set("Content-Type", "application/x-tar")
+	response, err := c.stream(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// load progress is a json message stream, failures are reported inline
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var message struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to decode image load response: %v", err)
+		}
+		if message.Error != "" {
+			return fmt.Errorf("failed to load image: %s", message.Error)
+		}
+	}
+}
+
+func (c *engineClient) TagImage(nameOrID, reference string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultRequestTimeout)
+	defer cancel()
+
+	repository, tag := reference, "latest"
+	if colon := strings.LastIndex(reference, ":"); colon > strings.LastIndex(reference, "/") {
+		repository, tag = reference[:colon], reference[colon+1:]
+	}
+	query := url.Values{"repo": []string{repository}, "tag": []string{tag}}
+	return c.do(ctx, http.MethodPost, "/images/"+url.PathEscape(nameOrID)+"/tag", query, nil)
+}
+
+// performs long-running request without a timeout, returning the open response on success
+func (c *engineClient) stream(request *http.Request) (*http.Response, error) {
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("docker engine %s %s failed: %v", request.Method, request.URL.Path, err)
+	}
+	if response.StatusCode >= 400 {
+		defer response.Body.Close()
+		var engineErr apiError
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+		if json.Unmarshal(body, &engineErr) != nil || engineErr.Message == "" {
+			engineErr.Message = strings.TrimSpace(string(body))
+		}
+		return nil, fmt.Errorf("docker engine %s %s: %s (status %d)", request.Method, request.URL.Path, engineErr.Message, response.StatusCode)
+	}
+	return response, nil
+}
+
+// lists every container, running or not, created by compose from working dir
+func ComposeContainers(client Client, workingDir string) ([]Container, error) {
+	return client.ListContainers([]string{fmt.Sprintf("%s=%s", LabelComposeWorkingDir, workingDir)}, true)
+}
+
+// lists every container, running or not, belonging to compose project
+func ProjectContainers(client Client, project string) ([]Container, error) {
+	return client.ListContainers([]string{fmt.Sprintf("%s=%s", LabelComposeProject, project)}, true)
+}
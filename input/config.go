@@ -4,39 +4,267 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 
+	"github.com/adrian-griffin/cargoport/schedule"
+	"github.com/adrian-griffin/cargoport/snapshot"
 	"github.com/adrian-griffin/cargoport/util"
 )
 
 type ConfigFile struct {
-	DefaultCargoportDir string `yaml:"default_cargoport_directory"`
-	DefaultOutputDir    string `yaml:"default_output_directory"`
-	SkipLocal           bool   `yaml:"skip_local_backups"`
-	RemoteUser          string `yaml:"default_remote_user"`
-	RemoteHost          string `yaml:"default_remote_host"`
-	RemoteOutputDir     string `yaml:"default_remote_output_dir"`
-	Version             string `yaml:"version,omitempty"`
-	SSHKeyDir           string `yaml:"ssh_key_directory"`
-	SSHKeyName          string `yaml:"ssh_private_key_name"`
-	ICMPTest            bool   `yaml:"icmp_test"`
-	SSHTest             bool   `yaml:"ssh_test"`
-	LogLevel            string `yaml:"log_level"`
-	LogFormat           string `yaml:"log_format"`
-	LogTextColour       bool   `yaml:"log_text_format_colouring"`
+	DefaultCargoportDir    string `yaml:"default_cargoport_directory"`
+	DefaultOutputDir       string `yaml:"default_output_directory"`
+	SkipLocal              bool   `yaml:"skip_local_backups"`
+	StreamToRemote         bool   `yaml:"stream_to_remote"`
+	EmbedImages            bool   `yaml:"embed_images"`
+	DockerStopStrategy     string `yaml:"docker_stop_strategy"`
+	DockerStopTimeout      int    `yaml:"docker_stop_timeout_seconds"`
+	DockerSkipHealthCheck  bool   `yaml:"docker_skip_health_check"`
+	DockerHealthTimeout    int    `yaml:"docker_health_timeout_seconds"`
+	DockerSettleTime       int    `yaml:"docker_settle_seconds"`
+	NotifyWebhookURL       string `yaml:"notify_webhook_url"`
+	SnapshotProvider       string `yaml:"snapshot_provider"`
+	BackupMode             string `yaml:"backup_mode"`
+	IncrementalFullEvery   int    `yaml:"incremental_full_every"`
+	IncrementalKeepChains  int    `yaml:"incremental_keep_chains"`
+	BackupFormat           string `yaml:"backup_format"`
+	RepoDir                string `yaml:"repo_directory"`
+	RepoPasswordFile       string `yaml:"repo_password_file"`
+	RepoKeepLast           int    `yaml:"repo_keep_last"`
+	RemoteUser             string `yaml:"default_remote_user"`
+	RemoteHost             string `yaml:"default_remote_host"`
+	RemotePort             int    `yaml:"default_remote_port"`
+	RemoteOutputDir        string `yaml:"default_remote_output_dir"`
+	Version                string `yaml:"version,omitempty"`
+	SSHKeyDir              string `yaml:"ssh_key_directory"`
+	SSHKeyName             string `yaml:"ssh_private_key_name"`
+	RestrictRemoteKeys     bool   `yaml:"restrict_remote_keys"`
+	RemoteCargoportCommand string `yaml:"remote_cargoport_command"`
+	ICMPTest               bool   `yaml:"icmp_test"`
+	SSHTest                bool   `yaml:"ssh_test"`
+	ProbeTimeout           int    `yaml:"probe_timeout_seconds"`
+	LogLevel               string `yaml:"log_level"`
+	LogFormat              string `yaml:"log_format"`
+	LogTextColour          bool   `yaml:"log_text_format_colouring"`
+
+	DockerStopServices []string `yaml:"docker_stop_services"`
+
+	Remotes             []RemoteConfig `yaml:"remotes"`
+	RemoteSuccessPolicy string         `yaml:"remote_success_policy"`
+
+	TransferBandwidthLimit int `yaml:"transfer_bandwidth_limit_kbps"`
+	TransferRetries        int `yaml:"transfer_retries"`
+	TransferRetryBackoff   int `yaml:"transfer_retry_backoff_seconds"`
+
+	PullHosts    []PullHostConfig `yaml:"pull_hosts"`
+	PullKeepLast int              `yaml:"pull_keep_last"`
+
+	Discover DiscoverConfig `yaml:"discover"`
+}
+
+// compose project discovery settings for -discover
+type DiscoverConfig struct {
+	SkipLabels bool                    `yaml:"skip_label_discovery"` // skip finding projects via compose container labels
+	ScanRoots  []string                `yaml:"scan_roots"`           // directories scanned for compose files
+	ScanDepth  int                     `yaml:"scan_depth"`           // directory levels below each scan root searched
+	Exclude    []string                `yaml:"exclude"`              // project names, globs or directories never backed up
+	Projects   []DiscoverProjectConfig `yaml:"projects"`
+}
+
+// per-project overrides applied to discovered projects
+type DiscoverProjectConfig struct {
+	Name            string   `yaml:"name"`
+	Tag             string   `yaml:"tag"`
+	Remotes         []string `yaml:"remotes"`
+	StopStrategy    string   `yaml:"stop_strategy"`
+	StopServices    []string `yaml:"stop_services"`
+	EmbedImages     bool     `yaml:"embed_images"`
+	SkipHealthCheck bool     `yaml:"skip_health_check"`
+	Schedule        string   `yaml:"schedule"` // cron expression, overridden by the cargoport.schedule label
+}
+
+// returns discovery overrides for project name
+func (d *DiscoverConfig) FindProject(name string) (*DiscoverProjectConfig, bool) {
+	for i := range d.Projects {
+		if d.Projects[i].Name == name {
+			return &d.Projects[i], true
+		}
+	}
+	return nil, false
+}
+
+// named remote destination defined in configfile
+type RemoteConfig struct {
+	Name      string `yaml:"name"`
+	User      string `yaml:"user"`
+	Host      string `yaml:"host"`
+	Port      int    `yaml:"port"`
+	OutputDir string `yaml:"output_dir"`
+	Required  bool   `yaml:"required"`
+
+	BandwidthLimit int `yaml:"bandwidth_limit_kbps"`
+}
+
+// registered host for pull mode, fetched centrally by a backup server
+type PullHostConfig struct {
+	Name             string             `yaml:"name"`
+	User             string             `yaml:"user"`
+	Host             string             `yaml:"host"`
+	Port             int                `yaml:"port"`
+	Mode             string             `yaml:"mode"`              // 'job' or 'stream'
+	CargoportCommand string             `yaml:"cargoport_command"` // command used to invoke cargoport on the host in job mode
+	KeepLast         int                `yaml:"keep_last"`
+	Targets          []PullTargetConfig `yaml:"targets"`
+}
+
+// single target fetched from a pull host
+type PullTargetConfig struct {
+	DockerName string `yaml:"docker_name"`
+	TargetDir  string `yaml:"target_dir"`
+	Tag        string `yaml:"tag"`
+}
+
+// pull modes
+const (
+	PullModeJob    = "job"    // trigger a cargoport job on the host & fetch its archive
+	PullModeStream = "stream" // stream tar of the target directory directly from the host
+)
+
+// builds connectivity probe options for a remote from configfile settings
+func (c *ConfigFile) ProbeOptions(remoteUser string, remotePort int) util.ProbeOptions {
+	return util.ProbeOptions{
+		User:           remoteUser,
+		Port:           remotePort,
+		Timeout:        time.Duration(c.ProbeTimeout) * time.Second,
+		SSHHandshake:   c.SSHTest,
+		PrivateKeyPath: filepath.Join(c.SSHKeyDir, c.SSHKeyName),
+		KnownHostsFile: util.KnownHostsPath(c.SSHKeyDir),
+		ICMP:           c.ICMPTest,
+	}
+}
+
+// remote success policies, determines whether partial transfer success counts as job success
+const (
+	RemotePolicyAll      = "all"      // every destination must succeed
+	RemotePolicyAny      = "any"      // at least one destination must succeed
+	RemotePolicyRequired = "required" // every destination marked `required` must succeed
+)
+
+// docker stop strategies, determines how compose services are taken offline during backups
+const (
+	StopStrategyDown  = "down"  // remove containers & networks with `docker compose down`
+	StopStrategyStop  = "stop"  // stop containers, keeping containers & networks in place
+	StopStrategyPause = "pause" // freeze container processes without stopping them
+)
+
+// backup modes, incremental & differential archives chain to the last full backup of their target
+const (
+	BackupModeFull         = "full"         // archive everything, replacing the previous archive
+	BackupModeIncremental  = "incremental"  // archive changes since the previous backup in the chain
+	BackupModeDifferential = "differential" // archive changes since the chain's full backup
+)
+
+// backup formats, selected per job
+const (
+	BackupFormatTar  = "tar"  // compressed tarball per backup
+	BackupFormatRepo = "repo" // snapshot in a deduplicating chunk repository
+)
+
+// reports whether format is a known backup format
+func ValidBackupFormat(format string) bool {
+	return format == BackupFormatTar || format == BackupFormatRepo
+}
+
+// reports whether mode is a known backup mode
+func ValidBackupMode(mode string) bool {
+	switch mode {
+	case BackupModeFull, BackupModeIncremental, BackupModeDifferential:
+		return true
+	}
+	return false
+}
+
+// reports whether strategy is a known docker stop strategy
+func ValidStopStrategy(strategy string) bool {
+	switch strategy {
+	case StopStrategyDown, StopStrategyStop, StopStrategyPause:
+		return true
+	}
+	return false
+}
+
+// returns named remote from configfile
+func (c *ConfigFile) FindRemote(name string) (*RemoteConfig, bool) {
+	for i := range c.Remotes {
+		if c.Remotes[i].Name == name {
+			return &c.Remotes[i], true
+		}
+	}
+	return nil, false
+}
+
+// returns every distinct remote authenticated with the cargoport key (default remote, named remotes & pull hosts)
+func (c *ConfigFile) KeyRemotes() []util.SSHRemote {
+	var remotes []util.SSHRemote
+	seen := make(map[string]bool)
+	addRemote := func(name, user, host string, port int) {
+		if user == "" || host == "" {
+			return
+		}
+		if port == 0 {
+			port = c.RemotePort
+		}
+		key := fmt.Sprintf("%s@%s:%d", user, host, port)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		remotes = append(remotes, util.SSHRemote{Name: name, User: user, Host: host, Port: port})
+	}
+
+	addRemote(c.RemoteHost, c.RemoteUser, c.RemoteHost, c.RemotePort)
+	for _, remote := range c.Remotes {
+		addRemote(remote.Name, remote.User, remote.Host, remote.Port)
+	}
+	for _, pullHost := range c.PullHosts {
+		addRemote(pullHost.Name, pullHost.User, pullHost.Host, pullHost.Port)
+	}
+	return remotes
 }
 
 // system-wide config reference path
 const ConfigFilePointer = "/etc/.cargoport-pointerfile.conf"
 
-// determines configfile path based on global pointerfile
+// per-user config reference filename, stored under the XDG config dir for non-root users
+const UserConfigFilePointerName = "pointerfile.conf"
+
+// returns config reference path for current user, root always uses the system-wide pointer
+func ConfigFilePointerPath() string {
+	if util.IsRoot() {
+		return ConfigFilePointer
+	}
+	userConfigDir, err := util.UserConfigDir()
+	if err != nil {
+		return ConfigFilePointer
+	}
+	return filepath.Join(userConfigDir, UserConfigFilePointerName)
+}
+
+// determines configfile path based on pointerfile, non-root users fall back to the system-wide pointer
 func GetConfigFilePath() (string, error) {
+	pointerPath := ConfigFilePointerPath()
+	if _, err := os.Stat(pointerPath); os.IsNotExist(err) && pointerPath != ConfigFilePointer {
+		pointerPath = ConfigFilePointer
+	}
+
 	// opens configfile pointer file to reference path to yamlfile
-	pointerFileData, err := os.ReadFile(ConfigFilePointer)
+	pointerFileData, err := os.ReadFile(pointerPath)
 	if err != nil {
-		return "", fmt.Errorf("could not read %s: %v", ConfigFilePointer, err)
+		return "", fmt.Errorf("could not read %s: %v", pointerPath, err)
 	}
 	// strings data from pointerfile and gathers path location
 	targetConfigPath := strings.TrimSpace(string(pointerFileData))
@@ -49,15 +277,9 @@ func GetConfigFilePath() (string, error) {
 // parse config file
 func LoadConfigFile() (*ConfigFile, error) {
 
-	// opens configfile pointer file to reference path to yamlfile
-	pointerFileData, err := os.ReadFile(ConfigFilePointer)
+	targetConfigPath, err := GetConfigFilePath()
 	if err != nil {
-		return nil, fmt.Errorf("could not read %s: %v", ConfigFilePointer, err)
-	}
-	// strings data from pointerfile and gathers path location
-	targetConfigPath := strings.TrimSpace(string(pointerFileData))
-	if _, err := os.Stat(targetConfigPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("config file in path %s does not exist", targetConfigPath)
+		return nil, err
 	}
 
 	// read config data from config file
@@ -109,11 +331,214 @@ func LoadConfigFile() (*ConfigFile, error) {
 		}
 	}
 
+	// validate ssh port & probe timeout
+	if config.RemotePort == 0 {
+		config.RemotePort = util.DefaultSSHPort
+	}
+	if config.RemotePort < 1 || config.RemotePort > 65535 {
+		return nil, fmt.Errorf("invalid `default_remote_port`: %d", config.RemotePort)
+	}
+	if config.ProbeTimeout <= 0 {
+		config.ProbeTimeout = 5
+	}
+
 	// error if empty default_remote_user
 	if config.RemoteUser == "" {
 		return nil, fmt.Errorf("invalid `default_remote_user` in configfile")
 	}
 
+	// validate named remotes, names must be unique & each remote must have a valid host and user
+	seenRemotes := map[string]bool{}
+	for i := range config.Remotes {
+		remote := &config.Remotes[i]
+		if remote.Name == "" {
+			return nil, fmt.Errorf("invalid `remotes` config: every remote must have a name")
+		}
+		if seenRemotes[remote.Name] {
+			return nil, fmt.Errorf("invalid `remotes` config: duplicate remote name '%s'", remote.Name)
+		}
+		seenRemotes[remote.Name] = true
+
+		if remote.User == "" || remote.Host == "" {
+			return nil, fmt.Errorf("invalid `remotes` config: remote '%s' requires both user and host", remote.Name)
+		}
+		if err := util.ValidateIP(remote.Host); err != nil {
+			return nil, fmt.Errorf("invalid `remotes` config: remote '%s': %v", remote.Name, err)
+		}
+		if remote.Port == 0 {
+			remote.Port = config.RemotePort
+		}
+		if remote.Port < 1 || remote.Port > 65535 {
+			return nil, fmt.Errorf("invalid `remotes` config: remote '%s' has invalid port %d", remote.Name, remote.Port)
+		}
+	}
+
+	// validate pull hosts
+	seenPullHosts := map[string]bool{}
+	for i := range config.PullHosts {
+		pullHost := &config.PullHosts[i]
+		if pullHost.Name == "" {
+			return nil, fmt.Errorf("invalid `pull_hosts` config: every pull host must have a name")
+		}
+		if !isPlainName(pullHost.Name) {
+			return nil, fmt.Errorf("invalid `pull_hosts` config: pull host name '%s' must not contain '/' or '..'", pullHost.Name)
+		}
+		if seenPullHosts[pullHost.Name] {
+			return nil, fmt.Errorf("invalid `pull_hosts` config: duplicate pull host name '%s'", pullHost.Name)
+		}
+		seenPullHosts[pullHost.Name] = true
+
+		if pullHost.User == "" || pullHost.Host == "" {
+			return nil, fmt.Errorf("invalid `pull_hosts` config: pull host '%s' requires both user and host", pullHost.Name)
+		}
+		if pullHost.Mode == "" {
+			pullHost.Mode = PullModeJob
+		}
+		if pullHost.Mode != PullModeJob && pullHost.Mode != PullModeStream {
+			return nil, fmt.Errorf("invalid `pull_hosts` config: pull host '%s' has invalid mode '%s'", pullHost.Name, pullHost.Mode)
+		}
+		if pullHost.Port == 0 {
+			pullHost.Port = config.RemotePort
+		}
+		if pullHost.CargoportCommand == "" {
+			pullHost.CargoportCommand = "cargoport"
+		}
+		if pullHost.KeepLast == 0 {
+			pullHost.KeepLast = config.PullKeepLast
+		}
+		for _, target := range pullHost.Targets {
+			if (target.DockerName == "") == (target.TargetDir == "") {
+				return nil, fmt.Errorf("invalid `pull_hosts` config: pull host '%s' targets require exactly one of docker_name or target_dir", pullHost.Name)
+			}
+			// pulled archives are stored under <host>/<target>-<tag>-<timestamp>
+			targetName := target.DockerName
+			if targetName == "" {
+				targetName = filepath.Base(strings.TrimSuffix(target.TargetDir, "/"))
+			}
+			if !isPlainName(targetName) || (target.Tag != "" && !isPlainName(target.Tag)) {
+				return nil, fmt.Errorf("invalid `pull_hosts` config: pull host '%s' target '%s' names must not contain '/' or '..'", pullHost.Name, targetName)
+			}
+			if pullHost.Mode == PullModeStream && target.TargetDir == "" {
+				return nil, fmt.Errorf("invalid `pull_hosts` config: pull host '%s' uses stream mode, which requires target_dir", pullHost.Name)
+			}
+		}
+	}
+
+	// validate transfer settings
+	if config.TransferBandwidthLimit < 0 {
+		return nil, fmt.Errorf("invalid `transfer_bandwidth_limit_kbps`: must not be negative")
+	}
+	if config.TransferRetries < 0 {
+		return nil, fmt.Errorf("invalid `transfer_retries`: must not be negative")
+	}
+	if config.TransferRetryBackoff <= 0 {
+		config.TransferRetryBackoff = 5
+	}
+
+	// command invoking cargoport on remotes within restricted authorized_keys entries
+	if config.RemoteCargoportCommand == "" {
+		config.RemoteCargoportCommand = "cargoport"
+	}
+
+	// validate docker stop settings
+	// warn if invalid, default to "down"
+	// validate snapshot_provider
+	// warn if invalid, default to "auto"
+	if config.SnapshotProvider == "" {
+		config.SnapshotProvider = snapshot.ProviderAuto
+	}
+	if !snapshot.ValidProvider(config.SnapshotProvider) {
+		log.Printf("invalid `snapshot_provider` supplied, defaulting to `auto`")
+		config.SnapshotProvider = snapshot.ProviderAuto
+	}
+
+	// validate backup_mode
+	// warn if invalid, default to "full"
+	if config.BackupMode == "" {
+		config.BackupMode = BackupModeFull
+	}
+	if !ValidBackupMode(config.BackupMode) {
+		log.Printf("invalid `backup_mode` supplied, defaulting to `full`")
+		config.BackupMode = BackupModeFull
+	}
+	if config.IncrementalFullEvery <= 0 {
+		config.IncrementalFullEvery = 7
+	}
+	// 0 keeps every chain, as with keep_last
+	if config.IncrementalKeepChains < 0 {
+		log.Printf("invalid `incremental_keep_chains` supplied, defaulting to 0 (keep every chain)")
+		config.IncrementalKeepChains = 0
+	}
+
+	// validate backup_format
+	// warn if invalid, default to "tar"
+	if config.BackupFormat == "" {
+		config.BackupFormat = BackupFormatTar
+	}
+	if !ValidBackupFormat(config.BackupFormat) {
+		log.Printf("invalid `backup_format` supplied, defaulting to `tar`")
+		config.BackupFormat = BackupFormatTar
+	}
+	if config.RepoDir == "" {
+		config.RepoDir = filepath.Join(config.DefaultCargoportDir, "repo")
+	}
+	if config.RepoKeepLast < 0 {
+		config.RepoKeepLast = 0
+	}
+
+	if config.DockerStopStrategy == "" {
+		config.DockerStopStrategy = StopStrategyDown
+	}
+	if !ValidStopStrategy(config.DockerStopStrategy) {
+		log.Printf("invalid `docker_stop_strategy` supplied, defaulting to `down`")
+		config.DockerStopStrategy = StopStrategyDown
+	}
+	if config.DockerStopTimeout <= 0 {
+		config.DockerStopTimeout = 10
+	}
+	if config.DockerHealthTimeout <= 0 {
+		config.DockerHealthTimeout = 120
+	}
+	if config.DockerSettleTime <= 0 {
+		config.DockerSettleTime = 10
+	}
+	if config.DockerSettleTime > config.DockerHealthTimeout {
+		return nil, fmt.Errorf("invalid `docker_settle_seconds`: must not exceed `docker_health_timeout_seconds`")
+	}
+
+	// validate discovery settings
+	if config.Discover.ScanDepth <= 0 {
+		config.Discover.ScanDepth = 2
+	}
+	for _, project := range config.Discover.Projects {
+		if project.Name == "" {
+			return nil, fmt.Errorf("invalid `discover` config: every project override must have a name")
+		}
+		if project.StopStrategy != "" && !ValidStopStrategy(project.StopStrategy) {
+			return nil, fmt.Errorf("invalid `discover` config: project '%s' has invalid stop_strategy '%s'", project.Name, project.StopStrategy)
+		}
+		if project.Schedule != "" {
+			if _, err := schedule.Parse(project.Schedule); err != nil {
+				return nil, fmt.Errorf("invalid `discover` config: project '%s': %v", project.Name, err)
+			}
+		}
+	}
+
+	// validate remote_success_policy
+	// warn if invalid, default to "all"
+	validRemotePolicies := map[string]bool{
+		RemotePolicyAll:      true,
+		RemotePolicyAny:      true,
+		RemotePolicyRequired: true,
+	}
+	if config.RemoteSuccessPolicy == "" {
+		config.RemoteSuccessPolicy = RemotePolicyAll
+	}
+	if !validRemotePolicies[config.RemoteSuccessPolicy] {
+		log.Printf("invalid `remote_success_policy` supplied, defaulting to `all`")
+		config.RemoteSuccessPolicy = RemotePolicyAll
+	}
+
 	// validate log_level
 	// warn if invalid, default to "info"
 	validLogLevels := map[string]bool{
@@ -145,7 +570,16 @@ func LoadConfigFile() (*ConfigFile, error) {
 	return &config, nil
 }
 
-// handles writes between true configfile at /etc/ an configfile reference in declared parent dir
+// handles writes between true configfile at /etc/ (or the user config dir) an configfile reference in declared parent dir
 func saveTrueConfigReference(configFilePath string) error {
-	return os.WriteFile(ConfigFilePointer, []byte(configFilePath), 0644)
+	pointerPath := ConfigFilePointerPath()
+	if err := os.MkdirAll(filepath.Dir(pointerPath), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(pointerPath), err)
+	}
+	return os.WriteFile(pointerPath, []byte(configFilePath), 0644)
+}
+
+// reports whether name can be used as a single path component
+func isPlainName(name string) bool {
+	return name != "" && name != "." && !strings.Contains(name, "..") && !strings.ContainsAny(name, `/\`)
 }
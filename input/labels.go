@@ -0,0 +1,133 @@
+package input
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/schedule"
+)
+
+// compose service labels configuring per-stack backup behaviour
+const (
+	LabelPrefix       = "cargoport."
+	LabelEnable       = "cargoport.enable"        // 'false' leaves the stack out of -discover
+	LabelExclude      = "cargoport.exclude"       // comma separated paths or globs, relative to the project dir
+	LabelStopStrategy = "cargoport.stop-strategy" // down, stop or pause
+	LabelPreHook      = "cargoport.pre-hook"      // command run inside the service's container before backup
+	LabelDump         = "cargoport.dump"          // database dump of the service taken before backup
+	LabelSchedule     = "cargoport.schedule"      // cron expression, -discover only backs the stack up when due
+)
+
+// database kinds supported by the dump label
+const (
+	DumpPostgres = "postgres"
+	DumpMySQL    = "mysql"
+	DumpMariaDB  = "mariadb"
+)
+
+// cargoport labels of a compose project, merged across its services
+// flags passed on the command line take precedence over labels, labels over configfile defaults
+type StackLabels struct {
+	Enable       *bool // nil when no service sets the label
+	Exclude      []string
+	StopStrategy string
+	Schedule     string
+	PreHooks     []job.ServiceHook
+	Dumps        []job.ServiceDump
+}
+
+// parses cargoport labels of each compose service, keyed by service name
+// stack-wide labels set on several services must agree
+func ParseStackLabels(serviceLabels map[string]map[string]string) (*StackLabels, error) {
+	labels := &StackLabels{}
+	stackValues := map[string]string{} // stack-wide label values seen so far
+	stackServices := map[string]string{}
+
+	services := make([]string, 0, len(serviceLabels))
+	for service := range serviceLabels {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	for _, service := range services {
+		for label, value := range serviceLabels[service] {
+			if !strings.HasPrefix(label, LabelPrefix) {
+				continue
+			}
+			value = strings.TrimSpace(value)
+
+			switch label {
+			case LabelEnable, LabelStopStrategy, LabelSchedule:
+				if previous, seen := stackValues[label]; seen && previous != value {
+					return nil, fmt.Errorf("label %s is '%s' on service %s but '%s' on service %s", label, previous, stackServices[label], value, service)
+				}
+				stackValues[label] = value
+				stackServices[label] = service
+			case LabelExclude:
+				for _, pattern := range strings.Split(value, ",") {
+					pattern, err := cleanExcludePattern(pattern)
+					if err != nil {
+						return nil, fmt.Errorf("invalid %s label on service %s: %v", label, service, err)
+					}
+					if pattern != "" {
+						labels.Exclude = append(labels.Exclude, pattern)
+					}
+				}
+			case LabelPreHook:
+				if value == "" {
+					return nil, fmt.Errorf("empty %s label on service %s", label, service)
+				}
+				labels.PreHooks = append(labels.PreHooks, job.ServiceHook{Service: service, Command: value})
+			case LabelDump:
+				kind := strings.ToLower(value)
+				if kind != DumpPostgres && kind != DumpMySQL && kind != DumpMariaDB {
+					return nil, fmt.Errorf("invalid %s label '%s' on service %s, must be one of postgres, mysql or mariadb", label, value, service)
+				}
+				labels.Dumps = append(labels.Dumps, job.ServiceDump{Service: service, Kind: kind})
+			default:
+				return nil, fmt.Errorf("unknown label %s on service %s", label, service)
+			}
+		}
+	}
+
+	if value, seen := stackValues[LabelEnable]; seen {
+		enable, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s label '%s', must be true or false", LabelEnable, value)
+		}
+		labels.Enable = &enable
+	}
+	if value := stackValues[LabelStopStrategy]; value != "" {
+		if !ValidStopStrategy(value) {
+			return nil, fmt.Errorf("invalid %s label '%s', must be one of down, stop or pause", LabelStopStrategy, value)
+		}
+		labels.StopStrategy = value
+	}
+	if value := stackValues[LabelSchedule]; value != "" {
+		if _, err := schedule.Parse(value); err != nil {
+			return nil, fmt.Errorf("invalid %s label: %v", LabelSchedule, err)
+		}
+		labels.Schedule = value
+	}
+	return labels, nil
+}
+
+// validates exclude pattern stays within the project dir, returning it without a leading './'
+func cleanExcludePattern(pattern string) (string, error) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" {
+		return "", nil
+	}
+	if strings.HasPrefix(pattern, "/") {
+		return "", fmt.Errorf("exclude '%s' must be relative to the project dir", pattern)
+	}
+	cleaned := path.Clean(pattern)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("exclude '%s' must be within the project dir", pattern)
+	}
+	return cleaned, nil
+}
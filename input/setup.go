@@ -57,16 +57,28 @@ func SetupTool() {
 	fmt.Println("    Thanks for trying this out!")
 	fmt.Println("                                 ")
 
+	// non-root users default to an XDG data dir they own
+	defaultRootDir := "/var/cargoport/"
+	if !util.IsRoot() {
+		userDataDir, err := util.UserDataDir()
+		if err != nil {
+			log.Fatalf("ERROR: Failed to determine user data directory: %v", err)
+		}
+		defaultRootDir = userDataDir
+		fmt.Printf("Running without root, config reference will be saved to %s\n", ConfigFilePointerPath())
+		fmt.Println(" ")
+	}
+
 	// prompt for root directory
 	var rootDir string
 	fmt.Println("Please specify the root directory for Cargoport's data & backup storage")
-	fmt.Println("Leave blank for /var/cargoport, which works in most cases")
+	fmt.Printf("Leave blank for %s, which works in most cases\n", defaultRootDir)
 	fmt.Println(" ")
-	fmt.Print("Root directory (default: /var/cargoport): ")
+	fmt.Printf("Root directory (default: %s): ", defaultRootDir)
 	fmt.Println(" ")
 	fmt.Scanln(&rootDir)
 	if rootDir == "" {
-		rootDir = "/var/cargoport/"
+		rootDir = defaultRootDir
 	}
 	fmt.Println(" ")
 	fmt.Println("------")
@@ -172,25 +184,164 @@ default_output_directory: %s/local
 ## Skip all local backups from this machine by default, requires remote flags
 skip_local_backups: false
 
+## Stream archives directly to remote targets over SSH by default, no local tempfile is written (implies skip_local_backups)
+stream_to_remote: false
+
+## Save compose images into <root>/images/ & send them alongside backups for offline restores
+## Images are stored once per image ID, so stacks sharing an image do not store it twice
+## Stored images are never pruned by retention, see the README for cleaning up images no manifest lists
+embed_images: false
+
+## How docker services are taken offline during backups
+##   down:  "docker compose down", removing containers & networks (default)
+##   stop:  stop containers, keeping containers & networks in place
+##   pause: freeze container processes, fastest to resume
+docker_stop_strategy: down
+docker_stop_timeout_seconds: 10
+
+## Only take the listed compose services offline, leaving the rest running (requires stop or pause)
+## Services are stopped & started in depends_on order
+#docker_stop_services:
+#  - db
+
+## After restart, wait for every service to report healthy (when it has a healthcheck) or to keep running for
+## docker_settle_seconds, failing the job with the last log lines of any service that does not
+docker_skip_health_check: false
+docker_health_timeout_seconds: 120
+docker_settle_seconds: 10
+
+## Snapshot the target dir while services are offline, restarting them before archiving rather than after
+##   auto:  btrfs subvolume or LVM thin volume snapshots when the target dir supports them & cargoport runs as root
+##   btrfs, lvm: always use the provider, failing the job when a snapshot cannot be taken
+##   none:  archive the live target dir, services stay offline until the archive is written
+snapshot_provider: auto
+
+## Backup mode, -mode overrides it per job
+##   full:         archive the whole target dir every time, replacing the previous archive
+##   incremental:  archive changes since the previous backup in the chain
+##   differential: archive changes since the chain's full backup
+## Chained archives are timestamped & kept side by side, a new chain starts with a full backup once a chain
+## holds incremental_full_every backups, & only the newest incremental_keep_chains chains are kept locally
+## incremental_keep_chains: 0 (or unset) keeps every chain, older chains are then never removed automatically
+backup_mode: full
+incremental_full_every: 7
+incremental_keep_chains: 2
+
+## Backup format, -format overrides it per job
+##   tar:   compressed tarball per backup
+##   repo:  snapshot in a deduplicating repository, storing only chunks not already held
+## Setting repo_password_file encrypts a new repository with the password held in that file
+backup_format: tar
+## repo_directory defaults to repo/ beneath default_cargoport_directory
+#repo_directory: /mnt/backups/cargoport-repo
+#repo_password_file: /root/.cargoport-repo-password
+## Newest snapshots kept per target in the repository after each backup, 0 keeps every snapshot
+repo_keep_last: 0
+
+## Failed jobs, including services failing to come back after a backup, are POSTed as json to this url
+#notify_webhook_url: https://hooks.example.com/cargoport
+
+# [ DISCOVERY ]
+## "cargoport -discover" backs up every compose project found via running container labels & scan_roots
+## exclude accepts project names, globs like "test-*", or absolute project directories
+## Projects with a schedule are only backed up once it fires after their last successful backup, so run
+## "cargoport -discover" from cron at least as often as the most frequent schedule
+## The cargoport.enable & cargoport.schedule compose labels take precedence over exclude & schedule here
+#discover:
+#  skip_label_discovery: false
+#  scan_roots:
+#    - /opt/docker
+#  scan_depth: 2
+#  exclude:
+#    - test-*
+#  projects:
+#    - name: vaultwarden
+#      remotes: [offsite]
+#      stop_strategy: stop
+#      stop_services: [db]
+#      embed_images: true
+#      skip_health_check: false
+#      schedule: "0 3 * * *"
+
 # [ REMOTE TRANSFER DEFAULTS]
 default_remote_user: admin
 default_remote_host: 10.0.0.1
 
 # If cargoport is also set up on the remote target machine(s), you may want to use this!
-#   Otherwise use the default ~/ output
+#   Otherwise use the default ~/ output, restricted keys (restrict_remote_keys) need a dedicated dir such as ~/cargoport
 #default_remote_output_dir: %s/remote
 default_remote_output_dir: ~/
 
+# Named remote destinations, a single job may send to several using "-remotes offsite,nas"
+# Transfers run in parallel, output_dir falls back to default_remote_output_dir
+#remotes:
+#  - name: offsite
+#    user: admin
+#    host: 10.0.0.2
+#    port: 2222
+#    output_dir: %s/remote
+#    required: true
+#  - name: nas
+#    user: backup
+#    host: nas.local
+#    bandwidth_limit_kbps: 2048
+
+# Determines whether partial remote success counts as job success
+#   'all' = every destination must succeed, 'any' = at least one must succeed
+#   'required' = every remote marked "required: true" must succeed
+# With -skip-local the local archive is kept whenever a required remote fails, whatever the policy
+remote_success_policy: all
+
+# Bandwidth cap for remote transfers in KiB/s, 0 is unlimited (remotes may override with bandwidth_limit_kbps)
+transfer_bandwidth_limit_kbps: 0
+
+# Failed transfers are retried with exponential backoff, interrupted rsync uploads resume where they left off
+# Streams are retried by archiving again, so remotes retried with -stream can hold different bytes under one name,
+# each remote's manifest describes its own copy & each remote's checksum is recorded in history.jsonl
+transfer_retries: 3
+transfer_retry_backoff_seconds: 5
+
+# [ PULL MODE ]
+# Registered hosts fetched centrally by "cargoport pull", archives are stored under %s/remote/<name>/
+#   'job' mode triggers cargoport on the host & fetches the archive, 'stream' mode streams a tar of target_dir
+#   This inverts trust, app hosts never hold credentials for the backup server
+#pull_hosts:
+#  - name: app1
+#    user: root
+#    host: 10.0.0.5
+#    mode: job
+#    cargoport_command: cargoport
+#    keep_last: 14
+#    targets:
+#      - docker_name: vaultwarden
+#      - target_dir: /srv/docker/gitea
+#        tag: nightly
+
+# Default number of pulled archives kept per host & target, 0 keeps everything
+pull_keep_last: 7
+
 # [ NETWORK SETTINGS ]
-# These tests run before every remote transfer
-# If you enable SSH tests, you will be prompted for the remote password twice until you copy the SSH key
-icmp_test: true
+# A TCP probe of each remote's SSH port runs once before every remote transfer
+# ssh_test additionally performs an in-process SSH handshake & key authentication check
+# icmp_test is an optional extra, networks dropping ICMP will not fail transfers
+icmp_test: false
 ssh_test: false
+probe_timeout_seconds: 5
+
+# SSH port used for remotes that do not define their own
+default_remote_port: 22
 
 # [ SSH KEYTOOL DEFAULTS ]
 ssh_key_directory: %s/keys
 ssh_private_key_name: cargoport-id-ed25519
 
+# Install keys on remotes as restricted forced-command entries (-copy-key), only permitting
+# cargoport uploads into the remote directory via "cargoport serve-receive", cargoport must be installed on the remote
+# Only applies to push destinations, keys used by pull hosts to trigger jobs must remain unrestricted
+# Uploads then never replace existing remote archives, so fixed archive names are only sent once
+restrict_remote_keys: false
+remote_cargoport_command: cargoport
+
 # [ LOGGING ]
 # I'd recommend debug or info for most cases
 log_level: info       # 'debug', 'info', 'warn', 'error', 'fatal'
@@ -202,7 +353,7 @@ log_format: text        # 'json' or 'text'
 # if 'text' format, logs will utilize ANSI codes for colouring
 # great for readability, but makes casual log grepping harder without using looser matches
 log_text_format_colouring: true
-`, rootDir, rootDir, rootDir, rootDir)
+`, rootDir, rootDir, rootDir, rootDir, rootDir, rootDir)
 
 	// Write default config file
 	return os.WriteFile(configFilePath, []byte(defaultConfig), 0644)
@@ -3,7 +3,9 @@ package input
 import (
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/adrian-griffin/cargoport/snapshot"
 	"github.com/adrian-griffin/cargoport/util"
 )
 
@@ -16,21 +18,145 @@ type InputContext struct {
 	SkipLocal        bool
 	RemoteUser       string
 	RemoteHost       string
+	RemotePort       int
 	RemoteOutputDir  string
 	SendDefaults     bool
 	Tag              string
 	CopySSHKey       bool
 	GenerateSSHKey   bool
+	RotateSSHKey     bool
+	HostKeyAction    string
 	RootDir          string
 	DefaultOutputDir string
+	RemoteNames      []string
+	Stream           bool
+	EmbedImages      bool
+	StopStrategy     string
+	StopServices     []string
+	SkipHealthCheck  bool
+	SnapshotProvider string
+	BackupMode       string
+	Format           string
+	Discover         bool
+
+	// cargoport compose labels of the target stack, nil when it has none
+	Labels *StackLabels
+	// flags passed on the command line, which take precedence over compose labels
+	SetFlags map[string]bool
+
+	// resolved remote destinations for the job
+	Destinations []RemoteTarget
 
 	Config *ConfigFile
 }
 
+// known host management actions
+const (
+	HostKeyActionTrust       = "trust"
+	HostKeyActionList        = "list"
+	HostKeyActionFingerprint = "fingerprint"
+	HostKeyActionRevoke      = "revoke"
+)
+
+// single resolved remote destination
+type RemoteTarget struct {
+	Name      string
+	User      string
+	Host      string
+	Port      int
+	OutputDir string
+	Required  bool
+
+	// bandwidth cap in KiB/s, 0 is unlimited
+	BandwidthLimit int
+}
+
+// splits comma separated list of remote names from cli input
+func ParseRemoteNames(remoteNames string) []string {
+	var names []string
+	for _, name := range strings.Split(remoteNames, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// builds destination list from explicit/default remote flags & named config remotes
+func ResolveDestinations(ic *InputContext) ([]RemoteTarget, error) {
+	var destinations []RemoteTarget
+	seenNames := map[string]bool{}
+	// destination names keyed by user@host:port, so one endpoint is never sent the same backup twice
+	seenEndpoints := map[string]string{}
+	addDestination := func(destination RemoteTarget) error {
+		endpoint := fmt.Sprintf("%s@%s:%d", destination.User, destination.Host, destination.Port)
+		if existing, ok := seenEndpoints[endpoint]; ok {
+			return fmt.Errorf("remote '%s' is the same destination as '%s' (%s)", destination.Name, existing, endpoint)
+		}
+		seenEndpoints[endpoint] = destination.Name
+		destinations = append(destinations, destination)
+		return nil
+	}
+
+	// explicit -remote-host/-remote-user or config defaults act as a single unnamed destination
+	if ic.RemoteHost != "" {
+		if err := addDestination(RemoteTarget{
+			Name:           ic.RemoteHost,
+			User:           ic.RemoteUser,
+			Host:           ic.RemoteHost,
+			Port:           ic.RemotePort,
+			OutputDir:      ic.RemoteOutputDir,
+			Required:       true,
+			BandwidthLimit: ic.Config.TransferBandwidthLimit,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	// named remotes from configfile
+	for _, name := range ic.RemoteNames {
+		if seenNames[name] {
+			return nil, fmt.Errorf("remote '%s' specified more than once", name)
+		}
+		seenNames[name] = true
+		remote, ok := ic.Config.FindRemote(name)
+		if !ok {
+			return nil, fmt.Errorf("remote '%s' is not defined in configfile", name)
+		}
+		outputDir := remote.OutputDir
+		if outputDir == "" {
+			outputDir = ic.Config.RemoteOutputDir
+		}
+		bandwidthLimit := remote.BandwidthLimit
+		if bandwidthLimit == 0 {
+			bandwidthLimit = ic.Config.TransferBandwidthLimit
+		}
+		if err := addDestination(RemoteTarget{
+			Name:           remote.Name,
+			User:           remote.User,
+			Host:           remote.Host,
+			Port:           remote.Port,
+			OutputDir:      outputDir,
+			Required:       remote.Required,
+			BandwidthLimit: bandwidthLimit,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return destinations, nil
+}
+
 // finalize merges config defaults and validates all input.
 func ValidateInputs(ic *InputContext) error {
 	cfg := ic.Config
 
+	// fallback to config default ssh port
+	if ic.RemotePort == 0 {
+		ic.RemotePort = cfg.RemotePort
+	}
+
 	// if ssh copykey bool then ensure both remote vars are set (explicit only)
 	if ic.CopySSHKey {
 		if ic.RemoteHost == "" || ic.RemoteUser == "" {
@@ -41,7 +167,23 @@ func ValidateInputs(ic *InputContext) error {
 		return nil
 	}
 
-	if ic.GenerateSSHKey {
+	if ic.GenerateSSHKey || ic.RotateSSHKey {
+		return nil
+	}
+
+	// known host management acts on explicit or named remotes, listing needs neither
+	if ic.HostKeyAction != "" {
+		if ic.HostKeyAction == HostKeyActionList {
+			return nil
+		}
+		if ic.RemoteHost == "" && len(ic.RemoteNames) == 0 {
+			return fmt.Errorf("-remote-host or -remotes must be specified to manage host keys")
+		}
+		destinations, err := ResolveDestinations(ic)
+		if err != nil {
+			return err
+		}
+		ic.Destinations = destinations
 		return nil
 	}
 
@@ -55,9 +197,83 @@ func ValidateInputs(ic *InputContext) error {
 		ic.RemoteOutputDir = cfg.RemoteOutputDir
 	}
 
-	// fallback to config default for skipLocal
-	if !ic.SkipLocal && cfg.SkipLocal {
-		ic.SkipLocal = true
+	// fallback to config default backup format
+	if ic.Format == "" {
+		ic.Format = cfg.BackupFormat
+	}
+	if !ValidBackupFormat(ic.Format) {
+		return fmt.Errorf("invalid -format %s, must be one of tar or repo", ic.Format)
+	}
+
+	// repositories are always kept locally, config defaults for streaming & skipping local backups only apply to tarballs
+	if ic.Format == BackupFormatRepo {
+		if ic.Stream || ic.SkipLocal {
+			return fmt.Errorf("-format repo cannot be combined with -stream or -skip-local")
+		}
+		// every snapshot is deduplicated against the whole repository, chains only apply to tarballs
+		if ic.BackupMode != "" && ic.BackupMode != BackupModeFull {
+			return fmt.Errorf("-mode %s only applies to tar backups, repository snapshots are always deduplicated", ic.BackupMode)
+		}
+		ic.BackupMode = BackupModeFull
+	} else {
+		// fallback to config default for skipLocal
+		if !ic.SkipLocal && cfg.SkipLocal {
+			ic.SkipLocal = true
+		}
+
+		// streaming never writes a local archive, implying skipLocal
+		if !ic.Stream && cfg.StreamToRemote {
+			ic.Stream = true
+		}
+		if ic.Stream {
+			ic.SkipLocal = true
+		}
+	}
+
+	// fallback to config default for embedding images
+	if !ic.EmbedImages && cfg.EmbedImages {
+		ic.EmbedImages = true
+	}
+
+	// compose labels override config defaults, but never flags passed on the command line
+	if ic.Labels != nil && ic.Labels.StopStrategy != "" && !ic.SetFlags["stop-strategy"] {
+		ic.StopStrategy = ic.Labels.StopStrategy
+	}
+
+	// fallback to config defaults for docker stop strategy & services
+	if ic.StopStrategy == "" {
+		ic.StopStrategy = cfg.DockerStopStrategy
+	}
+	if !ValidStopStrategy(ic.StopStrategy) {
+		return fmt.Errorf("invalid -stop-strategy %s, must be one of down, stop or pause", ic.StopStrategy)
+	}
+	if len(ic.StopServices) == 0 {
+		ic.StopServices = cfg.DockerStopServices
+	}
+	// compose down always acts on the whole project
+	if len(ic.StopServices) > 0 && ic.StopStrategy == StopStrategyDown {
+		return fmt.Errorf("stopping individual services requires the stop or pause strategy")
+	}
+
+	// fallback to config default backup mode
+	if ic.BackupMode == "" {
+		ic.BackupMode = cfg.BackupMode
+	}
+	if !ValidBackupMode(ic.BackupMode) {
+		return fmt.Errorf("invalid -mode %s, must be one of full, incremental or differential", ic.BackupMode)
+	}
+
+	// fallback to config default snapshot provider
+	if ic.SnapshotProvider == "" {
+		ic.SnapshotProvider = cfg.SnapshotProvider
+	}
+	if !snapshot.ValidProvider(ic.SnapshotProvider) {
+		return fmt.Errorf("invalid -snapshot %s, must be one of auto, btrfs, lvm or none", ic.SnapshotProvider)
+	}
+
+	// fallback to config default for skipping post-restart health verification
+	if !ic.SkipHealthCheck && cfg.DockerSkipHealthCheck {
+		ic.SkipHealthCheck = true
 	}
 
 	// fallback remoteOutputDir if still unset
@@ -74,8 +290,11 @@ func ValidateInputs(ic *InputContext) error {
 		ic.OutputDir = os.TempDir()
 	}
 
-	// validate target
-	if ic.TargetDir == "" && ic.DockerName == "" {
+	// validate target, discovery resolves a target per project
+	if ic.Discover && (ic.TargetDir != "" || ic.DockerName != "") {
+		return fmt.Errorf("-discover cannot be combined with -target-dir or -docker-name")
+	}
+	if ic.TargetDir == "" && ic.DockerName == "" && !ic.Discover {
 		return fmt.Errorf("must specify either -target-dir or -docker-name")
 	}
 	if ic.TargetDir != "" && ic.DockerName != "" {
@@ -89,21 +308,26 @@ func ValidateInputs(ic *InputContext) error {
 		}
 	}
 
-	// validate remote config
-	if ic.SkipLocal {
-		if ic.RemoteHost == "" || ic.RemoteUser == "" {
-			return fmt.Errorf("-skip-local requires remote-user and remote-host")
-		}
-	}
+	// connectivity probes run once per destination prior to transfer
 	if ic.RemoteHost != "" {
 		if err := util.ValidateIP(ic.RemoteHost); err != nil {
 			return fmt.Errorf("invalid remote-host: %v", err)
 		}
-		if cfg.ICMPTest {
-			if err := util.ICMPRemoteHost(ic.RemoteHost); err != nil {
-				return fmt.Errorf("ICMP test failed: %v", err)
-			}
-		}
+	}
+
+	// resolve all remote destinations for job
+	destinations, err := ResolveDestinations(ic)
+	if err != nil {
+		return err
+	}
+	ic.Destinations = destinations
+
+	// validate remote config
+	if ic.Stream && len(ic.Destinations) == 0 {
+		return fmt.Errorf("-stream requires remote-user and remote-host, or -remotes")
+	}
+	if ic.SkipLocal && len(ic.Destinations) == 0 {
+		return fmt.Errorf("-skip-local requires remote-user and remote-host, or -remotes")
 	}
 
 	return nil
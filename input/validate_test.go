@@ -0,0 +1,49 @@
+package input
+
+import "testing"
+
+func testDestinationConfig() *ConfigFile {
+	return &ConfigFile{
+		RemotePort: 2222,
+		Remotes: []RemoteConfig{
+			{Name: "offsite", User: "backup", Host: "10.0.0.2", Port: 22},
+			{Name: "10.0.0.1", User: "backup", Host: "10.0.0.3", Port: 22},
+			{Name: "offsite-alias", User: "backup", Host: "10.0.0.2", Port: 22},
+			{Name: "offsite-other-port", User: "backup", Host: "10.0.0.2", Port: 2200},
+		},
+	}
+}
+
+func TestResolveDestinationsUsesRemotePort(t *testing.T) {
+	ic := &InputContext{RemoteHost: "10.0.0.1", RemoteUser: "backup", RemotePort: 2222, Config: testDestinationConfig()}
+	destinations, err := ResolveDestinations(ic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(destinations) != 1 || destinations[0].Port != 2222 {
+		t.Errorf("destinations = %+v, want the default destination on port 2222", destinations)
+	}
+}
+
+func TestResolveDestinationsDeduplicatesEndpoints(t *testing.T) {
+	tests := []struct {
+		name        string
+		remoteHost  string
+		remoteNames []string
+		wantErr     bool
+	}{
+		// a remote named after the -remote-host value is a different destination
+		{"name matching remote host", "10.0.0.1", []string{"10.0.0.1"}, false},
+		{"same name twice", "", []string{"offsite", "offsite"}, true},
+		{"same endpoint under two names", "", []string{"offsite", "offsite-alias"}, true},
+		{"remote host matching a named remote", "10.0.0.2", []string{"offsite"}, true},
+		{"same host on another port", "", []string{"offsite", "offsite-other-port"}, false},
+	}
+	for _, test := range tests {
+		ic := &InputContext{RemoteHost: test.remoteHost, RemoteUser: "backup", RemotePort: 22, RemoteNames: test.remoteNames, Config: testDestinationConfig()}
+		_, err := ResolveDestinations(ic)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: err = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
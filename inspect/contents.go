@@ -0,0 +1,226 @@
+package inspect
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/backup"
+)
+
+// file types listed in an archive's file tree
+const (
+	FileTypeFile     = "file"
+	FileTypeDir      = "dir"
+	FileTypeSymlink  = "symlink"
+	FileTypeHardlink = "hardlink"
+	FileTypeOther    = "other"
+)
+
+// upper bound on a single captured file, larger files are listed without their content
+const maxCapturedFileSize = 4 * 1024 * 1024
+
+// single entry of an archive's file tree
+type File struct {
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Mode    string    `json:"mode"`
+	Owner   string    `json:"owner"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Link    string    `json:"link,omitempty"`
+	SHA256  string    `json:"sha256,omitempty"` // content checksum of regular files, when requested
+}
+
+// file tree & image lockfile read from an archive
+type Contents struct {
+	Files    []File
+	Lock     *backup.ImageLock // nil when the archive holds no lockfile
+	LockPath string
+	Captured map[string][]byte // content of files selected by ReadOptions.Capture
+	SHA256   string            // checksum of the compressed archive as stored
+}
+
+// selects what is read from archive contents beyond the file tree
+type ReadOptions struct {
+	Hash    bool                   // checksum the content of every regular file
+	Capture func(name string) bool // keep content of matching regular files, such as compose files
+}
+
+// streams archive through its decompressor, listing its file tree & reading its image lockfile
+// the lockfile is read from the top-level target dir, where it is written alongside the compose file
+func Read(source *Source, opts ReadOptions) (*Contents, error) {
+	stream, err := source.open()
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	rawHasher := sha256.New()
+	compression, buffered, err := backup.DetectStreamCompression(io.TeeReader(stream, rawHasher))
+	if err != nil {
+		return nil, err
+	}
+	decompressed, err := backup.Decompress(buffered, compression)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressed.Close()
+
+	contents := &Contents{Captured: map[string][]byte{}}
+	tarReader := tar.NewReader(decompressed)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("archive is corrupt after %d entries: %v", len(contents.Files), err)
+		}
+
+		file := fileFromHeader(header)
+		if file.Type == FileTypeFile {
+			if err := readContent(tarReader, &file, contents, opts); err != nil {
+				return nil, err
+			}
+		}
+		contents.Files = append(contents.Files, file)
+	}
+	if err := decompressed.Close(); err != nil {
+		return nil, fmt.Errorf("failed to decompress archive: %v", err)
+	}
+
+	// remaining padding is read so the checksum covers the whole archive
+	if _, err := io.Copy(io.Discard, buffered); err != nil {
+		return nil, fmt.Errorf("failed to read archive: %v", err)
+	}
+	if err := stream.Close(); err != nil {
+		return nil, fmt.Errorf("failed to read archive: %v", err)
+	}
+	contents.SHA256 = hex.EncodeToString(rawHasher.Sum(nil))
+	return contents, nil
+}
+
+// reads regular file content as requested, parsing the image lockfile when found
+func readContent(tarReader *tar.Reader, file *File, contents *Contents, opts ReadOptions) error {
+	isLock := path.Base(file.Path) == backup.LockFileName && strings.Count(file.Path, "/") == 1
+	capture := isLock || (opts.Capture != nil && opts.Capture(file.Path))
+
+	var captured bytes.Buffer
+	var writers []io.Writer
+	var fileHasher hash.Hash
+	if opts.Hash {
+		fileHasher = sha256.New()
+		writers = append(writers, fileHasher)
+	}
+	if capture && file.Size <= maxCapturedFileSize {
+		writers = append(writers, &captured)
+	}
+	if _, err := io.Copy(io.MultiWriter(append(writers, io.Discard)...), tarReader); err != nil {
+		return fmt.Errorf("archive is corrupt at %s: %v", file.Path, err)
+	}
+	if fileHasher != nil {
+		file.SHA256 = hex.EncodeToString(fileHasher.Sum(nil))
+	}
+	if !capture || file.Size > maxCapturedFileSize {
+		return nil
+	}
+
+	if isLock {
+		var lock backup.ImageLock
+		if err := json.Unmarshal(captured.Bytes(), &lock); err == nil {
+			contents.Lock = &lock
+			contents.LockPath = file.Path
+		}
+	}
+	if opts.Capture != nil && opts.Capture(file.Path) {
+		contents.Captured[file.Path] = captured.Bytes()
+	}
+	return nil
+}
+
+// builds file tree entry from tar header, paths are cleaned of leading ./ & trailing slashes
+func fileFromHeader(header *tar.Header) File {
+	file := File{
+		Path:    strings.TrimSuffix(strings.TrimPrefix(header.Name, "./"), "/"),
+		Mode:    fs.FileMode(header.Mode).Perm().String(),
+		Owner:   fmt.Sprintf("%d/%d", header.Uid, header.Gid),
+		Size:    header.Size,
+		ModTime: header.ModTime,
+	}
+	if header.Uname != "" || header.Gname != "" {
+		file.Owner = header.Uname + "/" + header.Gname
+	}
+
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		file.Type = FileTypeFile
+		file.Mode = "-" + file.Mode[1:]
+	case tar.TypeDir, 'D': // GNU incremental archives store directories as dumpdir entries
+		file.Type = FileTypeDir
+		file.Mode = "d" + file.Mode[1:]
+		file.Size = 0
+	case tar.TypeSymlink:
+		file.Type = FileTypeSymlink
+		file.Mode = "l" + file.Mode[1:]
+		file.Link = header.Linkname
+	case tar.TypeLink:
+		file.Type = FileTypeHardlink
+		file.Mode = "h" + file.Mode[1:]
+		file.Link = header.Linkname
+	default:
+		file.Type = FileTypeOther
+		file.Mode = "?" + file.Mode[1:]
+	}
+	return file
+}
+
+// extracts archive members matching paths into destDir, streaming through tar's decompressor
+// directories are extracted with everything beneath them, returns the checksum of the archive as read
+func Extract(source *Source, paths []string, destDir string) (string, error) {
+	stream, err := source.open()
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	rawHasher := sha256.New()
+	compression, buffered, err := backup.DetectStreamCompression(io.TeeReader(stream, rawHasher))
+	if err != nil {
+		return "", err
+	}
+
+	tarArgs := append([]string{"-x"}, backup.TarCompressionFlags(compression)...)
+	tarArgs = append(tarArgs, "-f", "-", "-C", destDir, "--")
+	for _, memberPath := range paths {
+		tarArgs = append(tarArgs, strings.TrimSuffix(strings.TrimPrefix(memberPath, "./"), "/"))
+	}
+
+	var output bytes.Buffer
+	cmd := exec.Command("tar", tarArgs...)
+	cmd.Stdin = buffered
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed to extract from %s: %s", source.Name(), strings.TrimSpace(output.String()))
+	}
+
+	// tar may stop reading before the end of the archive, the remainder is read so the checksum covers all of it
+	if _, err := io.Copy(io.Discard, buffered); err != nil {
+		return "", fmt.Errorf("failed to read archive: %v", err)
+	}
+	if err := stream.Close(); err != nil {
+		return "", fmt.Errorf("failed to read archive: %v", err)
+	}
+	return hex.EncodeToString(rawHasher.Sum(nil)), nil
+}
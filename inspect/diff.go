@@ -0,0 +1,401 @@
+package inspect
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/backup"
+)
+
+// kinds of change reported between two archives
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// manifest field differing between two archives
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// file added, removed or modified between two archives, paths are shown as in the newer archive
+type FileChange struct {
+	Path      string   `json:"path"`
+	Change    string   `json:"change"`
+	Details   []string `json:"details,omitempty"` // what changed on modified files, such as content, mode or owner
+	OldSize   int64    `json:"old_size"`
+	NewSize   int64    `json:"new_size"`
+	OldSHA256 string   `json:"old_sha256,omitempty"`
+	NewSHA256 string   `json:"new_sha256,omitempty"`
+}
+
+// compose service whose locked image differs between two archives
+type ImageChange struct {
+	Service   string   `json:"service"`
+	Change    string   `json:"change"`
+	Details   []string `json:"details,omitempty"` // image, digest, platform or build
+	OldImage  string   `json:"old_image,omitempty"`
+	NewImage  string   `json:"new_image,omitempty"`
+	OldDigest string   `json:"old_digest,omitempty"`
+	NewDigest string   `json:"new_digest,omitempty"`
+}
+
+// line diff of a compose or .env file, in unified diff format
+type TextDiff struct {
+	Path   string   `json:"path"`
+	Change string   `json:"change"`
+	Lines  []string `json:"lines,omitempty"`
+}
+
+// differences between an older & newer archive of the same target
+type Diff struct {
+	Old      string        `json:"old"`
+	New      string        `json:"new"`
+	Warnings []string      `json:"warnings,omitempty"`
+	Manifest []FieldChange `json:"manifest"`
+	Images   []ImageChange `json:"images"`
+	Files    []FileChange  `json:"files"`
+	Configs  []TextDiff    `json:"configs"`
+}
+
+// counts file changes by kind
+func (d *Diff) FileCounts() (added, removed, modified int) {
+	for _, change := range d.Files {
+		switch change.Change {
+		case ChangeAdded:
+			added++
+		case ChangeRemoved:
+			removed++
+		case ChangeModified:
+			modified++
+		}
+	}
+	return added, removed, modified
+}
+
+// archive read for comparison, with the file tree keyed by path beneath the target dir
+type diffSide struct {
+	manifest *backup.Manifest
+	contents *Contents
+	files    map[string]File
+}
+
+// compares two archives of the same target, reading file content checksums, image lockfiles,
+// compose files & .env files from both; chained archives held locally are merged with their
+// parents so the comparison covers the target as backed up, rather than only the changes each holds
+func Compare(oldSource, newSource *Source) (*Diff, error) {
+	diff := &Diff{Old: oldSource.String(), New: newSource.String()}
+
+	oldSide, err := readDiffSide(oldSource, diff)
+	if err != nil {
+		return nil, err
+	}
+	newSide, err := readDiffSide(newSource, diff)
+	if err != nil {
+		return nil, err
+	}
+
+	if oldSide.manifest != nil && newSide.manifest != nil && oldSide.manifest.Target != newSide.manifest.Target {
+		diff.Warnings = append(diff.Warnings, fmt.Sprintf("archives are of different targets, %s & %s", oldSide.manifest.Target, newSide.manifest.Target))
+	}
+	if oldSide.manifest != nil && newSide.manifest != nil && newSide.manifest.CreatedAt.Before(oldSide.manifest.CreatedAt) {
+		diff.Warnings = append(diff.Warnings, "second archive is older than the first, changes are shown from the first to the second")
+	}
+
+	diff.Manifest = compareManifests(oldSide.manifest, newSide.manifest)
+	diff.Images = compareLocks(oldSide.contents.Lock, newSide.contents.Lock)
+	diff.Files = compareFiles(oldSide.files, newSide.files)
+	diff.Configs = compareConfigs(oldSide, newSide)
+	return diff, nil
+}
+
+// reads archive for comparison, merging local chained archives with their parents back to the full backup
+func readDiffSide(source *Source, diff *Diff) (*diffSide, error) {
+	side := &diffSide{files: map[string]File{}}
+	side.manifest, _ = source.Manifest()
+	if side.manifest == nil {
+		diff.Warnings = append(diff.Warnings, fmt.Sprintf("no manifest found alongside %s, only archive contents are compared", source.Name()))
+	}
+
+	chain := []*Source{source}
+	if side.manifest != nil && side.manifest.ParentJobID != "" {
+		if source.Remote != nil {
+			diff.Warnings = append(diff.Warnings, fmt.Sprintf("%s is a remote %s archive, only files changed since its parent are compared", source.Name(), side.manifest.BackupLevel))
+		} else {
+			archives, err := backup.ResolveChain(source.Path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve backup chain of %s: %v", source.Name(), err)
+			}
+			chain = chain[:0]
+			for _, archivePath := range archives {
+				chain = append(chain, &Source{Path: archivePath})
+			}
+		}
+	}
+
+	side.contents = &Contents{Captured: map[string][]byte{}}
+	for _, archive := range chain {
+		contents, err := Read(archive, ReadOptions{Hash: true, Capture: isConfigFile})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", archive.Name(), err)
+		}
+		if manifest, err := archive.Manifest(); err == nil {
+			side.removeDeleted(manifest.Deleted)
+		}
+
+		for _, file := range contents.Files {
+			side.files[relativePath(file.Path)] = file
+		}
+		for name, content := range contents.Captured {
+			side.contents.Captured[name] = content
+		}
+		if contents.Lock != nil {
+			side.contents.Lock, side.contents.LockPath = contents.Lock, contents.LockPath
+		}
+		side.contents.SHA256 = contents.SHA256
+	}
+
+	// captured files removed later in the chain are dropped with the rest of the file tree
+	for name := range side.contents.Captured {
+		if _, found := side.files[relativePath(name)]; !found {
+			delete(side.contents.Captured, name)
+		}
+	}
+	return side, nil
+}
+
+// drops paths deleted since the parent backup, along with everything beneath them
+func (s *diffSide) removeDeleted(deleted []string) {
+	for _, deletedPath := range deleted {
+		key := relativePath(deletedPath)
+		for name := range s.files {
+			if name == key || strings.HasPrefix(name, key+"/") {
+				delete(s.files, name)
+			}
+		}
+	}
+}
+
+// path beneath the archive's top-level target dir, so archives of renamed target dirs still line up
+func relativePath(archivePath string) string {
+	if slash := strings.Index(archivePath, "/"); slash >= 0 {
+		return archivePath[slash+1:]
+	}
+	return "."
+}
+
+// compose files & .env files at the top of the target dir
+func isConfigFile(name string) bool {
+	if strings.Count(name, "/") != 1 {
+		return false
+	}
+	base := path.Base(name)
+	if strings.HasPrefix(base, ".env") {
+		return true
+	}
+	ext := path.Ext(base)
+	if ext != ".yml" && ext != ".yaml" {
+		return false
+	}
+	return strings.HasPrefix(base, "compose") || strings.HasPrefix(base, "docker-compose")
+}
+
+// lists manifest fields differing between archives, creation time & size are always listed
+func compareManifests(oldManifest, newManifest *backup.Manifest) []FieldChange {
+	changes := []FieldChange{}
+	if oldManifest == nil || newManifest == nil {
+		return changes
+	}
+
+	add := func(field, oldValue, newValue string, always bool) {
+		if always || oldValue != newValue {
+			changes = append(changes, FieldChange{Field: field, Old: oldValue, New: newValue})
+		}
+	}
+	add("created", oldManifest.CreatedAt.Local().Format(time.DateTime), newManifest.CreatedAt.Local().Format(time.DateTime), true)
+	add("size", fmt.Sprintf("%.2f MB", float64(oldManifest.SizeBytes)/1024.0/1024.0), fmt.Sprintf("%.2f MB", float64(newManifest.SizeBytes)/1024.0/1024.0), true)
+	add("job id", oldManifest.JobID, newManifest.JobID, false)
+	add("target", oldManifest.Target, newManifest.Target, false)
+	add("tag", oldManifest.Tag, newManifest.Tag, false)
+	add("target dir", oldManifest.TargetDir, newManifest.TargetDir, false)
+	add("hostname", oldManifest.Hostname, newManifest.Hostname, false)
+	add("cargoport version", oldManifest.CargoportVersion, newManifest.CargoportVersion, false)
+	add("docker", fmt.Sprint(oldManifest.Docker), fmt.Sprint(newManifest.Docker), false)
+	add("compression", oldManifest.Compression, newManifest.Compression, false)
+	add("backup level", oldManifest.BackupLevel, newManifest.BackupLevel, false)
+	add("snapshot", oldManifest.Snapshot, newManifest.Snapshot, false)
+	add("embedded images", strings.Join(oldManifest.Images, ", "), strings.Join(newManifest.Images, ", "), false)
+
+	services := map[string]bool{}
+	for service := range oldManifest.ServiceStates {
+		services[service] = true
+	}
+	for service := range newManifest.ServiceStates {
+		services[service] = true
+	}
+	for _, service := range sortedKeys(services) {
+		add("service "+service, oldManifest.ServiceStates[service], newManifest.ServiceStates[service], false)
+	}
+	return changes
+}
+
+// lists compose services whose locked image was added, removed or changed
+func compareLocks(oldLock, newLock *backup.ImageLock) []ImageChange {
+	changes := []ImageChange{}
+	oldServices, newServices := map[string]backup.ServiceLock{}, map[string]backup.ServiceLock{}
+	if oldLock != nil {
+		oldServices = oldLock.Services
+	}
+	if newLock != nil {
+		newServices = newLock.Services
+	}
+
+	services := map[string]bool{}
+	for service := range oldServices {
+		services[service] = true
+	}
+	for service := range newServices {
+		services[service] = true
+	}
+	for _, service := range sortedKeys(services) {
+		oldService, inOld := oldServices[service]
+		newService, inNew := newServices[service]
+		change := ImageChange{
+			Service:   service,
+			OldImage:  oldService.Image,
+			NewImage:  newService.Image,
+			OldDigest: oldService.Digest,
+			NewDigest: newService.Digest,
+		}
+		switch {
+		case !inOld:
+			change.Change = ChangeAdded
+		case !inNew:
+			change.Change = ChangeRemoved
+		default:
+			if oldService.Image != newService.Image {
+				change.Details = append(change.Details, "image")
+			}
+			if oldService.Digest != newService.Digest || (oldService.Digest == "" && oldService.ImageID != newService.ImageID) {
+				change.Details = append(change.Details, "digest")
+			}
+			if oldService.Platform != newService.Platform {
+				change.Details = append(change.Details, "platform")
+			}
+			if (oldService.Build == nil) != (newService.Build == nil) || (oldService.Build != nil && *oldService.Build != *newService.Build) {
+				change.Details = append(change.Details, "build")
+			}
+			if len(change.Details) == 0 {
+				continue
+			}
+			change.Change = ChangeModified
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// lists files added, removed or modified between file trees, ignoring directory timestamps
+func compareFiles(oldFiles, newFiles map[string]File) []FileChange {
+	changes := []FileChange{}
+	names := map[string]bool{}
+	for name := range oldFiles {
+		names[name] = true
+	}
+	for name := range newFiles {
+		names[name] = true
+	}
+
+	for _, name := range sortedKeys(names) {
+		oldFile, inOld := oldFiles[name]
+		newFile, inNew := newFiles[name]
+		switch {
+		case !inOld:
+			changes = append(changes, FileChange{Path: newFile.Path, Change: ChangeAdded, NewSize: newFile.Size, NewSHA256: newFile.SHA256})
+		case !inNew:
+			changes = append(changes, FileChange{Path: oldFile.Path, Change: ChangeRemoved, OldSize: oldFile.Size, OldSHA256: oldFile.SHA256})
+		default:
+			var details []string
+			if oldFile.Type != newFile.Type {
+				details = append(details, "type")
+			} else if oldFile.SHA256 != newFile.SHA256 || oldFile.Size != newFile.Size {
+				details = append(details, "content")
+			}
+			if oldFile.Link != newFile.Link {
+				details = append(details, "link")
+			}
+			if oldFile.Mode[1:] != newFile.Mode[1:] {
+				details = append(details, "mode")
+			}
+			if oldFile.Owner != newFile.Owner {
+				details = append(details, "owner")
+			}
+			if len(details) == 0 {
+				continue
+			}
+			changes = append(changes, FileChange{
+				Path:      newFile.Path,
+				Change:    ChangeModified,
+				Details:   details,
+				OldSize:   oldFile.Size,
+				NewSize:   newFile.Size,
+				OldSHA256: oldFile.SHA256,
+				NewSHA256: newFile.SHA256,
+			})
+		}
+	}
+	return changes
+}
+
+// line diffs compose & .env files differing between archives
+func compareConfigs(oldSide, newSide *diffSide) []TextDiff {
+	diffs := []TextDiff{}
+	oldConfigs, newConfigs := map[string]string{}, map[string]string{}
+	for name := range oldSide.contents.Captured {
+		oldConfigs[relativePath(name)] = name
+	}
+	for name := range newSide.contents.Captured {
+		newConfigs[relativePath(name)] = name
+	}
+	names := map[string]bool{}
+	for name := range oldConfigs {
+		names[name] = true
+	}
+	for name := range newConfigs {
+		names[name] = true
+	}
+
+	for _, name := range sortedKeys(names) {
+		oldName, inOld := oldConfigs[name]
+		newName, inNew := newConfigs[name]
+		textDiff := TextDiff{Path: newName, Change: ChangeModified}
+		switch {
+		case !inOld:
+			textDiff.Change = ChangeAdded
+		case !inNew:
+			textDiff.Path, textDiff.Change = oldName, ChangeRemoved
+		}
+		oldContent, newContent := oldSide.contents.Captured[oldName], newSide.contents.Captured[newName]
+		if inOld && inNew && string(oldContent) == string(newContent) {
+			continue
+		}
+		textDiff.Lines = unifiedDiff(splitLines(string(oldContent)), splitLines(string(newContent)), 3)
+		diffs = append(diffs, textDiff)
+	}
+	return diffs
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,139 @@
+package inspect
+
+import (
+	"fmt"
+	"strings"
+)
+
+// files with more lines than this on either side are reported as differing without a line diff
+const maxDiffLines = 2000
+
+// edit operation on a single line, ' ' for unchanged, '-' for removed & '+' for added
+type lineEdit struct {
+	op   byte
+	line string
+}
+
+// splits file content into lines, without trailing newline
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// line diff of oldLines to newLines in unified diff format, with context lines around each hunk
+func unifiedDiff(oldLines, newLines []string, context int) []string {
+	if len(oldLines) > maxDiffLines || len(newLines) > maxDiffLines {
+		return []string{fmt.Sprintf("files differ (%d & %d lines, too long to compare line by line)", len(oldLines), len(newLines))}
+	}
+	edits := diffLines(oldLines, newLines)
+
+	var output []string
+	for start := 0; start < len(edits); {
+		// skip to the next change, then extend the hunk until changes are more than 2*context lines apart
+		for start < len(edits) && edits[start].op == ' ' {
+			start++
+		}
+		if start == len(edits) {
+			break
+		}
+		end := start
+		for unchanged := 0; end < len(edits); end++ {
+			if edits[end].op != ' ' {
+				unchanged = 0
+				continue
+			}
+			if unchanged++; unchanged > 2*context {
+				end -= unchanged - 1
+				break
+			}
+		}
+		if end == len(edits) {
+			for end > start && edits[end-1].op == ' ' {
+				end--
+			}
+		}
+		hunkStart := max(start-context, 0)
+		hunkEnd := min(end+context, len(edits))
+
+		// line numbers of the hunk in old & new files, counted from the edits before it
+		oldLine, newLine := 1, 1
+		for _, edit := range edits[:hunkStart] {
+			if edit.op != '+' {
+				oldLine++
+			}
+			if edit.op != '-' {
+				newLine++
+			}
+		}
+		var oldCount, newCount int
+		var hunk []string
+		for _, edit := range edits[hunkStart:hunkEnd] {
+			if edit.op != '+' {
+				oldCount++
+			}
+			if edit.op != '-' {
+				newCount++
+			}
+			hunk = append(hunk, string(edit.op)+edit.line)
+		}
+		output = append(output, fmt.Sprintf("@@ -%s +%s @@", hunkRange(oldLine, oldCount), hunkRange(newLine, newCount)))
+		output = append(output, hunk...)
+		start = hunkEnd
+	}
+	return output
+}
+
+// line range of a hunk as shown in its header, empty ranges refer to the line before them
+func hunkRange(line, count int) string {
+	if count == 0 {
+		line--
+	}
+	if count == 1 {
+		return fmt.Sprint(line)
+	}
+	return fmt.Sprintf("%d,%d", line, count)
+}
+
+// edits turning oldLines into newLines, from the longest common subsequence of lines
+func diffLines(oldLines, newLines []string) []lineEdit {
+	// common[i][j] is the length of the longest common subsequence of oldLines[i:] & newLines[j:]
+	common := make([][]int, len(oldLines)+1)
+	for i := range common {
+		common[i] = make([]int, len(newLines)+1)
+	}
+	for i := len(oldLines) - 1; i >= 0; i-- {
+		for j := len(newLines) - 1; j >= 0; j-- {
+			if oldLines[i] == newLines[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else {
+				common[i][j] = max(common[i+1][j], common[i][j+1])
+			}
+		}
+	}
+
+	var edits []lineEdit
+	i, j := 0, 0
+	for i < len(oldLines) && j < len(newLines) {
+		switch {
+		case oldLines[i] == newLines[j]:
+			edits = append(edits, lineEdit{' ', oldLines[i]})
+			i++
+			j++
+		case common[i+1][j] >= common[i][j+1]:
+			edits = append(edits, lineEdit{'-', oldLines[i]})
+			i++
+		default:
+			edits = append(edits, lineEdit{'+', newLines[j]})
+			j++
+		}
+	}
+	for ; i < len(oldLines); i++ {
+		edits = append(edits, lineEdit{'-', oldLines[i]})
+	}
+	for ; j < len(newLines); j++ {
+		edits = append(edits, lineEdit{'+', newLines[j]})
+	}
+	return edits
+}
@@ -0,0 +1,83 @@
+package inspect
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	var numbered, renumbered []string
+	for i := 1; i <= 20; i++ {
+		numbered = append(numbered, strconv.Itoa(i))
+	}
+	renumbered = append(renumbered, numbered...)
+	renumbered[1], renumbered[17] = "two", "eighteen"
+	renumbered = append(renumbered, "x")
+
+	tests := []struct {
+		name     string
+		old, new string
+		context  int
+		want     []string
+	}{
+		{
+			name: "nearby changes share a hunk",
+			old:  "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n", new: "a\nB\nc\nd\ne\nf\ng\nH\ni\nj\n", context: 3,
+			want: strings.Split("@@ -1,10 +1,10 @@| a|-b|+B| c| d| e| f| g|-h|+H| i| j", "|"),
+		},
+		{
+			name: "changes further apart than twice the context are split",
+			old:  "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n", new: "a\nB\nc\nd\ne\nf\ng\nH\ni\nj\n", context: 2,
+			want: strings.Split("@@ -1,4 +1,4 @@| a|-b|+B| c| d|@@ -6,5 +6,5 @@| f| g|-h|+H| i| j", "|"),
+		},
+		{
+			name: "line numbers account for earlier hunks",
+			old:  strings.Join(numbered, "\n"), new: strings.Join(renumbered, "\n"), context: 3,
+			want: strings.Split("@@ -1,5 +1,5 @@| 1|-2|+two| 3| 4| 5|@@ -15,6 +15,7 @@| 15| 16| 17|-18|+eighteen| 19| 20|+x", "|"),
+		},
+		{
+			name: "added to empty file",
+			old:  "", new: "x\n", context: 3,
+			want: []string{"@@ -0,0 +1 @@", "+x"},
+		},
+		{
+			name: "single line ranges omit the count",
+			old:  "x\ny\n", new: "y\n", context: 3,
+			want: []string{"@@ -1,2 +1 @@", "-x", " y"},
+		},
+		{
+			name: "identical",
+			old:  "a\nb\n", new: "a\nb\n", context: 3,
+			want: nil,
+		},
+	}
+	for _, test := range tests {
+		got := unifiedDiff(splitLines(test.old), splitLines(test.new), test.context)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\ngot  %q\nwant %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestUnifiedDiffSkipsLongFiles(t *testing.T) {
+	long := make([]string, maxDiffLines+1)
+	got := unifiedDiff(long, []string{"x"}, 3)
+	if len(got) != 1 || !strings.Contains(got[0], "too long") {
+		t.Errorf("diff of long file = %q, want a single summary line", got)
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	if lines := splitLines(""); lines != nil {
+		t.Errorf("splitLines(\"\") = %q, want none", lines)
+	}
+	if lines, want := splitLines("a\nb\n"), []string{"a", "b"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("splitLines = %q, want %q", lines, want)
+	}
+	// a missing final newline is not a line of its own
+	if lines, want := splitLines("a\nb"), []string{"a", "b"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("splitLines = %q, want %q", lines, want)
+	}
+}
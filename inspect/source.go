@@ -0,0 +1,110 @@
+package inspect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/adrian-griffin/cargoport/backup"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// archive read from the local filesystem, or streamed from a remote host over ssh
+type Source struct {
+	Path   string              // local path, or path on the remote host
+	Remote *input.RemoteTarget // nil for local archives
+
+	cargoportKey string
+}
+
+// resolves archive argument to a local path, or to a remote archive given as
+// [user@]host:path or <remote name>:path, as shown by `cargoport -list`
+// remote archives are read with `cat` over ssh, so cannot be read through restricted keys
+func ResolveSource(configFile *input.ConfigFile, archive string) (*Source, error) {
+	source := &Source{
+		Path:         archive,
+		cargoportKey: filepath.Join(configFile.SSHKeyDir, configFile.SSHKeyName),
+	}
+
+	colon := strings.Index(archive, ":")
+	if _, err := os.Stat(archive); err == nil || colon <= 0 || strings.Contains(archive[:colon], "/") {
+		return source, nil
+	}
+
+	remotePart := archive[:colon]
+	source.Path = archive[colon+1:]
+	if source.Path == "" {
+		return nil, fmt.Errorf("remote archive %s has no path", archive)
+	}
+	remote := input.RemoteTarget{Name: remotePart, Host: remotePart, User: configFile.RemoteUser, Port: configFile.RemotePort}
+	if at := strings.LastIndex(remotePart, "@"); at >= 0 {
+		remote.User, remote.Host = remotePart[:at], remotePart[at+1:]
+	} else if named, ok := configFile.FindRemote(remotePart); ok {
+		remote.User, remote.Host = named.User, named.Host
+		if named.Port != 0 {
+			remote.Port = named.Port
+		}
+	}
+	if remote.User == "" {
+		return nil, fmt.Errorf("no user for remote archive %s, pass it as user@host:path", archive)
+	}
+	source.Remote = &remote
+	return source, nil
+}
+
+// archive file name
+func (s *Source) Name() string {
+	return path.Base(s.Path)
+}
+
+// archive location as shown to users
+func (s *Source) String() string {
+	if s.Remote == nil {
+		return s.Path
+	}
+	return fmt.Sprintf("%s@%s:%s", s.Remote.User, s.Remote.Host, s.Path)
+}
+
+// reads the archive's sidecar manifest
+func (s *Source) Manifest() (*backup.Manifest, error) {
+	if s.Remote == nil {
+		return backup.ReadManifest(s.Path)
+	}
+	output, err := util.RunCommandWithOutput("ssh", s.sshArgs("cat "+backup.RemoteShellPath(backup.ManifestPath(s.Path)))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read remote manifest: %s", strings.TrimSpace(output))
+	}
+	var manifest backup.Manifest
+	if err := json.Unmarshal([]byte(output), &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	return &manifest, nil
+}
+
+// opens the raw, still compressed archive stream
+func (s *Source) open() (io.ReadCloser, error) {
+	if s.Remote == nil {
+		archiveFile, err := os.Open(s.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open archive: %v", err)
+		}
+		return archiveFile, nil
+	}
+	if err := util.ValidateSSHPrivateKeyPerms(s.cargoportKey); err != nil {
+		return nil, fmt.Errorf("key validation error: %v", err)
+	}
+	stream, err := util.StartCommandReader(nil, "ssh", s.sshArgs("cat "+backup.RemoteShellPath(s.Path))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read remote archive: %v", err)
+	}
+	return stream, nil
+}
+
+func (s *Source) sshArgs(remoteCommand string) []string {
+	return append(util.SSHBaseOptions(s.cargoportKey, s.Remote.Port), fmt.Sprintf("%s@%s", s.Remote.User, s.Remote.Host), remoteCommand)
+}
@@ -23,6 +23,74 @@ type JobContext struct {
 	RemoteUser             string
 	CompressedSizeBytesInt int64
 	CompressedSizeMBString string
+	ArchiveSHA256          string
+	RemoteResults          []RemoteResult
+	EmbedImages            bool
+	ImageStoreDir          string
+	ImageFiles             []string // image tarballs in the image store used by this job
+	StopStrategy           string
+	StopServices           []string      // compose services to take offline, empty for the whole project
+	StopTimeout            time.Duration // grace period before stopped containers are killed
+	StoppedContainers      []StoppedContainer
+	ServiceStates          map[string]string // compose service states recorded before backup
+	HealthCheck            bool
+	HealthTimeout          time.Duration  // maximum wait for services to become healthy after restart
+	SettleTime             time.Duration  // time services without a healthcheck must stay running
+	Standalone             bool           // target is a plain `docker run` container with a generated compose file
+	ArchiveMounts          []ArchiveMount // host paths archived alongside the target dir
+	ArchiveExclude         []string       // tar exclude patterns, relative to the target dir
+	PreHooks               []ServiceHook  // commands run inside service containers before backup
+	Dumps                  []ServiceDump  // database dumps written into the target dir before backup
+	SnapshotProvider       string         // provider of the snapshot archived in place of the live target dir
+	SnapshotDir            string         // target dir within the active snapshot
+	ServicesRestored       bool           // docker services were brought back online, once per job
+	BackupLevel            string         // 'full', 'incremental' or 'differential' for chained archives, empty otherwise
+	ChainID                string         // job id of the full backup the archive chains to
+	ParentJobID            string         // job id of the archive this one holds changes against
+	IncrementalBase        string         // tar snapshot index the archive is taken against, empty for full backups
+	IncrementalIndex       string         // working copy of the index tar updates while archiving
+	DeletedPaths           []string       // archive paths removed since the parent backup
+	RepoSnapshotID         string         // snapshot recorded in the backup repository, in place of a tarball
+}
+
+// command run inside a compose service's container via `sh -c`
+type ServiceHook struct {
+	Service string
+	Command string
+}
+
+// database dump of a compose service, kind being 'postgres', 'mysql' or 'mariadb'
+type ServiceDump struct {
+	Service string
+	Kind    string
+}
+
+// host path stored in the archive beneath the target dir, used for standalone container mounts
+type ArchiveMount struct {
+	Source string // absolute host path
+	Path   string // path relative to the target dir within the archive
+}
+
+// container taken offline by the stop or pause strategy, recorded in stop order
+type StoppedContainer struct {
+	Service string
+	ID      string
+}
+
+// per-destination outcome of a remote transfer
+type RemoteResult struct {
+	Name     string        `json:"name"`
+	Host     string        `json:"host"`
+	User     string        `json:"user"`
+	Required bool          `json:"required"`
+	Success  bool          `json:"success"`
+	Error    string        `json:"error,omitempty"`
+	Attempts int           `json:"attempts"`
+	Duration time.Duration `json:"duration_ns"`
+
+	// archive as received by this destination, streams retried on a later pass hold a different archive
+	SHA256    string `json:"sha256,omitempty"`
+	SizeBytes int64  `json:"size_bytes,omitempty"`
 }
 
 func GenerateJobID() string {
@@ -0,0 +1,78 @@
+package job
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// history ledger filename, stored in cargoport root dir
+const LedgerFileName = "history.jsonl"
+
+// single job record appended to the history ledger
+type LedgerEntry struct {
+	JobID     string    `json:"job_id"`
+	Kind      string    `json:"kind"` // 'backup', 'pull' or 'migrate'
+	Time      time.Time `json:"time"`
+	Host      string    `json:"host,omitempty"`
+	Target    string    `json:"target"`
+	Tag       string    `json:"tag,omitempty"`
+	Archive   string    `json:"archive,omitempty"`
+	Snapshot  string    `json:"repo_snapshot,omitempty"` // snapshot id when archived to the backup repository
+	SizeBytes int64     `json:"size_bytes"`
+	SHA256    string    `json:"sha256,omitempty"`
+	Verified  bool      `json:"verified"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	Duration  float64   `json:"duration_seconds"`
+
+	Remotes []RemoteResult `json:"remotes,omitempty"`
+}
+
+// appends entry to the history ledger as a single json line
+func AppendLedger(rootDir string, entry LedgerEntry) error {
+	entryData, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode ledger entry: %v", err)
+	}
+
+	ledgerPath := filepath.Join(rootDir, LedgerFileName)
+	ledgerFile, err := os.OpenFile(ledgerPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open history ledger %s: %v", ledgerPath, err)
+	}
+	defer ledgerFile.Close()
+
+	if _, err := ledgerFile.Write(append(entryData, '\n')); err != nil {
+		return fmt.Errorf("failed to write history ledger %s: %v", ledgerPath, err)
+	}
+	return nil
+}
+
+// reads every entry of the history ledger, a missing ledger holds no entries
+func ReadLedger(rootDir string) ([]LedgerEntry, error) {
+	ledgerPath := filepath.Join(rootDir, LedgerFileName)
+	ledgerData, err := os.ReadFile(ledgerPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read history ledger %s: %v", ledgerPath, err)
+	}
+
+	var entries []LedgerEntry
+	for _, line := range bytes.Split(ledgerData, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry LedgerEntry
+		// a partially written line from an interrupted job is skipped rather than failing the read
+		if err := json.Unmarshal(line, &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
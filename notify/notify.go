@@ -0,0 +1,63 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// timeout for a single webhook delivery
+const webhookTimeout = 10 * time.Second
+
+// event kinds sent to webhooks
+const (
+	EventJobFailed = "job_failed"
+)
+
+// notification payload posted as json to the configured webhook
+type Event struct {
+	Event   string    `json:"event"`
+	Host    string    `json:"host"`
+	JobID   string    `json:"job_id,omitempty"`
+	Target  string    `json:"target,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// builds event for the local host
+func NewEvent(kind, jobID, target, message string) Event {
+	hostname, _ := os.Hostname()
+	return Event{
+		Event:   kind,
+		Host:    hostname,
+		JobID:   jobID,
+		Target:  target,
+		Message: message,
+		Time:    time.Now().UTC(),
+	}
+}
+
+// posts event to webhook url, a non-2xx response counts as failure
+func SendWebhook(webhookURL string, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %v", err)
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	response, err := client.Post(webhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to send notification: %v", err)
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("notification webhook responded with status %d", response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package pull
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/backup"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/logger"
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// debug level logging output fields for pull package
+func pullLogDebugFields(context *job.JobContext) map[string]interface{} {
+	coreFields := logger.CoreLogFields(context, "pull")
+	fields := logger.MergeFields(coreFields, map[string]interface{}{
+		"remote":      context.Remote,
+		"remote_host": context.RemoteHost,
+		"remote_user": context.RemoteUser,
+		"tag":         context.Tag,
+	})
+	return fields
+}
+
+// fetches archives from every registered pull host, or only from `hostFilter` when set
+func RunPull(configFile *input.ConfigFile, hostFilter string) error {
+	if len(configFile.PullHosts) == 0 {
+		return fmt.Errorf("no `pull_hosts` defined in configfile")
+	}
+
+	cargoportKey := filepath.Join(configFile.SSHKeyDir, configFile.SSHKeyName)
+	if err := util.ValidateSSHPrivateKeyPerms(cargoportKey); err != nil {
+		return fmt.Errorf("key validation error: %v", err)
+	}
+
+	matched := false
+	var failed []string
+	for _, pullHost := range configFile.PullHosts {
+		if hostFilter != "" && pullHost.Name != hostFilter {
+			continue
+		}
+		matched = true
+
+		for _, target := range pullHost.Targets {
+			if err := pullTarget(configFile, pullHost, target, cargoportKey); err != nil {
+				failed = append(failed, fmt.Sprintf("%s/%s", pullHost.Name, pullTargetName(target)))
+			}
+		}
+	}
+
+	if !matched {
+		return fmt.Errorf("pull host '%s' is not defined in configfile", hostFilter)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to pull: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// display name for pull target
+func pullTargetName(target input.PullTargetConfig) string {
+	if target.DockerName != "" {
+		return target.DockerName
+	}
+	return filepath.Base(strings.TrimSuffix(target.TargetDir, "/"))
+}
+
+// errors unless target named in a pulled manifest is a plain name matching the configured target
+// docker_name targets are named after their compose project dir on the pull host, which is not known centrally
+func checkPulledTarget(manifestTarget string, target input.PullTargetConfig) error {
+	if manifestTarget == "" || manifestTarget == "." || strings.Contains(manifestTarget, "..") || strings.ContainsAny(manifestTarget, `/\`) {
+		return fmt.Errorf("pulled manifest names unsafe target %q", manifestTarget)
+	}
+	if target.TargetDir != "" && manifestTarget != pullTargetName(target) {
+		return fmt.Errorf("pulled manifest names target %q, expected %q", manifestTarget, pullTargetName(target))
+	}
+	return nil
+}
+
+// fetches, verifies, records & applies retention for a single target on a pull host
+func pullTarget(configFile *input.ConfigFile, pullHost input.PullHostConfig, target input.PullTargetConfig, cargoportKey string) error {
+	jobCTX := job.JobContext{
+		Target:     pullTargetName(target),
+		Remote:     true,
+		JobID:      job.GenerateJobID(),
+		StartTime:  time.Now(),
+		TargetDir:  target.TargetDir,
+		RootDir:    configFile.DefaultCargoportDir,
+		Tag:        target.Tag,
+		RemoteHost: pullHost.Host,
+		RemoteUser: pullHost.User,
+	}
+	verboseFields := pullLogDebugFields(&jobCTX)
+
+	logger.LogxWithFields("info", fmt.Sprintf("New pull job added from '%s'", pullHost.Name), logger.MergeFields(verboseFields, map[string]interface{}{
+		"pull_host": pullHost.Name,
+		"mode":      pullHost.Mode,
+	}))
+
+	// local storage for archives fetched from this host
+	hostDir := filepath.Join(configFile.DefaultCargoportDir, "remote", pullHost.Name)
+	if err := os.MkdirAll(hostDir, 0755); err != nil {
+		return recordPull(&jobCTX, pullHost, "", false, fmt.Errorf("failed to create pull directory %s: %v", hostDir, err))
+	}
+
+	// probe tcp/ssh reachability prior to pulling
+	probeReport := util.ProbeRemote(pullHost.Host, configFile.ProbeOptions(pullHost.User, pullHost.Port))
+	util.LogProbeReport(probeReport, logger.MergeFields(verboseFields, map[string]interface{}{
+		"pull_host": pullHost.Name,
+	}))
+	if err := probeReport.Err(); err != nil {
+		return recordPull(&jobCTX, pullHost, "", false, fmt.Errorf("pull host is not reachable: %v", err))
+	}
+
+	var archivePath string
+	var err error
+	switch pullHost.Mode {
+	case input.PullModeStream:
+		archivePath, err = streamPull(&jobCTX, pullHost, target, hostDir, cargoportKey)
+	default:
+		archivePath, err = triggerPull(&jobCTX, pullHost, target, hostDir, cargoportKey)
+	}
+	if err != nil {
+		logger.LogxWithFields("error", fmt.Sprintf("Pull from '%s' failed: %v", pullHost.Name, err), verboseFields)
+		return recordPull(&jobCTX, pullHost, "", false, err)
+	}
+
+	// verify archive centrally against checksum recorded in manifest
+	if err := backup.VerifyArchive(archivePath, jobCTX.ArchiveSHA256); err != nil {
+		logger.LogxWithFields("error", fmt.Sprintf("Pulled archive failed verification: %v", err), verboseFields)
+		// discard failed archive so it never counts towards retention
+		os.Remove(archivePath)
+		os.Remove(backup.ManifestPath(archivePath))
+		return recordPull(&jobCTX, pullHost, archivePath, false, fmt.Errorf("verification failed: %v", err))
+	}
+
+	// apply retention for this host & target
+	if _, err := backup.ApplyRetention(hostDir, jobCTX.Target, jobCTX.Tag, pullHost.KeepLast); err != nil {
+		logger.LogxWithFields("warn", fmt.Sprintf("Failed to apply retention: %v", err), verboseFields)
+	}
+
+	logger.LogxWithFields("info", fmt.Sprintf("Pull success, execution time: %.2fs", time.Since(jobCTX.StartTime).Seconds()), map[string]interface{}{
+		"package":   "pull",
+		"target":    jobCTX.Target,
+		"job_id":    jobCTX.JobID,
+		"pull_host": pullHost.Name,
+		"success":   true,
+		"size":      jobCTX.CompressedSizeMBString,
+	})
+	return recordPull(&jobCTX, pullHost, archivePath, true, nil)
+}
+
+// triggers a cargoport job on the pull host, then fetches the resulting archive & manifest
+func triggerPull(jobctx *job.JobContext, pullHost input.PullHostConfig, target input.PullTargetConfig, hostDir, cargoportKey string) (string, error) {
+	verboseFields := pullLogDebugFields(jobctx)
+
+	remoteUserHost := fmt.Sprintf("%s@%s", pullHost.User, pullHost.Host)
+	remoteTempDir := fmt.Sprintf("/tmp/cargoport-pull-%s", jobctx.JobID)
+
+	// always clean up remote temp dir once finished
+	defer func() {
+		sshArgs := append(util.SSHBaseOptions(cargoportKey, pullHost.Port), remoteUserHost, "rm -rf "+util.ShellQuote(remoteTempDir))
+		if _, err := util.RunCommandWithOutput("ssh", sshArgs...); err != nil {
+			logger.LogxWithFields("warn", fmt.Sprintf("Failed to clean up remote temp dir %s: %v", remoteTempDir, err), verboseFields)
+		}
+	}()
+
+	// build remote cargoport invocation
+	remoteCommand := []string{pullHost.CargoportCommand}
+	if target.DockerName != "" {
+		remoteCommand = append(remoteCommand, "-docker-name", util.ShellQuote(target.DockerName))
+	} else {
+		remoteCommand = append(remoteCommand, "-target-dir", util.ShellQuote(target.TargetDir))
+	}
+	if target.Tag != "" {
+		remoteCommand = append(remoteCommand, "-tag", util.ShellQuote(target.Tag))
+	}
+	remoteCommand = append(remoteCommand, "-output-dir", util.ShellQuote(remoteTempDir))
+
+	shellCommand := fmt.Sprintf("mkdir -p %s && %s", util.ShellQuote(remoteTempDir), strings.Join(remoteCommand, " "))
+	logger.LogxWithFields("debug", fmt.Sprintf("Triggering remote job on %s: %s", remoteUserHost, shellCommand), verboseFields)
+
+	sshArgs := append(util.SSHBaseOptions(cargoportKey, pullHost.Port), remoteUserHost, shellCommand)
+	if output, err := util.RunCommandWithOutput("ssh", sshArgs...); err != nil {
+		return "", fmt.Errorf("remote job failed: %s", strings.TrimSpace(output))
+	}
+
+	// fetch remote output dir into local incoming dir
+	incomingDir := filepath.Join(hostDir, ".incoming-"+jobctx.JobID)
+	if err := os.MkdirAll(incomingDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create incoming directory: %v", err)
+	}
+	defer os.RemoveAll(incomingDir)
+
+	if err := util.RunCommand("rsync", "-az", "-e", util.SSHCommandString(cargoportKey, pullHost.Port),
+		fmt.Sprintf("%s:%s/", remoteUserHost, remoteTempDir), incomingDir+"/"); err != nil {
+		return "", fmt.Errorf("rsync fetch failed: %v", err)
+	}
+
+	// locate fetched archive
+	matches, err := filepath.Glob(filepath.Join(incomingDir, "*"+backup.ArchiveSuffix))
+	if err != nil || len(matches) != 1 {
+		return "", fmt.Errorf("expected exactly one archive from remote job, found %d", len(matches))
+	}
+	fetchedArchive := matches[0]
+
+	// prefer remote manifest for checksum, fall back to a fresh manifest
+	// the manifest comes from the pull host & is treated as data, local paths only use the configured target name
+	manifest, err := backup.ReadManifest(fetchedArchive)
+	if err != nil {
+		logger.LogxWithFields("warn", "Remote archive has no manifest, checksum will be computed locally", verboseFields)
+		manifest = backup.NewManifest(jobctx, fetchedArchive)
+		manifest.Hostname = pullHost.Name
+		if manifest.SHA256, err = backup.FileSHA256(fetchedArchive); err != nil {
+			return "", fmt.Errorf("failed to checksum fetched archive: %v", err)
+		}
+	} else if err := checkPulledTarget(manifest.Target, target); err != nil {
+		return "", err
+	}
+	manifest.Target = jobctx.Target
+
+	fileInfo, err := os.Stat(fetchedArchive)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat fetched archive: %v", err)
+	}
+	setArchiveSize(jobctx, fileInfo.Size())
+	jobctx.ArchiveSHA256 = manifest.SHA256
+
+	// move into host dir under timestamped name
+	archivePath := filepath.Join(hostDir, backup.TimestampedArchiveName(jobctx.Target, jobctx.Tag, jobctx.StartTime))
+	if err := os.Rename(fetchedArchive, archivePath); err != nil {
+		return "", fmt.Errorf("failed to store fetched archive: %v", err)
+	}
+	manifest.Archive = filepath.Base(archivePath)
+	if err := backup.WriteManifest(archivePath, manifest); err != nil {
+		return "", err
+	}
+
+	return archivePath, nil
+}
+
+// streams tar of the target directory from the pull host, checksumming in-flight
+func streamPull(jobctx *job.JobContext, pullHost input.PullHostConfig, target input.PullTargetConfig, hostDir, cargoportKey string) (string, error) {
+	verboseFields := pullLogDebugFields(jobctx)
+
+	remoteUserHost := fmt.Sprintf("%s@%s", pullHost.User, pullHost.Host)
+	targetDir := strings.TrimSuffix(target.TargetDir, "/")
+	tarCommand := fmt.Sprintf("tar -czf - -C %s %s", util.ShellQuote(filepath.Dir(targetDir)), util.ShellQuote(filepath.Base(targetDir)))
+
+	archivePath := filepath.Join(hostDir, backup.TimestampedArchiveName(jobctx.Target, jobctx.Tag, jobctx.StartTime))
+	partialPath := archivePath + ".partial"
+
+	logger.LogxWithFields("debug", fmt.Sprintf("Streaming %s:%s to %s", remoteUserHost, targetDir, archivePath), verboseFields)
+
+	partialFile, err := os.Create(partialPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create partial archive: %v", err)
+	}
+
+	// write stream to disk & hasher simultaneously
+	hasher := sha256.New()
+	sshArgs := append(util.SSHBaseOptions(cargoportKey, pullHost.Port), remoteUserHost, tarCommand)
+	cmd := exec.Command("ssh", sshArgs...)
+	cmd.Stdout = io.MultiWriter(partialFile, hasher)
+	cmd.Stderr = os.Stderr
+
+	runErr := cmd.Run()
+	closeErr := partialFile.Close()
+	if runErr != nil || closeErr != nil {
+		os.Remove(partialPath)
+		if runErr != nil {
+			return "", fmt.Errorf("remote tar stream failed: %v", runErr)
+		}
+		return "", fmt.Errorf("failed to write partial archive: %v", closeErr)
+	}
+
+	if err := os.Rename(partialPath, archivePath); err != nil {
+		os.Remove(partialPath)
+		return "", fmt.Errorf("failed to store streamed archive: %v", err)
+	}
+
+	fileInfo, err := os.Stat(archivePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat streamed archive: %v", err)
+	}
+	setArchiveSize(jobctx, fileInfo.Size())
+	jobctx.ArchiveSHA256 = hex.EncodeToString(hasher.Sum(nil))
+
+	manifest := backup.NewManifest(jobctx, archivePath)
+	manifest.Hostname = pullHost.Name
+	if err := backup.WriteManifest(archivePath, manifest); err != nil {
+		return "", err
+	}
+
+	return archivePath, nil
+}
+
+// populates job context archive size fields
+func setArchiveSize(jobctx *job.JobContext, sizeBytes int64) {
+	jobctx.CompressedSizeBytesInt = sizeBytes
+	jobctx.CompressedSizeMBString = fmt.Sprintf("%.2f MB", float64(sizeBytes)/1024.0/1024.0)
+}
+
+// appends pull outcome to history ledger, passing through original error
+func recordPull(jobctx *job.JobContext, pullHost input.PullHostConfig, archivePath string, verified bool, pullErr error) error {
+	entry := job.LedgerEntry{
+		JobID:     jobctx.JobID,
+		Kind:      "pull",
+		Time:      jobctx.StartTime,
+		Host:      pullHost.Name,
+		Target:    jobctx.Target,
+		Tag:       jobctx.Tag,
+		Archive:   archivePath,
+		SizeBytes: jobctx.CompressedSizeBytesInt,
+		SHA256:    jobctx.ArchiveSHA256,
+		Verified:  verified,
+		Success:   pullErr == nil,
+		Duration:  time.Since(jobctx.StartTime).Seconds(),
+	}
+	if pullErr != nil {
+		entry.Error = pullErr.Error()
+	}
+
+	if err := job.AppendLedger(jobctx.RootDir, entry); err != nil {
+		logger.LogxWithFields("warn", fmt.Sprintf("Failed to record pull in history ledger: %v", err), pullLogDebugFields(jobctx))
+	}
+	return pullErr
+}
@@ -0,0 +1,64 @@
+package receive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// upper bound on a single manifest read while listing archives
+const maxListedManifestLength = 1024 * 1024
+
+// lists archives & manifests within the quoted directory word of a util.ListArchivesCommand, matching its output
+// only regular files are listed, symlinks are skipped rather than followed outside of the allowed dir
+func (r *Receiver) listArchives(quotedDir, allowedDir string) error {
+	tokens, err := splitShellWords(quotedDir, r.HomeDir)
+	if err != nil || len(tokens) != 1 || tokens[0].operator {
+		return fmt.Errorf("rejected command: archive listing must name a single directory")
+	}
+	listDir := tokens[0].value
+	if !filepath.IsAbs(listDir) {
+		listDir = filepath.Join(r.HomeDir, listDir)
+	}
+	if err := r.checkWithin(listDir, allowedDir); err != nil {
+		return fmt.Errorf("rejected command: %v", err)
+	}
+
+	entries, err := os.ReadDir(listDir)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".partial") {
+			continue
+		}
+		filePath := filepath.Join(listDir, name)
+
+		switch {
+		case strings.HasSuffix(name, ".bak.tar.gz.manifest.json"):
+			manifestFile, err := os.Open(filePath)
+			if err != nil {
+				continue
+			}
+			manifestData, err := io.ReadAll(io.LimitReader(manifestFile, maxListedManifestLength))
+			manifestFile.Close()
+			var compacted bytes.Buffer
+			if err != nil || json.Compact(&compacted, manifestData) != nil {
+				continue
+			}
+			fmt.Fprintf(r.Stdout, "M\t%s\t%s\n", name, compacted.String())
+		case strings.HasSuffix(name, ".bak.tar.gz"):
+			fileInfo, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(r.Stdout, "A\t%d\t%d\t%s\n", fileInfo.Size(), fileInfo.ModTime().Unix(), name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,449 @@
+package receive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// short option cluster of rsync's server-side args for cargoport uploads (-a, -v, -z, -c),
+// anything after `e` is capability flags rather than options
+var allowedRsyncFlags = regexp.MustCompile(`^-[vlogDtprcz]+(e[.A-Za-z]*)?$`)
+
+// bandwidth cap passed through to the rsync server
+var allowedRsyncBandwidthLimit = regexp.MustCompile(`^--bwlimit=[0-9]+$`)
+
+// long options cargoport uploads pass to the rsync server, every other option is rejected
+var allowedRsyncOptions = map[string]bool{
+	"--checksum":        true,
+	"--ignore-existing": true,
+}
+
+// option every rsync upload must pass, so rsync never replaces files already in the allowed dir
+const requiredRsyncOption = "--ignore-existing"
+
+// partial dir passed to rsync by cargoport uploads
+const rsyncPartialDir = ".cargoport-partial"
+
+// upper bound on a single public key line read during key rotation
+const maxAuthorizedKeyLength = 16 * 1024
+
+// completed uploads may only be removed within this window, allowing failed streams
+// to clean up while preventing a compromised host from deleting older backups
+const removableWindow = time.Hour
+
+// forced-command handler for restricted cargoport keys, validates the original ssh command
+// & only performs uploads into, or archive listings of, the allowed directory
+type Receiver struct {
+	AllowedDir       string // uploads are confined to this directory, `~` expands to home dir
+	CargoportCommand string // command re-used in forced command options for rotated keys
+	HomeDir          string
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// validates & runs original ssh command as passed via SSH_ORIGINAL_COMMAND
+func (r *Receiver) Serve(originalCommand string) error {
+	originalCommand = strings.TrimSpace(originalCommand)
+	if originalCommand == "" {
+		return fmt.Errorf("interactive sessions are not permitted for this key")
+	}
+
+	allowedDir, err := r.allowedRoot()
+	if err != nil {
+		return err
+	}
+
+	// key rotation commands are matched verbatim
+	if originalCommand == util.AuthorizedKeysInstallCommand {
+		return r.installAuthorizedKey()
+	}
+	if keyBody, keepKeyBody, ok := r.matchRemoveKeyCommand(originalCommand); ok {
+		return r.removeAuthorizedKey(keyBody, keepKeyBody)
+	}
+	if quotedDir, ok := util.MatchListArchivesCommand(originalCommand); ok {
+		return r.listArchives(quotedDir, allowedDir)
+	}
+
+	tokens, err := splitShellWords(originalCommand, r.HomeDir)
+	if err != nil {
+		return fmt.Errorf("rejected command: %v", err)
+	}
+	commands := splitCommands(tokens)
+
+	// rsync must be the only command, it is executed directly rather than through a shell
+	if len(commands) > 0 && len(commands[0]) > 0 && commands[0][0].value == "rsync" {
+		if len(commands) != 1 {
+			return fmt.Errorf("rejected command: rsync must not be chained")
+		}
+		return r.runRsyncServer(commands[0], allowedDir)
+	}
+
+	// validate every command before performing any of them
+	for _, command := range commands {
+		if err := r.validateCommand(command, allowedDir); err != nil {
+			return fmt.Errorf("rejected command: %v", err)
+		}
+	}
+	for _, command := range commands {
+		if err := r.runCommand(command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolves allowed dir to an absolute, symlink-free path, refusing the home dir or any of its ancestors,
+// as uploads there could replace authorized_keys
+func (r *Receiver) allowedRoot() (string, error) {
+	allowedDir := r.AllowedDir
+	if allowedDir == "" || allowedDir == "~" {
+		allowedDir = r.HomeDir
+	} else if strings.HasPrefix(allowedDir, "~/") {
+		allowedDir = filepath.Join(r.HomeDir, strings.TrimPrefix(allowedDir, "~/"))
+	}
+	if !filepath.IsAbs(allowedDir) {
+		return "", fmt.Errorf("allowed directory %s must be absolute", allowedDir)
+	}
+	resolvedDir, err := resolvePath(allowedDir)
+	if err != nil {
+		return "", err
+	}
+	homeDir, err := resolvePath(r.HomeDir)
+	if err != nil {
+		return "", err
+	}
+	if relativePath, err := filepath.Rel(resolvedDir, homeDir); err == nil && relativePath != ".." && !strings.HasPrefix(relativePath, "../") {
+		return "", fmt.Errorf("allowed directory %s holds the home dir, restricted keys must be confined to a dedicated dir such as %s", allowedDir, util.DefaultRemoteDir)
+	}
+	return resolvedDir, nil
+}
+
+// checks a single command against the permitted upload operations
+func (r *Receiver) validateCommand(command []shellToken, allowedDir string) error {
+	name := command[0].value
+	args := command[1:]
+
+	var paths []string
+	switch {
+	case name == "true" && len(args) == 0:
+		return nil
+	case name == "mkdir" && len(args) == 2 && args[0].value == "-p":
+		paths = []string{args[1].value}
+	case name == "cat" && len(args) == 2 && args[0].operator && args[0].value == ">":
+		paths = []string{args[1].value}
+	case name == "mv" && len(args) == 2:
+		paths = []string{args[0].value, args[1].value}
+	case name == "rm" && len(args) >= 2 && args[0].value == "-f":
+		for _, arg := range args[1:] {
+			if err := checkRemovable(arg.value); err != nil {
+				return err
+			}
+			paths = append(paths, arg.value)
+		}
+	default:
+		return fmt.Errorf("%q is not a permitted operation", name)
+	}
+
+	for i, arg := range args {
+		if arg.operator && !(name == "cat" && i == 0) {
+			return fmt.Errorf("unexpected %q in %s", arg.value, name)
+		}
+	}
+	for _, path := range paths {
+		if err := r.checkWithin(path, allowedDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// performs validated command natively, without invoking a shell
+func (r *Receiver) runCommand(command []shellToken) error {
+	args := command[1:]
+	switch command[0].value {
+	case "true":
+		return nil
+	case "mkdir":
+		if err := os.MkdirAll(args[1].value, 0755); err != nil {
+			return fmt.Errorf("mkdir failed: %v", err)
+		}
+	case "cat":
+		// uploads never truncate an existing file, so older backups & in-flight partial uploads cannot be overwritten
+		file, err := os.OpenFile(args[1].value, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %v", args[1].value, err)
+		}
+		if _, err := io.Copy(file, r.Stdin); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write %s: %v", args[1].value, err)
+		}
+		if err := file.Close(); err != nil {
+			return fmt.Errorf("failed to write %s: %v", args[1].value, err)
+		}
+	case "mv":
+		// linking fails when the destination exists, so older backups cannot be replaced
+		if err := os.Link(args[0].value, args[1].value); err != nil {
+			if os.IsExist(err) {
+				return fmt.Errorf("mv failed: %s already exists, restricted keys cannot replace existing files", args[1].value)
+			}
+			return fmt.Errorf("mv failed: %v", err)
+		}
+		if err := os.Remove(args[0].value); err != nil {
+			return fmt.Errorf("mv failed: %v", err)
+		}
+	case "rm":
+		for _, arg := range args[1:] {
+			if err := os.Remove(arg.value); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("rm failed: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// runs rsync in server mode after checking every arg against those sent by cargoport uploads,
+// `rsync --server <options> . <destination>`
+func (r *Receiver) runRsyncServer(command []shellToken, allowedDir string) error {
+	if len(command) < 4 || command[1].value != "--server" {
+		return fmt.Errorf("rejected command: only rsync server uploads are permitted")
+	}
+
+	var rsyncArgs []string
+	for _, token := range command[1:] {
+		if token.operator {
+			return fmt.Errorf("rejected command: unexpected %q in rsync", token.value)
+		}
+		rsyncArgs = append(rsyncArgs, token.value)
+	}
+	if rsyncArgs[len(rsyncArgs)-2] != "." {
+		return fmt.Errorf("rejected command: rsync must upload to a single destination")
+	}
+
+	options := rsyncArgs[1 : len(rsyncArgs)-2]
+	ignoresExisting := false
+	for i := 0; i < len(options); i++ {
+		option := options[i]
+		switch {
+		case allowedRsyncOptions[option], allowedRsyncFlags.MatchString(option), allowedRsyncBandwidthLimit.MatchString(option):
+		case option == "--partial-dir="+rsyncPartialDir:
+		case option == "--partial-dir" && i+1 < len(options) && options[i+1] == rsyncPartialDir:
+			i++
+		default:
+			return fmt.Errorf("rejected command: rsync option %s is not permitted", option)
+		}
+		ignoresExisting = ignoresExisting || option == requiredRsyncOption
+	}
+	if !ignoresExisting {
+		return fmt.Errorf("rejected command: rsync uploads must pass %s, set restrict_remote_keys on the sending host", requiredRsyncOption)
+	}
+
+	// final argument is the upload destination
+	destination := rsyncArgs[len(rsyncArgs)-1]
+	if err := r.checkWithin(destination, allowedDir); err != nil {
+		return fmt.Errorf("rejected command: %v", err)
+	}
+	// uploads naming an existing file would be skipped without error, so are refused outright
+	destinationPath := destination
+	if !filepath.IsAbs(destinationPath) {
+		destinationPath = filepath.Join(r.HomeDir, destinationPath)
+	}
+	if fileInfo, err := os.Lstat(destinationPath); err == nil && !fileInfo.IsDir() {
+		return fmt.Errorf("rejected command: %s already exists, restricted keys cannot replace existing files", destination)
+	}
+
+	cmd := exec.Command("rsync", rsyncArgs...)
+	cmd.Stdin = r.Stdin
+	cmd.Stdout = r.Stdout
+	cmd.Stderr = r.Stderr
+	return cmd.Run()
+}
+
+// key bodies quoted within cargoport key removal commands
+var removeKeyArgs = regexp.MustCompile(`-([vq])F '([A-Za-z0-9+/=]+)'`)
+
+// returns key body to remove & key body to keep when command is exactly a cargoport key removal command
+func (r *Receiver) matchRemoveKeyCommand(command string) (string, string, bool) {
+	var keyBody, keepKeyBody string
+	for _, match := range removeKeyArgs.FindAllStringSubmatch(command, -1) {
+		if match[1] == "v" {
+			keyBody = match[2]
+		} else {
+			keepKeyBody = match[2]
+		}
+	}
+	if keyBody == "" || keepKeyBody == "" || util.RemoveAuthorizedKeyCommand(keyBody, keepKeyBody) != command {
+		return "", "", false
+	}
+	return keyBody, keepKeyBody, true
+}
+
+// appends rotated public key from stdin, re-applying this forced command so restrictions carry over
+func (r *Receiver) installAuthorizedKey() error {
+	keyLine, err := bufio.NewReader(io.LimitReader(r.Stdin, maxAuthorizedKeyLength)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read public key: %v", err)
+	}
+	publicKey, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(keyLine))
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+
+	authorizedEntry := fmt.Sprintf("%s %s", util.RestrictedKeyOptions(r.CargoportCommand, r.AllowedDir), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))))
+	if comment != "" {
+		authorizedEntry += " " + comment
+	}
+
+	authorizedKeysPath := filepath.Join(r.HomeDir, ".ssh", "authorized_keys")
+	authorizedKeys, err := os.OpenFile(authorizedKeysPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open authorized_keys: %v", err)
+	}
+	defer authorizedKeys.Close()
+	if _, err := authorizedKeys.WriteString(authorizedEntry + "\n"); err != nil {
+		return fmt.Errorf("failed to write authorized_keys: %v", err)
+	}
+	return nil
+}
+
+// removes authorized_keys entries for exactly the key with key body, as long as the key with keep key body remains
+// only entries carrying the serve-receive forced command are removed, leaving unrestricted keys such as the operator's untouched
+func (r *Receiver) removeAuthorizedKey(keyBody, keepKeyBody string) error {
+	removeKey, err := parseKeyBody(keyBody)
+	if err != nil {
+		return fmt.Errorf("invalid key to remove: %v", err)
+	}
+	keepKey, err := parseKeyBody(keepKeyBody)
+	if err != nil {
+		return fmt.Errorf("invalid key to keep: %v", err)
+	}
+
+	authorizedKeysPath := filepath.Join(r.HomeDir, ".ssh", "authorized_keys")
+	authorizedKeys, err := os.ReadFile(authorizedKeysPath)
+	if err != nil {
+		return fmt.Errorf("failed to read authorized_keys: %v", err)
+	}
+
+	var keptLines []string
+	kept := false
+	for _, line := range strings.SplitAfter(string(authorizedKeys), "\n") {
+		if line == "" {
+			continue
+		}
+		// comments, blank & unparseable lines are kept as they are
+		publicKey, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err == nil && bytes.Equal(publicKey.Marshal(), removeKey.Marshal()) && isServeReceiveEntry(options) {
+			continue
+		}
+		keptLines = append(keptLines, line)
+		kept = kept || (err == nil && bytes.Equal(publicKey.Marshal(), keepKey.Marshal()))
+	}
+	if !kept {
+		return fmt.Errorf("refusing to remove key, authorized_keys would no longer hold the key in use")
+	}
+
+	tempPath := authorizedKeysPath + ".cargoport-tmp"
+	if err := os.WriteFile(tempPath, []byte(strings.Join(keptLines, "")), 0600); err != nil {
+		return fmt.Errorf("failed to write authorized_keys: %v", err)
+	}
+	return os.Rename(tempPath, authorizedKeysPath)
+}
+
+// parses base64 key body, as found in the second field of an authorized_keys line
+func parseKeyBody(keyBody string) (ssh.PublicKey, error) {
+	keyData, err := base64.StdEncoding.DecodeString(keyBody)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePublicKey(keyData)
+}
+
+// reports whether authorized_keys options force the serve-receive command
+func isServeReceiveEntry(options []string) bool {
+	for _, option := range options {
+		if strings.HasPrefix(option, `command="`) && strings.Contains(option, " serve-receive ") {
+			return true
+		}
+	}
+	return false
+}
+
+// errors unless path is a partial upload or was written within the removable window
+func checkRemovable(path string) error {
+	if strings.HasSuffix(path, ".partial") {
+		return nil
+	}
+	fileInfo, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if time.Since(fileInfo.ModTime()) > removableWindow {
+		return fmt.Errorf("removing %s is not permitted, only recent uploads may be removed", path)
+	}
+	return nil
+}
+
+// errors unless path resolves to within allowed dir, following symlinks of existing parents
+func (r *Receiver) checkWithin(path, allowedDir string) error {
+	// relative paths are relative to the home dir, where sshd starts the forced command
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(r.HomeDir, path)
+	}
+	resolvedPath, err := resolvePath(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	relativePath, err := filepath.Rel(allowedDir, resolvedPath)
+	if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, "../") {
+		return fmt.Errorf("path %s is outside of %s", path, allowedDir)
+	}
+	// hidden files could configure tools run from within the allowed dir, only rsync's partial dir is permitted
+	if relativePath != "." {
+		for _, component := range strings.Split(relativePath, "/") {
+			if strings.HasPrefix(component, ".") && component != rsyncPartialDir {
+				return fmt.Errorf("path %s is hidden, only plain files & dirs may be written", path)
+			}
+		}
+	}
+	return nil
+}
+
+// resolves symlinks of the deepest existing ancestor, appending the remaining path
+func resolvePath(path string) (string, error) {
+	existing := path
+	var remainder []string
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		remainder = append([]string{filepath.Base(existing)}, remainder...)
+		existing = parent
+	}
+
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", path, err)
+	}
+	return filepath.Join(append([]string{resolved}, remainder...)...), nil
+}
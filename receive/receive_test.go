@@ -0,0 +1,219 @@
+package receive
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// returns receiver confined to ~/cargoport within a new home dir
+func newTestReceiver(t *testing.T, stdin string) *Receiver {
+	t.Helper()
+	homeDir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Receiver{
+		AllowedDir:       util.DefaultRemoteDir,
+		CargoportCommand: "cargoport",
+		HomeDir:          homeDir,
+		Stdin:            strings.NewReader(stdin),
+		Stdout:           &bytes.Buffer{},
+		Stderr:           &bytes.Buffer{},
+	}
+}
+
+// stream upload command as sent by cargoport for remote path beneath the home dir
+func streamCommand(remotePath string) string {
+	quote := func(p string) string { return `"$HOME"/` + util.ShellQuote(p) }
+	return "mkdir -p " + quote(filepath.Dir(remotePath)) + " && cat > " + quote(remotePath+".partial") + " && mv " + quote(remotePath+".partial") + " " + quote(remotePath)
+}
+
+func TestAllowedRootRefusesHomeDir(t *testing.T) {
+	receiver := newTestReceiver(t, "")
+	for _, allowedDir := range []string{"", "~", "/", filepath.Dir(receiver.HomeDir), receiver.HomeDir} {
+		receiver.AllowedDir = allowedDir
+		if err := receiver.Serve("true"); err == nil {
+			t.Errorf("allowed dir %q accepted, want home dir & its ancestors refused", allowedDir)
+		}
+	}
+	receiver.AllowedDir = util.DefaultRemoteDir
+	if err := receiver.Serve("true"); err != nil {
+		t.Errorf("allowed dir %s refused: %v", util.DefaultRemoteDir, err)
+	}
+}
+
+func TestStreamUploadNeverReplacesExistingFiles(t *testing.T) {
+	receiver := newTestReceiver(t, "first")
+	command := streamCommand("cargoport/app/app.bak.tar.gz")
+	if err := receiver.Serve(command); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(receiver.HomeDir, "cargoport", "app", "app.bak.tar.gz")
+	if content, err := os.ReadFile(archivePath); err != nil || string(content) != "first" {
+		t.Fatalf("uploaded archive = %q, %v, want first", content, err)
+	}
+
+	receiver.Stdin = strings.NewReader("second")
+	if err := receiver.Serve(command); err == nil {
+		t.Error("repeated upload to the same name succeeded, want error")
+	}
+	if content, _ := os.ReadFile(archivePath); string(content) != "first" {
+		t.Errorf("existing archive replaced with %q", content)
+	}
+
+	// an in-flight partial upload cannot be truncated either
+	partialPath := filepath.Join(receiver.HomeDir, "cargoport", "app", "other.bak.tar.gz.partial")
+	if err := os.WriteFile(partialPath, []byte("in flight"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	receiver.Stdin = strings.NewReader("third")
+	if err := receiver.Serve(streamCommand("cargoport/app/other.bak.tar.gz")); err == nil {
+		t.Error("upload over an existing partial file succeeded, want error")
+	}
+	if content, _ := os.ReadFile(partialPath); string(content) != "in flight" {
+		t.Errorf("partial upload truncated to %q", content)
+	}
+}
+
+func TestRsyncUploadNeverReplacesExistingFiles(t *testing.T) {
+	receiver := newTestReceiver(t, "")
+	archivePath := filepath.Join(receiver.HomeDir, "cargoport", "app.bak.tar.gz")
+	if err := os.MkdirAll(filepath.Dir(archivePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(archivePath, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// server args as sent by a cargoport upload to a restricted remote
+	upload := `rsync --server -vlogDtprcze.iLsfxCIvu --checksum --partial-dir .cargoport-partial --ignore-existing . "$HOME"/'cargoport/app.bak.tar.gz'`
+	withoutIgnoreExisting := strings.Replace(upload, " --ignore-existing", "", 1)
+
+	// commands must be refused before rsync runs, rather than failing within it
+	for name, command := range map[string]string{
+		"existing archive":                      upload,
+		"without --ignore-existing":             withoutIgnoreExisting,
+		"new archive without --ignore-existing": strings.Replace(withoutIgnoreExisting, "app.bak.tar.gz", "new.bak.tar.gz", 1),
+	} {
+		if err := receiver.Serve(command); err == nil || !strings.Contains(err.Error(), "rejected command") {
+			t.Errorf("%s: rsync upload = %v, want rejection", name, err)
+		}
+	}
+	if content, _ := os.ReadFile(archivePath); string(content) != "first" {
+		t.Errorf("existing archive replaced with %q", content)
+	}
+}
+
+func TestRejectedCommands(t *testing.T) {
+	receiver := newTestReceiver(t, "")
+	if err := os.MkdirAll(filepath.Join(receiver.HomeDir, "cargoport"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range []string{
+		"",
+		"sh",
+		`cat > "$HOME"/.ssh/authorized_keys`,
+		`cat > "$HOME"/'cargoport/../.ssh/authorized_keys'`,
+		`cat > "$HOME"/'cargoport/.bashrc'`,
+		`mkdir -p "$HOME"/'cargoport/app/.git'`,
+		`mv "$HOME"/'cargoport/a' "$HOME"/'b'`,
+		`cat > "$HOME"/'cargoport/a' ; sh`,
+		`cat "$HOME"/'cargoport/a'`,
+		// rsync options beyond those of cargoport uploads
+		`rsync --server -vlogDtprze.iLsfxCIvu --remove-source-files . "$HOME"/'cargoport/a'`,
+		`rsync --server -vlogDtprze.iLsfxCIvu --delete . "$HOME"/'cargoport/'`,
+		`rsync --server -vlogDtprze.iLsfxCIvu --partial-dir=../partial . "$HOME"/'cargoport/a'`,
+		`rsync --server --sender -vlogDtprze.iLsfxCIvu . "$HOME"/'cargoport/a'`,
+		`rsync --server -vlogDtprze.iLsfxCIvu . "$HOME"/'other/a'`,
+		`rsync --server -vlogDtprze.iLsfxCIvu . "$HOME"/'cargoport/.hidden'`,
+		`rsync --server -vlogDtprze.iLsfxCIvu . "$HOME"/'cargoport/a' && true`,
+	} {
+		if err := receiver.Serve(command); err == nil {
+			t.Errorf("command %q accepted, want rejection", command)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Join(receiver.HomeDir, "cargoport")); len(entries) != 0 {
+		t.Errorf("rejected commands wrote %s", entries[0].Name())
+	}
+}
+
+// returns body of a new public key, as found in the second field of an authorized_keys line
+func newTestKeyBody(t *testing.T) string {
+	t.Helper()
+	rawKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ssh.NewPublicKey(rawKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Fields(string(ssh.MarshalAuthorizedKey(publicKey)))[1]
+}
+
+func TestRemoveAuthorizedKeyOnlyRemovesRestrictedEntries(t *testing.T) {
+	receiver := newTestReceiver(t, "")
+	oldKeyBody := newTestKeyBody(t)
+	newKeyBody := newTestKeyBody(t)
+	restricted := util.RestrictedKeyOptions("cargoport", util.DefaultRemoteDir)
+
+	operatorEntry := "ssh-ed25519 " + oldKeyBody + " operator\n"
+	newEntry := restricted + " ssh-ed25519 " + newKeyBody + " cargoport\n"
+	authorizedKeys := "# managed keys\n" + operatorEntry + restricted + " ssh-ed25519 " + oldKeyBody + " cargoport\n" + newEntry
+
+	authorizedKeysPath := filepath.Join(receiver.HomeDir, ".ssh", "authorized_keys")
+	if err := os.MkdirAll(filepath.Dir(authorizedKeysPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(authorizedKeysPath, []byte(authorizedKeys), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := receiver.Serve(util.RemoveAuthorizedKeyCommand(oldKeyBody, newKeyBody)); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(authorizedKeysPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "# managed keys\n" + operatorEntry + newEntry; string(content) != want {
+		t.Errorf("authorized_keys =\n%s\nwant\n%s", content, want)
+	}
+}
+
+func TestRemoveAuthorizedKeyKeepsKeyInUse(t *testing.T) {
+	receiver := newTestReceiver(t, "")
+	oldKeyBody := newTestKeyBody(t)
+	newKeyBody := newTestKeyBody(t)
+	restricted := util.RestrictedKeyOptions("cargoport", util.DefaultRemoteDir)
+	authorizedKeys := restricted + " ssh-ed25519 " + oldKeyBody + " cargoport\n"
+
+	authorizedKeysPath := filepath.Join(receiver.HomeDir, ".ssh", "authorized_keys")
+	if err := os.MkdirAll(filepath.Dir(authorizedKeysPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(authorizedKeysPath, []byte(authorizedKeys), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new key was never installed, so removing the old one would lock cargoport out
+	if err := receiver.Serve(util.RemoveAuthorizedKeyCommand(oldKeyBody, newKeyBody)); err == nil {
+		t.Error("removal without the key in use succeeded, want error")
+	}
+	// a truncated key body matches no key exactly
+	if err := receiver.Serve(util.RemoveAuthorizedKeyCommand(oldKeyBody[:20], oldKeyBody)); err == nil {
+		t.Error("removal of a partial key body succeeded, want error")
+	}
+	if content, _ := os.ReadFile(authorizedKeysPath); string(content) != authorizedKeys {
+		t.Errorf("authorized_keys changed to\n%s", content)
+	}
+}
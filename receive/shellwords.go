@@ -0,0 +1,153 @@
+package receive
+
+import (
+	"fmt"
+	"strings"
+)
+
+// single word or control operator parsed from a remote command
+type shellToken struct {
+	value    string
+	operator bool // unquoted `&&`, `;`, `>` or `>>`
+}
+
+// splits command into words & operators following posix quoting rules,
+// only `$HOME` & a leading `~` are expanded, any other expansion is rejected
+func splitShellWords(command, homeDir string) ([]shellToken, error) {
+	var tokens []shellToken
+	var word strings.Builder
+	inWord := false
+
+	flushWord := func() {
+		if inWord {
+			tokens = append(tokens, shellToken{value: word.String()})
+			word.Reset()
+			inWord = false
+		}
+	}
+
+	for i := 0; i < len(command); i++ {
+		char := command[i]
+		switch {
+		case char == ' ' || char == '\t' || char == '\n':
+			flushWord()
+
+		case char == '\'':
+			end := strings.IndexByte(command[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			word.WriteString(command[i+1 : i+1+end])
+			inWord = true
+			i += end + 1
+
+		case char == '"':
+			inWord = true
+			i++
+			for ; i < len(command) && command[i] != '"'; i++ {
+				switch command[i] {
+				case '\\':
+					if i+1 < len(command) && strings.IndexByte("\"\\$`", command[i+1]) >= 0 {
+						i++
+					}
+					word.WriteByte(command[i])
+				case '$':
+					expanded, consumed, err := expandVariable(command[i:], homeDir)
+					if err != nil {
+						return nil, err
+					}
+					word.WriteString(expanded)
+					i += consumed - 1
+				case '`':
+					return nil, fmt.Errorf("command substitution is not permitted")
+				default:
+					word.WriteByte(command[i])
+				}
+			}
+			if i >= len(command) {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+
+		case char == '\\':
+			if i+1 >= len(command) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			word.WriteByte(command[i])
+			inWord = true
+
+		case char == '$':
+			expanded, consumed, err := expandVariable(command[i:], homeDir)
+			if err != nil {
+				return nil, err
+			}
+			word.WriteString(expanded)
+			inWord = true
+			i += consumed - 1
+
+		case char == '~' && !inWord && (i+1 == len(command) || command[i+1] == '/'):
+			word.WriteString(homeDir)
+			inWord = true
+
+		case char == ';':
+			flushWord()
+			tokens = append(tokens, shellToken{value: ";", operator: true})
+
+		case char == '&':
+			if i+1 >= len(command) || command[i+1] != '&' {
+				return nil, fmt.Errorf("background jobs are not permitted")
+			}
+			flushWord()
+			tokens = append(tokens, shellToken{value: "&&", operator: true})
+			i++
+
+		case char == '>':
+			flushWord()
+			if i+1 < len(command) && command[i+1] == '>' {
+				tokens = append(tokens, shellToken{value: ">>", operator: true})
+				i++
+			} else {
+				tokens = append(tokens, shellToken{value: ">", operator: true})
+			}
+
+		case strings.IndexByte("|<`(){}*?[", char) >= 0:
+			return nil, fmt.Errorf("shell metacharacter %q is not permitted", char)
+
+		default:
+			word.WriteByte(char)
+			inWord = true
+		}
+	}
+	flushWord()
+	return tokens, nil
+}
+
+// expands `$HOME` or `${HOME}`, returning expansion & number of bytes consumed
+func expandVariable(text, homeDir string) (string, int, error) {
+	for _, variable := range []string{"${HOME}", "$HOME"} {
+		if strings.HasPrefix(text, variable) {
+			return homeDir, len(variable), nil
+		}
+	}
+	return "", 0, fmt.Errorf("variable expansion is only permitted for $HOME")
+}
+
+// splits tokens into individual commands on `&&` & `;`
+func splitCommands(tokens []shellToken) [][]shellToken {
+	var commands [][]shellToken
+	var current []shellToken
+	for _, token := range tokens {
+		if token.operator && (token.value == "&&" || token.value == ";") {
+			if len(current) > 0 {
+				commands = append(commands, current)
+			}
+			current = nil
+			continue
+		}
+		current = append(current, token)
+	}
+	if len(current) > 0 {
+		commands = append(commands, current)
+	}
+	return commands
+}
@@ -0,0 +1,181 @@
+package repo
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+// permission & special mode bits recorded for files
+const recordedModeBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// directory recorded into a snapshot, placed at Path within it
+type Source struct {
+	Dir  string
+	Path string
+}
+
+// records sources into snap, storing chunks not already held by the repository
+// exclude patterns are matched against snapshot paths as with path.Match, excluded directories are skipped entirely
+// returns snapshot paths of sockets, devices & fifos, which are not recorded
+func (r *Repository) Backup(snap *Snapshot, sources []Source, exclude []string) ([]string, error) {
+	unlock, err := r.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	writer := &snapshotWriter{repository: r, snap: snap, exclude: exclude, stored: map[string]bool{}}
+	for _, source := range sources {
+		if err := filepath.WalkDir(source.Dir, func(filePath string, entry fs.DirEntry, walkErr error) error {
+			if walkErr != nil {
+				return walkErr
+			}
+			relative, err := filepath.Rel(source.Dir, filePath)
+			if err != nil {
+				return err
+			}
+			return writer.add(filePath, path.Join(source.Path, filepath.ToSlash(relative)), entry)
+		}); err != nil {
+			return nil, fmt.Errorf("failed to back up %s: %v", source.Dir, err)
+		}
+	}
+
+	if err := r.saveSnapshot(snap); err != nil {
+		return nil, err
+	}
+	return writer.skipped, nil
+}
+
+// state of a snapshot being recorded
+type snapshotWriter struct {
+	repository *Repository
+	snap       *Snapshot
+	exclude    []string
+	stored     map[string]bool // chunks known to be in the repository
+	skipped    []string
+}
+
+// records a single walked entry, storing its content for regular files
+func (w *snapshotWriter) add(filePath, snapshotPath string, entry fs.DirEntry) error {
+	for _, pattern := range w.exclude {
+		if matched, _ := path.Match(pattern, snapshotPath); matched {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+	}
+
+	info, err := entry.Info()
+	if err != nil {
+		return err
+	}
+	file := File{
+		Path:    snapshotPath,
+		Mode:    uint32(info.Mode() & recordedModeBits),
+		ModTime: info.ModTime(),
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		file.UID = int(stat.Uid)
+		file.GID = int(stat.Gid)
+	}
+
+	switch {
+	case info.Mode().IsDir():
+		file.Type = FileTypeDir
+	case info.Mode()&fs.ModeSymlink != 0:
+		file.Type = FileTypeSymlink
+		if file.Link, err = os.Readlink(filePath); err != nil {
+			return err
+		}
+	case info.Mode().IsRegular():
+		file.Type = FileTypeFile
+		if err := w.storeContent(filePath, &file); err != nil {
+			return err
+		}
+	default:
+		w.skipped = append(w.skipped, snapshotPath)
+		return nil
+	}
+
+	w.snap.Files = append(w.snap.Files, file)
+	return nil
+}
+
+// splits file content into chunks, storing each one the repository does not yet hold
+func (w *snapshotWriter) storeContent(filePath string, file *File) error {
+	contentFile, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer contentFile.Close()
+
+	chunks := newChunker(contentFile, w.repository.Config.Chunker)
+	for {
+		data, err := chunks.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", filePath, err)
+		}
+
+		id := w.repository.chunkID(data)
+		if !w.stored[id] {
+			added, err := w.repository.storeChunk(id, data)
+			if err != nil {
+				return err
+			}
+			w.stored[id] = true
+			w.snap.AddedBytes += added
+		}
+		file.Chunks = append(file.Chunks, id)
+		file.Size += int64(len(data))
+	}
+	w.snap.Size += file.Size
+	return nil
+}
+
+// writes chunk unless already present, returning its stored size when written
+func (r *Repository) storeChunk(id string, data []byte) (int64, error) {
+	chunkPath := r.chunkPath(id)
+	if _, err := os.Stat(chunkPath); err == nil {
+		return 0, nil
+	}
+	stored, err := r.encode(data)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode chunk: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(chunkPath), 0700); err != nil {
+		return 0, fmt.Errorf("failed to create chunk directory: %v", err)
+	}
+	if err := writeFileAtomic(chunkPath, stored); err != nil {
+		return 0, fmt.Errorf("failed to write chunk: %v", err)
+	}
+	return int64(len(stored)), nil
+}
+
+// reads chunk, verifying its content still matches its id
+func (r *Repository) readChunk(id string) ([]byte, error) {
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 64 {
+		return nil, fmt.Errorf("invalid chunk id '%s'", id)
+	}
+	stored, err := os.ReadFile(r.chunkPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s: %v", id, err)
+	}
+	data, err := r.decode(stored)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s is corrupt: %v", id, err)
+	}
+	if r.chunkID(data) != id {
+		return nil, fmt.Errorf("chunk %s is corrupt: content does not match its id", id)
+	}
+	return data, nil
+}
@@ -0,0 +1,114 @@
+package repo
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// outcome of checking a repository
+type CheckResult struct {
+	Snapshots    int
+	Chunks       int      // chunks referenced by snapshots
+	Unreferenced int      // chunks no snapshot references, removed by prune
+	Errors       []string // unreadable snapshots, missing & corrupt chunks
+}
+
+// reports whether the repository is consistent
+func (c *CheckResult) OK() bool {
+	return len(c.Errors) == 0
+}
+
+// verifies every snapshot can be read & every chunk it references exists
+// readData additionally reads & verifies the content of every referenced chunk
+func (r *Repository) Check(readData bool) (*CheckResult, error) {
+	unlock, err := r.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	present := map[string]bool{}
+	err = filepath.WalkDir(filepath.Join(r.Dir, chunksDirName), func(chunkPath string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil || entry.IsDir() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			return walkErr
+		}
+		present[entry.Name()] = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %v", err)
+	}
+
+	ids, err := r.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+	result := &CheckResult{Snapshots: len(ids)}
+	referenced := map[string]bool{}
+	for _, id := range ids {
+		snap, err := r.readSnapshot(id)
+		if err != nil {
+			result.Errors = append(result.Errors, err.Error())
+			continue
+		}
+		for _, file := range snap.Files {
+			for _, chunkID := range file.Chunks {
+				if referenced[chunkID] {
+					continue
+				}
+				referenced[chunkID] = true
+				if !present[chunkID] {
+					result.Errors = append(result.Errors, fmt.Sprintf("chunk %s of %s in snapshot %s is missing", chunkID, file.Path, id))
+				}
+			}
+		}
+	}
+	result.Chunks = len(referenced)
+	for chunkID := range present {
+		if !referenced[chunkID] {
+			result.Unreferenced++
+		}
+	}
+
+	if readData {
+		chunkIDs := make([]string, 0, len(referenced))
+		for chunkID := range referenced {
+			if present[chunkID] {
+				chunkIDs = append(chunkIDs, chunkID)
+			}
+		}
+		sort.Strings(chunkIDs)
+		for _, chunkID := range chunkIDs {
+			if _, err := r.readChunk(chunkID); err != nil {
+				result.Errors = append(result.Errors, err.Error())
+			}
+		}
+	}
+	return result, nil
+}
+
+// reads & verifies the content of every chunk referenced by a single snapshot
+func (r *Repository) VerifySnapshot(snap *Snapshot) error {
+	unlock, err := r.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	verified := map[string]bool{}
+	for _, file := range snap.Files {
+		for _, chunkID := range file.Chunks {
+			if verified[chunkID] {
+				continue
+			}
+			if _, err := r.readChunk(chunkID); err != nil {
+				return fmt.Errorf("%s: %v", file.Path, err)
+			}
+			verified[chunkID] = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// content-defined chunk size bounds, chunk boundaries follow content so insertions only change nearby chunks
+type ChunkerParams struct {
+	Min int `json:"min"`
+	Avg int `json:"avg"`
+	Max int `json:"max"`
+}
+
+var DefaultChunkerParams = ChunkerParams{
+	Min: 256 * 1024,
+	Avg: 1024 * 1024,
+	Max: 4 * 1024 * 1024,
+}
+
+func (p ChunkerParams) validate() error {
+	if p.Min <= 0 || p.Avg <= p.Min || p.Max <= p.Avg || p.Avg&(p.Avg-1) != 0 {
+		return fmt.Errorf("invalid chunker parameters %d/%d/%d", p.Min, p.Avg, p.Max)
+	}
+	return nil
+}
+
+// gear hash table, derived from sha256 so it never changes between builds
+var gearTable [256]uint64
+
+func init() {
+	for i := range gearTable {
+		sum := sha256.Sum256([]byte{byte(i)})
+		gearTable[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+}
+
+// splits a stream into content-defined chunks using a gear rolling hash, as in FastCDC
+// boundaries are harder to hit below the average size & easier above it, narrowing the chunk size spread
+type chunker struct {
+	reader     io.Reader
+	params     ChunkerParams
+	maskSmall  uint64
+	maskLarge  uint64
+	buffer     []byte
+	start, end int
+	eof        bool
+}
+
+func newChunker(reader io.Reader, params ChunkerParams) *chunker {
+	avgBits := bits.TrailingZeros(uint(params.Avg))
+	return &chunker{
+		reader: reader,
+		params: params,
+		// masks test the hash's high bits, which depend on the last 64 bytes rather than just the last few
+		maskSmall: ^uint64(0) << (64 - avgBits - 1),
+		maskLarge: ^uint64(0) << (64 - avgBits + 1),
+		buffer:    make([]byte, params.Max),
+	}
+}
+
+// returns the next chunk, only valid until the following call, & io.EOF once the stream is exhausted
+func (c *chunker) next() ([]byte, error) {
+	if c.end-c.start < c.params.Max && !c.eof {
+		copy(c.buffer, c.buffer[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+		read, err := io.ReadFull(c.reader, c.buffer[c.end:])
+		c.end += read
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	length := c.cutPoint(c.buffer[c.start:c.end])
+	chunk := c.buffer[c.start : c.start+length]
+	c.start += length
+	return chunk, nil
+}
+
+// returns length of the chunk at the start of data
+func (c *chunker) cutPoint(data []byte) int {
+	if len(data) <= c.params.Min {
+		return len(data)
+	}
+	normalSize := c.params.Avg
+	if normalSize > len(data) {
+		normalSize = len(data)
+	}
+
+	var hash uint64
+	for i := c.params.Min; i < normalSize; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for i := normalSize; i < len(data); i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&c.maskLarge == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
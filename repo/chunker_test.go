@@ -0,0 +1,116 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+var testChunkerParams = ChunkerParams{Min: 1024, Avg: 4096, Max: 16384}
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// splits data into chunks, copying each since chunks are only valid until the next call
+func chunkAll(t *testing.T, data []byte, params ChunkerParams) [][]byte {
+	t.Helper()
+	var chunks [][]byte
+	chunker := newChunker(bytes.NewReader(data), params)
+	for {
+		chunk, err := chunker.next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunkerReassemblesWithinBounds(t *testing.T) {
+	data := randomData(1, 1024*1024)
+	chunks := chunkAll(t, data, testChunkerParams)
+
+	if reassembled := bytes.Join(chunks, nil); !bytes.Equal(reassembled, data) {
+		t.Fatal("chunks do not reassemble into the input")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > testChunkerParams.Max {
+			t.Errorf("chunk %d is %d bytes, above the maximum", i, len(chunk))
+		}
+		// only the final chunk may fall short of the minimum
+		if len(chunk) < testChunkerParams.Min && i != len(chunks)-1 {
+			t.Errorf("chunk %d is %d bytes, below the minimum", i, len(chunk))
+		}
+	}
+	average := len(data) / len(chunks)
+	if average < testChunkerParams.Avg/2 || average > testChunkerParams.Avg*2 {
+		t.Errorf("average chunk size %d, want near %d", average, testChunkerParams.Avg)
+	}
+}
+
+func TestChunkerSmallAndEmptyInput(t *testing.T) {
+	if chunks := chunkAll(t, nil, testChunkerParams); len(chunks) != 0 {
+		t.Errorf("empty input gave %d chunks, want none", len(chunks))
+	}
+	data := randomData(2, testChunkerParams.Min/2)
+	if chunks := chunkAll(t, data, testChunkerParams); len(chunks) != 1 || !bytes.Equal(chunks[0], data) {
+		t.Errorf("input below the minimum gave %d chunks, want one", len(chunks))
+	}
+}
+
+func TestChunkerCutsRepetitiveDataAtMaximum(t *testing.T) {
+	data := make([]byte, testChunkerParams.Max*3)
+	chunks := chunkAll(t, data, testChunkerParams)
+	if len(chunks) != 3 {
+		t.Fatalf("zeroed input gave %d chunks, want 3", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if len(chunk) != testChunkerParams.Max {
+			t.Errorf("chunk %d is %d bytes, want %d", i, len(chunk), testChunkerParams.Max)
+		}
+	}
+}
+
+func TestChunkerBoundariesFollowContent(t *testing.T) {
+	data := randomData(3, 512*1024)
+	// inserting bytes near the start only changes the chunks around the insertion
+	shifted := append(append(append([]byte(nil), data[:10000]...), []byte("inserted")...), data[10000:]...)
+
+	original := map[[32]byte]bool{}
+	for _, chunk := range chunkAll(t, data, testChunkerParams) {
+		original[sha256.Sum256(chunk)] = true
+	}
+	shiftedChunks := chunkAll(t, shifted, testChunkerParams)
+	shared := 0
+	for _, chunk := range shiftedChunks {
+		if original[sha256.Sum256(chunk)] {
+			shared++
+		}
+	}
+	if shared < len(shiftedChunks)-3 {
+		t.Errorf("only %d of %d chunks unchanged by an insertion", shared, len(shiftedChunks))
+	}
+}
+
+func TestChunkerParamsValidate(t *testing.T) {
+	if err := DefaultChunkerParams.validate(); err != nil {
+		t.Errorf("default parameters rejected: %v", err)
+	}
+	for _, params := range []ChunkerParams{
+		{Min: 0, Avg: 4096, Max: 16384},
+		{Min: 4096, Avg: 4096, Max: 16384},
+		{Min: 1024, Avg: 4096, Max: 4096},
+		{Min: 1024, Avg: 5000, Max: 16384},
+	} {
+		if err := params.validate(); err == nil {
+			t.Errorf("parameters %+v accepted, want error", params)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package repo
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// argon2id parameters for deriving the key which wraps a repository's keys from its password
+const (
+	kdfArgon2id = "argon2id"
+	kdfTime     = 3
+	kdfMemory   = 64 * 1024 // KiB
+	kdfThreads  = 4
+)
+
+// repository keys wrapped by a password derived key, stored in the repository config
+type KeyFile struct {
+	KDF     string `json:"kdf"`
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+	Data    []byte `json:"data"` // nonce followed by the sealed encryption & chunk id keys
+}
+
+// keys of an encrypted repository
+// chunk ids are keyed hashes, so stored chunk names reveal nothing about their content
+type keys struct {
+	encryption []byte
+	id         []byte
+	aead       cipher.AEAD
+}
+
+// generates new repository keys, wrapped by password
+func newKeyFile(password string) (*KeyFile, *keys, error) {
+	keyFile := &KeyFile{
+		KDF:     kdfArgon2id,
+		Salt:    make([]byte, 16),
+		Time:    kdfTime,
+		Memory:  kdfMemory,
+		Threads: kdfThreads,
+	}
+	keyMaterial := make([]byte, 64)
+	if _, err := rand.Read(keyFile.Salt); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key salt: %v", err)
+	}
+	if _, err := rand.Read(keyMaterial); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate repository keys: %v", err)
+	}
+
+	wrapKeys, err := newKeys(keyFile.deriveKey(password), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keyFile.Data, err = wrapKeys.seal(keyMaterial); err != nil {
+		return nil, nil, err
+	}
+
+	repoKeys, err := newKeys(keyMaterial[:32], keyMaterial[32:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return keyFile, repoKeys, nil
+}
+
+// unwraps repository keys with password
+func (k *KeyFile) unlock(password string) (*keys, error) {
+	if k.KDF != kdfArgon2id {
+		return nil, fmt.Errorf("unsupported repository key derivation '%s'", k.KDF)
+	}
+	wrapKeys, err := newKeys(k.deriveKey(password), nil)
+	if err != nil {
+		return nil, err
+	}
+	keyMaterial, err := wrapKeys.open(k.Data)
+	if err != nil || len(keyMaterial) != 64 {
+		return nil, fmt.Errorf("wrong repository password")
+	}
+	return newKeys(keyMaterial[:32], keyMaterial[32:])
+}
+
+func (k *KeyFile) deriveKey(password string) []byte {
+	return argon2.IDKey([]byte(password), k.Salt, k.Time, k.Memory, k.Threads, 32)
+}
+
+func newKeys(encryptionKey, idKey []byte) (*keys, error) {
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise cipher: %v", err)
+	}
+	return &keys{encryption: encryptionKey, id: idKey, aead: aead}, nil
+}
+
+// encrypts data with AES-256-GCM under a random nonce, prepended to the sealed data
+func (k *keys) seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(data)+k.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return k.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func (k *keys) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < k.aead.NonceSize() {
+		return nil, fmt.Errorf("object too short to decrypt")
+	}
+	data, err := k.aead.Open(nil, sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt object: %v", err)
+	}
+	return data, nil
+}
+
+// returns the id a chunk is stored under, sha256 of its content or hmac-sha256 for encrypted repositories
+func (r *Repository) chunkID(data []byte) string {
+	if r.keys == nil {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, r.keys.id)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,85 @@
+package repo
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// outcome of pruning a repository
+type PruneResult struct {
+	Removed    []*Snapshot // snapshots beyond the retention policy
+	Chunks     int         // chunks no longer referenced by any remaining snapshot
+	FreedBytes int64
+}
+
+// removes all but the newest keepLast snapshots of each host, target & tag, then every chunk left unreferenced
+// target restricts pruning to snapshots of that target, dryRun reports what would be removed without removing it
+func (r *Repository) Prune(keepLast int, target string, dryRun bool) (*PruneResult, error) {
+	if keepLast <= 0 {
+		return nil, fmt.Errorf("keep-last must be at least 1")
+	}
+	unlock, err := r.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	// newest first within each group, so everything past keepLast expires
+	result := &PruneResult{}
+	kept := map[string]int{}
+	referenced := map[string]bool{}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snap := snapshots[i]
+		group := snap.Hostname + "\x00" + snap.Target + "\x00" + snap.Tag
+		if (target == "" || snap.Target == target) && kept[group] >= keepLast {
+			result.Removed = append(result.Removed, snap)
+			continue
+		}
+		kept[group]++
+		for _, file := range snap.Files {
+			for _, id := range file.Chunks {
+				referenced[id] = true
+			}
+		}
+	}
+
+	if !dryRun {
+		for _, snap := range result.Removed {
+			if err := os.Remove(r.snapshotPath(snap.ID)); err != nil {
+				return nil, fmt.Errorf("failed to remove snapshot %s: %v", snap.ID, err)
+			}
+		}
+	}
+
+	// leftover temporary files belong to interrupted backups, as the exclusive lock rules out running ones
+	err = filepath.WalkDir(filepath.Join(r.Dir, chunksDirName), func(chunkPath string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil || entry.IsDir() {
+			return walkErr
+		}
+		if referenced[entry.Name()] {
+			return nil
+		}
+		if !strings.HasPrefix(entry.Name(), ".tmp-") {
+			if info, err := entry.Info(); err == nil {
+				result.FreedBytes += info.Size()
+			}
+			result.Chunks++
+		}
+		if dryRun {
+			return nil
+		}
+		return os.Remove(chunkPath)
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to remove unreferenced chunks: %v", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,242 @@
+package repo
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// current repository format version
+const Version = 1
+
+const (
+	configName       = "config.json"
+	lockName         = "lock"
+	chunksDirName    = "chunks"
+	snapshotsDirName = "snapshots"
+)
+
+// stored object encodings, the first byte of every object once decrypted
+const (
+	encodingRaw   byte = 0
+	encodingFlate byte = 1
+)
+
+// repository settings, fixed once the repository is created
+type Config struct {
+	Version    int           `json:"version"`
+	ID         string        `json:"id"`
+	CreatedAt  time.Time     `json:"created_at"`
+	Chunker    ChunkerParams `json:"chunker"`
+	Encryption *KeyFile      `json:"encryption,omitempty"`
+}
+
+// content-addressed repository, storing deduplicated file chunks & snapshot indexes in a directory
+type Repository struct {
+	Dir    string
+	Config Config
+	keys   *keys // nil for unencrypted repositories
+}
+
+// reports whether dir holds a repository
+func Exists(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, configName))
+	return err == nil
+}
+
+// creates a repository in dir, encrypted when password is not empty
+func Init(dir, password string) (*Repository, error) {
+	if Exists(dir) {
+		return nil, fmt.Errorf("repository already exists at %s", dir)
+	}
+	for _, subDir := range []string{chunksDirName, snapshotsDirName} {
+		if err := os.MkdirAll(filepath.Join(dir, subDir), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create repository: %v", err)
+		}
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate repository id: %v", err)
+	}
+	repository := &Repository{
+		Dir: dir,
+		Config: Config{
+			Version:   Version,
+			ID:        hex.EncodeToString(idBytes),
+			CreatedAt: time.Now(),
+			Chunker:   DefaultChunkerParams,
+		},
+	}
+	if password != "" {
+		keyFile, repoKeys, err := newKeyFile(password)
+		if err != nil {
+			return nil, err
+		}
+		repository.Config.Encryption = keyFile
+		repository.keys = repoKeys
+	}
+
+	configData, err := json.MarshalIndent(repository.Config, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode repository config: %v", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, configName), configData); err != nil {
+		return nil, fmt.Errorf("failed to write repository config: %v", err)
+	}
+	return repository, nil
+}
+
+// reads the settings of the repository in dir, which are readable without the password
+func ReadConfig(dir string) (Config, error) {
+	var config Config
+	configData, err := os.ReadFile(filepath.Join(dir, configName))
+	if err != nil {
+		return config, fmt.Errorf("no repository found at %s: %v", dir, err)
+	}
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return config, fmt.Errorf("failed to parse repository config: %v", err)
+	}
+	return config, nil
+}
+
+// opens the repository in dir, password is required for encrypted repositories & ignored otherwise
+func Open(dir, password string) (*Repository, error) {
+	config, err := ReadConfig(dir)
+	if err != nil {
+		return nil, err
+	}
+	repository := &Repository{Dir: dir, Config: config}
+	if repository.Config.Version != Version {
+		return nil, fmt.Errorf("unsupported repository version %d", repository.Config.Version)
+	}
+	if err := repository.Config.Chunker.validate(); err != nil {
+		return nil, err
+	}
+
+	if repository.Config.Encryption != nil {
+		if password == "" {
+			return nil, fmt.Errorf("repository at %s is encrypted, a password is required", dir)
+		}
+		repository.keys, err = repository.Config.Encryption.unlock(password)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return repository, nil
+}
+
+// opens the repository in dir, creating it first when none exists
+func OpenOrInit(dir, password string) (*Repository, error) {
+	if !Exists(dir) {
+		return Init(dir, password)
+	}
+	return Open(dir, password)
+}
+
+// reports whether repository contents are encrypted
+func (r *Repository) Encrypted() bool {
+	return r.keys != nil
+}
+
+// holds the repository lock until the returned func is called
+// backups share the lock, while prune holds it exclusively so it never removes chunks of a backup in progress
+func (r *Repository) lock(exclusive bool) (func(), error) {
+	lockFile, err := os.OpenFile(filepath.Join(r.Dir, lockName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository lock: %v", err)
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(lockFile.Fd()), how|syscall.LOCK_NB); err != nil {
+		lockFile.Close()
+		return nil, fmt.Errorf("repository at %s is locked by another cargoport process", r.Dir)
+	}
+	return func() {
+		syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+		lockFile.Close()
+	}, nil
+}
+
+// compresses & encrypts object data for storage, compression is skipped for data which does not shrink
+func (r *Repository) encode(data []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	compressed.WriteByte(encodingFlate)
+	writer, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	encoded := compressed.Bytes()
+	if len(encoded) > len(data) {
+		encoded = append([]byte{encodingRaw}, data...)
+	}
+	if r.keys == nil {
+		return encoded, nil
+	}
+	return r.keys.seal(encoded)
+}
+
+// decrypts & decompresses stored object data
+func (r *Repository) decode(stored []byte) ([]byte, error) {
+	encoded := stored
+	if r.keys != nil {
+		var err error
+		if encoded, err = r.keys.open(stored); err != nil {
+			return nil, err
+		}
+	}
+	if len(encoded) == 0 {
+		return nil, fmt.Errorf("empty object")
+	}
+
+	switch encoded[0] {
+	case encodingRaw:
+		return encoded[1:], nil
+	case encodingFlate:
+		data, err := io.ReadAll(flate.NewReader(bytes.NewReader(encoded[1:])))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress object: %v", err)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("unknown object encoding %d", encoded[0])
+}
+
+// writes file via a temporary file renamed into place, so readers never see partial objects
+func writeFileAtomic(filePath string, data []byte) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(filePath), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	if err := os.Rename(tempFile.Name(), filePath); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	return nil
+}
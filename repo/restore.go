@@ -0,0 +1,152 @@
+package repo
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// recreates every file of snap beneath destDir, verifying each chunk as it is read
+// ownership is only restored when running as root
+func (r *Repository) Restore(snap *Snapshot, destDir string) error {
+	restoreOwners := os.Geteuid() == 0
+	var dirs, symlinks []File
+
+	for _, file := range snap.Files {
+		targetPath, err := restorePath(destDir, file.Path)
+		if err != nil {
+			return err
+		}
+
+		switch file.Type {
+		case FileTypeDir:
+			if err := os.MkdirAll(targetPath, 0700); err != nil {
+				return fmt.Errorf("failed to create directory %s: %v", targetPath, err)
+			}
+			dirs = append(dirs, file)
+		case FileTypeSymlink:
+			// symlinks are created once everything else is written, so none can redirect later entries
+			symlinks = append(symlinks, file)
+			continue
+		case FileTypeFile:
+			if err := r.restoreFile(file, targetPath); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown type '%s' of %s in snapshot", file.Type, file.Path)
+		}
+
+		if restoreOwners {
+			if err := os.Lchown(targetPath, file.UID, file.GID); err != nil {
+				return fmt.Errorf("failed to restore owner of %s: %v", targetPath, err)
+			}
+		}
+		if file.Type == FileTypeFile {
+			if err := restoreAttributes(targetPath, file); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, file := range symlinks {
+		// parents are checked again, as an earlier symlink may now sit above this one
+		targetPath, err := restorePath(destDir, file.Path)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0700); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %v", targetPath, err)
+		}
+		if info, err := os.Lstat(targetPath); err == nil && info.IsDir() {
+			return fmt.Errorf("snapshot symlink %s would replace a directory", file.Path)
+		}
+		os.Remove(targetPath)
+		if err := os.Symlink(file.Link, targetPath); err != nil {
+			return fmt.Errorf("failed to create symlink %s: %v", targetPath, err)
+		}
+		if restoreOwners {
+			if err := os.Lchown(targetPath, file.UID, file.GID); err != nil {
+				return fmt.Errorf("failed to restore owner of %s: %v", targetPath, err)
+			}
+		}
+	}
+
+	// directory attributes are restored last, as restoring their contents changes their mtimes
+	for i := len(dirs) - 1; i >= 0; i-- {
+		targetPath, err := restorePath(destDir, dirs[i].Path)
+		if err != nil {
+			return err
+		}
+		if err := restoreAttributes(targetPath, dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writes file content chunk by chunk
+func (r *Repository) restoreFile(file File, targetPath string) error {
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0700); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", targetPath, err)
+	}
+	os.Remove(targetPath) // replaces symlinks & read-only files rather than writing through them
+	targetFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", targetPath, err)
+	}
+	for _, id := range file.Chunks {
+		data, err := r.readChunk(id)
+		if err != nil {
+			targetFile.Close()
+			return fmt.Errorf("failed to restore %s: %v", file.Path, err)
+		}
+		if _, err := targetFile.Write(data); err != nil {
+			targetFile.Close()
+			return fmt.Errorf("failed to write %s: %v", targetPath, err)
+		}
+	}
+	if err := targetFile.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", targetPath, err)
+	}
+	return nil
+}
+
+func restoreAttributes(targetPath string, file File) error {
+	if err := os.Chmod(targetPath, fs.FileMode(file.Mode)); err != nil {
+		return fmt.Errorf("failed to restore mode of %s: %v", targetPath, err)
+	}
+	if err := os.Chtimes(targetPath, file.ModTime, file.ModTime); err != nil {
+		return fmt.Errorf("failed to restore mtime of %s: %v", targetPath, err)
+	}
+	return nil
+}
+
+// resolves snapshot path beneath destDir, rejecting paths which would escape it
+// either lexically or through a symlink in one of its parent directories
+func restorePath(destDir, snapshotPath string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(snapshotPath))
+	if filepath.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("snapshot path %s escapes the restore directory", snapshotPath)
+	}
+
+	parentPath := destDir
+	for _, component := range strings.Split(filepath.Dir(cleaned), string(filepath.Separator)) {
+		if component == "." {
+			break
+		}
+		parentPath = filepath.Join(parentPath, component)
+		info, err := os.Lstat(parentPath)
+		if os.IsNotExist(err) {
+			break // remaining parents are created as directories
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to check %s: %v", parentPath, err)
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("snapshot path %s escapes the restore directory through symlink %s", snapshotPath, parentPath)
+		}
+	}
+	return filepath.Join(destDir, cleaned), nil
+}
@@ -0,0 +1,89 @@
+package repo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupRestoreRoundTrip(t *testing.T) {
+	sourceDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(sourceDir, "config"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := randomData(4, 3*1024*1024)
+	if err := os.WriteFile(filepath.Join(sourceDir, "config", "data.bin"), content, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("config/data.bin", filepath.Join(sourceDir, "current")); err != nil {
+		t.Fatal(err)
+	}
+
+	repository, err := Init(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := &Snapshot{ID: "test", Time: time.Now()}
+	if _, err := repository.Backup(snap, []Source{{Dir: sourceDir, Path: "app"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	destDir := t.TempDir()
+	if err := repository.Restore(snap, destDir); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := os.ReadFile(filepath.Join(destDir, "app", "config", "data.bin"))
+	if err != nil || string(restored) != string(content) {
+		t.Fatalf("restored content differs from source: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(destDir, "app", "config", "data.bin")); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("restored mode = %v, %v, want 0640", info.Mode().Perm(), err)
+	}
+	if link, err := os.Readlink(filepath.Join(destDir, "app", "current")); err != nil || link != "config/data.bin" {
+		t.Errorf("restored symlink = %q, %v, want config/data.bin", link, err)
+	}
+}
+
+func TestRestoreRejectsWritesThroughSymlinks(t *testing.T) {
+	repository, err := Init(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]File{
+		"file beneath a snapshot symlink": {
+			{Path: "a", Type: FileTypeSymlink, Link: "OUTSIDE"},
+			{Path: "a/passwd", Type: FileTypeFile, Mode: 0644},
+		},
+		"symlink beneath a snapshot symlink": {
+			{Path: "a", Type: FileTypeSymlink, Link: "OUTSIDE"},
+			{Path: "a/passwd", Type: FileTypeSymlink, Link: "/dev/null"},
+		},
+		"file beneath an existing symlink": {
+			{Path: "existing/passwd", Type: FileTypeFile, Mode: 0644},
+		},
+		"path outside the restore dir": {
+			{Path: "../passwd", Type: FileTypeFile, Mode: 0644},
+		},
+	}
+	for name, files := range tests {
+		outsideDir := t.TempDir()
+		destDir := t.TempDir()
+		if err := os.Symlink(outsideDir, filepath.Join(destDir, "existing")); err != nil {
+			t.Fatal(err)
+		}
+		for i := range files {
+			if files[i].Link == "OUTSIDE" {
+				files[i].Link = outsideDir
+			}
+		}
+
+		if err := repository.Restore(&Snapshot{Files: files}, destDir); err == nil {
+			t.Errorf("%s: restore succeeded, want error", name)
+		}
+		if entries, _ := os.ReadDir(outsideDir); len(entries) != 0 {
+			t.Errorf("%s: restore wrote %s outside the restore dir", name, entries[0].Name())
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// file types recorded in snapshot indexes
+const (
+	FileTypeFile    = "file"
+	FileTypeDir     = "dir"
+	FileTypeSymlink = "symlink"
+)
+
+// index of a single backup, listing every file & the chunks holding its content
+type Snapshot struct {
+	ID               string            `json:"id"` // job id of the backup
+	Time             time.Time         `json:"time"`
+	Hostname         string            `json:"hostname"`
+	Target           string            `json:"target"`
+	TargetDir        string            `json:"target_dir"`
+	Tag              string            `json:"tag,omitempty"`
+	Docker           bool              `json:"docker"`
+	CargoportVersion string            `json:"cargoport_version"`
+	ServiceStates    map[string]string `json:"service_states,omitempty"`
+	Snapshot         string            `json:"snapshot,omitempty"` // filesystem snapshot provider the backup was taken from
+
+	Size       int64  `json:"size_bytes"`  // total size of files in the snapshot
+	AddedBytes int64  `json:"added_bytes"` // stored size of chunks first written by this snapshot
+	Files      []File `json:"files"`
+}
+
+// file within a snapshot, paths are slash separated & start with the target's base name as in tar archives
+type File struct {
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Mode    uint32    `json:"mode"`
+	UID     int       `json:"uid"`
+	GID     int       `json:"gid"`
+	ModTime time.Time `json:"mtime"`
+	Size    int64     `json:"size,omitempty"`
+	Link    string    `json:"link,omitempty"`
+	Chunks  []string  `json:"chunks,omitempty"`
+}
+
+// writes snapshot index, the backup it records is only visible once this completes
+func (r *Repository) saveSnapshot(snap *Snapshot) error {
+	snapshotData, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %v", err)
+	}
+	stored, err := r.encode(snapshotData)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %v", err)
+	}
+	if err := writeFileAtomic(r.snapshotPath(snap.ID), stored); err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	return nil
+}
+
+// reads snapshot by id, or by a prefix matching a single snapshot id
+func (r *Repository) LoadSnapshot(id string) (*Snapshot, error) {
+	ids, err := r.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, candidate := range ids {
+		if candidate == id {
+			matches = []string{candidate}
+			break
+		}
+		if strings.HasPrefix(candidate, id) {
+			matches = append(matches, candidate)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no snapshot '%s' in repository", id)
+	case 1:
+		return r.readSnapshot(matches[0])
+	}
+	return nil, fmt.Errorf("snapshot id '%s' is ambiguous, matching %d snapshots", id, len(matches))
+}
+
+// reads every snapshot in the repository, oldest first
+func (r *Repository) Snapshots() ([]*Snapshot, error) {
+	ids, err := r.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*Snapshot
+	for _, id := range ids {
+		snap, err := r.readSnapshot(id)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snap)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.Before(snapshots[j].Time)
+	})
+	return snapshots, nil
+}
+
+func (r *Repository) readSnapshot(id string) (*Snapshot, error) {
+	stored, err := os.ReadFile(r.snapshotPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot %s: %v", id, err)
+	}
+	snapshotData, err := r.decode(stored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %s: %v", id, err)
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(snapshotData, &snap); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot %s: %v", id, err)
+	}
+	return &snap, nil
+}
+
+func (r *Repository) snapshotIDs() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(r.Dir, snapshotsDirName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %v", err)
+	}
+	var ids []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
+
+func (r *Repository) snapshotPath(id string) string {
+	return filepath.Join(r.Dir, snapshotsDirName, id)
+}
+
+func (r *Repository) chunkPath(id string) string {
+	return filepath.Join(r.Dir, chunksDirName, id[:2], id)
+}
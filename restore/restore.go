@@ -0,0 +1,263 @@
+package restore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/backup"
+	"github.com/adrian-griffin/cargoport/dockerapi"
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/logger"
+	"github.com/adrian-griffin/cargoport/repo"
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// restore options passed from `cargoport restore`
+type Options struct {
+	ArchivePath string
+	DestDir     string
+	Pin         bool // generate pinned compose override from the archived lockfile
+	Up          bool // bring restored compose project up once extracted
+	LoadImages  bool // load embedded images missing from the local engine
+	ImageDirs   []string
+
+	// wait for started services to become healthy, failing the restore when they do not
+	VerifyHealth  bool
+	HealthTimeout time.Duration
+	SettleTime    time.Duration
+
+	// job id restore is logged under, such as the migration invoking it, empty for standalone restores
+	JobID string
+}
+
+// base logging fields for restore, tagged with the invoking job when set
+func restoreLogFields(opts Options, fields map[string]interface{}) map[string]interface{} {
+	fields["package"] = "restore"
+	fields["dest_dir"] = opts.DestDir
+	if opts.JobID != "" {
+		fields["job_id"] = opts.JobID
+	}
+	return fields
+}
+
+// verifies & extracts archive into destination, pinning & starting compose services when requested
+func RunRestore(opts Options) error {
+	logFields := restoreLogFields(opts, map[string]interface{}{
+		"archive": filepath.Base(opts.ArchivePath),
+	})
+
+	// target & service states come from the requested archive, even when restoring a chain
+	target := ""
+	var serviceStates map[string]string
+	if manifest, err := backup.ReadManifest(opts.ArchivePath); err == nil {
+		target = manifest.Target
+		serviceStates = manifest.ServiceStates
+	}
+
+	// incremental & differential archives are restored on top of every archive they depend on, oldest first
+	chain, err := backup.ResolveChain(opts.ArchivePath)
+	if err != nil {
+		return err
+	}
+	if len(chain) > 1 {
+		logger.LogxWithFields("info", fmt.Sprintf("Restoring backup chain of %d archives, starting from %s", len(chain), filepath.Base(chain[0])), logFields)
+	}
+
+	if err := os.MkdirAll(opts.DestDir, 0755); err != nil {
+		return fmt.Errorf("failed to create destination %s: %v", opts.DestDir, err)
+	}
+	for _, archivePath := range chain {
+		if err := extractArchive(archivePath, opts.DestDir, len(chain) > 1); err != nil {
+			return err
+		}
+	}
+	logger.LogxWithFields("info", fmt.Sprintf("Archive extracted to %s", opts.DestDir), logFields)
+
+	return finishRestore(opts, target, serviceStates, logFields)
+}
+
+// restores a snapshot from the backup repository into destination, pinning & starting compose services when requested
+func RunRepoRestore(repository *repo.Repository, snapshotID string, opts Options) error {
+	snap, err := repository.LoadSnapshot(snapshotID)
+	if err != nil {
+		return err
+	}
+	logFields := restoreLogFields(opts, map[string]interface{}{
+		"snapshot_id": snap.ID,
+	})
+
+	if err := os.MkdirAll(opts.DestDir, 0755); err != nil {
+		return fmt.Errorf("failed to create destination %s: %v", opts.DestDir, err)
+	}
+	if err := repository.Restore(snap, opts.DestDir); err != nil {
+		return fmt.Errorf("failed to restore snapshot %s: %v", snap.ID, err)
+	}
+	logger.LogxWithFields("info", fmt.Sprintf("Snapshot %s of %s restored to %s", snap.ID, snap.Target, opts.DestDir), logFields)
+
+	// plain directory snapshots hold no compose project to pin or start
+	if !snap.Docker && !opts.Up {
+		return nil
+	}
+	return finishRestore(opts, snap.Target, snap.ServiceStates, logFields)
+}
+
+// pins, loads images for & starts the restored compose project of target as requested by opts
+func finishRestore(opts Options, target string, serviceStates map[string]string, logFields map[string]interface{}) error {
+	composeDir, err := findRestoredComposeDir(opts.DestDir, target)
+	if err != nil {
+		if opts.Pin || opts.Up {
+			return err
+		}
+		return nil
+	}
+
+	// pin services to their locked digests
+	composeFiles := []string{}
+	lock, err := backup.ReadImageLock(composeDir)
+	if err == nil {
+		composeFiles = append(composeFiles, filepath.Join(composeDir, lock.ComposeFile))
+	}
+	lockErr := err
+
+	// load embedded images prior to pinning, as loaded images need no registry digest
+	loaded := map[string]bool{}
+	if opts.LoadImages && lockErr == nil {
+		client, err := dockerapi.NewClient()
+		if err != nil {
+			return err
+		}
+		loaded, err = backup.LoadEmbeddedImages(client, lock, opts.ImageDirs)
+		if err != nil {
+			return err
+		}
+		if len(loaded) > 0 {
+			logger.LogxWithFields("info", fmt.Sprintf("Loaded embedded images for %d service(s)", len(loaded)), logFields)
+		}
+	}
+
+	if opts.Pin {
+		if lockErr != nil {
+			return fmt.Errorf("cannot pin images: %v", lockErr)
+		}
+		overridePath, unpinned, err := backup.WritePinnedOverride(composeDir, lock, loaded)
+		if err != nil {
+			return err
+		}
+		composeFiles = append(composeFiles, overridePath)
+		logger.LogxWithFields("info", fmt.Sprintf("Pinned compose override written to %s", overridePath), logFields)
+		if len(unpinned) > 0 {
+			logger.LogxWithFields("warn", fmt.Sprintf("Locally built services could not be pinned to a digest: %s", strings.Join(unpinned, ", ")), logFields)
+		}
+	}
+
+	if !opts.Up {
+		return nil
+	}
+	if len(composeFiles) == 0 {
+		composeFiles = append(composeFiles, filepath.Join(composeDir, "docker-compose.yml"))
+	}
+
+	// reproduce the service states recorded at backup time, archives without them start every service
+	if len(serviceStates) > 0 {
+		if err := backup.StartRecordedServices(composeFiles, serviceStates); err != nil {
+			return fmt.Errorf("failed to start restored compose project: %v", err)
+		}
+		if err := verifyRestoredHealth(opts, target, composeFiles[0], serviceStates, logFields); err != nil {
+			return err
+		}
+		client, err := dockerapi.NewClient()
+		if err != nil {
+			return err
+		}
+		if err := backup.PauseRecordedServices(client, composeFiles[0], serviceStates); err != nil {
+			return err
+		}
+		logger.LogxWithFields("info", fmt.Sprintf("Restored compose project from %s to its recorded service states", composeDir), logFields)
+		return nil
+	}
+
+	composeArgs := []string{"compose"}
+	for _, composeFile := range composeFiles {
+		composeArgs = append(composeArgs, "-f", composeFile)
+	}
+	composeArgs = append(composeArgs, "up", "-d")
+	if err := util.RunCommand("docker", composeArgs...); err != nil {
+		return fmt.Errorf("failed to start restored compose project: %v", err)
+	}
+	if err := verifyRestoredHealth(opts, target, composeFiles[0], nil, logFields); err != nil {
+		return err
+	}
+	logger.LogxWithFields("info", fmt.Sprintf("Restored compose project started from %s", composeDir), logFields)
+	return nil
+}
+
+// waits for started services to become healthy when requested, before any recorded as paused are paused again
+func verifyRestoredHealth(opts Options, target, composeFilePath string, serviceStates map[string]string, logFields map[string]interface{}) error {
+	if !opts.VerifyHealth {
+		return nil
+	}
+	logger.LogxWithFields("info", fmt.Sprintf("Waiting up to %s for restored services to become healthy", opts.HealthTimeout), logFields)
+	context := &job.JobContext{
+		Target:        target,
+		JobID:         opts.JobID,
+		Docker:        true,
+		HealthTimeout: opts.HealthTimeout,
+		SettleTime:    opts.SettleTime,
+	}
+	if err := backup.VerifyComposeHealth(context, composeFilePath, serviceStates); err != nil {
+		return fmt.Errorf("restored compose project failed health verification: %v", err)
+	}
+	logger.LogxWithFields("info", "Restored services passed health verification", logFields)
+	return nil
+}
+
+// verifies archive against its sidecar manifest when present & extracts it into destination
+// chained archives are extracted as incremental, replaying files deleted since their parent
+func extractArchive(archivePath, destDir string, chained bool) error {
+	logFields := map[string]interface{}{
+		"package":  "restore",
+		"archive":  filepath.Base(archivePath),
+		"dest_dir": destDir,
+	}
+
+	expectedSHA256 := ""
+	if manifest, err := backup.ReadManifest(archivePath); err == nil {
+		expectedSHA256 = manifest.SHA256
+	} else {
+		logger.LogxWithFields("warn", "No manifest found alongside archive, checksum will not be verified", logFields)
+	}
+
+	compression, err := backup.DetectCompression(archivePath)
+	if err != nil {
+		return err
+	}
+	if err := backup.VerifyArchive(archivePath, expectedSHA256); err != nil {
+		return fmt.Errorf("archive %s failed verification: %v", filepath.Base(archivePath), err)
+	}
+
+	tarArgs := append([]string{"-x"}, backup.TarCompressionFlags(compression)...)
+	if chained {
+		tarArgs = append(tarArgs, "--listed-incremental=/dev/null")
+	}
+	tarArgs = append(tarArgs, "-f", archivePath, "-C", destDir)
+	if output, err := util.RunCommandWithOutput("tar", tarArgs...); err != nil {
+		return fmt.Errorf("failed to extract archive %s: %v", filepath.Base(archivePath), strings.TrimSpace(output))
+	}
+	logger.LogxWithFields("debug", fmt.Sprintf("Extracted %s to %s", filepath.Base(archivePath), destDir), logFields)
+	return nil
+}
+
+// locates restored compose project dir, named after the backup target
+func findRestoredComposeDir(destDir, target string) (string, error) {
+	if target != "" {
+		return filepath.Join(destDir, target), nil
+	}
+	lockFiles, _ := filepath.Glob(filepath.Join(destDir, "*", backup.LockFileName))
+	if len(lockFiles) == 1 {
+		return filepath.Dir(lockFiles[0]), nil
+	}
+	return "", fmt.Errorf("unable to determine restored compose project within %s", destDir)
+}
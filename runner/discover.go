@@ -0,0 +1,132 @@
+package runner
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/discover"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/logger"
+)
+
+// outcome of a discovered project's backup job
+type ProjectResult struct {
+	Project   discover.Project
+	JobID     string
+	Success   bool
+	Skipped   string // reason the project was not backed up
+	Error     string
+	SizeBytes int64
+	Duration  time.Duration
+}
+
+// runs a backup job per discovered project, skipping excluded projects & those whose compose file is gone
+// base holds the unvalidated inputs shared by every job, per-project overrides from config are applied on top
+func RunDiscovered(base input.InputContext, projects []discover.Project) []ProjectResult {
+	var results []ProjectResult
+	for _, project := range projects {
+		result := ProjectResult{Project: project}
+		switch {
+		case project.Excluded:
+			result.Skipped = "excluded"
+		case project.Status == discover.StatusMissing:
+			result.Skipped = "compose file missing"
+		case project.Error != "":
+			result.Error = fmt.Sprintf("invalid cargoport labels: %s", project.Error)
+			results = append(results, result)
+			continue
+		case !project.Due:
+			result.Skipped = fmt.Sprintf("not due, schedule '%s'", project.Schedule)
+		}
+		if result.Skipped != "" {
+			results = append(results, result)
+			continue
+		}
+
+		inputctx := base
+		inputctx.Discover = false
+		inputctx.TargetDir = project.Dir
+		inputctx.Labels = project.Labels
+		applyProjectOverrides(&inputctx, project)
+
+		startTime := time.Now()
+		if err := input.ValidateInputs(&inputctx); err != nil {
+			result.Error = err.Error()
+			result.Duration = time.Since(startTime)
+			results = append(results, result)
+			continue
+		}
+		entry, err := RunJob(&inputctx)
+		result.JobID = entry.JobID
+		result.Success = err == nil
+		result.SizeBytes = entry.SizeBytes
+		result.Duration = time.Since(startTime)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	logDiscoveredResults(results)
+	return results
+}
+
+// applies config overrides for project, flags passed on the command line still take precedence
+func applyProjectOverrides(inputctx *input.InputContext, project discover.Project) {
+	overrides, ok := inputctx.Config.Discover.FindProject(project.Name)
+	if !ok {
+		return
+	}
+	if inputctx.Tag == "" {
+		inputctx.Tag = overrides.Tag
+	}
+	if len(inputctx.RemoteNames) == 0 && len(overrides.Remotes) > 0 {
+		inputctx.RemoteNames = overrides.Remotes
+	}
+	if inputctx.StopStrategy == "" {
+		inputctx.StopStrategy = overrides.StopStrategy
+	}
+	if len(inputctx.StopServices) == 0 {
+		inputctx.StopServices = overrides.StopServices
+	}
+	inputctx.EmbedImages = inputctx.EmbedImages || overrides.EmbedImages
+	inputctx.SkipHealthCheck = inputctx.SkipHealthCheck || overrides.SkipHealthCheck
+}
+
+// logs a summary line per project & overall totals
+func logDiscoveredResults(results []ProjectResult) {
+	succeeded, failed, skipped := 0, 0, 0
+	for _, result := range results {
+		fields := map[string]interface{}{
+			"package":  "discover",
+			"target":   result.Project.Name,
+			"dir":      result.Project.Dir,
+			"status":   result.Project.Status,
+			"job_id":   result.JobID,
+			"duration": fmt.Sprintf("%.2fs", result.Duration.Seconds()),
+		}
+		switch {
+		case result.Skipped != "":
+			skipped++
+			fields["skipped"] = result.Skipped
+			logger.LogxWithFields("info", fmt.Sprintf("Discovered project %s skipped: %s", result.Project.Name, result.Skipped), fields)
+		case result.Success:
+			succeeded++
+			fields["success"] = true
+			logger.LogxWithFields("info", fmt.Sprintf("Discovered project %s backed up", result.Project.Name), fields)
+		default:
+			failed++
+			fields["success"] = false
+			logger.LogxWithFields("error", fmt.Sprintf("Discovered project %s failed: %s", result.Project.Name, result.Error), fields)
+		}
+	}
+	level := "info"
+	if failed > 0 {
+		level = "error"
+	}
+	logger.LogxWithFields(level, fmt.Sprintf("Discovery run complete: %d succeeded, %d failed, %d skipped", succeeded, failed, skipped), map[string]interface{}{
+		"package":   "discover",
+		"succeeded": succeeded,
+		"failed":    failed,
+		"skipped":   skipped,
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/adrian-griffin/cargoport/job"
 	"github.com/adrian-griffin/cargoport/logger"
 	"github.com/adrian-griffin/cargoport/meta"
+	"github.com/adrian-griffin/cargoport/notify"
 	"github.com/adrian-griffin/cargoport/util"
 )
 
@@ -30,13 +31,26 @@ func jobhandlerLogDebugFields(context *job.JobContext) map[string]interface{} {
 	return fields
 }
 
-func RunJob(inputctx *input.InputContext) error {
+// runs a single backup job & records its outcome in the history ledger, returning the recorded entry
+func RunJob(inputctx *input.InputContext) (job.LedgerEntry, error) {
+	jobCTX := newJobContext(inputctx)
+	outputFilePath, err := runBackupJob(inputctx, &jobCTX)
+
+	entry := job.LedgerEntry{Kind: "backup"}
+	if !jobCTX.SkipLocal {
+		entry.Archive = outputFilePath
+	}
+	return recordJob(inputctx, &jobCTX, entry, err), err
+}
+
+// builds context for a new job from validated inputs
+func newJobContext(inputctx *input.InputContext) job.JobContext {
 	// generate job ID & populate jobcontext
 	jobID := job.GenerateJobID()
 
 	jobCTX := job.JobContext{
 		Target:                 "",
-		Remote:                 (inputctx.RemoteHost != ""),
+		Remote:                 (len(inputctx.Destinations) > 0),
 		Docker:                 false,
 		SkipLocal:              inputctx.SkipLocal,
 		JobID:                  jobID,
@@ -49,8 +63,75 @@ func RunJob(inputctx *input.InputContext) error {
 		RemoteUser:             string(inputctx.RemoteUser),
 		CompressedSizeBytesInt: 0,
 		CompressedSizeMBString: "0.0 MB",
+		EmbedImages:            inputctx.EmbedImages,
+		ImageStoreDir:          filepath.Join(inputctx.Config.DefaultCargoportDir, "images"),
+		StopStrategy:           inputctx.StopStrategy,
+		StopServices:           inputctx.StopServices,
+		StopTimeout:            time.Duration(inputctx.Config.DockerStopTimeout) * time.Second,
+		HealthCheck:            !inputctx.SkipHealthCheck,
+		HealthTimeout:          time.Duration(inputctx.Config.DockerHealthTimeout) * time.Second,
+		SettleTime:             time.Duration(inputctx.Config.DockerSettleTime) * time.Second,
+	}
+	if inputctx.Labels != nil {
+		jobCTX.ArchiveExclude = inputctx.Labels.Exclude
+		jobCTX.PreHooks = inputctx.Labels.PreHooks
+		jobCTX.Dumps = inputctx.Labels.Dumps
+	}
+	return jobCTX
+}
+
+// runs backup job steps, returning local output file path
+func runBackupJob(inputctx *input.InputContext, jobCTX *job.JobContext) (string, error) {
+	outputFilePath, err := runJob(inputctx, jobCTX)
+
+	// incremental chains only advance past archives which completed, streamed archives are never held locally
+	if err != nil {
+		backup.DiscardIncrementalIndex(jobCTX)
+	} else {
+		chainArchive := outputFilePath
+		if inputctx.Stream {
+			chainArchive = ""
+		}
+		if chainErr := backup.CommitChain(jobCTX, inputctx, chainArchive); chainErr != nil {
+			logger.LogxWithFields("warn", fmt.Sprintf("Failed to update incremental chain: %v", chainErr), logger.CoreLogFields(jobCTX, "jobhandler"))
+		}
+	}
+	return outputFilePath, err
+}
+
+// completes entry from job outcome, records it in the history ledger & notifies failures, returning the recorded entry
+func recordJob(inputctx *input.InputContext, jobCTX *job.JobContext, entry job.LedgerEntry, err error) job.LedgerEntry {
+	entry.JobID = jobCTX.JobID
+	entry.Time = jobCTX.StartTime
+	entry.Target = jobCTX.Target
+	entry.Tag = jobCTX.Tag
+	entry.SizeBytes = jobCTX.CompressedSizeBytesInt
+	entry.SHA256 = jobCTX.ArchiveSHA256
+	entry.Success = err == nil
+	entry.Duration = time.Since(jobCTX.StartTime).Seconds()
+	entry.Remotes = jobCTX.RemoteResults
+	entry.Snapshot = jobCTX.RepoSnapshotID
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if ledgerErr := job.AppendLedger(jobCTX.RootDir, entry); ledgerErr != nil {
+		logger.LogxWithFields("warn", fmt.Sprintf("Failed to record job in history ledger: %v", ledgerErr), logger.CoreLogFields(jobCTX, "jobhandler"))
+	}
+
+	// failed jobs, including services failing to come back after backup, are sent to the notification webhook
+	if err != nil && inputctx.Config.NotifyWebhookURL != "" {
+		event := notify.NewEvent(notify.EventJobFailed, jobCTX.JobID, jobCTX.Target, err.Error())
+		if notifyErr := notify.SendWebhook(inputctx.Config.NotifyWebhookURL, event); notifyErr != nil {
+			logger.LogxWithFields("warn", fmt.Sprintf("Failed to send job failure notification: %v", notifyErr), logger.CoreLogFields(jobCTX, "jobhandler"))
+		}
 	}
 
+	return entry
+}
+
+// performs backup job steps, returns local output file path
+func runJob(inputctx *input.InputContext, jobCTX *job.JobContext) (string, error) {
+
 	// log & print job start
 	logger.LogxWithFields("info", " --------------------------------------------------- ", map[string]interface{}{
 		"package": "spacer",
@@ -58,14 +139,32 @@ func RunJob(inputctx *input.InputContext) error {
 	})
 
 	// resolve target dir intended for backup
-	composeFilePath, outputFilePath, err := backup.ResolveTarget(inputctx, &jobCTX)
+	composeFilePath, outputFilePath, err := backup.ResolveTarget(inputctx, jobCTX)
 	if err != nil {
-		return fmt.Errorf("error determining intended backup target: %v", err)
+		return "", fmt.Errorf("error determining intended backup target: %v", err)
 	}
 
 	// define jobhandler logging
-	coreFields := logger.CoreLogFields(&jobCTX, "jobhandler")
-	verboseFields := jobhandlerLogDebugFields(&jobCTX)
+	coreFields := logger.CoreLogFields(jobCTX, "jobhandler")
+	verboseFields := jobhandlerLogDebugFields(jobCTX)
+
+	// permission pre-check, explains exactly what is inaccessible when running without root
+	if jobCTX.Docker {
+		if err := util.CheckDockerAccess(); err != nil {
+			logger.LogxWithFields("error", fmt.Sprintf("Docker permission pre-check failed: %v", err), coreFields)
+			return "", err
+		}
+	}
+	for _, mount := range jobCTX.ArchiveMounts {
+		if err := util.CheckReadable(mount.Source); err != nil {
+			logger.LogxWithFields("error", fmt.Sprintf("Permission pre-check failed: %v", err), coreFields)
+			return "", err
+		}
+	}
+	if err := util.CheckReadable(jobCTX.TargetDir); err != nil {
+		logger.LogxWithFields("error", fmt.Sprintf("Permission pre-check failed: %v", err), coreFields)
+		return "", err
+	}
 
 	logger.LogxWithFields("info", "New backup job added", map[string]interface{}{
 		"package": "jobhandler",
@@ -84,55 +183,70 @@ func RunJob(inputctx *input.InputContext) error {
 
 	// handle pre-backup docker tasks
 	if jobCTX.Docker {
-		if err := backup.HandleDockerPreBackup(&jobCTX, composeFilePath, targetBaseName); err != nil {
+		if err := backup.HandleDockerPreBackup(jobCTX, composeFilePath, targetBaseName); err != nil {
 			logger.LogxWithFields("error", fmt.Sprintf("error performing pre-snapshot docker tasks: %v", err), coreFields)
-			return err
+			return outputFilePath, err
 		}
 	}
 
-	// attempt compression of data; if fail && dockerEnabled then attempt to handle docker restart
-	if err := backup.ShellCompressDirectory(&jobCTX, jobCTX.TargetDir, outputFilePath); err != nil {
-
-		// if docker restart fails, log error
+	// snapshot target dir while services are offline, bringing them back online before archiving rather than after
+	snap, err := backup.CreateSnapshot(jobCTX, inputctx.SnapshotProvider, inputctx.Config.DefaultCargoportDir)
+	if err != nil {
+		logger.LogxWithFields("error", fmt.Sprintf("error creating snapshot: %v", err), coreFields)
 		if jobCTX.Docker {
-			if dockererr := backup.HandleDockerPostBackup(&jobCTX, composeFilePath, jobCTX.RestartDocker); dockererr != nil {
-				logger.LogxWithFields("error", fmt.Sprintf("error handling docker compose after backup: %v", dockererr), coreFields)
-				return err
+			if dockererr := backup.HandleDockerPostBackup(jobCTX, composeFilePath, jobCTX.RestartDocker); dockererr != nil {
+				logger.LogxWithFields("error", fmt.Sprintf("error reinitializing docker service after failed snapshot: %v", dockererr), coreFields)
 			}
 		}
-
-		logger.LogxWithFields("error", fmt.Sprintf("error compressing target: %v", err), coreFields)
-		return err
+		return outputFilePath, err
 	}
+	releaseSnapshot := func() {
+		if snap != nil {
+			backup.RemoveSnapshot(jobCTX, snap)
+			snap = nil
+		}
+	}
+	defer releaseSnapshot()
 
-	// handle remote transfer
-	if inputctx.RemoteHost != "" {
-		err := backup.HandleRemoteTransfer(&jobCTX, outputFilePath, inputctx)
-		if err != nil {
-			// if remote fail, then remove tempfile when skipLocal enabled
-			if jobCTX.SkipLocal {
-				util.RemoveTempFile(&jobCTX, outputFilePath)
-				logger.LogxWithFields("debug", fmt.Sprintf("Removing local tempfile %s", outputFilePath), verboseFields)
-
-			}
+	// the snapshot is archived regardless of services failing to come back, the job still fails afterwards
+	var restartErr error
+	if snap != nil && jobCTX.Docker {
+		if restartErr = backup.HandleDockerPostBackup(jobCTX, composeFilePath, jobCTX.RestartDocker); restartErr != nil {
+			logger.LogxWithFields("error", fmt.Sprintf("error restarting docker service, archiving snapshot regardless: %v", restartErr), coreFields)
+		}
+	}
 
-			// if remote fail, then handle post-backup docker jobs
+	// repository format stores a deduplicated snapshot, stream mode compresses straight to remote destinations,
+	// otherwise compress locally & transfer
+	if inputctx.Format == input.BackupFormatRepo {
+		if err := repositoryAndTransfer(inputctx, jobCTX, composeFilePath, releaseSnapshot); err != nil {
+			return outputFilePath, err
+		}
+	} else if inputctx.Stream {
+		if err := backup.StreamToRemotes(jobCTX, inputctx, backup.ArchiveSourceDir(jobCTX), filepath.Base(outputFilePath)); err != nil {
 			if jobCTX.Docker {
-				if err := backup.HandleDockerPostBackup(&jobCTX, composeFilePath, jobCTX.RestartDocker); err != nil {
-					logger.LogxWithFields("error", fmt.Sprintf("error reinitializing docker service after failed transfer: %v", err), coreFields)
-					return err
+				if dockererr := backup.HandleDockerPostBackup(jobCTX, composeFilePath, jobCTX.RestartDocker); dockererr != nil {
+					logger.LogxWithFields("error", fmt.Sprintf("error reinitializing docker service after failed stream: %v", dockererr), coreFields)
+					return "", err
 				}
 			}
-			logger.LogxWithFields("error", fmt.Sprintf("error completing remote transfer: %v", err), verboseFields)
-			return err
+			logger.LogxWithFields("error", fmt.Sprintf("error streaming to remote: %v", err), verboseFields)
+			return "", err
 		}
+	} else {
+		if err := compressAndTransfer(inputctx, jobCTX, composeFilePath, outputFilePath, releaseSnapshot); err != nil {
+			return outputFilePath, err
+		}
+	}
+	if restartErr != nil {
+		return outputFilePath, restartErr
 	}
 
 	// handle docker post backup
 	if jobCTX.Docker {
-		if err := backup.HandleDockerPostBackup(&jobCTX, composeFilePath, jobCTX.RestartDocker); err != nil {
+		if err := backup.HandleDockerPostBackup(jobCTX, composeFilePath, jobCTX.RestartDocker); err != nil {
 			logger.LogxWithFields("error", fmt.Sprintf("error restarting docker service: %v", err), coreFields)
-			return err
+			return outputFilePath, err
 		}
 	}
 
@@ -149,12 +263,105 @@ func RunJob(inputctx *input.InputContext) error {
 		"duration": fmt.Sprintf("%.2fs", executionSeconds),
 		"success":  true,
 		"size":     jobCTX.CompressedSizeMBString,
+		"remotes":  len(jobCTX.RemoteResults),
 	})
 	logger.LogxWithFields("info", " --------------------------------------------------- ", map[string]interface{}{
 		"package":    "spacer",
 		"end_job_id": jobCTX.JobID,
 	})
 
+	return outputFilePath, nil
+}
+
+// compresses target to local output file & handles remote transfer when destinations are defined
+// the snapshot is released as soon as the archive is written, rather than held for the transfer
+func compressAndTransfer(inputctx *input.InputContext, jobCTX *job.JobContext, composeFilePath, outputFilePath string, releaseSnapshot func()) error {
+
+	// define jobhandler logging
+	coreFields := logger.CoreLogFields(jobCTX, "jobhandler")
+	verboseFields := jobhandlerLogDebugFields(jobCTX)
+
+	// attempt compression of data; if fail && dockerEnabled then attempt to handle docker restart
+	err := backup.ShellCompressDirectory(jobCTX, backup.ArchiveSourceDir(jobCTX), outputFilePath)
+	releaseSnapshot()
+	if err != nil {
+
+		// if docker restart fails, log error
+		if jobCTX.Docker {
+			if dockererr := backup.HandleDockerPostBackup(jobCTX, composeFilePath, jobCTX.RestartDocker); dockererr != nil {
+				logger.LogxWithFields("error", fmt.Sprintf("error handling docker compose after backup: %v", dockererr), coreFields)
+				return err
+			}
+		}
+
+		logger.LogxWithFields("error", fmt.Sprintf("error compressing target: %v", err), coreFields)
+		return err
+	}
+
+	// checksum archive & write sidecar manifest alongside local backups
+	archiveSHA256, err := backup.FileSHA256(outputFilePath)
+	if err != nil {
+		logger.LogxWithFields("warn", fmt.Sprintf("Failed to checksum archive: %v", err), verboseFields)
+	}
+	jobCTX.ArchiveSHA256 = archiveSHA256
+	if !jobCTX.SkipLocal {
+		if err := backup.WriteManifest(outputFilePath, backup.NewManifest(jobCTX, outputFilePath)); err != nil {
+			logger.LogxWithFields("warn", fmt.Sprintf("Failed to write archive manifest: %v", err), verboseFields)
+		}
+	}
+
+	// handle remote transfer
+	if len(inputctx.Destinations) > 0 {
+		err := backup.HandleRemoteTransfer(jobCTX, outputFilePath, inputctx)
+		if err != nil {
+			// if remote fail, then handle post-backup docker jobs
+			if jobCTX.Docker {
+				if err := backup.HandleDockerPostBackup(jobCTX, composeFilePath, jobCTX.RestartDocker); err != nil {
+					logger.LogxWithFields("error", fmt.Sprintf("error reinitializing docker service after failed transfer: %v", err), coreFields)
+					return err
+				}
+			}
+			logger.LogxWithFields("error", fmt.Sprintf("error completing remote transfer: %v", err), verboseFields)
+			return err
+		}
+	}
+
 	return nil
+}
+
+// stores target as a snapshot in the backup repository & syncs the repository when destinations are defined
+// the snapshot is released as soon as the repository snapshot is written, rather than held for the transfer
+func repositoryAndTransfer(inputctx *input.InputContext, jobCTX *job.JobContext, composeFilePath string, releaseSnapshot func()) error {
 
+	// define jobhandler logging
+	coreFields := logger.CoreLogFields(jobCTX, "jobhandler")
+	verboseFields := jobhandlerLogDebugFields(jobCTX)
+
+	err := backup.BackupToRepository(jobCTX, inputctx)
+	releaseSnapshot()
+	if err != nil {
+		if jobCTX.Docker {
+			if dockererr := backup.HandleDockerPostBackup(jobCTX, composeFilePath, jobCTX.RestartDocker); dockererr != nil {
+				logger.LogxWithFields("error", fmt.Sprintf("error handling docker compose after backup: %v", dockererr), coreFields)
+				return err
+			}
+		}
+		logger.LogxWithFields("error", fmt.Sprintf("error storing target in repository: %v", err), coreFields)
+		return err
+	}
+
+	if len(inputctx.Destinations) > 0 {
+		if err := backup.HandleRepoTransfer(jobCTX, inputctx); err != nil {
+			if jobCTX.Docker {
+				if err := backup.HandleDockerPostBackup(jobCTX, composeFilePath, jobCTX.RestartDocker); err != nil {
+					logger.LogxWithFields("error", fmt.Sprintf("error reinitializing docker service after failed transfer: %v", err), coreFields)
+					return err
+				}
+			}
+			logger.LogxWithFields("error", fmt.Sprintf("error syncing repository to remote: %v", err), verboseFields)
+			return err
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,198 @@
+package runner
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/adrian-griffin/cargoport/backup"
+	"github.com/adrian-griffin/cargoport/input"
+	"github.com/adrian-griffin/cargoport/job"
+	"github.com/adrian-griffin/cargoport/logger"
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// terminal colour codes stripped from remote output before it is logged
+var ansiEscapes = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// migration options passed from `cargoport migrate`
+type MigrateOptions struct {
+	RestoreDir string // dir the stack is restored into on the destination, defaults to the source target dir's parent
+	Clone      bool   // leave the source stack running once migrated, rather than stopped
+	Force      bool   // restore over an existing target dir on the destination
+}
+
+// migrates target to the single destination in inputctx under one job id: streams a full backup to the
+// destination, restores & starts it with the destination's cargoport over ssh & verifies the stack is healthy
+// the source stack is left stopped unless cloning, & brought back up when the migration fails once any
+// stack the failed restore started on the destination is down, so the stack never runs on both hosts
+func RunMigrate(inputctx *input.InputContext, opts MigrateOptions) (job.LedgerEntry, error) {
+	destination := inputctx.Destinations[0]
+
+	// failover takes the whole stack offline & leaves it there, rather than pausing or stopping some services
+	inputctx.RestartDocker = opts.Clone
+	if !opts.Clone {
+		inputctx.StopServices = nil
+		if inputctx.StopStrategy == input.StopStrategyPause {
+			inputctx.StopStrategy = input.StopStrategyStop
+		}
+	}
+
+	jobCTX := newJobContext(inputctx)
+	entry := job.LedgerEntry{Kind: "migrate", Host: destination.Name}
+	outputFilePath, err := runMigration(inputctx, &jobCTX, destination, opts)
+	if len(jobCTX.RemoteResults) > 0 && jobCTX.RemoteResults[0].Success {
+		entry.Archive = fmt.Sprintf("%s@%s:%s", destination.User, destination.Host, backup.RemoteArchivePath(destination.OutputDir, filepath.Base(outputFilePath)))
+	}
+	return recordJob(inputctx, &jobCTX, entry, err), err
+}
+
+// performs migration steps, returning the local output file path the streamed archive is named after
+func runMigration(inputctx *input.InputContext, jobCTX *job.JobContext, destination input.RemoteTarget, opts MigrateOptions) (string, error) {
+	mode := "failover"
+	if opts.Clone {
+		mode = "clone"
+	}
+	fields := map[string]interface{}{
+		"package":     "migrate",
+		"job_id":      jobCTX.JobID,
+		"remote_name": destination.Name,
+		"remote_host": destination.Host,
+		"mode":        mode,
+	}
+	logger.LogxWithFields("info", fmt.Sprintf("New migration job added to '%s' (%s)", destination.Name, mode), fields)
+
+	// remote cargoport must be reachable & usable before the source is taken offline
+	cargoportKey := filepath.Join(inputctx.Config.SSHKeyDir, inputctx.Config.SSHKeyName)
+	probeReport := util.ProbeRemote(destination.Host, inputctx.Config.ProbeOptions(destination.User, destination.Port))
+	util.LogProbeReport(probeReport, fields)
+	if err := probeReport.Err(); err != nil {
+		return "", fmt.Errorf("destination is not reachable: %v", err)
+	}
+	versionOutput, err := util.RunCommandWithOutput("ssh", migrateSSHArgs(destination, cargoportKey, inputctx.Config.RemoteCargoportCommand+" -version")...)
+	if err != nil {
+		return "", fmt.Errorf("failed to run cargoport on destination, check remote_cargoport_command & that the key is not restricted: %s", strings.TrimSpace(versionOutput))
+	}
+	logger.LogxWithFields("debug", fmt.Sprintf("Destination cargoport: %s", strings.Join(strings.Fields(versionOutput), " ")), fields)
+
+	// a failed failover brings the source back, so the stack is never left offline on both hosts
+	restartSource := func(err error) error {
+		if opts.Clone || !jobCTX.Docker {
+			return err
+		}
+		logger.LogxWithFields("warn", "Migration failed, restarting source stack", fields)
+		jobCTX.ServicesRestored = false
+		if restartErr := backup.HandleDockerPostBackup(jobCTX, backup.FindComposeFileInDir(jobCTX.TargetDir), true); restartErr != nil {
+			logger.LogxWithFields("error", fmt.Sprintf("Failed to restart source stack: %v", restartErr), fields)
+			return fmt.Errorf("%v, source stack failed to restart: %v", err, restartErr)
+		}
+		return err
+	}
+
+	// back up & stream the target, services are only restarted afterwards when cloning
+	outputFilePath, err := runBackupJob(inputctx, jobCTX)
+	fields["target"] = jobCTX.Target
+	if err != nil {
+		return outputFilePath, restartSource(fmt.Errorf("backup of source failed: %v", err))
+	}
+
+	restoreDir := opts.RestoreDir
+	if restoreDir == "" {
+		restoreDir = filepath.Dir(jobCTX.TargetDir)
+	}
+	remoteTargetDir := strings.TrimSuffix(restoreDir, "/") + "/" + filepath.Base(jobCTX.TargetDir)
+	if !opts.Force {
+		if err := checkDestinationDir(destination, cargoportKey, remoteTargetDir); err != nil {
+			return outputFilePath, restartSource(err)
+		}
+	}
+	remoteArchive := backup.RemoteArchivePath(destination.OutputDir, filepath.Base(outputFilePath))
+	if err := restoreOnDestination(inputctx, jobCTX, destination, cargoportKey, remoteArchive, restoreDir, fields); err != nil {
+		// the restore may have started services before failing, which must be down before the source returns
+		if !opts.Clone && jobCTX.Docker {
+			if downErr := stopOnDestination(jobCTX, destination, cargoportKey, remoteTargetDir, fields); downErr != nil {
+				logger.LogxWithFields("error", fmt.Sprintf("Failed to stop restored stack on '%s', source stack left stopped so it is not running on both hosts: %v", destination.Name, downErr), fields)
+				return outputFilePath, fmt.Errorf("%v, restored stack on '%s' could not be stopped & the source stack was left stopped: %v", err, destination.Name, downErr)
+			}
+		}
+		return outputFilePath, restartSource(err)
+	}
+
+	sourceState := "left stopped"
+	if opts.Clone {
+		sourceState = "left running"
+	} else if !jobCTX.Docker {
+		sourceState = "left in place"
+	}
+	logger.LogxWithFields("info", fmt.Sprintf("Migration success, %s restored on '%s' into %s, source %s, execution time: %.2fs",
+		jobCTX.Target, destination.Name, restoreDir, sourceState, time.Since(jobCTX.StartTime).Seconds()), logger.MergeFields(fields, map[string]interface{}{
+		"success": true,
+		"size":    jobCTX.CompressedSizeMBString,
+	}))
+	return outputFilePath, nil
+}
+
+// refuses to restore over an existing target dir on the destination
+func checkDestinationDir(destination input.RemoteTarget, cargoportKey, remoteTargetDir string) error {
+	output, err := util.RunCommandWithOutput("ssh", migrateSSHArgs(destination, cargoportKey, fmt.Sprintf("if [ -e %s ]; then echo exists; fi", backup.RemoteShellPath(remoteTargetDir)))...)
+	if err != nil {
+		return fmt.Errorf("failed to check destination dir %s: %s", remoteTargetDir, strings.TrimSpace(output))
+	}
+	if strings.TrimSpace(output) == "exists" {
+		return fmt.Errorf("%s already exists on '%s', pass -force to restore over it", remoteTargetDir, destination.Name)
+	}
+	return nil
+}
+
+// restores streamed archive with the destination's cargoport, logging its output under the migration's job id
+func restoreOnDestination(inputctx *input.InputContext, jobCTX *job.JobContext, destination input.RemoteTarget, cargoportKey, remoteArchive, restoreDir string, fields map[string]interface{}) error {
+	restoreCommand := []string{
+		inputctx.Config.RemoteCargoportCommand, "restore", backup.RemoteShellPath(remoteArchive),
+		"-to", backup.RemoteShellPath(restoreDir),
+		"-job-id", util.ShellQuote(jobCTX.JobID),
+	}
+	if jobCTX.Docker {
+		restoreCommand = append(restoreCommand, "-up")
+		if jobCTX.HealthCheck {
+			restoreCommand = append(restoreCommand, "-verify-health")
+		}
+	} else {
+		// plain directories hold no compose project to pin
+		restoreCommand = append(restoreCommand, "-pin=false")
+	}
+	logger.LogxWithFields("info", fmt.Sprintf("Restoring %s on '%s' into %s", filepath.Base(remoteArchive), destination.Name, restoreDir), fields)
+
+	remoteFields := logger.MergeFields(fields, map[string]interface{}{"remote_output": true})
+	err := util.RunCommandWithLines(func(line string) {
+		if line = strings.TrimSpace(ansiEscapes.ReplaceAllString(line, "")); line != "" {
+			logger.LogxWithFields("info", "remote: "+line, remoteFields)
+		}
+	}, "ssh", migrateSSHArgs(destination, cargoportKey, strings.Join(restoreCommand, " "))...)
+	if err != nil {
+		return fmt.Errorf("restore on '%s' failed: %v", destination.Name, err)
+	}
+	return nil
+}
+
+// takes the restored compose project down on the destination, succeeding when its compose file was never restored
+func stopOnDestination(jobCTX *job.JobContext, destination input.RemoteTarget, cargoportKey, remoteTargetDir string, fields map[string]interface{}) error {
+	composeFileName := "docker-compose.yml"
+	if composeFilePath := backup.FindComposeFileInDir(jobCTX.TargetDir); composeFilePath != "" {
+		composeFileName = filepath.Base(composeFilePath)
+	}
+	remoteComposeFile := backup.RemoteShellPath(strings.TrimSuffix(remoteTargetDir, "/") + "/" + composeFileName)
+
+	logger.LogxWithFields("warn", fmt.Sprintf("Restore failed, stopping restored stack on '%s'", destination.Name), fields)
+	downCommand := fmt.Sprintf("if [ -f %s ]; then docker compose -f %s down; fi", remoteComposeFile, remoteComposeFile)
+	output, err := util.RunCommandWithOutput("ssh", migrateSSHArgs(destination, cargoportKey, downCommand)...)
+	if err != nil {
+		return fmt.Errorf("docker compose down failed: %s", strings.TrimSpace(output))
+	}
+	return nil
+}
+
+func migrateSSHArgs(destination input.RemoteTarget, cargoportKey, remoteCommand string) []string {
+	return append(util.SSHBaseOptions(cargoportKey, destination.Port), fmt.Sprintf("%s@%s", destination.User, destination.Host), remoteCommand)
+}
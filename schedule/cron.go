@@ -0,0 +1,181 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// furthest back a schedule is searched for its previous run
+const searchLimitYears = 5
+
+// parsed 5-field cron expression, 'minute hour day-of-month month day-of-week'
+type Schedule struct {
+	expression string
+	minutes    [60]bool
+	hours      [24]bool
+	days       [32]bool
+	months     [13]bool
+	weekdays   [7]bool
+
+	// cron matches either day field when both are restricted, both when either is '*'
+	daysStar     bool
+	weekdaysStar bool
+}
+
+// shorthand expressions accepted in place of the 5 fields
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var weekdayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parses a standard cron expression or @hourly/@daily/@weekly/@monthly/@yearly shorthand
+func Parse(expression string) (*Schedule, error) {
+	fields := strings.Fields(strings.ToLower(expression))
+	if len(fields) == 1 {
+		if expanded, ok := macros[fields[0]]; ok {
+			fields = strings.Fields(expanded)
+		}
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule '%s': expected 5 fields 'minute hour day month weekday'", expression)
+	}
+
+	s := &Schedule{expression: expression}
+	var err error
+	if err = parseField(fields[0], 0, 59, nil, s.minutes[:]); err != nil {
+		return nil, fmt.Errorf("invalid schedule '%s' minute: %v", expression, err)
+	}
+	if err = parseField(fields[1], 0, 23, nil, s.hours[:]); err != nil {
+		return nil, fmt.Errorf("invalid schedule '%s' hour: %v", expression, err)
+	}
+	if err = parseField(fields[2], 1, 31, nil, s.days[:]); err != nil {
+		return nil, fmt.Errorf("invalid schedule '%s' day of month: %v", expression, err)
+	}
+	if err = parseField(fields[3], 1, 12, monthNames, s.months[:]); err != nil {
+		return nil, fmt.Errorf("invalid schedule '%s' month: %v", expression, err)
+	}
+	// day of week accepts 7 as sunday
+	var weekdays [8]bool
+	if err = parseField(fields[4], 0, 7, weekdayNames, weekdays[:]); err != nil {
+		return nil, fmt.Errorf("invalid schedule '%s' day of week: %v", expression, err)
+	}
+	copy(s.weekdays[:], weekdays[:7])
+	s.weekdays[0] = s.weekdays[0] || weekdays[7]
+
+	s.daysStar = strings.HasPrefix(fields[2], "*")
+	s.weekdaysStar = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// marks values matched by a comma separated list of '*', 'n', 'a-b' & '/step' terms
+func parseField(field string, min, max int, names map[string]int, matched []bool) error {
+	for _, term := range strings.Split(field, ",") {
+		step := 1
+		if rangePart, stepPart, found := strings.Cut(term, "/"); found {
+			parsedStep, err := strconv.Atoi(stepPart)
+			if err != nil || parsedStep <= 0 {
+				return fmt.Errorf("invalid step '%s'", stepPart)
+			}
+			term, step = rangePart, parsedStep
+		}
+
+		low, high := min, max
+		if term != "*" {
+			lowPart, highPart, isRange := strings.Cut(term, "-")
+			var err error
+			if low, err = parseValue(lowPart, min, max, names); err != nil {
+				return err
+			}
+			high = low
+			if isRange {
+				if high, err = parseValue(highPart, min, max, names); err != nil {
+					return err
+				}
+			} else if step > 1 {
+				// 'n/step' runs from n through the end of the range
+				high = max
+			}
+			if low > high {
+				return fmt.Errorf("invalid range '%s'", term)
+			}
+		}
+		for value := low; value <= high; value += step {
+			matched[value] = true
+		}
+	}
+	return nil
+}
+
+func parseValue(value string, min, max int, names map[string]int) (int, error) {
+	if named, ok := names[value]; ok {
+		return named, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value '%s'", value)
+	}
+	if parsed < min || parsed > max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", parsed, min, max)
+	}
+	return parsed, nil
+}
+
+// returns the expression the schedule was parsed from
+func (s *Schedule) String() string {
+	return s.expression
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dayMatch := s.days[t.Day()]
+	weekdayMatch := s.weekdays[t.Weekday()]
+	if s.daysStar || s.weekdaysStar {
+		return dayMatch && weekdayMatch
+	}
+	return dayMatch || weekdayMatch
+}
+
+// returns the latest time at or before t the schedule fires, zero if it never fired within the search limit
+func (s *Schedule) Prev(t time.Time) time.Time {
+	location := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, location)
+	limit := t.AddDate(-searchLimitYears, 0, 0)
+
+	// walks backwards, skipping whole months, days & hours that cannot match
+	for t.After(limit) {
+		switch {
+		case !s.months[t.Month()]:
+			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, location).Add(-time.Minute)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location).Add(-time.Minute)
+		case !s.hours[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, location).Add(-time.Minute)
+		case !s.minutes[t.Minute()]:
+			t = t.Add(-time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// reports whether the schedule fired after lastRun, up to & including now
+func (s *Schedule) Due(lastRun, now time.Time) bool {
+	previous := s.Prev(now)
+	return !previous.IsZero() && previous.After(lastRun)
+}
@@ -0,0 +1,120 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func date(value string) time.Time {
+	parsed, err := time.ParseInLocation("2006-01-02 15:04", value, time.UTC)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+func TestParseRejectsInvalidExpressions(t *testing.T) {
+	for _, expression := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@fortnightly",
+	} {
+		if _, err := Parse(expression); err == nil {
+			t.Errorf("Parse(%q) succeeded, want error", expression)
+		}
+	}
+}
+
+func TestPrev(t *testing.T) {
+	tests := []struct {
+		expression string
+		now        string
+		want       string
+	}{
+		// fires at the current minute
+		{"30 2 * * *", "2024-03-15 02:30", "2024-03-15 02:30"},
+		{"30 2 * * *", "2024-03-15 02:29", "2024-03-14 02:30"},
+		{"@hourly", "2024-03-15 10:59", "2024-03-15 10:00"},
+		{"@daily", "2024-03-01 00:00", "2024-03-01 00:00"},
+		{"@monthly", "2024-03-15 10:00", "2024-03-01 00:00"},
+		{"@yearly", "2024-03-15 10:00", "2024-01-01 00:00"},
+		{"*/15 * * * *", "2024-03-15 10:44", "2024-03-15 10:30"},
+		{"10/20 * * * *", "2024-03-15 10:05", "2024-03-15 09:50"},
+		{"0 9-17 * * *", "2024-03-15 20:00", "2024-03-15 17:00"},
+		{"0 0,12 * * *", "2024-03-15 11:00", "2024-03-15 00:00"},
+		// 2024-03-15 is a friday
+		{"0 3 * * mon", "2024-03-15 10:00", "2024-03-11 03:00"},
+		{"0 3 * * 7", "2024-03-15 10:00", "2024-03-10 03:00"},
+		{"0 3 * * 0", "2024-03-15 10:00", "2024-03-10 03:00"},
+		{"0 0 * feb *", "2024-03-15 10:00", "2024-02-29 00:00"},
+		{"0 0 31 * *", "2024-03-15 10:00", "2024-01-31 00:00"},
+		// restricted day of month & weekday match either
+		{"0 0 1 * fri", "2024-03-14 10:00", "2024-03-08 00:00"},
+		{"0 0 13 * fri", "2024-03-14 10:00", "2024-03-13 00:00"},
+		// a wildcard day of month requires the weekday
+		{"0 0 */1 * fri", "2024-03-14 10:00", "2024-03-08 00:00"},
+		// never within the search limit
+		{"0 0 30 feb *", "2024-03-15 10:00", ""},
+	}
+	for _, test := range tests {
+		schedule, err := Parse(test.expression)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", test.expression, err)
+		}
+		got := schedule.Prev(date(test.now))
+		var want time.Time
+		if test.want != "" {
+			want = date(test.want)
+		}
+		if !got.Equal(want) {
+			t.Errorf("Parse(%q).Prev(%s) = %v, want %v", test.expression, test.now, got, want)
+		}
+	}
+}
+
+func TestPrevIgnoresSeconds(t *testing.T) {
+	schedule, err := Parse("30 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := date("2024-03-15 02:30").Add(45 * time.Second)
+	if got, want := schedule.Prev(now), date("2024-03-15 02:30"); !got.Equal(want) {
+		t.Errorf("Prev(%v) = %v, want %v", now, got, want)
+	}
+}
+
+func TestDue(t *testing.T) {
+	schedule, err := Parse("0 3 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		lastRun string
+		now     string
+		want    bool
+	}{
+		{"2024-03-14 03:00", "2024-03-15 02:59", false},
+		{"2024-03-14 03:00", "2024-03-15 03:00", true},
+		{"2024-03-15 03:00", "2024-03-15 03:00", false},
+		{"2024-03-15 03:01", "2024-03-15 10:00", false},
+		{"2024-03-10 03:00", "2024-03-15 10:00", true},
+	}
+	for _, test := range tests {
+		if got := schedule.Due(date(test.lastRun), date(test.now)); got != test.want {
+			t.Errorf("Due(%s, %s) = %v, want %v", test.lastRun, test.now, got, test.want)
+		}
+	}
+	// a schedule that never ran is due as soon as it has fired
+	if !schedule.Due(time.Time{}, date("2024-03-15 10:00")) {
+		t.Error("Due(zero, now) = false, want true")
+	}
+}
@@ -0,0 +1,120 @@
+package snapshot
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// inode number of every btrfs subvolume root
+const btrfsSubvolumeInode = 256
+
+// directory within the snapshotted subvolume holding cargoport's snapshots
+const btrfsHolderName = ".cargoport-snapshots"
+
+// read-only btrfs subvolume snapshots of the subvolume holding the target dir
+type btrfsProvider struct{}
+
+func (btrfsProvider) Name() string { return ProviderBtrfs }
+
+func (btrfsProvider) Create(dir, name string) (*Snapshot, error) {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", dir, err)
+	}
+	if err := requireCommand("btrfs", "btrfs-progs"); err != nil {
+		return nil, err
+	}
+	subvolume, err := containingSubvolume(resolved)
+	if err != nil {
+		return nil, err
+	}
+	// nested subvolumes are not part of a snapshot, their contents would silently be missing from the archive
+	if nested, err := nestedSubvolume(resolved); err != nil {
+		return nil, err
+	} else if nested != "" {
+		return nil, fmt.Errorf("%s contains nested btrfs subvolume %s, which snapshots do not include", dir, nested)
+	}
+
+	holderDir := filepath.Join(subvolume, btrfsHolderName)
+	snapshotDir := filepath.Join(holderDir, name)
+	if err := os.MkdirAll(snapshotDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %v", err)
+	}
+	cleanupDirs := func() {
+		os.Remove(snapshotDir)
+		os.Remove(holderDir) // left in place while other jobs hold snapshots
+	}
+
+	snapshotPath := filepath.Join(snapshotDir, snapshotBaseName(subvolume))
+	if _, err := util.RunCommandWithOutput("btrfs", "subvolume", "snapshot", "-r", subvolume, snapshotPath); err != nil {
+		cleanupDirs()
+		return nil, fmt.Errorf("failed to snapshot btrfs subvolume %s: %v", subvolume, err)
+	}
+
+	relative, _ := filepath.Rel(subvolume, resolved)
+	snapshot := &Snapshot{
+		Provider: ProviderBtrfs,
+		Source:   dir,
+		Dir:      filepath.Join(snapshotPath, relative),
+		remove: func() error {
+			if _, err := util.RunCommandWithOutput("btrfs", "subvolume", "delete", snapshotPath); err != nil {
+				return fmt.Errorf("failed to delete btrfs snapshot %s: %v", snapshotPath, err)
+			}
+			cleanupDirs()
+			return nil
+		},
+	}
+	// the holder dir exists before the snapshot is taken, so is captured empty when the target is the subvolume itself
+	if relative == "." {
+		snapshot.Exclude = []string{btrfsHolderName}
+	}
+	return snapshot, nil
+}
+
+// walks up from dir to the root of the btrfs subvolume holding it
+func containingSubvolume(dir string) (string, error) {
+	for path := dir; ; path = filepath.Dir(path) {
+		if isSubvolumeRoot(path) {
+			return path, nil
+		}
+		if path == "/" {
+			return "", fmt.Errorf("%s is not on a btrfs subvolume", dir)
+		}
+	}
+}
+
+// returns the first btrfs subvolume found beneath dir, empty when there are none
+func nestedSubvolume(dir string) (string, error) {
+	var nested string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir || !entry.IsDir() {
+			return nil
+		}
+		if isSubvolumeRoot(path) {
+			nested = path
+			return fs.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to check %s for nested btrfs subvolumes: %v", dir, err)
+	}
+	return nested, nil
+}
+
+func isSubvolumeRoot(path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Ino == btrfsSubvolumeInode
+}
@@ -0,0 +1,112 @@
+package snapshot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/adrian-griffin/cargoport/util"
+)
+
+// thin LVM snapshots of the logical volume holding the target dir, mounted read-only beneath mountDir
+type lvmProvider struct {
+	mountDir string
+}
+
+func (lvmProvider) Name() string { return ProviderLVM }
+
+func (p lvmProvider) Create(dir, name string) (*Snapshot, error) {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", dir, err)
+	}
+	mount, err := findMount(resolved)
+	if err != nil {
+		return nil, err
+	}
+	volumeGroup, logicalVolume, pool, err := lvmVolume(mount.Source)
+	if err != nil {
+		return nil, err
+	}
+	// classic snapshots need a preallocated size & slow the origin down, only thin snapshots are supported
+	if pool == "" {
+		return nil, fmt.Errorf("%s is not a thin logical volume, only thin snapshots are supported", mount.Source)
+	}
+
+	// thin snapshots skip activation by default, which would leave them unmountable
+	snapshotVolume := volumeGroup + "/" + name
+	if _, err := util.RunCommandWithOutput("lvcreate", "--snapshot", "--setactivationskip", "n", "--name", name, volumeGroup+"/"+logicalVolume); err != nil {
+		return nil, fmt.Errorf("failed to snapshot logical volume %s/%s: %v", volumeGroup, logicalVolume, err)
+	}
+	removeVolume := func() error {
+		if _, err := util.RunCommandWithOutput("lvremove", "--yes", snapshotVolume); err != nil {
+			return fmt.Errorf("failed to remove LVM snapshot %s: %v", snapshotVolume, err)
+		}
+		return nil
+	}
+
+	snapshotDir := filepath.Join(p.mountDir, name)
+	mountPoint := filepath.Join(snapshotDir, snapshotBaseName(resolved))
+	cleanupDirs := func() {
+		os.Remove(mountPoint)
+		os.Remove(snapshotDir)
+	}
+	if err := os.MkdirAll(mountPoint, 0700); err != nil {
+		removeVolume()
+		return nil, fmt.Errorf("failed to create snapshot mountpoint: %v", err)
+	}
+
+	// xfs refuses to mount a second filesystem carrying the same uuid as the origin
+	mountOptions := "ro"
+	if mount.FSType == "xfs" {
+		mountOptions = "ro,nouuid"
+	}
+	if _, err := util.RunCommandWithOutput("mount", "-t", mount.FSType, "-o", mountOptions, filepath.Join("/dev", volumeGroup, name), mountPoint); err != nil {
+		cleanupDirs()
+		removeVolume()
+		return nil, fmt.Errorf("failed to mount LVM snapshot %s: %v", snapshotVolume, err)
+	}
+
+	// bind mounts expose a subdirectory of the filesystem, mirrored within the snapshot's mount
+	relative, _ := filepath.Rel(mount.Point, resolved)
+	return &Snapshot{
+		Provider: ProviderLVM,
+		Source:   dir,
+		Dir:      filepath.Join(mountPoint, mount.Root, relative),
+		remove: func() error {
+			if _, err := util.RunCommandWithOutput("umount", mountPoint); err != nil {
+				return fmt.Errorf("failed to unmount LVM snapshot %s: %v", mountPoint, err)
+			}
+			cleanupDirs()
+			return removeVolume()
+		},
+	}, nil
+}
+
+// reports whether device is a thin logical volume
+func isThinVolume(device string) bool {
+	if !strings.HasPrefix(device, "/dev/") {
+		return false
+	}
+	_, _, pool, err := lvmVolume(device)
+	return err == nil && pool != ""
+}
+
+// returns volume group, logical volume & thin pool of device, pool is empty for non-thin volumes
+func lvmVolume(device string) (string, string, string, error) {
+	if err := requireCommand("lvs", "lvm2"); err != nil {
+		return "", "", "", err
+	}
+	output, err := util.RunCommandWithOutput("lvs", "--noheadings", "--separator", "|", "-o", "vg_name,lv_name,pool_lv", device)
+	if err != nil {
+		return "", "", "", fmt.Errorf("%s is not an LVM logical volume: %v", device, strings.TrimSpace(output))
+	}
+	// output also carries any warnings lvs printed to stderr
+	for _, line := range strings.Split(output, "\n") {
+		if fields := strings.Split(strings.TrimSpace(line), "|"); len(fields) == 3 {
+			return strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1]), strings.TrimSpace(fields[2]), nil
+		}
+	}
+	return "", "", "", fmt.Errorf("unexpected lvs output for %s: %s", device, strings.TrimSpace(output))
+}
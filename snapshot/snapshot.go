@@ -0,0 +1,199 @@
+package snapshot
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// snapshot provider names, auto selects a provider from the target dir's filesystem
+const (
+	ProviderAuto  = "auto"
+	ProviderBtrfs = "btrfs"
+	ProviderLVM   = "lvm"
+	ProviderNone  = "none"
+)
+
+// reports whether name is a known snapshot provider
+func ValidProvider(name string) bool {
+	switch name {
+	case ProviderAuto, ProviderBtrfs, ProviderLVM, ProviderNone:
+		return true
+	}
+	return false
+}
+
+// takes point-in-time, read-only snapshots of the filesystem holding a directory
+type Provider interface {
+	Name() string
+	// snapshots the filesystem holding dir, name identifies the snapshot & is unique per job
+	Create(dir, name string) (*Snapshot, error)
+}
+
+// active snapshot of a target dir
+type Snapshot struct {
+	Provider string
+	Source   string   // live directory the snapshot was taken of
+	Dir      string   // source dir within the snapshot, always sharing the source's base name
+	Exclude  []string // provider artifacts captured within the snapshot, relative to Dir
+
+	remove func() error
+}
+
+// deletes the snapshot & any mounts or directories created for it
+func (s *Snapshot) Remove() error {
+	if s.remove == nil {
+		return nil
+	}
+	return s.remove()
+}
+
+// returns the provider for name, auto detecting one from dir's filesystem
+// auto falls back to the no-op provider for filesystems without snapshot support
+// mountDir holds mountpoints of snapshots which must be mounted to be read
+func ForDir(name, dir, mountDir string) (Provider, error) {
+	switch name {
+	case ProviderNone:
+		return noopProvider{}, nil
+	case ProviderBtrfs:
+		return btrfsProvider{}, nil
+	case ProviderLVM:
+		return lvmProvider{mountDir: mountDir}, nil
+	case ProviderAuto:
+		return detect(dir, mountDir)
+	}
+	return nil, fmt.Errorf("unknown snapshot provider '%s'", name)
+}
+
+// selects a provider from the filesystem type & backing device of dir
+func detect(dir, mountDir string) (Provider, error) {
+	mount, err := findMount(dir)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case mount.FSType == "btrfs":
+		return btrfsProvider{}, nil
+	case isThinVolume(mount.Source):
+		return lvmProvider{mountDir: mountDir}, nil
+	}
+	return noopProvider{}, nil
+}
+
+// archives the live directory, services stay offline for the duration of the archive
+type noopProvider struct{}
+
+func (noopProvider) Name() string { return ProviderNone }
+
+func (noopProvider) Create(dir, name string) (*Snapshot, error) {
+	return &Snapshot{Provider: ProviderNone, Source: dir, Dir: dir}, nil
+}
+
+// mounted filesystem, parsed from /proc/self/mountinfo
+type mountInfo struct {
+	Root   string // path within the filesystem mounted at Point, '/' unless a bind mount
+	Point  string
+	FSType string
+	Source string
+}
+
+// returns the mount holding dir, the longest mountpoint prefix of its resolved path
+func findMount(dir string) (*mountInfo, error) {
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", dir, err)
+	}
+	mountsFile, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %v", err)
+	}
+	defer mountsFile.Close()
+
+	var found *mountInfo
+	scanner := bufio.NewScanner(mountsFile)
+	for scanner.Scan() {
+		mount, ok := parseMountInfoLine(scanner.Text())
+		if !ok || !withinDir(resolved, mount.Point) {
+			continue
+		}
+		// later entries for the same mountpoint are stacked on top of earlier ones
+		if found == nil || len(mount.Point) >= len(found.Point) {
+			found = mount
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %v", err)
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no mount found for %s", resolved)
+	}
+	return found, nil
+}
+
+// parses 'id parent major:minor root mountpoint options [optional...] - fstype source superoptions'
+func parseMountInfoLine(line string) (*mountInfo, bool) {
+	fields := strings.Fields(line)
+	separator := -1
+	for i, field := range fields {
+		if field == "-" {
+			separator = i
+			break
+		}
+	}
+	if separator < 6 || len(fields) < separator+3 {
+		return nil, false
+	}
+	return &mountInfo{
+		Root:   unescapeMountPath(fields[3]),
+		Point:  unescapeMountPath(fields[4]),
+		FSType: fields[separator+1],
+		Source: unescapeMountPath(fields[separator+2]),
+	}, true
+}
+
+// mountinfo escapes spaces, tabs, newlines & backslashes as 3 digit octal
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var unescaped strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if value, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				unescaped.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(path[i])
+	}
+	return unescaped.String()
+}
+
+// reports whether path is dir or beneath it
+func withinDir(path, dir string) bool {
+	if dir == "/" {
+		return true
+	}
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// ensures command needed by a provider is installed
+func requireCommand(command, packageName string) error {
+	if _, err := exec.LookPath(command); err != nil {
+		return fmt.Errorf("%s not found, install %s to use snapshots", command, packageName)
+	}
+	return nil
+}
+
+// returns base name used for a snapshotted filesystem root, as '/' has none
+func snapshotBaseName(path string) string {
+	if base := filepath.Base(path); base != "/" {
+		return base
+	}
+	return "rootfs"
+}
@@ -0,0 +1,208 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/adrian-griffin/cargoport/logger"
+)
+
+// cargoport-owned known_hosts filename, stored in ssh key directory
+const KnownHostsFileName = "known_hosts"
+
+// single trusted host key entry
+type KnownHostEntry struct {
+	Hosts       []string `json:"hosts"`
+	KeyType     string   `json:"key_type"`
+	Fingerprint string   `json:"fingerprint"`
+	Line        int      `json:"line"`
+}
+
+// returns path to cargoport known_hosts within ssh key directory
+func KnownHostsPath(sshKeyDir string) string {
+	return filepath.Join(sshKeyDir, KnownHostsFileName)
+}
+
+// normalized known_hosts address for host & port, e.g: `10.0.0.1` or `[10.0.0.1]:2222`
+func knownHostsAddress(remoteHost string, remotePort int) string {
+	if remotePort == 0 {
+		remotePort = DefaultSSHPort
+	}
+	return knownhosts.Normalize(net.JoinHostPort(remoteHost, strconv.Itoa(remotePort)))
+}
+
+// parses all entries in known_hosts file, a missing file has no entries
+func ListKnownHosts(knownHostsPath string) ([]KnownHostEntry, error) {
+	data, err := os.ReadFile(knownHostsPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts %s: %v", knownHostsPath, err)
+	}
+
+	var entries []KnownHostEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, hosts, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry on line %d of %s: %v", lineNumber, knownHostsPath, err)
+		}
+		entries = append(entries, KnownHostEntry{
+			Hosts:       hosts,
+			KeyType:     key.Type(),
+			Fingerprint: ssh.FingerprintSHA256(key),
+			Line:        lineNumber,
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// returns trusted entries matching host & port
+func KnownHostFingerprints(knownHostsPath, remoteHost string, remotePort int) ([]KnownHostEntry, error) {
+	entries, err := ListKnownHosts(knownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	address := knownHostsAddress(remoteHost, remotePort)
+	var matches []KnownHostEntry
+	for _, entry := range entries {
+		for _, host := range entry.Hosts {
+			if host == address {
+				matches = append(matches, entry)
+				break
+			}
+		}
+	}
+	return matches, nil
+}
+
+// scans remote's current host keys, without trusting them
+func ScanHostKeys(remoteHost string, remotePort int) ([]ssh.PublicKey, error) {
+	if remotePort == 0 {
+		remotePort = DefaultSSHPort
+	}
+	output, err := RunCommandWithOutput("ssh-keyscan", "-T", "10", "-p", strconv.Itoa(remotePort), remoteHost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan host keys for %s: %v", remoteHost, err)
+	}
+
+	var keys []ssh.PublicKey
+	rest := []byte(output)
+	for len(rest) > 0 {
+		var key ssh.PublicKey
+		_, _, key, _, rest, err = ssh.ParseKnownHosts(rest)
+		if err != nil {
+			break // no further entries, keyscan comment lines are skipped by the parser
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no host keys returned by %s", remoteHost)
+	}
+	return keys, nil
+}
+
+// replaces any existing entries for host & port with the supplied keys
+func TrustHostKeys(knownHostsPath, remoteHost string, remotePort int, keys []ssh.PublicKey) error {
+	address := knownHostsAddress(remoteHost, remotePort)
+
+	if _, err := removeKnownHost(knownHostsPath, address); err != nil {
+		return err
+	}
+
+	knownHostsFile, err := os.OpenFile(knownHostsPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open known hosts %s: %v", knownHostsPath, err)
+	}
+	defer knownHostsFile.Close()
+
+	for _, key := range keys {
+		if _, err := fmt.Fprintln(knownHostsFile, knownhosts.Line([]string{address}, key)); err != nil {
+			return fmt.Errorf("failed to write known hosts %s: %v", knownHostsPath, err)
+		}
+	}
+
+	logger.LogxWithFields("info", fmt.Sprintf("Trusted %d host key(s) for %s", len(keys), address), map[string]interface{}{
+		"package":     "sshkeytool",
+		"action":      "trust_host",
+		"remote_host": remoteHost,
+		"remote_port": remotePort,
+	})
+	return nil
+}
+
+// removes all entries for host & port, returning number of removed entries
+func RevokeHostKeys(knownHostsPath, remoteHost string, remotePort int) (int, error) {
+	address := knownHostsAddress(remoteHost, remotePort)
+	removed, err := removeKnownHost(knownHostsPath, address)
+	if err != nil {
+		return 0, err
+	}
+
+	logger.LogxWithFields("info", fmt.Sprintf("Revoked %d host key(s) for %s", removed, address), map[string]interface{}{
+		"package":     "sshkeytool",
+		"action":      "revoke_host",
+		"remote_host": remoteHost,
+		"remote_port": remotePort,
+	})
+	return removed, nil
+}
+
+// rewrites known_hosts without entries for address
+func removeKnownHost(knownHostsPath, address string) (int, error) {
+	data, err := os.ReadFile(knownHostsPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read known hosts %s: %v", knownHostsPath, err)
+	}
+
+	var kept []string
+	removed := 0
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			if _, hosts, _, _, _, err := ssh.ParseKnownHosts([]byte(trimmed)); err == nil && containsHost(hosts, address) {
+				removed++
+				continue
+			}
+		}
+		kept = append(kept, line)
+	}
+
+	output := strings.Join(kept, "\n")
+	if output != "" {
+		output += "\n"
+	}
+	if err := os.WriteFile(knownHostsPath, []byte(output), 0600); err != nil {
+		return 0, fmt.Errorf("failed to write known hosts %s: %v", knownHostsPath, err)
+	}
+	return removed, nil
+}
+
+func containsHost(hosts []string, address string) bool {
+	for _, host := range hosts {
+		if host == address {
+			return true
+		}
+	}
+	return false
+}
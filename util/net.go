@@ -4,21 +4,9 @@ import (
 	"fmt"
 	"net"
 
-	"github.com/adrian-griffin/cargoport/job"
 	"github.com/adrian-griffin/cargoport/logger"
 )
 
-// debug level logging output fields for docker package
-func netHandlerLogDebugFields(context *job.JobContext) map[string]interface{} {
-	coreFields := logger.CoreLogFields(context, "net")
-	fields := logger.MergeFields(coreFields, map[string]interface{}{
-		"remote":      context.Remote,
-		"remote_user": context.RemoteUser,
-		"remote_host": context.RemoteHost,
-	})
-	return fields
-}
-
 // validate string as valid IPv4, IPv6 address, or resolvable DNS name
 func ValidateIP(remoteHost string) error {
 
@@ -68,26 +56,3 @@ func ICMPRemoteHost(remoteHost string) error {
 	})
 	return nil
 }
-
-// test SSH connectivity to remote host
-func SSHTestRemoteHost(context *job.JobContext, remoteHost, remoteUser, sshPrivKeypath string) error {
-
-	// defining logging fields
-	verboseFields := netHandlerLogDebugFields(context)
-
-	// check ssh connectivity rechability using keys
-	_, err := RunCommandWithOutput("ssh",
-		"-i", sshPrivKeypath,
-		"-o", "StrictHostKeyChecking=accept-new",
-		fmt.Sprintf("%s@%s", remoteUser, remoteHost),
-		"whoami")
-
-	if err != nil {
-		return fmt.Errorf("failed to connect via SSH to %s@%s: %v", remoteUser, remoteHost, err)
-	}
-
-	logger.LogxWithFields("debug", fmt.Sprintf("SSH connection test success, remote user: %s", remoteUser), logger.MergeFields(verboseFields, map[string]interface{}{
-		"success": true,
-	}))
-	return nil
-}
@@ -0,0 +1,183 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// linux capability allowing reads of any file regardless of permissions
+const CapDACReadSearch = 2
+
+// linux capability required to create snapshots & mount filesystems
+const CapSysAdmin = 21
+
+// default docker engine socket when DOCKER_HOST is unset
+const DefaultDockerSocket = "/var/run/docker.sock"
+
+// maximum unreadable paths reported by the permission pre-check
+const maxUnreadableReported = 20
+
+// reports whether process is running as root
+func IsRoot() bool {
+	return os.Geteuid() == 0
+}
+
+// reports whether capability is present in the effective set, as listed in /proc/self/status
+func HasCapability(capability uint) bool {
+	statusFile, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer statusFile.Close()
+
+	scanner := bufio.NewScanner(statusFile)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		capabilities, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			return false
+		}
+		return capabilities&(1<<capability) != 0
+	}
+	return false
+}
+
+// reports whether process can read any file, either as root or via CAP_DAC_READ_SEARCH
+func CanReadAll() bool {
+	return IsRoot() || HasCapability(CapDACReadSearch)
+}
+
+// command reading the filesystem, such as tar, which inherits CAP_DAC_READ_SEARCH when running without root,
+// so children can read everything the permission pre-check skipped
+func ReadAllCommand(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	if !IsRoot() && HasCapability(CapDACReadSearch) {
+		inheritReadAll(cmd)
+	}
+	return cmd
+}
+
+// walks dir & returns paths that cannot be read by the current user
+func FindUnreadablePaths(dir string) ([]string, error) {
+	var unreadable []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if len(unreadable) >= maxUnreadableReported {
+			return fs.SkipAll
+		}
+		if err != nil {
+			unreadable = append(unreadable, path)
+			if entry != nil && entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		// symlinks are archived as links, their targets are never read
+		if entry.Type()&fs.ModeSymlink != 0 || !(entry.IsDir() || entry.Type().IsRegular()) {
+			return nil
+		}
+		file, openErr := os.Open(path)
+		if openErr != nil {
+			unreadable = append(unreadable, path)
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		file.Close()
+		return nil
+	})
+	return unreadable, err
+}
+
+// checks that every path under dir is readable, returning an error listing offending paths
+// skipped when the process can read all files, as archivers started with ReadAllCommand inherit that access
+func CheckReadable(dir string) error {
+	if CanReadAll() {
+		return nil
+	}
+	unreadable, err := FindUnreadablePaths(dir)
+	if err != nil {
+		return fmt.Errorf("failed to check permissions under %s: %v", dir, err)
+	}
+	if len(unreadable) == 0 {
+		return nil
+	}
+
+	message := fmt.Sprintf("%d path(s) under %s are not readable by uid %d", len(unreadable), dir, os.Geteuid())
+	if len(unreadable) >= maxUnreadableReported {
+		message = fmt.Sprintf("at least %d paths under %s are not readable by uid %d", len(unreadable), dir, os.Geteuid())
+	}
+	return fmt.Errorf("%s: %s; run as root, grant CAP_DAC_READ_SEARCH (setcap cap_dac_read_search+ep <cargoport>), or adjust ownership",
+		message, strings.Join(unreadable, ", "))
+}
+
+// returns docker engine unix socket path from DOCKER_HOST, or the default socket
+// empty when DOCKER_HOST points at a non-unix endpoint
+func DockerSocketPath() string {
+	dockerHost := os.Getenv("DOCKER_HOST")
+	if dockerHost == "" {
+		return DefaultDockerSocket
+	}
+	if strings.HasPrefix(dockerHost, "unix://") {
+		return strings.TrimPrefix(dockerHost, "unix://")
+	}
+	return ""
+}
+
+// verifies the docker engine socket is reachable by the current user
+func CheckDockerAccess() error {
+	socketPath := DockerSocketPath()
+	if socketPath == "" {
+		// tcp/ssh DOCKER_HOST endpoints are left to the docker cli
+		return nil
+	}
+
+	conn, err := net.DialTimeout("unix", socketPath, 2*time.Second)
+	if err != nil {
+		if os.IsPermission(err) || strings.Contains(err.Error(), "permission denied") {
+			return fmt.Errorf("permission denied on docker socket %s; add uid %d to the docker group, or set DOCKER_HOST for rootless docker", socketPath, os.Geteuid())
+		}
+		if os.Getenv("DOCKER_HOST") == "" && !IsRoot() {
+			return fmt.Errorf("docker socket %s is unreachable: %v; for rootless docker set DOCKER_HOST=unix://$XDG_RUNTIME_DIR/docker.sock", socketPath, err)
+		}
+		return fmt.Errorf("docker socket %s is unreachable: %v", socketPath, err)
+	}
+	conn.Close()
+	return nil
+}
+
+// returns directory for per-user cargoport config, honouring XDG_CONFIG_HOME
+func UserConfigDir() (string, error) {
+	if configHome := os.Getenv("XDG_CONFIG_HOME"); configHome != "" {
+		return filepath.Join(configHome, "cargoport"), nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".config", "cargoport"), nil
+}
+
+// returns default cargoport root dir for non-root users, honouring XDG_DATA_HOME
+func UserDataDir() (string, error) {
+	if dataHome := os.Getenv("XDG_DATA_HOME"); dataHome != "" {
+		return filepath.Join(dataHome, "cargoport"), nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".local", "share", "cargoport"), nil
+}
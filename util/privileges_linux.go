@@ -0,0 +1,11 @@
+package util
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// raises CAP_DAC_READ_SEARCH into the ambient set of cmd, as file capabilities are dropped across execve
+func inheritReadAll(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{AmbientCaps: []uintptr{CapDACReadSearch}}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package util
+
+import "os/exec"
+
+// capabilities are linux only, commands run with the user's own permissions elsewhere
+func inheritReadAll(cmd *exec.Cmd) {}
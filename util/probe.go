@@ -0,0 +1,225 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/adrian-griffin/cargoport/logger"
+)
+
+// default ssh port when none is configured
+const DefaultSSHPort = 22
+
+// options for a remote connectivity probe
+type ProbeOptions struct {
+	User           string
+	Port           int
+	Timeout        time.Duration
+	SSHHandshake   bool   // perform in-process ssh handshake & key auth
+	PrivateKeyPath string // key used to authenticate during handshake
+	KnownHostsFile string // host key is verified against this file when set
+	ICMP           bool   // optional extra icmp check, never required for reachability
+}
+
+// outcome of a single probe check
+type ProbeCheck struct {
+	Name     string        `json:"name"`
+	Success  bool          `json:"success"`
+	Duration time.Duration `json:"duration_ns"`
+	Detail   string        `json:"detail,omitempty"`
+}
+
+// structured diagnostics for all checks run against a remote
+type ProbeReport struct {
+	Host   string       `json:"host"`
+	Port   int          `json:"port"`
+	Checks []ProbeCheck `json:"checks"`
+}
+
+// returns first failed required check as an error, icmp is informational only
+func (r *ProbeReport) Err() error {
+	for _, check := range r.Checks {
+		if !check.Success && check.Name != "icmp" {
+			return fmt.Errorf("%s check against %s failed: %s", check.Name, net.JoinHostPort(r.Host, strconv.Itoa(r.Port)), check.Detail)
+		}
+	}
+	return nil
+}
+
+// flattened log fields for report
+func (r *ProbeReport) Fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		"package":     "net",
+		"remote_host": r.Host,
+		"remote_port": r.Port,
+	}
+	for _, check := range r.Checks {
+		fields["probe_"+check.Name] = check.Success
+		fields["probe_"+check.Name+"_ms"] = check.Duration.Milliseconds()
+	}
+	return fields
+}
+
+// probes remote reachability over tcp, optionally performing an ssh handshake & icmp check
+func ProbeRemote(remoteHost string, opts ProbeOptions) *ProbeReport {
+	if opts.Port == 0 {
+		opts.Port = DefaultSSHPort
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+
+	report := &ProbeReport{Host: remoteHost, Port: opts.Port}
+	address := net.JoinHostPort(remoteHost, strconv.Itoa(opts.Port))
+
+	// optional icmp, recorded but never blocks transfers
+	if opts.ICMP {
+		startTime := time.Now()
+		check := ProbeCheck{Name: "icmp", Success: true}
+		if err := ICMPRemoteHost(remoteHost); err != nil {
+			check.Success = false
+			check.Detail = err.Error()
+		}
+		check.Duration = time.Since(startTime)
+		report.Checks = append(report.Checks, check)
+	}
+
+	// tcp reachability of ssh port
+	startTime := time.Now()
+	conn, err := net.DialTimeout("tcp", address, opts.Timeout)
+	tcpCheck := ProbeCheck{Name: "tcp", Success: err == nil, Duration: time.Since(startTime)}
+	if err != nil {
+		tcpCheck.Detail = err.Error()
+		report.Checks = append(report.Checks, tcpCheck)
+		return report
+	}
+	report.Checks = append(report.Checks, tcpCheck)
+
+	if !opts.SSHHandshake {
+		conn.Close()
+		return report
+	}
+
+	// in-process ssh handshake, host key verification & key authentication
+	report.Checks = append(report.Checks, sshHandshakeChecks(conn, address, opts)...)
+	return report
+}
+
+// performs ssh handshake on open connection, returning host key & auth checks
+func sshHandshakeChecks(conn net.Conn, address string, opts ProbeOptions) []ProbeCheck {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(opts.Timeout))
+
+	hostKeyCheck := ProbeCheck{Name: "host_key"}
+	authCheck := ProbeCheck{Name: "ssh_auth"}
+
+	// verify host key against known hosts file when provided, otherwise record fingerprint only
+	var verifyHostKey ssh.HostKeyCallback
+	if opts.KnownHostsFile != "" {
+		callback, err := knownhosts.New(opts.KnownHostsFile)
+		if errors.Is(err, os.ErrNotExist) {
+			hostKeyCheck.Detail = "no trusted host keys, run `cargoport -trust-host` first"
+			return []ProbeCheck{hostKeyCheck}
+		}
+		if err != nil {
+			hostKeyCheck.Detail = fmt.Sprintf("failed to load known hosts %s: %v", opts.KnownHostsFile, err)
+			return []ProbeCheck{hostKeyCheck}
+		}
+		verifyHostKey = callback
+	}
+	hostKeyCallback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hostKeyCheck.Detail = ssh.FingerprintSHA256(key)
+		if verifyHostKey == nil {
+			hostKeyCheck.Success = true
+			return nil
+		}
+		if err := verifyHostKey(hostname, remote, key); err != nil {
+			var keyErr *knownhosts.KeyError
+			if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+				hostKeyCheck.Detail = fmt.Sprintf("unknown host key %s, run `cargoport -trust-host` to trust it", ssh.FingerprintSHA256(key))
+			} else if errors.As(err, &keyErr) {
+				hostKeyCheck.Detail = fmt.Sprintf("host key mismatch, presented %s, possible MITM or rebuilt host", ssh.FingerprintSHA256(key))
+			} else {
+				hostKeyCheck.Detail = err.Error()
+			}
+			return err
+		}
+		hostKeyCheck.Success = true
+		return nil
+	}
+
+	clientConfig := &ssh.ClientConfig{
+		User:            opts.User,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         opts.Timeout,
+	}
+
+	// authenticate with private key when provided
+	hasKey := false
+	if opts.PrivateKeyPath != "" {
+		keyData, err := os.ReadFile(opts.PrivateKeyPath)
+		if err == nil {
+			signer, err := ssh.ParsePrivateKey(keyData)
+			if err == nil {
+				clientConfig.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+				hasKey = true
+			}
+		}
+		if !hasKey {
+			authCheck.Detail = fmt.Sprintf("failed to load private key %s", opts.PrivateKeyPath)
+		}
+	}
+
+	startTime := time.Now()
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, address, clientConfig)
+	duration := time.Since(startTime)
+	hostKeyCheck.Duration = duration
+	authCheck.Duration = duration
+
+	if err == nil {
+		client := ssh.NewClient(sshConn, channels, requests)
+		client.Close()
+		authCheck.Success = hasKey
+		if !hasKey && authCheck.Detail == "" {
+			authCheck.Detail = "no private key supplied"
+		}
+		return []ProbeCheck{hostKeyCheck, authCheck}
+	}
+
+	// handshake never reached host key verification
+	if hostKeyCheck.Detail == "" {
+		return []ProbeCheck{{Name: "ssh_handshake", Duration: duration, Detail: err.Error()}}
+	}
+	if !hostKeyCheck.Success {
+		return []ProbeCheck{hostKeyCheck}
+	}
+
+	// host key accepted, failure happened during authentication
+	if authCheck.Detail == "" {
+		authCheck.Detail = strings.TrimPrefix(err.Error(), "ssh: ")
+	}
+	return []ProbeCheck{hostKeyCheck, authCheck}
+}
+
+// logs probe report as structured diagnostics
+func LogProbeReport(report *ProbeReport, baseFields map[string]interface{}) {
+	fields := logger.MergeFields(baseFields, report.Fields())
+	if err := report.Err(); err != nil {
+		logger.LogxWithFields("warn", fmt.Sprintf("Connectivity probe against %s failed: %v", report.Host, err), fields)
+		return
+	}
+	for _, check := range report.Checks {
+		if check.Name == "icmp" && !check.Success {
+			logger.LogxWithFields("debug", fmt.Sprintf("Remote %s does not respond to ICMP, continuing as TCP probe succeeded", report.Host), fields)
+		}
+	}
+	logger.LogxWithFields("debug", fmt.Sprintf("Connectivity probe against %s successful", report.Host), fields)
+}
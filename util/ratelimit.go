@@ -0,0 +1,38 @@
+package util
+
+import (
+	"io"
+	"time"
+)
+
+// throttles writes to an average rate of bytes per second
+type RateLimitedWriter struct {
+	writer      io.Writer
+	bytesPerSec int64
+	startTime   time.Time
+	written     int64
+}
+
+// wraps writer with limit in KiB/s, a limit of 0 returns the writer untouched
+func NewRateLimitedWriter(writer io.Writer, limitKBps int) io.Writer {
+	if limitKBps <= 0 {
+		return writer
+	}
+	return &RateLimitedWriter{
+		writer:      writer,
+		bytesPerSec: int64(limitKBps) * 1024,
+		startTime:   time.Now(),
+	}
+}
+
+func (r *RateLimitedWriter) Write(p []byte) (int, error) {
+	n, err := r.writer.Write(p)
+	r.written += int64(n)
+
+	// sleep until elapsed time catches up with the allowed rate
+	expected := time.Duration(float64(r.written) / float64(r.bytesPerSec) * float64(time.Second))
+	if elapsed := time.Since(r.startTime); expected > elapsed {
+		time.Sleep(expected - elapsed)
+	}
+	return n, err
+}
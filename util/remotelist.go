@@ -0,0 +1,26 @@
+package util
+
+import "strings"
+
+// remainder of ListArchivesCommand following the listed directory
+const listArchivesScript = ` 2>/dev/null || exit 0; for f in *; do [ -f "$f" ] && [ ! -L "$f" ] || continue; case "$f" in *.partial) ;; *.bak.tar.gz.manifest.json) printf 'M\t%s\t' "$f"; tr -d '\n' < "$f"; echo ;; *.bak.tar.gz) printf 'A\t%s\t%s\t%s\n' "$(wc -c < "$f" | tr -d ' ')" "$(date -r "$f" +%s)" "$f" ;; esac; done`
+
+// remote shell command listing cargoport archives & manifests within remoteDir, a single quoted shell word
+// prints one tab separated record per regular file, skipping symlinks, in name order, a missing directory prints nothing:
+//
+//	A <size bytes> <modified unix time> <archive name>
+//	M <manifest name> <manifest json on a single line>
+//
+// matched by `cargoport serve-receive` on restricted remotes, which performs the same listing natively
+func ListArchivesCommand(remoteDir string) string {
+	return "cd " + remoteDir + listArchivesScript
+}
+
+// returns the quoted directory word when command is exactly a ListArchivesCommand
+func MatchListArchivesCommand(command string) (string, bool) {
+	if !strings.HasPrefix(command, "cd ") || !strings.HasSuffix(command, listArchivesScript) {
+		return "", false
+	}
+	remoteDir := strings.TrimSuffix(strings.TrimPrefix(command, "cd "), listArchivesScript)
+	return remoteDir, remoteDir != ""
+}
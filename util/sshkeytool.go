@@ -6,6 +6,8 @@ import (
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -77,18 +79,34 @@ func GenerateSSHKeypair(sshDir, keyName string) error {
 }
 
 // copy public key to remote machine
-func CopyPublicKey(sshPrivKeypath, remoteUser, remoteHost string) error {
+func CopyPublicKey(sshPrivKeypath, remoteUser, remoteHost string, remotePort int, restrictOptions string) error {
 	// define pubkey
 	sshPubKeyPath := sshPrivKeypath + ".pub"
 
-	// utilize ssh-copy-id
-	cmd := exec.Command("ssh-copy-id", "-i", sshPubKeyPath, fmt.Sprintf("%s@%s", remoteUser, remoteHost))
+	if restrictOptions != "" {
+		if err := copyRestrictedPublicKey(sshPrivKeypath, remoteUser, remoteHost, remotePort, restrictOptions); err != nil {
+			return err
+		}
+	} else {
+		// utilize ssh-copy-id
+		copyArgs := []string{
+			"-i", sshPubKeyPath,
+			"-o", "StrictHostKeyChecking=yes",
+			"-o", "UserKnownHostsFile=" + KnownHostsPath(filepath.Dir(sshPrivKeypath)),
+			"-o", "GlobalKnownHostsFile=/dev/null",
+		}
+		if remotePort != 0 && remotePort != DefaultSSHPort {
+			copyArgs = append(copyArgs, "-p", strconv.Itoa(remotePort))
+		}
+		copyArgs = append(copyArgs, fmt.Sprintf("%s@%s", remoteUser, remoteHost))
+		cmd := exec.Command("ssh-copy-id", copyArgs...)
 
-	// redir sshkeygen stdout to os
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to copy SSH public key to remote: %v", err)
+		// redir sshkeygen stdout to os
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to copy SSH public key to remote: %v", err)
+		}
 	}
 
 	logger.LogxWithFields("info", fmt.Sprintf("Successfully installed local public key into %s@%s:~/.ssh/authorized_keys", remoteUser, remoteHost), logrus.Fields{
@@ -96,12 +114,42 @@ func CopyPublicKey(sshPrivKeypath, remoteUser, remoteHost string) error {
 		"remote":      true,
 		"success":     true,
 		"action":      "copy_key",
+		"restricted":  restrictOptions != "",
 		"remote_host": remoteHost,
 		"remote_user": remoteUser,
 	})
 	return nil
 }
 
+// installs public key prefixed with forced command options, replacing any existing entry for the same key
+func copyRestrictedPublicKey(sshPrivKeypath, remoteUser, remoteHost string, remotePort int, restrictOptions string) error {
+	publicKey, err := os.ReadFile(sshPrivKeypath + ".pub")
+	if err != nil {
+		return fmt.Errorf("failed to read public key: %v", err)
+	}
+	keyBody, err := publicKeyBody(string(publicKey))
+	if err != nil {
+		return fmt.Errorf("failed to parse public key: %v", err)
+	}
+	authorizedEntry := fmt.Sprintf("%s %s\n", restrictOptions, strings.TrimSpace(string(publicKey)))
+
+	// drop prior unrestricted entries for this key so only the restricted entry remains
+	authorizedKeys := `"$HOME/.ssh/authorized_keys"`
+	installCommand := fmt.Sprintf(`umask 077; mkdir -p "$HOME/.ssh" && touch %s && { grep -vF %s %s; cat; } > %s.cargoport-tmp && mv %s.cargoport-tmp %s`,
+		authorizedKeys, ShellQuote(keyBody), authorizedKeys, authorizedKeys, authorizedKeys, authorizedKeys)
+
+	// password authentication is expected here, ssh prompts on the tty
+	sshArgs := append(SSHBaseOptions(sshPrivKeypath, remotePort), fmt.Sprintf("%s@%s", remoteUser, remoteHost), installCommand)
+	cmd := exec.Command("ssh", sshArgs...)
+	cmd.Stdin = strings.NewReader(authorizedEntry)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to install restricted SSH public key on remote: %v", err)
+	}
+	return nil
+}
+
 // validate private key integrity
 func ValidateSSHPrivateKeyPerms(privKeyPath string) error {
 	privKeyInfo, err := os.Stat(privKeyPath)
@@ -139,3 +187,209 @@ func ValidateSSHPrivateKeyPerms(privKeyPath string) error {
 
 	return nil
 }
+
+// base ssh client options used for all cargoport ssh & rsync connections
+// host keys are strictly checked against the cargoport-owned known_hosts stored alongside the key
+func SSHBaseOptions(sshPrivKeypath string, port int) []string {
+	options := []string{
+		"-i", sshPrivKeypath,
+		"-o", "ConnectTimeout=10",
+		"-o", "ServerAliveInterval=5",
+		"-o", "ServerAliveCountMax=2",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "UserKnownHostsFile=" + KnownHostsPath(filepath.Dir(sshPrivKeypath)),
+		"-o", "GlobalKnownHostsFile=/dev/null",
+	}
+	if port != 0 && port != DefaultSSHPort {
+		options = append(options, "-p", strconv.Itoa(port))
+	}
+	return options
+}
+
+// ssh command string for use with rsync's `-e` flag
+func SSHCommandString(sshPrivKeypath string, port int) string {
+	return "ssh " + strings.Join(SSHBaseOptions(sshPrivKeypath, port), " ")
+}
+
+// remote shell command appending stdin to authorized_keys, matched verbatim by `cargoport serve-receive`
+// on restricted remotes, which re-applies the forced command to the incoming key
+const AuthorizedKeysInstallCommand = `umask 077; mkdir -p "$HOME/.ssh" && cat >> "$HOME/.ssh/authorized_keys"`
+
+// remote dir used when no remote output dir is configured, kept apart from the home dir
+// so uploads never reach `~/.ssh` or other dotfiles
+const DefaultRemoteDir = "~/cargoport"
+
+// errors when a restricted key's allowed dir would be the remote user's home dir or an ancestor of it,
+// which would let the key overwrite authorized_keys. only checked lexically, serve-receive checks the resolved path
+func CheckRestrictedDir(allowedDir, remoteUser string) error {
+	cleanDir := strings.TrimSuffix(allowedDir, "/")
+	if cleanDir == "" || cleanDir == "~" || strings.HasPrefix(cleanDir, "~/..") {
+		return fmt.Errorf("restricted keys cannot be confined to the home dir, use a dedicated dir such as %s", DefaultRemoteDir)
+	}
+	if !strings.HasPrefix(cleanDir, "/") {
+		return nil
+	}
+	homeDir := "/home/" + remoteUser
+	if remoteUser == "root" {
+		homeDir = "/root"
+	}
+	cleanDir = filepath.Clean(cleanDir)
+	if cleanDir == "/" || cleanDir == homeDir || strings.HasPrefix(homeDir, cleanDir+"/") {
+		return fmt.Errorf("restricted keys cannot be confined to %s, as it holds %s's home dir, use a dedicated dir such as %s", cleanDir, remoteUser, DefaultRemoteDir)
+	}
+	return nil
+}
+
+// authorized_keys options forcing every login with the key through `cargoport serve-receive`
+func RestrictedKeyOptions(cargoportCommand, allowedDir string) string {
+	forcedCommand := fmt.Sprintf("%s serve-receive -dir %s", cargoportCommand, ShellQuote(allowedDir))
+	forcedCommand = strings.ReplaceAll(forcedCommand, `\`, `\\`)
+	forcedCommand = strings.ReplaceAll(forcedCommand, `"`, `\"`)
+	return fmt.Sprintf(`command="%s",restrict`, forcedCommand)
+}
+
+// remote authenticating with the cargoport key
+type SSHRemote struct {
+	Name string
+	User string
+	Host string
+	Port int
+}
+
+// returns base64 key body (second field) of an authorized_keys style public key line
+func publicKeyBody(publicKeyLine string) (string, error) {
+	fields := strings.Fields(publicKeyLine)
+	if len(fields) < 2 {
+		return "", fmt.Errorf("malformed public key")
+	}
+	return fields[1], nil
+}
+
+// runs command on remote over ssh with supplied key, passing stdin
+func runRemoteWithKey(sshPrivKeypath string, remote SSHRemote, remoteCommand, stdin string) (string, error) {
+	sshArgs := append(SSHBaseOptions(sshPrivKeypath, remote.Port), "-o", "BatchMode=yes", fmt.Sprintf("%s@%s", remote.User, remote.Host), remoteCommand)
+	cmd := exec.Command("ssh", sshArgs...)
+	cmd.Stdin = strings.NewReader(stdin)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// generates a new keypair, installs it on every remote using the old key, verifies login with the new key,
+// then removes the old key from each remote's authorized_keys & archives it locally
+func RotateSSHKeypair(sshDir, keyName string, remotes []SSHRemote) error {
+	oldKeyPath := filepath.Join(sshDir, keyName)
+	newKeyPath := oldKeyPath + ".rotating"
+
+	logFields := map[string]interface{}{
+		"package":  "sshkeytool",
+		"action":   "rotate_key",
+		"key_path": oldKeyPath,
+	}
+
+	if err := ValidateSSHPrivateKeyPerms(oldKeyPath); err != nil {
+		return fmt.Errorf("current key failed validation: %v", err)
+	}
+	oldPublicKey, err := os.ReadFile(oldKeyPath + ".pub")
+	if err != nil {
+		return fmt.Errorf("failed to read current public key: %v", err)
+	}
+	oldKeyBody, err := publicKeyBody(string(oldPublicKey))
+	if err != nil {
+		return fmt.Errorf("failed to parse current public key: %v", err)
+	}
+
+	// clear any leftovers from an interrupted rotation, then generate new pair
+	os.Remove(newKeyPath)
+	os.Remove(newKeyPath + ".pub")
+	if err := GenerateSSHKeypair(sshDir, keyName+".rotating"); err != nil {
+		return err
+	}
+	newPublicKey, err := os.ReadFile(newKeyPath + ".pub")
+	if err != nil {
+		return fmt.Errorf("failed to read new public key: %v", err)
+	}
+	newKeyBody, err := publicKeyBody(string(newPublicKey))
+	if err != nil {
+		return fmt.Errorf("failed to parse new public key: %v", err)
+	}
+
+	// install new key using old key, then verify login using new key
+	var installed []SSHRemote
+	var installErr error
+	for _, remote := range remotes {
+		if _, err := runRemoteWithKey(oldKeyPath, remote, AuthorizedKeysInstallCommand, string(newPublicKey)); err != nil {
+			installErr = fmt.Errorf("failed to install new key on %s: %v", remote.Name, err)
+			break
+		}
+		installed = append(installed, remote)
+
+		if _, err := runRemoteWithKey(newKeyPath, remote, "true", ""); err != nil {
+			installErr = fmt.Errorf("failed to log in to %s with new key: %v", remote.Name, err)
+			break
+		}
+		logger.LogxWithFields("info", fmt.Sprintf("New key installed & verified on %s@%s", remote.User, remote.Host), logger.MergeFields(logFields, map[string]interface{}{
+			"remote_name": remote.Name,
+			"remote_host": remote.Host,
+		}))
+	}
+
+	// on any failure, roll back new key from remotes it reached & keep the old key active
+	if installErr != nil {
+		for _, remote := range installed {
+			if _, err := runRemoteWithKey(oldKeyPath, remote, RemoveAuthorizedKeyCommand(newKeyBody, oldKeyBody), ""); err != nil {
+				logger.LogxWithFields("warn", fmt.Sprintf("Failed to roll back new key on %s: %v", remote.Name, err), logFields)
+			}
+		}
+		os.Remove(newKeyPath)
+		os.Remove(newKeyPath + ".pub")
+		return fmt.Errorf("key rotation aborted, current key remains active: %v", installErr)
+	}
+
+	// retire old key on every remote, authenticating with the new key
+	var retireFailures []string
+	for _, remote := range remotes {
+		if _, err := runRemoteWithKey(newKeyPath, remote, RemoveAuthorizedKeyCommand(oldKeyBody, newKeyBody), ""); err != nil {
+			retireFailures = append(retireFailures, remote.Name)
+			logger.LogxWithFields("warn", fmt.Sprintf("Failed to remove old key from %s: %v", remote.Name, err), logFields)
+		}
+	}
+
+	// archive old key locally with timestamp, then promote new key
+	archiveDir := filepath.Join(sshDir, "archive")
+	if err := os.MkdirAll(archiveDir, 0700); err != nil {
+		return fmt.Errorf("failed to create key archive directory: %v", err)
+	}
+	archivedKeyPath := filepath.Join(archiveDir, fmt.Sprintf("%s-%s", keyName, time.Now().Format("20060102-150405")))
+	if err := os.Rename(oldKeyPath, archivedKeyPath); err != nil {
+		return fmt.Errorf("failed to archive old private key: %v", err)
+	}
+	if err := os.Rename(oldKeyPath+".pub", archivedKeyPath+".pub"); err != nil {
+		return fmt.Errorf("failed to archive old public key: %v", err)
+	}
+	if err := os.Rename(newKeyPath, oldKeyPath); err != nil {
+		return fmt.Errorf("failed to promote new private key: %v", err)
+	}
+	if err := os.Rename(newKeyPath+".pub", oldKeyPath+".pub"); err != nil {
+		return fmt.Errorf("failed to promote new public key: %v", err)
+	}
+
+	logger.LogxWithFields("info", fmt.Sprintf("SSH key rotated across %d remote(s), old key archived at %s", len(remotes), archivedKeyPath), logger.MergeFields(logFields, map[string]interface{}{
+		"success": len(retireFailures) == 0,
+	}))
+	if len(retireFailures) > 0 {
+		return fmt.Errorf("new key is active, but old key could not be removed from: %s", strings.Join(retireFailures, ", "))
+	}
+	return nil
+}
+
+// remote shell command removing every authorized_keys line containing key body, matched verbatim by
+// `cargoport serve-receive` on restricted remotes. authorized_keys is only replaced once the filtered copy
+// was written & still holds keepKeyBody, so a failed read never locks the remote out
+func RemoveAuthorizedKeyCommand(keyBody, keepKeyBody string) string {
+	authorizedKeys := `"$HOME/.ssh/authorized_keys"`
+	return fmt.Sprintf(`umask 077; grep -vF %s %s > %s.cargoport-tmp && grep -qF %s %s.cargoport-tmp && mv %s.cargoport-tmp %s || { rm -f %s.cargoport-tmp; exit 1; }`,
+		ShellQuote(keyBody), authorizedKeys, authorizedKeys, ShellQuote(keepKeyBody), authorizedKeys, authorizedKeys, authorizedKeys, authorizedKeys)
+}
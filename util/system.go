@@ -1,11 +1,14 @@
 package util
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/adrian-griffin/cargoport/job"
 	"github.com/adrian-griffin/cargoport/logger"
@@ -46,6 +49,88 @@ func RunCommandWithOutput(cmd string, args ...string) (string, error) {
 	return output, nil
 }
 
+// executes command on os, passing each line of its combined output to onLine as it is written
+func RunCommandWithLines(onLine func(line string), cmd string, args ...string) error {
+	reader, writer := io.Pipe()
+	command := exec.Command(cmd, args...)
+	command.Stdout = writer
+	command.Stderr = writer
+
+	scanned := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			onLine(scanner.Text())
+		}
+		// overlong lines stop the scanner, the remainder is drained so the command never blocks
+		io.Copy(io.Discard, reader)
+		close(scanned)
+	}()
+
+	err := command.Run()
+	writer.Close()
+	<-scanned
+	return err
+}
+
+// executes command on os, writing its stdout to outputPath & returning stderr on failure
+func RunCommandToFile(outputPath string, cmd string, args ...string) error {
+	outputFile, err := os.OpenFile(outputPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	var stderr bytes.Buffer
+	command := exec.Command(cmd, args...)
+	command.Stdout = outputFile
+	command.Stderr = &stderr
+	if err := command.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("%s", message)
+		}
+		return err
+	}
+	return outputFile.Sync()
+}
+
+// starts command reading stdin when set, streaming its stdout
+// closing the returned reader waits for the command, returning stderr on failure
+func StartCommandReader(stdin io.Reader, cmd string, args ...string) (io.ReadCloser, error) {
+	var stderr bytes.Buffer
+	command := exec.Command(cmd, args...)
+	command.Stdin = stdin
+	command.Stderr = &stderr
+	stdout, err := command.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := command.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %v", cmd, err)
+	}
+	return &commandReader{ReadCloser: stdout, command: command, stderr: &stderr}, nil
+}
+
+// stdout of a running command
+type commandReader struct {
+	io.ReadCloser
+	command *exec.Cmd
+	stderr  *bytes.Buffer
+}
+
+func (c *commandReader) Close() error {
+	// drain unread output so the command is never left blocked writing
+	io.Copy(io.Discard, c.ReadCloser)
+	if err := c.command.Wait(); err != nil {
+		if message := strings.TrimSpace(c.stderr.String()); message != "" {
+			return fmt.Errorf("%s", message)
+		}
+		return err
+	}
+	return nil
+}
+
 // remove file from os
 func RemoveTempFile(context *job.JobContext, filePath string) error {
 
@@ -92,3 +177,8 @@ func ValidateDirectoryWriteable(directoryPathString string) error {
 
 	return nil
 }
+
+// single-quotes string for safe use within a remote shell command
+func ShellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'"'"'`) + "'"
+}